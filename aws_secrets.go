@@ -0,0 +1,128 @@
+package oauth2proxy
+
+import (
+	"fmt"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/secretsmanager"
+	"github.com/aws/aws-sdk-go/service/ssm"
+)
+
+// Secret option values with one of these prefixes are references to a
+// secret held by AWS and are fetched at startup, e.g.
+//
+//	aws-secretsmanager:arn:aws:secretsmanager:us-east-1:123456789012:secret:oauth2-proxy
+//	aws-ssm:/oauth2-proxy/client-secret
+const (
+	awsSecretsManagerPrefix = "aws-secretsmanager:"
+	awsSSMPrefix            = "aws-ssm:"
+)
+
+func isAWSSecretRef(value string) bool {
+	return strings.HasPrefix(value, awsSecretsManagerPrefix) ||
+		strings.HasPrefix(value, awsSSMPrefix)
+}
+
+// fetchAWSSecret resolves an AWS secret reference; it is a variable so
+// tests can replace it.
+var fetchAWSSecret = func(ref, region string) (string, error) {
+	var id string
+	if strings.HasPrefix(ref, awsSecretsManagerPrefix) {
+		id = strings.TrimPrefix(ref, awsSecretsManagerPrefix)
+	} else {
+		id = strings.TrimPrefix(ref, awsSSMPrefix)
+	}
+	sess, err := awsSession(arnRegionOr(id, region))
+	if err != nil {
+		return "", err
+	}
+
+	if strings.HasPrefix(ref, awsSecretsManagerPrefix) {
+		out, err := secretsmanager.New(sess).GetSecretValue(
+			&secretsmanager.GetSecretValueInput{SecretId: aws.String(id)})
+		if err != nil {
+			return "", err
+		}
+		if out.SecretString != nil {
+			return *out.SecretString, nil
+		}
+		return string(out.SecretBinary), nil
+	}
+
+	out, err := ssm.New(sess).GetParameter(&ssm.GetParameterInput{
+		Name:           aws.String(id),
+		WithDecryption: aws.Bool(true),
+	})
+	if err != nil {
+		return "", err
+	}
+	return aws.StringValue(out.Parameter.Value), nil
+}
+
+// awsSession returns an AWS session for region, configured from the
+// environment and shared config files.
+func awsSession(region string) (*session.Session, error) {
+	cfg := aws.NewConfig().WithHTTPClient(&http.Client{Timeout: kmsTimeout})
+	if region != "" {
+		cfg = cfg.WithRegion(region)
+	}
+	return session.NewSessionWithOptions(session.Options{
+		Config:            *cfg,
+		SharedConfigState: session.SharedConfigEnable,
+	})
+}
+
+// arnRegion returns the region component of an ARN, or "" if id isn't one.
+func arnRegion(id string) string {
+	parts := strings.SplitN(id, ":", 6)
+	if len(parts) != 6 || parts[0] != "arn" {
+		return ""
+	}
+	return parts[3]
+}
+
+func resolveAWSSecret(value, name, region string, msgs []string) (string, []string) {
+	if !isAWSSecretRef(value) {
+		return value, msgs
+	}
+	secret, err := fetchAWSSecret(value, region)
+	if err != nil {
+		return value, append(msgs, fmt.Sprintf("unable to fetch %s from %q: %s", name, value, err))
+	}
+	return strings.TrimSpace(secret), msgs
+}
+
+// RefreshAWSClientSecret periodically re-fetches a client secret stored in
+// AWS and hands it to the provider when it has been rotated.
+func RefreshAWSClientSecret(opts *Options, done <-chan bool) {
+	if opts.clientSecretRef == "" || opts.AWSSecretRefreshInterval == time.Duration(0) {
+		return
+	}
+	ticker := time.NewTicker(opts.AWSSecretRefreshInterval)
+	go func() {
+		defer ticker.Stop()
+		for {
+			select {
+			case <-done:
+				return
+			case <-ticker.C:
+				secret, err := fetchAWSSecret(opts.clientSecretRef, opts.AWSRegion)
+				if err != nil {
+					log.Printf("error refreshing client-secret from %q: %s", opts.clientSecretRef, err)
+					continue
+				}
+				secret = strings.TrimSpace(secret)
+				p := opts.provider.Data()
+				if secret != "" && secret != p.ClientSecret {
+					log.Printf("client-secret %q was rotated", opts.clientSecretRef)
+					p.SetClientSecret(secret)
+				}
+			}
+		}
+	}()
+}
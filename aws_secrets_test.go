@@ -0,0 +1,43 @@
+package oauth2proxy
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestAWSSecretReferences(t *testing.T) {
+	orig := fetchAWSSecret
+	defer func() { fetchAWSSecret = orig }()
+	fetchAWSSecret = func(ref, region string) (string, error) {
+		switch ref {
+		case "aws-ssm:/oauth2-proxy/client-secret":
+			return "client secret from ssm\n", nil
+		case "aws-secretsmanager:cookie":
+			return "0123456789abcdefghijklmnopqrstuv", nil
+		}
+		return "", errors.New("ResourceNotFoundException")
+	}
+
+	o := testOptions()
+	o.ClientSecret = "aws-ssm:/oauth2-proxy/client-secret"
+	o.CookieSecret = "aws-secretsmanager:cookie"
+	assert.Equal(t, nil, o.Validate())
+	assert.Equal(t, "client secret from ssm", o.ClientSecret)
+	assert.Equal(t, "0123456789abcdefghijklmnopqrstuv", o.CookieSecret)
+	assert.Equal(t, "aws-ssm:/oauth2-proxy/client-secret", o.clientSecretRef)
+
+	o = testOptions()
+	o.ClientSecret = "aws-ssm:/missing"
+	err := o.Validate()
+	assert.NotEqual(t, nil, err)
+	expected := errorMsg([]string{
+		"unable to fetch client-secret from \"aws-ssm:/missing\": ResourceNotFoundException"})
+	assert.Equal(t, expected, err.Error())
+}
+
+func TestArnRegion(t *testing.T) {
+	assert.Equal(t, "eu-west-1", arnRegion("arn:aws:secretsmanager:eu-west-1:123456789012:secret:oauth2-proxy"))
+	assert.Equal(t, "", arnRegion("/oauth2-proxy/client-secret"))
+}
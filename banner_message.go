@@ -0,0 +1,118 @@
+package oauth2proxy
+
+import (
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+	"unicode"
+)
+
+// maxBannerMessageBytes caps the size of the banner-message-file.
+const maxBannerMessageBytes = 4 << 10
+
+// A bannerMessage is an announcement, such as planned downtime, read from
+// the banner-message-file and shown on the sign in page until the file is
+// emptied or removed.
+type bannerMessage struct {
+	path string
+
+	mu   sync.RWMutex
+	text string
+}
+
+// parseBannerMessage loads the banner-message-file, if there is one. The file
+// need not exist yet.
+func parseBannerMessage(o *Options, msgs []string) []string {
+	o.bannerMessage = nil
+	if o.BannerMessageFile == "" {
+		if o.BannerMessageHeader != "" {
+			msgs = append(msgs, "banner-message-header requires banner-message-file")
+		}
+		return msgs
+	}
+	if o.BannerMessageRefresh <= 0 {
+		msgs = append(msgs, "banner-message-refresh must be positive")
+	}
+	if h := o.BannerMessageHeader; h != "" && strings.ContainsAny(h, " \t\r\n,:") {
+		msgs = append(msgs, fmt.Sprintf("invalid banner-message-header %q", h))
+	}
+	b := &bannerMessage{path: o.BannerMessageFile}
+	if err := b.load(); err != nil {
+		return append(msgs, fmt.Sprintf("error reading banner-message-file %q: %s", o.BannerMessageFile, err))
+	}
+	o.bannerMessage = b
+	return msgs
+}
+
+// load re-reads the message from the file; a missing file clears it.
+func (b *bannerMessage) load() error {
+	data, err := ioutil.ReadFile(b.path)
+	if os.IsNotExist(err) {
+		data, err = nil, nil
+	} else if err != nil {
+		return err
+	} else if len(data) > maxBannerMessageBytes {
+		return fmt.Errorf("larger than %d bytes", maxBannerMessageBytes)
+	}
+	text := strings.TrimSpace(string(data))
+	b.mu.Lock()
+	changed := text != b.text
+	b.text = text
+	b.mu.Unlock()
+	if changed {
+		log.Printf("banner message updated from %s: %q", b.path, text)
+	}
+	return nil
+}
+
+// Text returns the current message, or "" for none.
+func (b *bannerMessage) Text() string {
+	if b == nil {
+		return ""
+	}
+	b.mu.RLock()
+	defer b.mu.RUnlock()
+	return b.text
+}
+
+// RefreshEvery re-reads the message at interval until done is closed; errors
+// keep the previous message.
+func (b *bannerMessage) RefreshEvery(interval time.Duration, done <-chan bool) {
+	ticker := time.NewTicker(interval)
+	go func() {
+		defer ticker.Stop()
+		for {
+			select {
+			case <-done:
+				return
+			case <-ticker.C:
+				if err := b.load(); err != nil {
+					log.Printf("error reading banner-message-file %s: %s", b.path, err)
+				}
+			}
+		}
+	}()
+}
+
+// setBannerMessageHeader passes the message to upstreams in the
+// banner-message-header, replacing any sent by the client.
+func (p *OAuthProxy) setBannerMessageHeader(req *http.Request) {
+	if p.bannerHeader == "" {
+		return
+	}
+	req.Header.Del(p.bannerHeader)
+	text := strings.Map(func(r rune) rune {
+		if unicode.IsControl(r) {
+			return ' '
+		}
+		return r
+	}, p.bannerMessage.Text())
+	if text = strings.Join(strings.Fields(text), " "); text != "" {
+		req.Header.Set(p.bannerHeader, text)
+	}
+}
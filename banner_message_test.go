@@ -0,0 +1,80 @@
+package oauth2proxy
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestBannerMessage(t *testing.T) {
+	dir, err := ioutil.TempDir("", "banner")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	file := filepath.Join(dir, "banner.txt")
+
+	opts := testOptions()
+	opts.BannerMessageFile = file
+	opts.BannerMessageHeader = "X-Banner-Message"
+	assert.Equal(t, nil, opts.Validate())
+	proxy := newOAuthProxy(opts, func(string) bool { return true })
+
+	signInPage := func() string {
+		rw := httptest.NewRecorder()
+		req, _ := http.NewRequest("GET", "/oauth2/sign_in", nil)
+		proxy.SignInPage(rw, req, 200)
+		return rw.Body.String()
+	}
+	upstreamHeader := func() string {
+		req, _ := http.NewRequest("GET", "/", nil)
+		req.Header.Set("X-Banner-Message", "spoofed")
+		proxy.setBannerMessageHeader(req)
+		return req.Header.Get("X-Banner-Message")
+	}
+
+	// the file need not exist
+	assert.NotContains(t, signInPage(), `class="notice"`)
+	assert.Equal(t, "", upstreamHeader())
+
+	assert.Equal(t, nil, ioutil.WriteFile(file, []byte("Down for <maintenance>\nat 10pm\n"), 0600))
+	assert.Equal(t, nil, proxy.bannerMessage.load())
+	assert.Contains(t, signInPage(), "<p class=\"notice\" role=\"status\">Down for &lt;maintenance&gt;\nat 10pm</p>")
+	assert.Equal(t, "Down for <maintenance> at 10pm", upstreamHeader())
+
+	assert.Equal(t, nil, os.Remove(file))
+	assert.Equal(t, nil, proxy.bannerMessage.load())
+	assert.NotContains(t, signInPage(), `class="notice"`)
+	assert.Equal(t, "", upstreamHeader())
+
+	// a file that is too large keeps the previous message
+	assert.Equal(t, nil, ioutil.WriteFile(file, []byte("Back soon"), 0600))
+	assert.Equal(t, nil, proxy.bannerMessage.load())
+	assert.Equal(t, nil, ioutil.WriteFile(file, []byte(strings.Repeat("x", maxBannerMessageBytes+1)), 0600))
+	assert.NotEqual(t, nil, proxy.bannerMessage.load())
+	assert.Equal(t, "Back soon", proxy.bannerMessage.Text())
+}
+
+func TestBannerMessageOptions(t *testing.T) {
+	o := testOptions()
+	o.BannerMessageHeader = "X-Banner-Message"
+	assert.Equal(t, errorMsg([]string{
+		"banner-message-header requires banner-message-file",
+	}), o.Validate().Error())
+
+	o = testOptions()
+	o.BannerMessageFile = os.TempDir()
+	o.BannerMessageRefresh = 0
+	o.BannerMessageHeader = "X-Banner Message"
+	assert.Equal(t, errorMsg([]string{
+		"banner-message-refresh must be positive",
+		"invalid banner-message-header \"X-Banner Message\"",
+		"error reading banner-message-file \"" + os.TempDir() + "\": read " + os.TempDir() + ": is a directory",
+	}), o.Validate().Error())
+}
@@ -0,0 +1,55 @@
+package oauth2proxy
+
+import (
+	"bytes"
+	"sync"
+)
+
+// proxyBufferSize is the size of the buffers upstream responses are copied
+// through, the same as io.Copy uses.
+const proxyBufferSize = 32 << 10
+
+// maxPooledBuffer is the capacity above which a bytes.Buffer isn't returned
+// to the pool, so that one large request body doesn't keep memory pinned.
+const maxPooledBuffer = 64 << 10
+
+// A bufferPool recycles the buffers the reverse proxies copy responses
+// through, rather than allocating one for every request. It implements
+// httputil.BufferPool.
+type bufferPool struct {
+	pool sync.Pool
+}
+
+var proxyBufferPool = newBufferPool(proxyBufferSize)
+
+func newBufferPool(size int) *bufferPool {
+	return &bufferPool{pool: sync.Pool{
+		New: func() interface{} { return make([]byte, size) },
+	}}
+}
+
+func (p *bufferPool) Get() []byte {
+	return p.pool.Get().([]byte)
+}
+
+func (p *bufferPool) Put(b []byte) {
+	p.pool.Put(b)
+}
+
+var bytesBufferPool = sync.Pool{
+	New: func() interface{} { return new(bytes.Buffer) },
+}
+
+// getBuffer returns an empty buffer from the pool, which should be given
+// back with putBuffer once nothing refers to its contents anymore.
+func getBuffer() *bytes.Buffer {
+	b := bytesBufferPool.Get().(*bytes.Buffer)
+	b.Reset()
+	return b
+}
+
+func putBuffer(b *bytes.Buffer) {
+	if b.Cap() <= maxPooledBuffer {
+		bytesBufferPool.Put(b)
+	}
+}
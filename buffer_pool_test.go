@@ -0,0 +1,75 @@
+package oauth2proxy
+
+import (
+	"bytes"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestBufferPool(t *testing.T) {
+	assert.Equal(t, proxyBufferPool, NewReverseProxy(&url.URL{Scheme: "http", Host: "upstream"}).BufferPool)
+	b := proxyBufferPool.Get()
+	assert.Equal(t, proxyBufferSize, len(b))
+	proxyBufferPool.Put(b)
+
+	buf := getBuffer()
+	buf.WriteString("stale")
+	putBuffer(buf)
+	assert.Equal(t, 0, getBuffer().Len())
+}
+
+func TestLogBody(t *testing.T) {
+	assert.Equal(t, "a=b c=d", logBody([]byte("\na=b\nc=d\n\n")))
+	assert.Equal(t, strings.Repeat("x", 500), logBody([]byte(strings.Repeat("x", 600))))
+}
+
+func BenchmarkReverseProxy(b *testing.B) {
+	body := bytes.Repeat([]byte("x"), 256<<10)
+	upstream := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		rw.Write(body)
+	}))
+	defer upstream.Close()
+	u, _ := url.Parse(upstream.URL)
+	proxy := NewReverseProxy(u)
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		rw := httptest.NewRecorder()
+		rw.Body = nil
+		req, _ := http.NewRequest("GET", "/", nil)
+		proxy.ServeHTTP(rw, req)
+	}
+}
+
+func BenchmarkLoggingHandlerBody(b *testing.B) {
+	handler := LoggingHandler(ioutil.Discard, http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		ioutil.ReadAll(req.Body)
+	}), true, true, defaultRequestLoggingFormat)
+	body := strings.Repeat("field=value&", 1024)
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		req, _ := http.NewRequest("POST", "/", strings.NewReader(body))
+		handler.ServeHTTP(httptest.NewRecorder(), req)
+	}
+}
+
+func BenchmarkLoggingHandlerBodyWorkers(b *testing.B) {
+	handler := newLoggingHandler(ioutil.Discard, http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		ioutil.ReadAll(req.Body)
+	}), true, true, defaultRequestLoggingFormat, 4)
+	defer handler.Close()
+	body := strings.Repeat("field=value&", 1024)
+	b.ReportAllocs()
+	b.RunParallel(func(pb *testing.PB) {
+		for pb.Next() {
+			req, _ := http.NewRequest("POST", "/", strings.NewReader(body))
+			handler.ServeHTTP(httptest.NewRecorder(), req)
+		}
+	})
+}
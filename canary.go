@@ -0,0 +1,79 @@
+package oauth2proxy
+
+import (
+	"fmt"
+	"hash/fnv"
+	"math/rand"
+	"net/http"
+	"net/url"
+)
+
+// A canaryHandler sends canary-percent of the requests for the path of an
+// upstream to a canary upstream, e.g. a new release of the application, and
+// the rest to the stable one. With canary-by-user, users are assigned by a
+// hash of their identity, so each user stays with one release; requests
+// without a user, as for skip-auth-regex paths, are assigned at random.
+type canaryHandler struct {
+	stable  http.Handler
+	canary  http.Handler
+	percent int
+	byUser  bool
+}
+
+// parseCanaryUpstreams checks that each canary upstream has a stable
+// upstream for the same path.
+func parseCanaryUpstreams(o *Options, msgs []string) []string {
+	o.canaryURLs = nil
+	if len(o.CanaryUpstreams) == 0 {
+		return msgs
+	}
+	if o.CanaryPercent < 0 || o.CanaryPercent > 100 {
+		msgs = append(msgs, "canary-percent must be between 0 and 100")
+	}
+	stable, canary := make(map[string]bool), make(map[string]bool)
+	for _, u := range o.proxyURLs {
+		stable[u.Path] = u.Scheme != "file"
+	}
+	for _, c := range o.CanaryUpstreams {
+		u, err := url.Parse(c)
+		if err != nil {
+			msgs = append(msgs, fmt.Sprintf("error parsing canary-upstream: %s", err))
+			continue
+		}
+		if u.Path == "" {
+			u.Path = "/"
+		}
+		if err := validateUpstream(u); err != nil {
+			msgs = append(msgs, fmt.Sprintf("invalid canary-upstream %q: %s", c, err))
+			continue
+		}
+		if u.Scheme == "file" || !stable[u.Path] {
+			msgs = append(msgs, fmt.Sprintf("invalid canary-upstream %q: no upstream proxying path %q", c, u.Path))
+			continue
+		}
+		if canary[u.Path] {
+			msgs = append(msgs, fmt.Sprintf("invalid canary-upstream %q: path %q has a canary-upstream already", c, u.Path))
+			continue
+		}
+		canary[u.Path] = true
+		o.canaryURLs = append(o.canaryURLs, u)
+	}
+	return msgs
+}
+
+func (h *canaryHandler) ServeHTTP(rw http.ResponseWriter, req *http.Request) {
+	if h.toCanary(rw.Header().Get("GAP-Auth")) {
+		h.canary.ServeHTTP(rw, req)
+	} else {
+		h.stable.ServeHTTP(rw, req)
+	}
+}
+
+func (h *canaryHandler) toCanary(user string) bool {
+	if h.byUser && user != "" {
+		hash := fnv.New32a()
+		hash.Write([]byte(user))
+		return int(hash.Sum32()%100) < h.percent
+	}
+	return rand.Intn(100) < h.percent
+}
@@ -0,0 +1,75 @@
+package oauth2proxy
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestCanaryUpstreamOptions(t *testing.T) {
+	o := testOptions()
+	o.Upstreams = []string{"http://127.0.0.1:8080/", "file:///var/www/static/#/static/"}
+	o.CanaryUpstreams = []string{"http://127.0.0.1:8081/", "http://127.0.0.1:8082/foo/", "file:///var/www/", "http://127.0.0.1:8083/"}
+	o.CanaryPercent = 101
+	assert.Equal(t, errorMsg([]string{
+		"canary-percent must be between 0 and 100",
+		`invalid canary-upstream "http://127.0.0.1:8082/foo/": no upstream proxying path "/foo/"`,
+		`invalid canary-upstream "file:///var/www/": no upstream proxying path "/var/www/"`,
+		`invalid canary-upstream "http://127.0.0.1:8083/": path "/" has a canary-upstream already`,
+	}), o.Validate().Error())
+	assert.Equal(t, 1, len(o.canaryURLs))
+}
+
+func TestCanaryUpstream(t *testing.T) {
+	newUpstream := func(name string) *httptest.Server {
+		return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.Write([]byte(name))
+		}))
+	}
+	stable, canary := newUpstream("stable"), newUpstream("canary")
+	defer stable.Close()
+	defer canary.Close()
+
+	opts := testOptions()
+	opts.Upstreams = []string{stable.URL + "/"}
+	opts.CanaryUpstreams = []string{canary.URL + "/"}
+	opts.CanaryPercent = 20
+	opts.CanaryByUser = true
+	assert.Equal(t, nil, opts.Validate())
+	proxy := newOAuthProxy(opts, func(string) bool { return true })
+
+	get := func(user string) string {
+		rw := httptest.NewRecorder()
+		if user != "" {
+			rw.Header().Set("GAP-Auth", user)
+		}
+		req, _ := http.NewRequest("GET", "/", nil)
+		req.RequestURI = "/"
+		proxy.serveMux.ServeHTTP(rw, req)
+		return rw.Body.String()
+	}
+	served := map[string]int{}
+	for i := 0; i < 1000; i++ {
+		served[get(fmt.Sprintf("user%d@example.com", i))]++
+	}
+	assert.True(t, served["canary"] > 100 && served["canary"] < 300, "%v", served)
+
+	// each user stays with one upstream
+	for i := 0; i < 10; i++ {
+		assert.Equal(t, get("user1@example.com"), get("user1@example.com"))
+	}
+}
+
+func TestCanaryHandlerPercent(t *testing.T) {
+	for _, percent := range []int{0, 100} {
+		h := &canaryHandler{percent: percent}
+		for i := 0; i < 100; i++ {
+			assert.Equal(t, percent == 100, h.toCanary(""))
+		}
+		h.byUser = true
+		assert.Equal(t, percent == 100, h.toCanary("user@example.com"))
+	}
+}
@@ -0,0 +1,11 @@
+// Command oauth2_proxy is a reverse proxy that provides authentication with
+// Google, GitHub or other providers.
+package main
+
+import (
+	"github.com/bitly/oauth2_proxy"
+)
+
+func main() {
+	oauth2proxy.Main()
+}
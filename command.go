@@ -0,0 +1,385 @@
+package oauth2proxy
+
+import (
+	"flag"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"runtime"
+	"strings"
+	"time"
+
+	"github.com/mreiferson/go-options"
+)
+
+// commands are run as "oauth2_proxy <command> [flags]" and return the exit
+// status.
+var commands = map[string]func(args []string) int{
+	"convert-config":  convertConfigCommand,
+	"evaluate-policy": evaluatePolicyCommand,
+	"generate-secret": generateSecretCommand,
+	"service":         serviceCommand,
+}
+
+// Main runs the oauth2_proxy command with the command line arguments of the
+// process.
+func Main() {
+	log.SetFlags(log.Ldate | log.Ltime | log.Lshortfile)
+	if len(os.Args) > 1 {
+		if command, ok := commands[os.Args[1]]; ok {
+			os.Exit(command(os.Args[2:]))
+		}
+	}
+	runProxy(os.Args[1:], (*Server).ListenAndServe)
+}
+
+// runProxy configures the proxy from the command line arguments, environment
+// and config file and calls serve to run it.
+func runProxy(args []string, serve func(s *Server)) {
+	flagSet := newFlagSet("oauth2_proxy")
+	showVersion := flagSet.Bool("version", false, "print version string")
+	printConfig := flagSet.Bool("print-config", false, "print the effective configuration with secrets redacted and exit")
+	checkConfig := flagSet.Bool("check-config", false, "validate the configuration and exit (non-zero exit status on errors)")
+	flagSet.Parse(args)
+
+	if *showVersion {
+		fmt.Printf("oauth2_proxy v%s (built with %s)\n", VERSION, runtime.Version())
+		return
+	}
+
+	opts, cfg, tenants := loadOptions(flagSet)
+	if *printConfig {
+		PrintConfig(os.Stdout, opts, flagSet, cfg, tenants)
+		return
+	}
+	var err error
+	if len(tenants) != 0 {
+		err = ValidateTenants(tenants)
+	} else {
+		err = opts.Validate()
+	}
+	if err != nil {
+		log.Printf("%s", err)
+		os.Exit(1)
+	}
+	if *checkConfig {
+		fmt.Println("configuration OK")
+		return
+	}
+
+	var handler, metrics http.Handler
+	var proxies []*OAuthProxy
+	if len(tenants) != 0 {
+		mux := make(TenantMux)
+		for _, t := range tenants {
+			log.Printf("tenant %q serving %s", t.Name, strings.Join(t.Hosts, ", "))
+			p, err := newOAuthProxyForOptions(t.Opts)
+			if err != nil {
+				log.Fatalf("FATAL: tenant %q: %s", t.Name, err)
+			}
+			mux.Handle(t, p)
+			proxies = append(proxies, p)
+		}
+		handler = mux
+	} else {
+		p, err := newOAuthProxyForOptions(opts)
+		if err != nil {
+			log.Fatalf("FATAL: %s", err)
+		}
+		handler, metrics = p, p.metricsHandler(opts.MetricsPath)
+		proxies = append(proxies, p)
+	}
+
+	logging := newLoggingHandler(os.Stdout, handler, opts.RequestLogging, opts.RequestBodyLogging, opts.RequestLoggingFormat, opts.RequestLogWorkers)
+	s := NewServer(logging, opts, metrics)
+	serve(s)
+	for _, p := range proxies {
+		p.Close()
+	}
+	logging.Close()
+}
+
+// newFlagSet returns a flag set with the flags for all options.
+func newFlagSet(name string) *flag.FlagSet {
+	flagSet := flag.NewFlagSet(name, flag.ExitOnError)
+
+	emailDomains := StringArray{}
+	upstreams := StringArray{}
+	canaryUpstreams := StringArray{}
+	maintenanceAllowCIDRs := StringArray{}
+	maintenanceAllowUsers := StringArray{}
+	maintenanceAllowGroups := StringArray{}
+	mirrorUpstreams := StringArray{}
+	skipAuthRegex := StringArray{}
+	googleGroups := StringArray{}
+	oktaGroups := StringArray{}
+	hostProviders := StringArray{}
+	loginProviders := StringArray{}
+	loginProviderLabels := StringArray{}
+	loginProviderIcons := StringArray{}
+	loginProviderOrder := StringArray{}
+	tlsCipherSuites := StringArray{}
+	tlsCurves := StringArray{}
+	allowCIDRs := StringArray{}
+	denyCIDRs := StringArray{}
+	whitelistDomains := StringArray{}
+	hostTemplatesDirs := StringArray{}
+	redirectSchemes := StringArray{}
+	corsAllowedOrigins := StringArray{}
+	corsAllowedHeaders := StringArray{}
+	upstreamCachePaths := StringArray{}
+	upstreamCacheContentTypes := StringArray{}
+
+	flagSet.String("config", "", "path to config file")
+
+	flagSet.String("http-address", "127.0.0.1:4180", "[http://]<addr>:<port> or unix://<path> to listen on for HTTP clients")
+	flagSet.String("unix-socket-mode", "", "permissions of the socket when http-address is unix://<path>, in octal (e.g. 0660)")
+	flagSet.String("https-address", ":443", "<addr>:<port> to listen on for HTTPS clients")
+	flagSet.String("http-address-ipv6", "", "[<IPv6 addr>]:<port> to also listen on for HTTP clients, e.g. [::]:4180 alongside an http-address of 0.0.0.0:4180")
+	flagSet.String("https-address-ipv6", "", "[<IPv6 addr>]:<port> to also listen on for HTTPS clients, e.g. [::]:443 alongside an https-address of 0.0.0.0:443")
+	flagSet.String("metrics-address", "", "<addr>:<port> to serve Prometheus metrics on at metrics-path, without authentication (e.g. 127.0.0.1:9100)")
+	flagSet.String("metrics-path", "/metrics", "path to serve Prometheus metrics at on the metrics-address")
+	flagSet.String("tls-cert", "", "path to certificate file")
+	flagSet.String("tls-key", "", "path to private key file")
+	flagSet.String("tls-min-version", "1.2", "minimum TLS version for HTTPS clients: 1.0, 1.1, 1.2 or 1.3")
+	flagSet.String("tls-max-version", "", "maximum TLS version for HTTPS clients: 1.0, 1.1, 1.2 or 1.3 (default: the newest supported)")
+	flagSet.Var(&tlsCipherSuites, "tls-cipher-suite", "restrict HTTPS to this cipher suite, e.g. TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256 (may be given multiple times, in order of preference)")
+	flagSet.Var(&tlsCurves, "tls-curve", "elliptic curve for HTTPS key exchange: P256, P384, P521 or X25519 (may be given multiple times, in order of preference)")
+	flagSet.String("tls-client-ca", "", "path to CA certificates (PEM) to verify HTTPS client certificates against; a verified certificate authenticates the request")
+	flagSet.Bool("tls-client-cert-required", false, "reject HTTPS clients without a certificate verified against tls-client-ca")
+	flagSet.Bool("http2", false, "offer HTTP/2 to HTTPS clients")
+	flagSet.Int("http2-max-concurrent-streams", 250, "maximum number of concurrent requests on each HTTP/2 connection")
+	flagSet.Bool("http3", false, "experimental: also serve HTTP/3 (QUIC) on the UDP port of https-address and advertise it with Alt-Svc")
+	flagSet.String("http-with-tls", "", "also listen on http-address when tls-cert/tls-key are set: \"serve\" to serve HTTP requests or \"redirect\" to redirect them to HTTPS")
+	flagSet.Duration("shutdown-timeout", time.Duration(30)*time.Second, "time to wait for active requests to complete on SIGTERM or after a restart")
+	flagSet.Duration("read-timeout", 0, "maximum duration for reading a request, including the body; 0 for no limit")
+	flagSet.Duration("read-header-timeout", 0, "maximum duration for reading the request headers, e.g. 10s to drop slowloris clients; 0 for the read-timeout")
+	flagSet.Duration("write-timeout", 0, "maximum duration from the end of reading the request headers to the end of writing the response; 0 for no limit")
+	flagSet.Duration("idle-timeout", 0, "how long to keep idle keep-alive connections open; 0 for the read-timeout")
+	flagSet.Duration("tcp-keepalive", 3*time.Minute, "period of TCP keep-alive probes on client connections; 0 to disable them")
+	flagSet.Bool("watch-files", false, "reload the htpasswd-file and tls-cert/tls-key when they change (e.g. updated Kubernetes ConfigMap or Secret mounts)")
+	flagSet.String("redirect-url", "", "the OAuth Redirect URL. ie: \"https://internalapp.yourcompany.com/oauth2/callback\"")
+	flagSet.Bool("set-xauthrequest", false, "set X-Auth-Request-User and X-Auth-Request-Email response headers (useful in Nginx auth_request mode)")
+	flagSet.Var(&upstreams, "upstream", "the http url(s) of the upstream endpoint, srv://<name> SRV records or consul://<service> Consul services of them, or file:// paths for static files. Routing is based on the path")
+	flagSet.Var(&canaryUpstreams, "canary-upstream", "upstream to send canary-percent of the requests for the path of an upstream to, e.g. a new release (may be given multiple times)")
+	flagSet.Int("canary-percent", 0, "percentage of requests sent to canary upstreams")
+	flagSet.Bool("canary-by-user", false, "assign users to canary upstreams by a hash of their identity, so each user stays with one upstream")
+	flagSet.Var(&mirrorUpstreams, "mirror-upstream", "http(s) shadow upstream to send copies of the requests for the path of an upstream to, discarding its responses (may be given multiple times)")
+	flagSet.Int("mirror-percent", 100, "percentage of requests copied to mirror upstreams")
+	flagSet.Bool("pass-basic-auth", true, "pass HTTP Basic Auth, X-Forwarded-User and X-Forwarded-Email information to upstream")
+	flagSet.Bool("pass-user-headers", true, "pass X-Forwarded-User and X-Forwarded-Email information to upstream")
+	flagSet.String("basic-auth-password", "", "the password to set when passing the HTTP Basic Auth header")
+	flagSet.Bool("pass-access-token", false, "pass OAuth access_token to upstream via X-Forwarded-Access-Token header")
+	flagSet.Bool("pass-host-header", true, "pass the request Host Header to upstream")
+	flagSet.Var(&skipAuthRegex, "skip-auth-regex", "bypass authentication for requests path's that match (may be given multiple times)")
+	flagSet.Bool("skip-provider-button", false, "will skip sign-in-page to directly reach the next step: oauth/start")
+	flagSet.Bool("skip-auth-preflight", false, "will skip authentication for OPTIONS requests")
+	flagSet.Bool("ssl-insecure-skip-verify", false, "skip validation of certificates presented when using HTTPS")
+	flagSet.Duration("max-age", time.Duration(0), "log in with oidc parameter max-age")
+	flagSet.Var(&whitelistDomains, "whitelist-domain", "allow redirects after sign in to this domain, or its subdomains with a leading dot, e.g. .yourcompany.com (may be given multiple times)")
+	flagSet.Var(&redirectSchemes, "redirect-scheme", "allow redirects after sign in to URLs with this custom scheme of a native app, e.g. myapp for myapp://callback (may be given multiple times)")
+
+	flagSet.Var(&emailDomains, "email-domain", "authenticate emails with the specified domain (may be given multiple times). Use * to authenticate any email")
+	flagSet.String("azure-tenant", "common", "go to a tenant-specific or common (tenant-independent) endpoint.")
+	flagSet.String("github-org", "", "restrict logins to members of this organisation")
+	flagSet.String("github-team", "", "restrict logins to members of this team")
+	flagSet.Var(&googleGroups, "google-group", "restrict logins to members of this google group (may be given multiple times).")
+	flagSet.String("google-admin-email", "", "the google admin to impersonate for api calls")
+	flagSet.String("google-service-account-json", "", "the path to the service account json credentials")
+	flagSet.String("okta-domain", "", "the full domain for which your organization's okta is configured (example.okta.com)")
+	flagSet.Var(&oktaGroups, "okta-group", "restrict logins to members of this okta group (may be given multiple times)")
+	flagSet.String("client-id", "", "the OAuth Client ID: ie: \"123456.apps.googleusercontent.com\"")
+	flagSet.String("client-secret", "", "the OAuth Client Secret")
+	flagSet.String("client-secret-file", "", "the file with the OAuth Client Secret (alternative to -client-secret)")
+	flagSet.String("authenticated-emails-file", "", "authenticate against emails via file (one per line)")
+	flagSet.Bool("authorization-audit-only", false, "log requests that the email domain, authenticated emails and group rules would deny as \"would deny\" and allow them")
+	flagSet.String("htpasswd-file", "", "additionally authenticate against a htpasswd file. Entries must be created with \"htpasswd -s\" for SHA encryption")
+	flagSet.Bool("display-htpasswd-form", true, "display username / password login form if an htpasswd file is provided")
+	flagSet.String("custom-templates-dir", "", "directory with sign_in.html, error.html, forbidden.html, sign_out.html, signed_out.html, device.html, terms.html and/or maintenance.html templates replacing the built-in ones")
+	flagSet.Var(&hostTemplatesDirs, "host-templates-dir", "host=dir: custom templates directory, like custom-templates-dir, for requests to host (may be given multiple times)")
+	flagSet.Bool("custom-templates-csp", false, "serve pages with custom-templates-dir or host-templates-dir with the strict Content-Security-Policy of the built-in pages")
+	flagSet.Bool("templates-watch", false, "re-parse the templates in custom-templates-dir and host-templates-dir when they change, logging template errors (for developing templates)")
+	flagSet.String("banner", "", "custom HTML shown above the sign in button instead of the allowed email domains. Use \"-\" to disable the default banner.")
+	flagSet.String("footer", "", "custom footer string. Use \"-\" to disable default footer.")
+	flagSet.String("brand-name", "", "product name shown on the built-in sign in and error pages")
+	flagSet.String("brand-logo-url", "", "URL of a logo shown on the built-in sign in and error pages")
+	flagSet.String("brand-color", "", "primary color of the built-in pages, e.g. #428bca")
+	flagSet.String("brand-support-contact", "", "email address or URL for help, shown on the built-in error page")
+	flagSet.String("banner-message-file", "", "file with a message, e.g. about planned maintenance, shown on the sign in page while the file exists and is not empty")
+	flagSet.Duration("banner-message-refresh", time.Minute, "how often to re-read the banner-message-file")
+	flagSet.String("banner-message-header", "", "request header passing the banner message to upstreams, e.g. X-Banner-Message")
+	flagSet.String("maintenance-file", "", "file that switches on maintenance mode, responding to requests for upstreams with a 503 page, while it exists; its content is shown on the page")
+	flagSet.Var(&maintenanceAllowCIDRs, "maintenance-allow-cidr", "let requests from client addresses in this CIDR block through to upstreams in maintenance mode (may be given multiple times)")
+	flagSet.Var(&maintenanceAllowUsers, "maintenance-allow-user", "let this email address, or @domain, through to upstreams in maintenance mode (may be given multiple times)")
+	flagSet.Var(&maintenanceAllowGroups, "maintenance-allow-group", "let members of this group through to upstreams in maintenance mode (may be given multiple times)")
+	flagSet.Bool("sign-out-confirm", true, "ask users to confirm signing out when they visit /oauth2/sign_out; otherwise only POST requests sign out")
+	flagSet.String("sign-out-redirect", "", "URL to redirect to after signing out, e.g. the provider's sign out page, instead of showing the signed out page")
+	flagSet.Var(&corsAllowedOrigins, "cors-allowed-origin", "origin allowed to call /oauth2/session, /oauth2/refresh and /oauth2/sign_out from the browser, e.g. https://app.yourcompany.com, https://*.yourcompany.com or \"*\" (may be given multiple times)")
+	flagSet.Bool("cors-allow-credentials", false, "allow cors-allowed-origin pages to send the session cookie with their requests")
+	flagSet.Var(&corsAllowedHeaders, "cors-allowed-header", "request header that cors-allowed-origin pages may send, e.g. X-CSRF-Token (may be given multiple times)")
+	flagSet.Bool("device-flow", false, "let signed in users sign in headless devices with a code on the /oauth2/device pairing page (requires session-store)")
+	flagSet.String("terms-file", "", "file with the terms of use (HTML) that users must accept on the /oauth2/terms page after signing in (requires a persistent session-store)")
+	flagSet.String("terms-version", "", "version of the terms-file; users accept the terms again when it changes (default: derived from the file content)")
+	flagSet.Duration("terms-interval", 0, "require accepting the terms again after this long; 0 for only when the terms change")
+	flagSet.String("proxy-prefix", "/oauth2", "the url root path that this proxy should be nested under (e.g. /<oauth2>/sign_in); also sets the path of redirect-url to <proxy-prefix>/callback")
+
+	flagSet.String("aws-region", "", "AWS region used to fetch aws-secretsmanager: and aws-ssm: secret references (defaults to the region of the ARN or the AWS SDK configuration)")
+	flagSet.Duration("aws-secret-refresh-interval", time.Duration(0), "re-fetch a client-secret stored in AWS at this interval; 0 to disable")
+
+	flagSet.String("cookie-name", "_oauth2_proxy", "the name of the cookie that the oauth_proxy creates")
+	flagSet.String("cookie-secret", "", "the seed string for secure cookies (optionally base64 encoded); must be 16, 24 or 32 bytes")
+	flagSet.String("cookie-secret-file", "", "the file with the seed string for secure cookies (alternative to -cookie-secret)")
+	flagSet.String("cookie-secret-kms-key", "", "the KMS key (aws-kms:<key>, gcp-kms:<key name> or azure-keyvault:<key URL>) that cookie-secret is wrapped with")
+	flagSet.String("cookie-domain", "", "an optional cookie domain to force cookies to (ie: .yourcompany.com)*")
+	flagSet.Duration("cookie-expire", time.Duration(168)*time.Hour, "expire timeframe for cookie")
+	flagSet.Duration("cookie-refresh", time.Duration(0), "refresh the cookie after this duration; 0 to disable")
+	flagSet.Bool("cookie-secure", true, "set secure (HTTPS) cookie flag")
+	flagSet.Bool("cookie-httponly", true, "set HttpOnly cookie flag")
+	flagSet.Bool("cookie-compress", false, "compress the session (with its access and refresh tokens) before encrypting it into the cookie")
+	flagSet.Int("cookie-max-size", 4096, "keep sessions whose cookie would exceed this many bytes in the session-store, if there is one, with only a ticket for them in the cookie; 0 to disable")
+
+	flagSet.String("revocation-webhook-token", "", "enable the session revocation webhook at /oauth2/revoke for requests authorized with this token (requires session-store)")
+	flagSet.String("admin-token", "", "enable the admin endpoints under /oauth2/admin/ for requests authorized with this token")
+	flagSet.String("session-store", "", "store shared by all replicas for OAuth state: redis://[:password@]host:port[/db] or rediss://...")
+	flagSet.Duration("refresh-ahead", 0, "refresh access tokens in the background this long before they expire, instead of on the first request after; requires session-store")
+	flagSet.Duration("session-validation-cache", 0, "reuse a successful validation of a session's access token with the provider for this long; 0 to always validate")
+
+	flagSet.Int("max-header-bytes", 0, "reject requests whose headers exceed this many bytes with 431; 0 for the default of 1MB")
+	flagSet.Int("max-header-count", 0, "reject requests with more than this many headers with 431; 0 to disable")
+	flagSet.Int("max-uri-length", 0, "reject requests whose URI exceeds this many bytes with 414; 0 to disable")
+	flagSet.Var(&allowCIDRs, "allow-cidr", "only accept requests from client addresses in this CIDR block, e.g. 10.0.0.0/8 (may be given multiple times)")
+	flagSet.Var(&denyCIDRs, "deny-cidr", "reject requests from client addresses in this CIDR block, even if allowed by allow-cidr (may be given multiple times)")
+	flagSet.Int("rate-limit-per-ip", 0, "limit requests from each client address to this many per minute; 0 to disable")
+	flagSet.Int("rate-limit-per-user", 0, "limit requests from each authenticated user to this many per minute; 0 to disable")
+	flagSet.Int("rate-limit-ipv6-prefix", 64, "count rate limits and lockouts of IPv6 clients by networks of this prefix length; 128 for each address")
+	flagSet.Int("max-concurrent-requests", 0, "limit the requests proxied to upstreams at once to this many; 0 to disable")
+	flagSet.Int("max-queued-requests", 0, "let this many requests over max-concurrent-requests wait for one to finish, instead of rejecting them with 503")
+	flagSet.Duration("queue-timeout", 5*time.Second, "how long requests wait in the max-queued-requests queue before they are rejected with 503")
+	flagSet.Int("lockout-threshold", 0, "block sign ins from a client address, or of a user from it, after this many failures; 0 to disable")
+	flagSet.Duration("lockout-duration", 15*time.Minute, "how long to block sign ins after lockout-threshold failures, and to remember failures")
+	flagSet.Duration("lockout-delay", time.Second, "block sign ins for this duration after a failure, doubled for each recent failure (up to 30s)")
+
+	flagSet.Bool("request-logging", true, "Log requests to stdout")
+	flagSet.Bool("request-body-logging", false, "Allow the logger to read request bodies")
+	flagSet.String("request-logging-format", defaultRequestLoggingFormat, "Template for log lines")
+	flagSet.Int("request-logging-workers", 0, "render and write request log lines on this many background workers instead of on each request")
+	flagSet.String("security-event-syslog", "", "send security events (sign ins, denials, sign outs, refresh failures) to this syslog server: udp://host:port or tcp://host:port")
+	flagSet.String("security-event-format", "cef", "format of security events: cef (ArcSight) or leef (QRadar)")
+
+	flagSet.String("provider", "google", "OAuth provider")
+	flagSet.Var(&hostProviders, "host-provider", "use a different OAuth provider and client for requests to a host: host=provider:client-id:client-secret-file (may be given multiple times)")
+	flagSet.Var(&loginProviders, "login-provider", "offer another OAuth provider and client on the sign in page: name=provider:client-id:client-secret-file (may be given multiple times)")
+	flagSet.Var(&loginProviderLabels, "login-provider-label", "name shown on the sign in page for a login-provider (or \"default\" for -provider): name=label (may be given multiple times)")
+	flagSet.Var(&loginProviderIcons, "login-provider-icon", "icon shown on the sign in page for a login-provider (or \"default\" for -provider): name=url (may be given multiple times)")
+	flagSet.Var(&loginProviderOrder, "login-provider-order", "name of a login-provider (or \"default\") in the order of the sign in page; others follow (may be given multiple times)")
+	flagSet.String("oidc-issuer-url", "", "OpenID Connect issuer URL (ie: https://accounts.google.com)")
+	flagSet.String("login-url", "", "Authentication endpoint")
+	flagSet.String("redeem-url", "", "Token redemption endpoint")
+	flagSet.String("profile-url", "", "Profile access endpoint")
+	flagSet.String("resource", "", "The resource that is protected (Azure AD only)")
+	flagSet.String("validate-url", "", "Access token validation endpoint")
+	flagSet.String("scope", "", "OAuth scope specification")
+	flagSet.String("prompt", "login", "OAuth prompt")
+
+	flagSet.String("signature-key", "", "GAP-Signature request signature key (algorithm:secretkey)")
+	flagSet.String("upstream-jwt-header", "", "pass a signed JWT with the user's identity to upstream in this header, e.g. X-Forwarded-Identity")
+	flagSet.String("upstream-jwt-key-file", "", "PEM encoded RSA or ECDSA P-256 private key to sign upstream JWTs with")
+	flagSet.String("upstream-jwt-issuer", "", "iss claim of upstream JWTs, e.g. https://internal.yourcompany.com/oauth2")
+	flagSet.Duration("upstream-jwt-expiration", time.Duration(5)*time.Minute, "lifetime of upstream JWTs")
+	flagSet.String("trusted-identity-header", "", "accept the user's identity from a fronting oauth2_proxy in the signed JWT in this request header, e.g. X-Forwarded-Identity")
+	flagSet.String("trusted-identity-key-file", "", "JSON Web Key Set, or PEM encoded public keys or certificates, to verify trusted-identity-header JWTs with")
+	flagSet.String("trusted-identity-issuer", "", "only accept trusted-identity-header JWTs from this issuer, e.g. https://internal.yourcompany.com/oauth2")
+	flagSet.String("trusted-identity-audience", "", "only accept trusted-identity-header JWTs issued for this audience, the upstream URL of this proxy on the fronting one, e.g. https://inner.yourcompany.com/")
+	flagSet.Int("upstream-cache-size", 0, "cache upstream responses marked public by their Cache-Control header in memory, up to this many bytes; 0 to disable")
+	flagSet.Var(&upstreamCachePaths, "upstream-cache-path", "only cache responses for request paths matching this regex, e.g. ^/static/ (may be given multiple times)")
+	flagSet.Var(&upstreamCacheContentTypes, "upstream-cache-content-type", "only cache responses with a Content-Type starting with this, e.g. image/ or text/css (may be given multiple times)")
+	flagSet.Duration("upstream-dns-refresh", 0, "resolve upstream hostnames again at this interval, e.g. the TTL of their DNS records, and move to new connections when the addresses change; 0 to disable (SRV records of srv:// upstreams are then looked up every 30s)")
+	flagSet.String("consul-address", "http://127.0.0.1:8500", "URL of the Consul agent to discover the instances of consul://<service> upstreams with")
+	flagSet.String("consul-token", "", "ACL token for Consul")
+	flagSet.String("consul-datacenter", "", "Consul datacenter of the services of consul:// upstreams (default the agent's)")
+
+	return flagSet
+}
+
+// loadOptions resolves the options from the flags, environment and config
+// file, along with the options of each tenant in the config file.
+func loadOptions(flagSet *flag.FlagSet) (*Options, EnvOptions, []*Tenant) {
+	config := flagSet.Lookup("config").Value.String()
+	opts := NewOptions()
+
+	cfg := make(EnvOptions)
+	if config != "" {
+		err := cfg.LoadConfigFile(config)
+		if err != nil {
+			log.Fatalf("ERROR: failed to load config file %s - %s", config, err)
+		}
+	}
+	cfg.LoadEnvForStruct(opts)
+	options.Resolve(opts, flagSet, cfg)
+
+	tenants, err := cfg.Tenants(flagSet)
+	if err != nil {
+		log.Fatalf("ERROR: failed to load config file %s - %s", config, err)
+	}
+	return opts, cfg, tenants
+}
+
+// newOAuthProxyForOptions returns the proxy for validated opts with its
+// background refreshes and file watches started.
+func newOAuthProxyForOptions(opts *Options) (*OAuthProxy, error) {
+	oauthproxy := newOAuthProxy(opts, nil)
+	// the authenticated-emails-file is watched until the proxy is closed
+	oauthproxy.Validator = newValidatorImpl(opts.EmailDomains, opts.AuthenticatedEmailsFile, oauthproxy.done, func() {})
+	oauthproxy.StartRefreshAhead()
+	oauthproxy.StartUpstreamDNSRefresh()
+	oauthproxy.StartConsulWatches()
+	RefreshAWSClientSecret(opts, oauthproxy.done)
+	if opts.bannerMessage != nil {
+		opts.bannerMessage.RefreshEvery(opts.BannerMessageRefresh, oauthproxy.done)
+	}
+	if opts.maintenance != nil {
+		opts.maintenance.RefreshEvery(maintenanceFileRefresh, oauthproxy.done)
+	}
+
+	if len(opts.EmailDomains) != 0 && opts.AuthenticatedEmailsFile == "" {
+		if len(opts.EmailDomains) > 1 {
+			oauthproxy.SignInMessage = fmt.Sprintf("Authenticate using one of the following domains: %v", strings.Join(opts.EmailDomains, ", "))
+		} else if opts.EmailDomains[0] != "*" {
+			oauthproxy.SignInMessage = fmt.Sprintf("Authenticate using %v", opts.EmailDomains[0])
+		}
+	}
+
+	if opts.HtpasswdFile != "" {
+		var err error
+		log.Printf("using htpasswd file %s", opts.HtpasswdFile)
+		oauthproxy.HtpasswdFile, err = NewHtpasswdFromFile(opts.HtpasswdFile)
+		oauthproxy.DisplayHtpasswdForm = opts.DisplayHtpasswdForm
+		if err != nil {
+			oauthproxy.Close()
+			return nil, fmt.Errorf("unable to open %s %s", opts.HtpasswdFile, err)
+		}
+		if opts.WatchFiles {
+			if err := oauthproxy.HtpasswdFile.WatchForUpdates(opts.HtpasswdFile, oauthproxy.done); err != nil {
+				oauthproxy.Close()
+				return nil, err
+			}
+		}
+	}
+	if opts.TemplatesWatch {
+		dirs := map[string]string{"": opts.CustomTemplatesDir}
+		for host, dir := range opts.templateDirs {
+			dirs[host] = dir
+		}
+		for host, dir := range dirs {
+			if dir == "" {
+				continue
+			}
+			if err := oauthproxy.WatchTemplates(host, dir, oauthproxy.done); err != nil {
+				oauthproxy.Close()
+				return nil, err
+			}
+		}
+	}
+	return oauthproxy, nil
+}
@@ -0,0 +1,84 @@
+package oauth2proxy
+
+import (
+	"log"
+	"net/http"
+	"time"
+)
+
+// A concurrencyLimit caps the requests proxied upstream at once, so that a
+// slow upstream can't tie up all the connections and memory of the proxy,
+// and with them the sign in of every other upstream. Requests over the cap
+// wait in a queue for up to the queue timeout, and are otherwise answered
+// with 503 Service Unavailable.
+type concurrencyLimit struct {
+	active  chan struct{}
+	queue   chan struct{}
+	timeout time.Duration
+}
+
+// parseConcurrencyLimit sets up the concurrency limit, if there is one.
+func parseConcurrencyLimit(o *Options, msgs []string) []string {
+	o.concurrency = nil
+	if o.MaxConcurrentRequests < 0 || o.MaxQueuedRequests < 0 || o.QueueTimeout < 0 {
+		return append(msgs, "max-concurrent-requests, max-queued-requests and queue-timeout must not be negative")
+	}
+	if o.MaxConcurrentRequests == 0 {
+		if o.MaxQueuedRequests != 0 {
+			msgs = append(msgs, "max-queued-requests requires max-concurrent-requests")
+		}
+		return msgs
+	}
+	o.concurrency = &concurrencyLimit{
+		active:  make(chan struct{}, o.MaxConcurrentRequests),
+		queue:   make(chan struct{}, o.MaxQueuedRequests),
+		timeout: o.QueueTimeout,
+	}
+	return msgs
+}
+
+// Handler passes requests on to next while there are less than the maximum
+// in progress.
+func (l *concurrencyLimit) Handler(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		if !l.acquire(req) {
+			log.Printf("%s too many concurrent requests, rejecting %s", getRemoteAddr(req), req.URL.Path)
+			rw.Header().Set("Retry-After", "1")
+			http.Error(rw, "Service Unavailable", http.StatusServiceUnavailable)
+			return
+		}
+		defer l.release()
+		next.ServeHTTP(rw, req)
+	})
+}
+
+// acquire takes a slot for req, waiting in the queue for one if there is
+// room in it, until the queue timeout or the client goes away.
+func (l *concurrencyLimit) acquire(req *http.Request) bool {
+	select {
+	case l.active <- struct{}{}:
+		return true
+	default:
+	}
+	select {
+	case l.queue <- struct{}{}:
+	default:
+		return false
+	}
+	defer func() { <-l.queue }()
+
+	timer := time.NewTimer(l.timeout)
+	defer timer.Stop()
+	select {
+	case l.active <- struct{}{}:
+		return true
+	case <-timer.C:
+		return false
+	case <-req.Context().Done():
+		return false
+	}
+}
+
+func (l *concurrencyLimit) release() {
+	<-l.active
+}
@@ -0,0 +1,90 @@
+package oauth2proxy
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestConcurrencyLimitOptions(t *testing.T) {
+	o := testOptions()
+	o.MaxQueuedRequests = 10
+	assert.Equal(t, errorMsg([]string{"max-queued-requests requires max-concurrent-requests"}), o.Validate().Error())
+
+	o = testOptions()
+	o.MaxConcurrentRequests = -1
+	assert.Equal(t, errorMsg([]string{
+		"max-concurrent-requests, max-queued-requests and queue-timeout must not be negative",
+	}), o.Validate().Error())
+
+	o = testOptions()
+	assert.Equal(t, nil, o.Validate())
+	assert.Equal(t, (*concurrencyLimit)(nil), o.concurrency)
+}
+
+func TestConcurrencyLimit(t *testing.T) {
+	opts := testOptions()
+	opts.MaxConcurrentRequests = 2
+	opts.MaxQueuedRequests = 1
+	opts.QueueTimeout = 50 * time.Millisecond
+	assert.Equal(t, nil, opts.Validate())
+
+	started := make(chan bool)
+	release := make(chan bool)
+	handler := opts.concurrency.Handler(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		started <- true
+		<-release
+	}))
+	codes := make(chan int, 4)
+	serve := func() {
+		rw := httptest.NewRecorder()
+		req, _ := http.NewRequest("GET", "/", nil)
+		handler.ServeHTTP(rw, req)
+		codes <- rw.Code
+	}
+
+	// two requests in progress, a third one queued
+	go serve()
+	go serve()
+	<-started
+	<-started
+	go serve()
+	for len(opts.concurrency.queue) == 0 {
+		time.Sleep(time.Millisecond)
+	}
+
+	// a fourth one is rejected right away, as the queue is full
+	rw := httptest.NewRecorder()
+	req, _ := http.NewRequest("GET", "/", nil)
+	handler.ServeHTTP(rw, req)
+	assert.Equal(t, 503, rw.Code)
+	assert.Equal(t, "1", rw.Header().Get("Retry-After"))
+
+	// the queued one gets through once a slot is free
+	release <- true
+	<-started
+	assert.Equal(t, 200, <-codes)
+	release <- true
+	release <- true
+	assert.Equal(t, 200, <-codes)
+	assert.Equal(t, 200, <-codes)
+
+	// and times out otherwise
+	go serve()
+	go serve()
+	<-started
+	<-started
+	start := time.Now()
+	rw = httptest.NewRecorder()
+	handler.ServeHTTP(rw, req)
+	assert.Equal(t, 503, rw.Code)
+	assert.True(t, time.Since(start) >= 50*time.Millisecond)
+	release <- true
+	release <- true
+	assert.Equal(t, 200, <-codes)
+	assert.Equal(t, 200, <-codes)
+	assert.Equal(t, 0, len(opts.concurrency.active))
+}
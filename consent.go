@@ -0,0 +1,98 @@
+package oauth2proxy
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"time"
+)
+
+// consentRetention is how long consent records are kept.
+const consentRetention = termsForever
+
+// A consentRecord is the audit record of a user accepting a document, such
+// as a version of the terms of use. Records are written once and never
+// changed or deleted by the proxy.
+type consentRecord struct {
+	Identity      string    `json:"identity"`
+	Document      string    `json:"document"`
+	Version       string    `json:"version"`
+	Time          time.Time `json:"time"`
+	ClientAddress string    `json:"client_address"`
+}
+
+// consentKey returns the prefix of the consent records of identity, which is
+// escaped so that identities containing ":" can't match those of others.
+func consentKey(identity string) string {
+	return "consent:" + url.QueryEscape(identity) + ":"
+}
+
+// recordConsent writes the consent record of identity accepting version of
+// document, to the store and to the log.
+func (p *OAuthProxy) recordConsent(req *http.Request, identity, document, version string) error {
+	r := consentRecord{
+		Identity:      identity,
+		Document:      document,
+		Version:       version,
+		Time:          time.Now().UTC(),
+		ClientAddress: clientIP(req),
+	}
+	value, _ := json.Marshal(&r)
+	key := consentKey(identity) + strconv.FormatInt(r.Time.UnixNano(), 10)
+	ok, err := p.consentStore.SetNX(key, value, consentRetention)
+	if err == nil && !ok {
+		err = fmt.Errorf("consent record %s exists", key)
+	}
+	if err != nil {
+		return err
+	}
+	log.Printf("%s consent record %s", getRemoteAddr(req), value)
+	return nil
+}
+
+// Consents lists the consent records, oldest first, optionally only those
+// of the given identity and/or version.
+func (p *OAuthProxy) Consents(rw http.ResponseWriter, req *http.Request) {
+	if !p.authorizeAdmin(rw, req) {
+		return
+	}
+	if req.Method != "GET" {
+		rw.Header().Set("Allow", "GET")
+		http.Error(rw, "Method Not Allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	prefix := "consent:"
+	if identity := req.FormValue("identity"); identity != "" {
+		prefix = consentKey(identity)
+	}
+	keys, err := p.consentStore.Keys(prefix)
+	if err != nil {
+		log.Printf("error listing consent records %s", err)
+		http.Error(rw, "Internal Error", http.StatusInternalServerError)
+		return
+	}
+	version := req.FormValue("version")
+	records := []*consentRecord{}
+	for _, key := range keys {
+		value, err := p.consentStore.Get(key)
+		if err != nil {
+			continue
+		}
+		var r consentRecord
+		if err := json.Unmarshal(value, &r); err != nil {
+			log.Printf("invalid consent record %s: %s", key, err)
+			continue
+		}
+		if version == "" || r.Version == version {
+			records = append(records, &r)
+		}
+	}
+	sort.Slice(records, func(i, j int) bool { return records[i].Time.Before(records[j].Time) })
+	rw.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(rw).Encode(records)
+}
@@ -0,0 +1,82 @@
+package oauth2proxy
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/bitly/oauth2_proxy/store"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestConsents(t *testing.T) {
+	file := writeTermsFile(t, "<p>Be nice.</p>")
+	defer os.Remove(file)
+	opts := testOptions()
+	opts.TermsFile = file
+	opts.SessionStore = "redis://localhost:6379/1"
+	opts.TermsVersion = "1"
+	opts.AdminToken = "secret"
+	assert.Equal(t, nil, opts.Validate())
+	opts.sessionStore = store.NewMemoryStore()
+	proxy := newOAuthProxy(opts, func(string) bool { return true })
+
+	accept := func(identity string) {
+		req, _ := http.NewRequest("POST", "/oauth2/terms", nil)
+		req.RemoteAddr = "203.0.113.7:1234"
+		assert.Equal(t, nil, proxy.acceptTerms(req, identity))
+	}
+	consents := func(query, token string) (int, []consentRecord) {
+		rw := httptest.NewRecorder()
+		req, _ := http.NewRequest("GET", "/oauth2/admin/consents"+query, nil)
+		req.Header.Set("Authorization", "Bearer "+token)
+		proxy.ServeHTTP(rw, req)
+		var records []consentRecord
+		json.Unmarshal(rw.Body.Bytes(), &records)
+		return rw.Code, records
+	}
+
+	start := time.Now()
+	accept("jane@example.com")
+	accept("john@example.com")
+	proxy.terms = &terms{HTML: "<p>Be very nice.</p>", Version: "2"}
+	accept("jane@example.com")
+
+	code, records := consents("", "secret")
+	assert.Equal(t, 200, code)
+	assert.Equal(t, 3, len(records))
+	r := records[0]
+	assert.Equal(t, "jane@example.com", r.Identity)
+	assert.Equal(t, "terms", r.Document)
+	assert.Equal(t, "1", r.Version)
+	assert.Equal(t, "203.0.113.7", r.ClientAddress)
+	assert.False(t, r.Time.Before(start.Add(-time.Second)))
+
+	_, records = consents("?identity=jane@example.com", "secret")
+	assert.Equal(t, 2, len(records))
+	assert.Equal(t, "2", records[1].Version)
+	_, records = consents("?version=1", "secret")
+	assert.Equal(t, 2, len(records))
+	_, records = consents("?identity=jane@example.com&version=2", "secret")
+	assert.Equal(t, 1, len(records))
+
+	// identities containing ":" don't match the records of others
+	accept("jane")
+	accept("jane:x")
+	_, records = consents("?identity=jane", "secret")
+	assert.Equal(t, 1, len(records))
+	assert.Equal(t, "jane", records[0].Identity)
+
+	code, _ = consents("", "wrong")
+	assert.Equal(t, 401, code)
+
+	// records can't be deleted
+	rw := httptest.NewRecorder()
+	req, _ := http.NewRequest("DELETE", "/oauth2/admin/consents", nil)
+	req.Header.Set("Authorization", "secret")
+	proxy.ServeHTTP(rw, req)
+	assert.Equal(t, 405, rw.Code)
+}
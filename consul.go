@@ -0,0 +1,179 @@
+package oauth2proxy
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+	"time"
+)
+
+const (
+	// consulWait is how long a blocking query to Consul waits for the
+	// instances of a service to change.
+	consulWait = 5 * time.Minute
+	// consulRetryDelay is the delay before querying Consul again after an
+	// error.
+	consulRetryDelay = 5 * time.Second
+)
+
+// A consulCatalog discovers the healthy instances of the services of
+// consul://<service> (or consul+https://<service>) upstreams with the health
+// API of a Consul agent.
+type consulCatalog struct {
+	address    *url.URL
+	token      string
+	datacenter string
+	client     *http.Client
+}
+
+// consulServiceEntry is the part of an entry of /v1/health/service/<service>
+// that locates an instance.
+type consulServiceEntry struct {
+	Node struct {
+		Address string
+	}
+	Service struct {
+		Address string
+		Port    int
+		Weights struct {
+			Passing int
+		}
+	}
+}
+
+// parseConsul sets up the Consul catalog if any upstream or canary upstream
+// is a consul:// one.
+func parseConsul(o *Options, msgs []string) []string {
+	o.consul = nil
+	used := false
+	for _, u := range append(append([]*url.URL{}, o.proxyURLs...), o.canaryURLs...) {
+		used = used || u.Scheme == "consul" || u.Scheme == "consul+https"
+	}
+	if !used {
+		return msgs
+	}
+	u, err := url.Parse(o.ConsulAddress)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return append(msgs, fmt.Sprintf("invalid consul-address %q; must be an http(s) URL such as http://127.0.0.1:8500", o.ConsulAddress))
+	}
+	o.consul = &consulCatalog{
+		address:    u,
+		token:      o.ConsulToken,
+		datacenter: o.ConsulDatacenter,
+		client:     &http.Client{Timeout: consulWait + time.Minute},
+	}
+	return msgs
+}
+
+// healthyInstances returns the instances of service with passing health
+// checks, and optionally tag, once the index of the service in Consul is past
+// index, or after consulWait. An index of 0 returns at once.
+func (c *consulCatalog) healthyInstances(service, tag string, index uint64) ([]*net.SRV, uint64, error) {
+	params := url.Values{"passing": {"1"}}
+	if tag != "" {
+		params.Set("tag", tag)
+	}
+	if c.datacenter != "" {
+		params.Set("dc", c.datacenter)
+	}
+	if index != 0 {
+		params.Set("index", strconv.FormatUint(index, 10))
+		params.Set("wait", fmt.Sprintf("%ds", int(consulWait/time.Second)))
+	}
+	u := *c.address
+	u.Path = "/v1/health/service/" + url.PathEscape(service)
+	u.RawQuery = params.Encode()
+	req, err := http.NewRequest("GET", u.String(), nil)
+	if err != nil {
+		return nil, 0, err
+	}
+	if c.token != "" {
+		req.Header.Set("X-Consul-Token", c.token)
+	}
+	resp, err := c.client.Do(req)
+	if err != nil {
+		return nil, 0, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, 0, fmt.Errorf("got %d from %s", resp.StatusCode, u.Path)
+	}
+	var entries []consulServiceEntry
+	if err := json.NewDecoder(resp.Body).Decode(&entries); err != nil {
+		return nil, 0, err
+	}
+
+	instances := make([]*net.SRV, 0, len(entries))
+	for _, e := range entries {
+		addr := e.Service.Address
+		if addr == "" {
+			addr = e.Node.Address
+		}
+		weight := e.Service.Weights.Passing
+		if weight <= 0 {
+			weight = 1
+		}
+		instances = append(instances, &net.SRV{Target: addr, Port: uint16(e.Service.Port), Weight: uint16(weight)})
+	}
+	newIndex, _ := strconv.ParseUint(resp.Header.Get("X-Consul-Index"), 10, 64)
+	return instances, newIndex, nil
+}
+
+// newConsulUpstream returns an upstream for the instances of service, as
+// they are at startup.
+func (c *consulCatalog) newConsulUpstream(service, tag string) (*srvUpstream, uint64) {
+	u := &srvUpstream{name: service, transport: newUpstreamTransport()}
+	instances, index, err := c.healthyInstances(service, tag, 0)
+	if err != nil {
+		log.Printf("error looking up consul service %s: %s", service, err)
+		return u, 0
+	}
+	u.setTargets(instances)
+	return u, index
+}
+
+// Watch keeps the targets of u in sync with the healthy instances of service
+// with blocking queries, starting from index, until done is closed.
+func (c *consulCatalog) Watch(u *srvUpstream, tag string, index uint64, done <-chan bool) {
+	go func() {
+		for {
+			select {
+			case <-done:
+				return
+			default:
+			}
+			instances, newIndex, err := c.healthyInstances(u.name, tag, index)
+			if err != nil {
+				log.Printf("error looking up consul service %s: %s", u.name, err)
+				time.Sleep(consulRetryDelay)
+				continue
+			}
+			// start over when the index goes backwards, as after a reset of
+			// Consul, but never from 0, which doesn't block
+			if newIndex < index || newIndex == 0 {
+				newIndex = 1
+			}
+			index = newIndex
+			u.setTargets(instances)
+		}
+	}()
+}
+
+// A consulWatch is a consul:// upstream to keep in sync with Consul.
+type consulWatch struct {
+	upstream *srvUpstream
+	tag      string
+	index    uint64
+}
+
+// StartConsulWatches starts keeping the consul:// upstreams in sync with
+// Consul in the background.
+func (p *OAuthProxy) StartConsulWatches() {
+	for _, w := range p.consulWatches {
+		p.consul.Watch(w.upstream, w.tag, w.index, p.done)
+	}
+}
@@ -0,0 +1,119 @@
+package oauth2proxy
+
+import (
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestConsulOptions(t *testing.T) {
+	o := testOptions()
+	assert.Equal(t, nil, o.Validate())
+	assert.Equal(t, (*consulCatalog)(nil), o.consul)
+
+	o = testOptions()
+	o.Upstreams = []string{"consul://web/"}
+	o.ConsulAddress = "127.0.0.1:8500"
+	assert.Equal(t, errorMsg([]string{
+		`invalid consul-address "127.0.0.1:8500"; must be an http(s) URL such as http://127.0.0.1:8500`}), o.Validate().Error())
+
+	o = testOptions()
+	o.Upstreams = []string{"consul+https://web/?tag=v2"}
+	o.ConsulToken = "token"
+	assert.Equal(t, nil, o.Validate())
+	assert.Equal(t, "127.0.0.1:8500", o.consul.address.Host)
+	assert.Equal(t, "token", o.consul.token)
+}
+
+func TestConsulHealthyInstances(t *testing.T) {
+	var query string
+	consul := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		assert.Equal(t, "/v1/health/service/web", r.URL.Path)
+		assert.Equal(t, "token", r.Header.Get("X-Consul-Token"))
+		query = r.URL.RawQuery
+		w.Header().Set("X-Consul-Index", "42")
+		w.Write([]byte(`[
+			{"Node": {"Address": "10.0.0.1"}, "Service": {"Address": "", "Port": 8080, "Weights": {"Passing": 3}}},
+			{"Node": {"Address": "10.0.0.1"}, "Service": {"Address": "10.0.1.2", "Port": 8081}}
+		]`))
+	}))
+	defer consul.Close()
+
+	o := testOptions()
+	o.Upstreams = []string{"consul://web/"}
+	o.ConsulAddress = consul.URL
+	o.ConsulToken = "token"
+	o.ConsulDatacenter = "dc2"
+	assert.Equal(t, nil, o.Validate())
+
+	instances, index, err := o.consul.healthyInstances("web", "v2", 0)
+	assert.Equal(t, nil, err)
+	assert.Equal(t, "dc=dc2&passing=1&tag=v2", query)
+	assert.Equal(t, uint64(42), index)
+	assert.Equal(t, []*net.SRV{
+		{Target: "10.0.0.1", Port: 8080, Weight: 3},
+		{Target: "10.0.1.2", Port: 8081, Weight: 1},
+	}, instances)
+
+	_, _, err = o.consul.healthyInstances("web", "", 42)
+	assert.Equal(t, nil, err)
+	assert.Equal(t, "dc=dc2&index=42&passing=1&wait=300s", query)
+}
+
+func TestConsulUpstream(t *testing.T) {
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("upstream"))
+	}))
+	defer upstream.Close()
+	host, port, _ := net.SplitHostPort(upstream.Listener.Addr().String())
+
+	// the instance deregisters after the first blocking query
+	registered := make(chan bool)
+	consul := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Query().Get("index") {
+		case "":
+			w.Header().Set("X-Consul-Index", "1")
+			w.Write([]byte(`[{"Service": {"Address": "` + host + `", "Port": ` + port + `}}]`))
+		case "1":
+			<-registered
+			w.Header().Set("X-Consul-Index", "2")
+			w.Write([]byte(`[]`))
+		default:
+			time.Sleep(100 * time.Millisecond)
+			w.Header().Set("X-Consul-Index", "2")
+			w.Write([]byte(`[]`))
+		}
+	}))
+	defer consul.Close()
+
+	opts := testOptions()
+	opts.Upstreams = []string{"consul://web/"}
+	opts.ConsulAddress = consul.URL
+	assert.Equal(t, nil, opts.Validate())
+	proxy := newOAuthProxy(opts, func(string) bool { return true })
+	assert.Equal(t, 1, len(proxy.consulWatches))
+	done := make(chan bool)
+	defer close(done)
+	proxy.consul.Watch(proxy.consulWatches[0].upstream, "", proxy.consulWatches[0].index, done)
+
+	get := func() *httptest.ResponseRecorder {
+		rw := httptest.NewRecorder()
+		req, _ := http.NewRequest("GET", "/", nil)
+		req.RequestURI = "/"
+		proxy.serveMux.ServeHTTP(rw, req)
+		return rw
+	}
+	rw := get()
+	assert.Equal(t, 200, rw.Code)
+	assert.Equal(t, "upstream", rw.Body.String())
+
+	close(registered)
+	for i := 0; i < 50 && proxy.consulWatches[0].upstream.pick() != nil; i++ {
+		time.Sleep(10 * time.Millisecond)
+	}
+	assert.Equal(t, 502, get().Code)
+}
@@ -0,0 +1,191 @@
+package oauth2proxy
+
+import (
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"reflect"
+	"sort"
+	"strings"
+
+	"github.com/mreiferson/go-options"
+)
+
+// legacyOptions maps config file options of earlier releases to their
+// current names.
+var legacyOptions = map[string]string{
+	"cookie_https":        "cookie_secure",
+	"cookie_key":          "cookie_secret",
+	"google_apps_domains": "email_domains",
+}
+
+// legacyFlags maps command line flags of earlier releases to their current
+// names.
+var legacyFlags = map[string]string{
+	"cookie-https":       "cookie-secure",
+	"cookie-key":         "cookie-secret",
+	"google-apps-domain": "email-domain",
+}
+
+// renameLegacyFlags rewrites legacy flags in args to their current names.
+func renameLegacyFlags(args []string) ([]string, []string) {
+	var notes []string
+	result := make([]string, 0, len(args))
+	for _, arg := range args {
+		if arg == "--" || !strings.HasPrefix(arg, "-") {
+			result = append(result, arg)
+			continue
+		}
+		name := strings.TrimLeft(arg, "-")
+		value := ""
+		if i := strings.Index(name, "="); i != -1 {
+			name, value = name[:i], name[i:]
+		}
+		if current, ok := legacyFlags[name]; ok {
+			notes = append(notes, fmt.Sprintf("flag -%s is deprecated; converted to -%s", name, current))
+			arg = "-" + current + value
+		}
+		result = append(result, arg)
+	}
+	return result, notes
+}
+
+// convertOptions renames legacy options in a config file (or [[tenant]]
+// block) and reports options that are unknown or conflict with each other.
+func convertOptions(cfg map[string]interface{}, known map[string]bool, where string) []string {
+	var notes []string
+	keys := make([]string, 0, len(cfg))
+	for k := range cfg {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	for _, k := range keys {
+		if current, ok := legacyOptions[k]; ok {
+			if _, conflict := cfg[current]; conflict {
+				notes = append(notes, fmt.Sprintf("%s: %s conflicts with %s; %s is used", where, k, current, current))
+			} else {
+				notes = append(notes, fmt.Sprintf("%s: %s is deprecated; converted to %s", where, k, current))
+				cfg[current] = cfg[k]
+			}
+			delete(cfg, k)
+		} else if !known[k] {
+			notes = append(notes, fmt.Sprintf("%s: unknown option %s is left out", where, k))
+			delete(cfg, k)
+		}
+	}
+	return notes
+}
+
+// ConvertConfig writes the options set by flags or the config file as a
+// config file. notes are included for review at the top, followed by any
+// configuration errors. It reports whether the configuration is valid.
+func ConvertConfig(w io.Writer, opts *Options, flagSet *flag.FlagSet, cfg EnvOptions, notes []string) bool {
+	set := make(map[string]bool)
+	flagSet.Visit(func(f *flag.Flag) { set[f.Name] = true })
+
+	// the copy is validated offline so converting does not depend on the
+	// identity provider or the secret stores being reachable
+	validated := *opts
+	validated.offline = true
+	var errs []string
+	if err := validated.Validate(); err != nil {
+		errs = strings.Split(strings.TrimPrefix(err.Error(), "Invalid configuration:\n  "), "\n  ")
+	}
+
+	fmt.Fprintln(w, "## converted by oauth2_proxy convert-config")
+	if len(notes) != 0 || len(errs) != 0 {
+		fmt.Fprintln(w, "## review before use:")
+		for _, note := range notes {
+			fmt.Fprintf(w, "#   %s\n", note)
+		}
+		for _, err := range errs {
+			fmt.Fprintf(w, "#   error: %s\n", err)
+		}
+	}
+	fmt.Fprintln(w)
+
+	val := reflect.ValueOf(opts).Elem()
+	typ := val.Type()
+	for i := 0; i < typ.NumField(); i++ {
+		field := typ.Field(i)
+		flagName := field.Tag.Get("flag")
+		if flagName == "" {
+			continue
+		}
+		cfgName := field.Tag.Get("cfg")
+		if cfgName == "" {
+			cfgName = strings.Replace(flagName, "-", "_", -1)
+		}
+		envName := field.Tag.Get("env")
+		switch {
+		case set[flagName]:
+		case envName != "" && os.Getenv(envName) != "":
+			fmt.Fprintf(w, "# %s is set by environment variable %s\n", cfgName, envName)
+			continue
+		case cfg[cfgName] != nil:
+		default:
+			continue
+		}
+		fmt.Fprintf(w, "%s = %s\n", cfgName, formatConfigValue(val.Field(i).Interface()))
+	}
+
+	if blocks, ok := cfg["tenant"].([]map[string]interface{}); ok {
+		for _, block := range blocks {
+			fmt.Fprintln(w, "\n[[tenant]]")
+			keys := make([]string, 0, len(block))
+			for k := range block {
+				keys = append(keys, k)
+			}
+			sort.Strings(keys)
+			for _, k := range keys {
+				fmt.Fprintf(w, "%s = %s\n", k, formatConfigValue(block[k]))
+			}
+		}
+	}
+	return len(errs) == 0
+}
+
+func convertConfigCommand(args []string) int {
+	flagSet := newFlagSet("oauth2_proxy convert-config")
+	args, notes := renameLegacyFlags(args)
+	flagSet.Parse(args)
+
+	opts := NewOptions()
+	known := map[string]bool{"tenant": true}
+	typ := reflect.TypeOf(opts).Elem()
+	for i := 0; i < typ.NumField(); i++ {
+		field := typ.Field(i)
+		if flagName := field.Tag.Get("flag"); flagName != "" {
+			cfgName := field.Tag.Get("cfg")
+			if cfgName == "" {
+				cfgName = strings.Replace(flagName, "-", "_", -1)
+			}
+			known[cfgName] = true
+		}
+	}
+
+	cfg := make(EnvOptions)
+	if config := flagSet.Lookup("config").Value.String(); config != "" {
+		if err := cfg.LoadConfigFile(config); err != nil {
+			log.Printf("ERROR: failed to load config file %s - %s", config, err)
+			return 2
+		}
+		notes = append(notes, convertOptions(cfg, known, config)...)
+		if blocks, ok := cfg["tenant"].([]map[string]interface{}); ok {
+			known["name"], known["hosts"] = true, true
+			for i, block := range blocks {
+				where := fmt.Sprintf("%s [[tenant]] %d", config, i+1)
+				notes = append(notes, convertOptions(block, known, where)...)
+			}
+		}
+	}
+	cfg.LoadEnvForStruct(opts)
+	options.Resolve(opts, flagSet, cfg)
+
+	if !ConvertConfig(os.Stdout, opts, flagSet, cfg, notes) {
+		return 1
+	}
+	return 0
+}
@@ -0,0 +1,87 @@
+package oauth2proxy
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+
+	"github.com/mreiferson/go-options"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRenameLegacyFlags(t *testing.T) {
+	args, notes := renameLegacyFlags([]string{
+		"--google-apps-domain=example.com", "-cookie-https", "false", "-upstream", "http://127.0.0.1:8080/",
+	})
+	assert.Equal(t, []string{
+		"-email-domain=example.com", "-cookie-secure", "false", "-upstream", "http://127.0.0.1:8080/",
+	}, args)
+	assert.Equal(t, []string{
+		"flag -google-apps-domain is deprecated; converted to -email-domain",
+		"flag -cookie-https is deprecated; converted to -cookie-secure",
+	}, notes)
+}
+
+func TestConvertConfig(t *testing.T) {
+	flagSet := newFlagSet("oauth2_proxy convert-config")
+	flagSet.Parse([]string{"-client-id=bazquux"})
+
+	cfg := EnvOptions{
+		"google_apps_domains": []interface{}{"example.com"},
+		"cookie_key":          "foobar",
+		"cookie_secret":       "0123456789abcdefghijklmnopqrstuv",
+		"client_secret":       "xyzzyplugh",
+		"upstreams":           []interface{}{"http://127.0.0.1:8080/"},
+		"no_such_option":      true,
+	}
+	known := map[string]bool{"client_secret": true, "cookie_secret": true, "email_domains": true, "upstreams": true}
+	notes := convertOptions(cfg, known, "legacy.cfg")
+	assert.Equal(t, []string{
+		"legacy.cfg: cookie_key conflicts with cookie_secret; cookie_secret is used",
+		"legacy.cfg: google_apps_domains is deprecated; converted to email_domains",
+		"legacy.cfg: unknown option no_such_option is left out",
+	}, notes)
+
+	opts := NewOptions()
+	options.Resolve(opts, flagSet, cfg)
+	var buf bytes.Buffer
+	assert.True(t, ConvertConfig(&buf, opts, flagSet, cfg, notes))
+	out := buf.String()
+	for _, line := range []string{
+		"#   legacy.cfg: unknown option no_such_option is left out",
+		"upstreams = [\"http://127.0.0.1:8080/\"]",
+		"email_domains = [\"example.com\"]",
+		"client_id = \"bazquux\"",
+		"client_secret = \"xyzzyplugh\"",
+		"cookie_secret = \"0123456789abcdefghijklmnopqrstuv\"",
+	} {
+		assert.True(t, strings.Contains(out, line+"\n"), line)
+	}
+	assert.False(t, strings.Contains(out, "cookie_name"))
+}
+
+func TestConvertConfigInvalid(t *testing.T) {
+	flagSet := newFlagSet("oauth2_proxy convert-config")
+	flagSet.Parse([]string{"-client-id=bazquux"})
+	opts := NewOptions()
+	options.Resolve(opts, flagSet, EnvOptions{})
+
+	var buf bytes.Buffer
+	assert.False(t, ConvertConfig(&buf, opts, flagSet, EnvOptions{}, nil))
+	assert.True(t, strings.Contains(buf.String(), "#   error: missing setting: cookie-secret\n"))
+}
+
+func TestConvertConfigOffline(t *testing.T) {
+	flagSet := newFlagSet("oauth2_proxy convert-config")
+	flagSet.Parse([]string{
+		"-client-id=bazquux", "-client-secret=xyzzyplugh", "-cookie-secret=0123456789abcdefghijklmnopqrstuv",
+		"-email-domain=example.com", "-provider=oidc", "-oidc-issuer-url=https://issuer.invalid",
+	})
+	opts := NewOptions()
+	options.Resolve(opts, flagSet, EnvOptions{})
+
+	var buf bytes.Buffer
+	assert.True(t, ConvertConfig(&buf, opts, flagSet, EnvOptions{}, nil))
+	assert.False(t, strings.Contains(buf.String(), "error:"))
+	assert.Equal(t, false, opts.offline)
+}
@@ -12,6 +12,7 @@ import (
 	"net/http"
 	"strconv"
 	"strings"
+	"sync"
 	"time"
 )
 
@@ -25,7 +26,10 @@ func Validate(cookie *http.Cookie, seed string, expiration time.Duration) (value
 	if len(parts) != 3 {
 		return
 	}
-	sig := cookieSignature(seed, cookie.Name, parts[0], parts[1])
+	buf := getBuffer(sha1.Size + len(parts[0]) + base64.URLEncoding.DecodedLen(len(parts[0])))
+	defer putBuffer(buf)
+	b := append((*buf)[:0], parts[0]...)
+	sig := cookieSignature(b[len(b):], seed, cookie.Name, b, parts[1])
 	if checkHmac(parts[2], sig) {
 		ts, err := strconv.Atoi(parts[1])
 		if err != nil {
@@ -38,9 +42,10 @@ func Validate(cookie *http.Cookie, seed string, expiration time.Duration) (value
 		t = time.Unix(int64(ts), 0)
 		if t.After(time.Now().Add(expiration*-1)) && t.Before(time.Now().Add(time.Minute*5)) {
 			// it's a valid cookie. now get the contents
-			rawValue, err := base64.URLEncoding.DecodeString(parts[0])
+			rawValue := sig[len(sig):cap(sig)]
+			n, err := base64.URLEncoding.Decode(rawValue, b)
 			if err == nil {
-				value = string(rawValue)
+				value = string(rawValue[:n])
 				ok = true
 				return
 			}
@@ -51,32 +56,41 @@ func Validate(cookie *http.Cookie, seed string, expiration time.Duration) (value
 
 // SignedValue returns a cookie that is signed and can later be checked with Validate
 func SignedValue(seed string, key string, value string, now time.Time) string {
-	encodedValue := base64.URLEncoding.EncodeToString([]byte(value))
-	timeStr := fmt.Sprintf("%d", now.Unix())
-	sig := cookieSignature(seed, key, encodedValue, timeStr)
-	cookieVal := fmt.Sprintf("%s|%s|%s", encodedValue, timeStr, sig)
-	return cookieVal
+	enc := base64.URLEncoding
+	timeStr := strconv.FormatInt(now.Unix(), 10)
+	n := enc.EncodedLen(len(value))
+	buf := getBuffer(len(value) + n + len(timeStr) + 2 + enc.EncodedLen(sha1.Size) + sha1.Size)
+	defer putBuffer(buf)
+	raw := append((*buf)[:0], value...)
+	cookieVal := raw[len(raw) : len(raw)+n]
+	enc.Encode(cookieVal, raw)
+	cookieVal = append(cookieVal, '|')
+	cookieVal = append(cookieVal, timeStr...)
+	cookieVal = append(cookieVal, '|')
+	end := len(cookieVal) + enc.EncodedLen(sha1.Size)
+	sig := cookieSignature(cookieVal[end:end], seed, key, cookieVal[:n], timeStr)
+	cookieVal = cookieVal[:end]
+	enc.Encode(cookieVal[end-enc.EncodedLen(sha1.Size):], sig)
+	return string(cookieVal)
 }
 
-func cookieSignature(args ...string) string {
-	h := hmac.New(sha1.New, []byte(args[0]))
-	for _, arg := range args[1:] {
-		h.Write([]byte(arg))
-	}
-	var b []byte
-	b = h.Sum(b)
-	return base64.URLEncoding.EncodeToString(b)
+// cookieSignature appends the signature of a cookie's encoded value and
+// timestamp to dst.
+func cookieSignature(dst []byte, seed, name string, value []byte, timeStr string) []byte {
+	h := hmac.New(sha1.New, []byte(seed))
+	io.WriteString(h, name)
+	h.Write(value)
+	io.WriteString(h, timeStr)
+	return h.Sum(dst)
 }
 
-func checkHmac(input, expected string) bool {
-	inputMAC, err1 := base64.URLEncoding.DecodeString(input)
-	if err1 == nil {
-		expectedMAC, err2 := base64.URLEncoding.DecodeString(expected)
-		if err2 == nil {
-			return hmac.Equal(inputMAC, expectedMAC)
-		}
+func checkHmac(input string, expected []byte) bool {
+	if len(input) != base64.URLEncoding.EncodedLen(sha1.Size) {
+		return false
 	}
-	return false
+	var inputMAC [sha1.Size + 1]byte
+	n, err := base64.URLEncoding.Decode(inputMAC[:], []byte(input))
+	return err == nil && hmac.Equal(inputMAC[:n], expected)
 }
 
 // Cipher provides methods to encrypt and decrypt cookie values
@@ -95,23 +109,33 @@ func NewCipher(secret []byte) (*Cipher, error) {
 
 // Encrypt a value for use in a cookie
 func (c *Cipher) Encrypt(value string) (string, error) {
-	ciphertext := make([]byte, aes.BlockSize+len(value))
+	n := aes.BlockSize + len(value)
+	buf := getBuffer(n + base64.StdEncoding.EncodedLen(n))
+	defer putBuffer(buf)
+	ciphertext := append((*buf)[:aes.BlockSize], value...)
 	iv := ciphertext[:aes.BlockSize]
 	if _, err := io.ReadFull(rand.Reader, iv); err != nil {
 		return "", fmt.Errorf("failed to create initialization vector %s", err)
 	}
 
 	stream := cipher.NewCFBEncrypter(c.Block, iv)
-	stream.XORKeyStream(ciphertext[aes.BlockSize:], []byte(value))
-	return base64.StdEncoding.EncodeToString(ciphertext), nil
+	stream.XORKeyStream(ciphertext[aes.BlockSize:], ciphertext[aes.BlockSize:])
+	encoded := ciphertext[n : n+base64.StdEncoding.EncodedLen(n)]
+	base64.StdEncoding.Encode(encoded, ciphertext)
+	return string(encoded), nil
 }
 
 // Decrypt a value from a cookie to it's original string
 func (c *Cipher) Decrypt(s string) (string, error) {
-	encrypted, err := base64.StdEncoding.DecodeString(s)
+	buf := getBuffer(len(s) + base64.StdEncoding.DecodedLen(len(s)))
+	defer putBuffer(buf)
+	src := append((*buf)[:0], s...)
+	encrypted := src[len(src) : len(src)+base64.StdEncoding.DecodedLen(len(s))]
+	n, err := base64.StdEncoding.Decode(encrypted, src)
 	if err != nil {
 		return "", fmt.Errorf("failed to decrypt cookie value %s", err)
 	}
+	encrypted = encrypted[:n]
 
 	if len(encrypted) < aes.BlockSize {
 		return "", fmt.Errorf("encrypted cookie value should be "+
@@ -126,3 +150,32 @@ func (c *Cipher) Decrypt(s string) (string, error) {
 
 	return string(encrypted), nil
 }
+
+// maxPooledBuffer is the capacity above which buffers aren't returned to
+// bufferPool, so that one large cookie doesn't keep memory pinned.
+const maxPooledBuffer = 16 << 10
+
+// bufferPool holds the scratch buffers cookies are encoded and decoded in,
+// which happens several times per request.
+var bufferPool = sync.Pool{
+	New: func() interface{} {
+		b := make([]byte, 0, 1024)
+		return &b
+	},
+}
+
+// getBuffer returns a scratch buffer of at least n bytes capacity.
+func getBuffer(n int) *[]byte {
+	b := bufferPool.Get().(*[]byte)
+	if cap(*b) < n {
+		*b = make([]byte, 0, n)
+	}
+	return b
+}
+
+func putBuffer(b *[]byte) {
+	if cap(*b) <= maxPooledBuffer {
+		*b = (*b)[:0]
+		bufferPool.Put(b)
+	}
+}
@@ -2,7 +2,10 @@ package cookie
 
 import (
 	"encoding/base64"
+	"net/http"
+	"strings"
 	"testing"
+	"time"
 
 	"github.com/stretchr/testify/assert"
 )
@@ -40,3 +43,72 @@ func TestEncodeAndDecodeAccessTokenB64(t *testing.T) {
 	assert.NotEqual(t, token, encoded)
 	assert.Equal(t, token, decoded)
 }
+
+func TestSignedValue(t *testing.T) {
+	now := time.Now()
+	for _, value := range []string{"", "v", "email:jane@example.com user:jane", strings.Repeat("x", 20000)} {
+		c := &http.Cookie{Name: "_oauth2_proxy", Value: SignedValue("seed", "_oauth2_proxy", value, now)}
+		got, ts, ok := Validate(c, "seed", time.Hour)
+		assert.True(t, ok)
+		assert.Equal(t, value, got)
+		assert.Equal(t, now.Unix(), ts.Unix())
+
+		_, _, ok = Validate(c, "other seed", time.Hour)
+		assert.False(t, ok)
+		tampered := *c
+		tampered.Name = "_other"
+		_, _, ok = Validate(&tampered, "seed", time.Hour)
+		assert.False(t, ok)
+		tampered.Name = c.Name
+		sig := strings.LastIndex(c.Value, "|") + 1
+		flipped := "A"
+		if c.Value[sig] == 'A' {
+			flipped = "B"
+		}
+		tampered.Value = c.Value[:sig] + flipped + c.Value[sig+1:]
+		_, _, ok = Validate(&tampered, "seed", time.Hour)
+		assert.False(t, ok)
+	}
+}
+
+func BenchmarkSignedValue(b *testing.B) {
+	value := strings.Repeat("session value ", 64)
+	now := time.Now()
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		SignedValue("seed", "_oauth2_proxy", value, now)
+	}
+}
+
+func BenchmarkValidate(b *testing.B) {
+	c := &http.Cookie{
+		Name:  "_oauth2_proxy",
+		Value: SignedValue("seed", "_oauth2_proxy", strings.Repeat("session value ", 64), time.Now()),
+	}
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		if _, _, ok := Validate(c, "seed", time.Hour); !ok {
+			b.Fatal("invalid cookie")
+		}
+	}
+}
+
+func BenchmarkEncrypt(b *testing.B) {
+	c, _ := NewCipher([]byte("0123456789abcdefghijklmnopqrstuv"))
+	token := strings.Repeat("access token ", 64)
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		c.Encrypt(token)
+	}
+}
+
+func BenchmarkDecrypt(b *testing.B) {
+	c, _ := NewCipher([]byte("0123456789abcdefghijklmnopqrstuv"))
+	encoded, _ := c.Encrypt(strings.Repeat("access token ", 64))
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		if _, err := c.Decrypt(encoded); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
@@ -0,0 +1,118 @@
+package oauth2proxy
+
+import (
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+)
+
+// corsMaxAge is how long browsers may cache the answer to a preflight
+// request, in seconds.
+const corsMaxAge = "600"
+
+// corsMethods are the methods that pages on other origins may use with the
+// CORS endpoints.
+const corsMethods = "GET, POST"
+
+// parseCORS validates the origins allowed to call the session endpoints.
+// Each cors-allowed-origin is an origin such as https://app.example.com, an
+// origin with a wildcard subdomain such as https://*.example.com, or "*".
+func parseCORS(o *Options, msgs []string) []string {
+	if len(o.CORSAllowedOrigins) == 0 {
+		if o.CORSAllowCredentials || len(o.CORSAllowedHeaders) != 0 {
+			msgs = append(msgs, "cors-allow-credentials and cors-allowed-header require cors-allowed-origin")
+		}
+		return msgs
+	}
+	for _, origin := range o.CORSAllowedOrigins {
+		if origin == "*" {
+			if o.CORSAllowCredentials {
+				msgs = append(msgs, "cors-allowed-origin \"*\" cannot be used with cors-allow-credentials")
+			}
+			continue
+		}
+		u, err := url.Parse(strings.Replace(origin, "://*.", "://wildcard.", 1))
+		if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" ||
+			u.User != nil || u.Path != "" || u.RawQuery != "" || u.Fragment != "" {
+			msgs = append(msgs, fmt.Sprintf("invalid cors-allowed-origin %q; must be an origin such as https://app.example.com", origin))
+		}
+	}
+	for _, header := range o.CORSAllowedHeaders {
+		if header == "" || strings.ContainsAny(header, " \t,:") {
+			msgs = append(msgs, fmt.Sprintf("invalid cors-allowed-header %q", header))
+		}
+	}
+	return msgs
+}
+
+// isCORSPath reports whether pages on the cors-allowed-origin may call path.
+func (p *OAuthProxy) isCORSPath(path string) bool {
+	return path == p.SessionPath || path == p.RefreshPath || path == p.SignOutPath
+}
+
+// corsOriginAllowed reports whether origin matches a cors-allowed-origin.
+func (p *OAuthProxy) corsOriginAllowed(origin string) bool {
+	return p.matchCORSOrigin(origin, true)
+}
+
+// corsOriginTrusted reports whether origin matches a cors-allowed-origin
+// other than "*", which allows reading responses from any origin but must
+// not let any site post a sign out.
+func (p *OAuthProxy) corsOriginTrusted(origin string) bool {
+	return p.matchCORSOrigin(origin, false)
+}
+
+func (p *OAuthProxy) matchCORSOrigin(origin string, wildcard bool) bool {
+	if origin == "" || origin == "null" {
+		return false
+	}
+	for _, allowed := range p.corsAllowedOrigins {
+		if (wildcard && allowed == "*") || strings.EqualFold(allowed, origin) {
+			return true
+		}
+		if i := strings.Index(allowed, "://*."); i != -1 {
+			scheme, domain := allowed[:i+3], allowed[i+4:]
+			if len(origin) > len(scheme)+len(domain) &&
+				strings.EqualFold(origin[:len(scheme)], scheme) &&
+				strings.HasSuffix(strings.ToLower(origin), strings.ToLower(domain)) &&
+				!strings.ContainsAny(origin[len(scheme):len(origin)-len(domain)], "/:@") {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// handleCORS sets the CORS headers of a response to a page on an allowed
+// origin, and answers its preflight requests. It reports whether the request
+// was a preflight request, which needs no further response.
+func (p *OAuthProxy) handleCORS(rw http.ResponseWriter, req *http.Request) bool {
+	if len(p.corsAllowedOrigins) == 0 {
+		return false
+	}
+	rw.Header().Add("Vary", "Origin")
+	origin := req.Header.Get("Origin")
+	preflight := req.Method == "OPTIONS" && req.Header.Get("Access-Control-Request-Method") != ""
+	if !p.corsOriginAllowed(origin) {
+		if preflight {
+			rw.WriteHeader(http.StatusForbidden)
+		}
+		return preflight
+	}
+
+	rw.Header().Set("Access-Control-Allow-Origin", origin)
+	if p.corsCredentials {
+		rw.Header().Set("Access-Control-Allow-Credentials", "true")
+	}
+	if !preflight {
+		return false
+	}
+	rw.Header().Set("Access-Control-Allow-Methods", corsMethods)
+	if len(p.corsAllowedHeaders) != 0 {
+		rw.Header().Set("Access-Control-Allow-Headers", strings.Join(p.corsAllowedHeaders, ", "))
+	}
+	rw.Header().Set("Access-Control-Max-Age", corsMaxAge)
+	rw.WriteHeader(http.StatusNoContent)
+	return true
+}
@@ -0,0 +1,89 @@
+package oauth2proxy
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestCORSOptions(t *testing.T) {
+	o := testOptions()
+	o.CORSAllowCredentials = true
+	assert.Equal(t, errorMsg([]string{
+		"cors-allow-credentials and cors-allowed-header require cors-allowed-origin",
+	}), o.Validate().Error())
+
+	o = testOptions()
+	o.CORSAllowedOrigins = []string{"https://app.example.com", "https://*.example.com", "*",
+		"app.example.com", "https://app.example.com/", "ftp://app.example.com"}
+	o.CORSAllowCredentials = true
+	o.CORSAllowedHeaders = []string{"X-CSRF-Token", "X-Bad Header"}
+	assert.Equal(t, errorMsg([]string{
+		"cors-allowed-origin \"*\" cannot be used with cors-allow-credentials",
+		"invalid cors-allowed-origin \"app.example.com\"; must be an origin such as https://app.example.com",
+		"invalid cors-allowed-origin \"https://app.example.com/\"; must be an origin such as https://app.example.com",
+		"invalid cors-allowed-origin \"ftp://app.example.com\"; must be an origin such as https://app.example.com",
+		"invalid cors-allowed-header \"X-Bad Header\"",
+	}), o.Validate().Error())
+}
+
+func TestCORS(t *testing.T) {
+	opts := testOptions()
+	opts.CORSAllowedOrigins = []string{"https://app.example.com", "https://*.apps.example.com"}
+	opts.CORSAllowCredentials = true
+	opts.CORSAllowedHeaders = []string{"X-CSRF-Token"}
+	opts.SkipAuthPreflight = true
+	assert.Equal(t, nil, opts.Validate())
+	proxy := newOAuthProxy(opts, func(string) bool { return true })
+
+	request := func(method, path, origin string) *httptest.ResponseRecorder {
+		rw := httptest.NewRecorder()
+		req, _ := http.NewRequest(method, path, nil)
+		req.Header.Set("Origin", origin)
+		if method == "OPTIONS" {
+			req.Header.Set("Access-Control-Request-Method", "POST")
+		}
+		proxy.ServeHTTP(rw, req)
+		return rw
+	}
+
+	rw := request("OPTIONS", "/oauth2/refresh", "https://app.example.com")
+	assert.Equal(t, 204, rw.Code)
+	assert.Equal(t, "https://app.example.com", rw.Header().Get("Access-Control-Allow-Origin"))
+	assert.Equal(t, "true", rw.Header().Get("Access-Control-Allow-Credentials"))
+	assert.Equal(t, "GET, POST", rw.Header().Get("Access-Control-Allow-Methods"))
+	assert.Equal(t, "X-CSRF-Token", rw.Header().Get("Access-Control-Allow-Headers"))
+	assert.Equal(t, "Origin", rw.Header().Get("Vary"))
+
+	rw = request("GET", "/oauth2/session", "https://foo.apps.example.com")
+	assert.Equal(t, 401, rw.Code)
+	assert.Equal(t, "https://foo.apps.example.com", rw.Header().Get("Access-Control-Allow-Origin"))
+
+	// other origins are refused
+	for _, origin := range []string{"https://evil.example.com", "http://app.example.com", "https://apps.example.com", "null"} {
+		rw = request("OPTIONS", "/oauth2/session", origin)
+		assert.Equal(t, 403, rw.Code, origin)
+		rw = request("GET", "/oauth2/session", origin)
+		assert.Equal(t, "", rw.Header().Get("Access-Control-Allow-Origin"), origin)
+	}
+
+	// allowed origins may sign out
+	rw = request("POST", "/oauth2/sign_out", "https://app.example.com")
+	assert.Equal(t, 200, rw.Code)
+	assert.Equal(t, "https://app.example.com", rw.Header().Get("Access-Control-Allow-Origin"))
+	rw = request("POST", "/oauth2/sign_out", "https://evil.example.com")
+	assert.Equal(t, 403, rw.Code)
+
+	// "*" lets any origin read the session, but not sign out
+	proxy.corsAllowedOrigins = []string{"*"}
+	rw = request("GET", "/oauth2/session", "https://evil.example.com")
+	assert.Equal(t, "https://evil.example.com", rw.Header().Get("Access-Control-Allow-Origin"))
+	rw = request("POST", "/oauth2/sign_out", "https://evil.example.com")
+	assert.Equal(t, 403, rw.Code)
+
+	// other endpoints have no CORS headers
+	rw = request("GET", "/oauth2/sign_in", "https://app.example.com")
+	assert.Equal(t, "", rw.Header().Get("Access-Control-Allow-Origin"))
+}
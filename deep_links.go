@@ -0,0 +1,158 @@
+package oauth2proxy
+
+import (
+	"crypto/hmac"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"mime"
+	"net/http"
+	"net/url"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/bitly/oauth2_proxy/cookie"
+	"github.com/bitly/oauth2_proxy/store"
+)
+
+// maxResubmitBytes caps the size of a form kept to be re-submitted after
+// sign in.
+const maxResubmitBytes = 64 << 10
+
+// A resubmit is a form posted by a user who wasn't signed in, kept to be
+// re-submitted once they are.
+type resubmit struct {
+	URL  string     `json:"url"`
+	Form url.Values `json:"form"`
+}
+
+func resubmitKey(id string) string {
+	return "resubmit:" + id
+}
+
+func (p *OAuthProxy) resubmitCookieName() string {
+	return p.CookieName + "_resubmit"
+}
+
+// signInRedirect returns where to go after signing in for a request that
+// was denied for lack of a session: the requested URL, or for a form posted
+// to it, the page to re-submit the form. The id of the form is also kept in
+// the resubmit cookie, so that only the browser that posted the form can
+// re-submit it, rather than anyone who sends a user to the page.
+func (p *OAuthProxy) signInRedirect(rw http.ResponseWriter, req *http.Request) string {
+	if redirect := req.Header.Get("X-Auth-Request-Redirect"); redirect != "" {
+		return redirect
+	}
+	if req.Method == "POST" {
+		id, err := p.saveResubmit(req)
+		if err != nil {
+			log.Printf("%s error saving form to re-submit %s", getRemoteAddr(req), err)
+		} else if id != "" {
+			http.SetCookie(rw, p.makeCookie(req, p.resubmitCookieName(), id, stateExpiration, time.Now()))
+			return p.ResubmitPath + "?id=" + id
+		}
+	}
+	return req.URL.RequestURI()
+}
+
+// saveResubmit keeps the URL-encoded form posted with req for as long as
+// the OAuth state is valid, and returns its id, or "" for other requests.
+func (p *OAuthProxy) saveResubmit(req *http.Request) (string, error) {
+	mediaType, _, _ := mime.ParseMediaType(req.Header.Get("Content-Type"))
+	if mediaType != "application/x-www-form-urlencoded" || req.Body == nil || req.ContentLength > maxResubmitBytes {
+		return "", nil
+	}
+	body, err := ioutil.ReadAll(io.LimitReader(req.Body, maxResubmitBytes+1))
+	if err != nil {
+		return "", err
+	} else if len(body) > maxResubmitBytes {
+		return "", nil
+	}
+	form, err := url.ParseQuery(string(body))
+	if err != nil {
+		return "", err
+	}
+	id, err := cookie.Nonce()
+	if err != nil {
+		return "", err
+	}
+	value, _ := json.Marshal(&resubmit{URL: req.URL.RequestURI(), Form: form})
+	return id, p.resubmitStore.Set(resubmitKey(id), value, stateExpiration)
+}
+
+// acceptsHTML reports whether req is a browser navigation.
+func acceptsHTML(req *http.Request) bool {
+	return req.Method == "GET" && strings.Contains(req.Header.Get("Accept"), "text/html")
+}
+
+// resubmitField is a field of a form to re-submit.
+type resubmitField struct {
+	Name  string
+	Value string
+}
+
+// Resubmit asks a signed in user to confirm re-submitting the form they
+// posted before signing in, from the same browser. The form is only shown
+// once.
+func (p *OAuthProxy) Resubmit(rw http.ResponseWriter, req *http.Request) {
+	if p.Authenticate(rw, req) != http.StatusAccepted {
+		http.Redirect(rw, req, p.SignInPath+"?"+url.Values{"rd": {req.URL.RequestURI()}}.Encode(), 302)
+		return
+	}
+
+	id := req.FormValue("id")
+	c, err := req.Cookie(p.resubmitCookieName())
+	if err != nil || id == "" || !hmac.Equal([]byte(c.Value), []byte(id)) {
+		if id != "" {
+			log.Printf("%s form to re-submit was not posted from this browser, potential attack", getRemoteAddr(req))
+		}
+		p.errorPage(rw, req, 404, "Not Found", "The form to re-submit has expired; please fill it in again.")
+		return
+	}
+	http.SetCookie(rw, p.makeCookie(req, p.resubmitCookieName(), "", time.Hour*-1, time.Now()))
+	value, err := p.resubmitStore.Take(resubmitKey(id))
+	if err == store.ErrNotFound {
+		p.errorPage(rw, req, 404, "Not Found", "The form to re-submit has expired; please fill it in again.")
+		return
+	} else if err != nil {
+		log.Printf("%s error loading form to re-submit %s", getRemoteAddr(req), err)
+		p.errorPage(rw, req, 500, "Internal Error", "Internal Error")
+		return
+	}
+	var r resubmit
+	if err := json.Unmarshal(value, &r); err != nil {
+		p.errorPage(rw, req, 500, "Internal Error", fmt.Sprintf("invalid form to re-submit: %s", err))
+		return
+	}
+
+	var fields []resubmitField
+	names := make([]string, 0, len(r.Form))
+	for name := range r.Form {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		for _, v := range r.Form[name] {
+			fields = append(fields, resubmitField{name, v})
+		}
+	}
+
+	nonce := p.setContentSecurityPolicy(rw)
+	t := struct {
+		URL         string
+		Fields      []resubmitField
+		ProxyPrefix string
+		CSPNonce    string
+		Brand       branding
+	}{
+		URL:         r.URL,
+		Fields:      fields,
+		ProxyPrefix: p.ProxyPrefix,
+		CSPNonce:    nonce,
+		Brand:       p.brand,
+	}
+	p.executeTemplate(rw, req, "resubmit.html", t)
+}
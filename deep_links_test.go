@@ -0,0 +1,97 @@
+package oauth2proxy
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"regexp"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/bitly/oauth2_proxy/providers"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestSkipProviderButtonKeepsQuery(t *testing.T) {
+	opts := testOptions()
+	opts.SkipProviderButton = true
+	assert.Equal(t, nil, opts.Validate())
+	proxy := newOAuthProxy(opts, func(string) bool { return true })
+
+	rw := httptest.NewRecorder()
+	req, _ := http.NewRequest("GET", "/docs/page?a=b", nil)
+	req.Header.Set("Accept", "text/html,application/xhtml+xml")
+	proxy.ServeHTTP(rw, req)
+	assert.Equal(t, 302, rw.Code)
+	location, _ := url.Parse(rw.Header().Get("Location"))
+	_, _, redirect, err := proxy.decodeState(location.Query().Get("state"))
+	assert.Equal(t, nil, err)
+	assert.Equal(t, "/docs/page?a=b", redirect)
+}
+
+func TestResubmit(t *testing.T) {
+	opts := testOptions()
+	assert.Equal(t, nil, opts.Validate())
+	proxy := newOAuthProxy(opts, func(string) bool { return true })
+
+	rw := httptest.NewRecorder()
+	req, _ := http.NewRequest("POST", "/comments?post=1", strings.NewReader("text=Hello+%3Cworld%3E&tag=a&tag=b"))
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	proxy.ServeHTTP(rw, req)
+	assert.Equal(t, 403, rw.Code)
+	var resubmitCookie *http.Cookie
+	for _, c := range rw.Result().Cookies() {
+		if c.Name == "_oauth2_proxy_resubmit" {
+			resubmitCookie = c
+		}
+	}
+	if resubmitCookie == nil {
+		t.Fatal("resubmit cookie not set")
+	}
+	match := regexp.MustCompile(`name="rd" value="(/oauth2/resubmit\?id=[0-9a-f]+)"`).FindStringSubmatch(rw.Body.String())
+	if match == nil {
+		t.Fatal("redirect to re-submit page not found in:\n" + rw.Body.String())
+	}
+	resubmitURL := match[1]
+
+	// not signed in yet
+	rw = httptest.NewRecorder()
+	req, _ = http.NewRequest("GET", resubmitURL, nil)
+	proxy.ServeHTTP(rw, req)
+	assert.Equal(t, 302, rw.Code)
+	assert.Equal(t, "/oauth2/sign_in?rd="+url.QueryEscape(resubmitURL), rw.Header().Get("Location"))
+
+	value, _ := (&providers.SessionState{Email: "jane@example.com"}).EncodeSessionState(nil)
+	signedIn := func(resubmitCookie *http.Cookie) *httptest.ResponseRecorder {
+		rw := httptest.NewRecorder()
+		req, _ := http.NewRequest("GET", resubmitURL, nil)
+		req.AddCookie(proxy.MakeSessionCookie(req, value, time.Hour, time.Now()))
+		if resubmitCookie != nil {
+			req.AddCookie(resubmitCookie)
+		}
+		proxy.ServeHTTP(rw, req)
+		return rw
+	}
+	// only the browser that posted the form can re-submit it
+	assert.Equal(t, 404, signedIn(nil).Code)
+	assert.Equal(t, 404, signedIn(&http.Cookie{Name: resubmitCookie.Name, Value: "0123"}).Code)
+
+	rw = signedIn(resubmitCookie)
+	assert.Equal(t, 200, rw.Code)
+	body := rw.Body.String()
+	assert.Contains(t, body, `<form method="POST" action="/comments?post=1">`)
+	assert.Contains(t, body, `<input type="hidden" name="tag" value="a">`)
+	assert.Contains(t, body, `<input type="hidden" name="tag" value="b">`)
+	assert.Contains(t, body, `<input type="hidden" name="text" value="Hello &lt;world&gt;">`)
+
+	// the form is only shown once
+	assert.Equal(t, 404, signedIn(resubmitCookie).Code)
+
+	// other posts are not kept
+	rw = httptest.NewRecorder()
+	req, _ = http.NewRequest("POST", "/upload", strings.NewReader("{}"))
+	req.Header.Set("Content-Type", "application/json")
+	proxy.ServeHTTP(rw, req)
+	assert.Contains(t, rw.Body.String(), `name="rd" value="/upload"`)
+}
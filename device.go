@@ -0,0 +1,281 @@
+package oauth2proxy
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"encoding/json"
+	"log"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/bitly/oauth2_proxy/cookie"
+	"github.com/bitly/oauth2_proxy/providers"
+	"github.com/bitly/oauth2_proxy/store"
+)
+
+// deviceCodeExpiration is how long users have to approve a device after it
+// requested a code.
+const deviceCodeExpiration = 10 * time.Minute
+
+// devicePollInterval is how often, in seconds, devices may ask whether they
+// were approved.
+const devicePollInterval = 5
+
+// deviceCodesPerMinute limits the codes each client address may request, as
+// they are kept until they expire.
+const deviceCodesPerMinute = 5
+
+// userCodeAlphabet has no vowels, so that user codes never spell words, and
+// no digits, which are easily confused with letters.
+const userCodeAlphabet = "BCDFGHJKLMNPQRSTVWXZ"
+
+// A deviceAuthorization is a request of a headless device to be signed in,
+// pending until a signed in user approves or denies it on the pairing page.
+type deviceAuthorization struct {
+	UserCode string `json:"user_code"`
+	Cookie   string `json:"cookie,omitempty"`
+	Denied   bool   `json:"denied,omitempty"`
+}
+
+func deviceKey(deviceCode string) string {
+	return "device:" + deviceCode
+}
+
+func userCodeKey(userCode string) string {
+	return "device-user:" + userCode
+}
+
+// newUserCode returns a code of 8 letters for users to type in, formatted as
+// XXXX-XXXX. Random bytes beyond the largest multiple of the alphabet size
+// are skipped, so that all letters are equally likely.
+func newUserCode() (string, error) {
+	const max = 256 - 256%len(userCodeAlphabet)
+	code := make([]byte, 0, 8)
+	b := make([]byte, 16)
+	for len(code) < cap(code) {
+		if _, err := rand.Read(b); err != nil {
+			return "", err
+		}
+		for _, c := range b {
+			if int(c) < max && len(code) < cap(code) {
+				code = append(code, userCodeAlphabet[int(c)%len(userCodeAlphabet)])
+			}
+		}
+	}
+	return string(code[:4]) + "-" + string(code[4:]), nil
+}
+
+// normalizeUserCode accepts user codes typed in lower case, with spaces or
+// without the dash.
+func normalizeUserCode(code string) string {
+	code = strings.ToUpper(strings.Map(func(r rune) rune {
+		if r == '-' || r == ' ' {
+			return -1
+		}
+		return r
+	}, code))
+	if len(code) != 8 {
+		return ""
+	}
+	return code[:4] + "-" + code[4:]
+}
+
+// deviceError responds to a device with an OAuth 2.0 device flow error.
+func deviceError(rw http.ResponseWriter, code int, err string) {
+	rw.Header().Set("Content-Type", "application/json")
+	rw.Header().Set("Cache-Control", "no-store")
+	rw.WriteHeader(code)
+	json.NewEncoder(rw).Encode(map[string]string{"error": err})
+}
+
+// DeviceCode starts signing in a headless device, which shows the user code
+// and the pairing page and then polls DeviceToken. The code is not part of
+// the pairing page URL, so that users must type in the code shown by the
+// device rather than approve a code sent to them with a link.
+func (p *OAuthProxy) DeviceCode(rw http.ResponseWriter, req *http.Request) {
+	if req.Method != "POST" {
+		rw.Header().Set("Allow", "POST")
+		http.Error(rw, "Method Not Allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	ok, _, err := p.deviceStore.TakeToken("device-codes:"+p.clientKey(req), float64(deviceCodesPerMinute)/60, deviceCodesPerMinute)
+	if err == nil && !ok {
+		log.Printf("%s device code limit exceeded", getRemoteAddr(req))
+		rw.Header().Set("Retry-After", "60")
+		deviceError(rw, http.StatusTooManyRequests, "slow_down")
+		return
+	}
+	deviceCode, err := cookie.Nonce()
+	var userCode string
+	if err == nil {
+		userCode, err = newUserCode()
+	}
+	if err == nil {
+		var locked bool
+		locked, err = p.deviceStore.SetNX(userCodeKey(userCode), []byte(deviceCode), deviceCodeExpiration)
+		if err == nil && !locked {
+			deviceError(rw, http.StatusServiceUnavailable, "temporarily_unavailable")
+			return
+		}
+	}
+	if err == nil {
+		value, _ := json.Marshal(&deviceAuthorization{UserCode: userCode})
+		err = p.deviceStore.Set(deviceKey(deviceCode), value, deviceCodeExpiration)
+	}
+	if err != nil {
+		log.Printf("%s error starting device sign in %s", getRemoteAddr(req), err)
+		deviceError(rw, http.StatusInternalServerError, "server_error")
+		return
+	}
+
+	verificationURI := p.issuer(req.Host) + "/device"
+	rw.Header().Set("Content-Type", "application/json")
+	rw.Header().Set("Cache-Control", "no-store")
+	json.NewEncoder(rw).Encode(map[string]interface{}{
+		"device_code":      deviceCode,
+		"user_code":        userCode,
+		"verification_uri": verificationURI,
+		"expires_in":       int64(deviceCodeExpiration.Seconds()),
+		"interval":         devicePollInterval,
+	})
+}
+
+// DeviceToken tells a device whether the user approved it, and once they
+// did, gives it the session cookie to send with its requests.
+func (p *OAuthProxy) DeviceToken(rw http.ResponseWriter, req *http.Request) {
+	if req.Method != "POST" {
+		rw.Header().Set("Allow", "POST")
+		http.Error(rw, "Method Not Allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	deviceCode := req.FormValue("device_code")
+	if deviceCode == "" {
+		deviceError(rw, http.StatusBadRequest, "invalid_request")
+		return
+	}
+	value, err := p.deviceStore.Get(deviceKey(deviceCode))
+	if err == store.ErrNotFound {
+		deviceError(rw, http.StatusBadRequest, "expired_token")
+		return
+	} else if err != nil {
+		log.Printf("%s error loading device sign in %s", getRemoteAddr(req), err)
+		deviceError(rw, http.StatusInternalServerError, "server_error")
+		return
+	}
+	var d deviceAuthorization
+	if err := json.Unmarshal(value, &d); err != nil {
+		deviceError(rw, http.StatusInternalServerError, "server_error")
+		return
+	}
+	switch {
+	case d.Denied:
+		p.deviceStore.Del(deviceKey(deviceCode))
+		deviceError(rw, http.StatusBadRequest, "access_denied")
+		return
+	case d.Cookie == "":
+		deviceError(rw, http.StatusBadRequest, "authorization_pending")
+		return
+	}
+
+	p.deviceStore.Del(deviceKey(deviceCode))
+	rw.Header().Set("Content-Type", "application/json")
+	rw.Header().Set("Cache-Control", "no-store")
+	json.NewEncoder(rw).Encode(map[string]interface{}{
+		"cookie_name":  p.CookieName,
+		"cookie_value": d.Cookie,
+		"expires_in":   int64(p.CookieExpire.Seconds()),
+	})
+}
+
+// DevicePage is the pairing page where signed in users enter the code shown
+// by a device to approve signing it in as themselves, or deny it.
+func (p *OAuthProxy) DevicePage(rw http.ResponseWriter, req *http.Request) {
+	session, _ := p.validSession(req)
+	if session == nil {
+		http.Redirect(rw, req, p.SignInPath+"?"+url.Values{"rd": {req.URL.RequestURI()}}.Encode(), 302)
+		return
+	}
+	t := struct {
+		Identity    string
+		UserCode    string
+		CSRFToken   string
+		Message     string
+		Done        bool
+		ProxyPrefix string
+		CSPNonce    string
+		Brand       branding
+	}{
+		Identity:    session.Email,
+		UserCode:    req.PostFormValue("user_code"),
+		CSRFToken:   p.pageCSRFToken(rw, req, session),
+		ProxyPrefix: p.ProxyPrefix,
+		Brand:       p.brand,
+	}
+	if t.Identity == "" {
+		t.Identity = session.User
+	}
+
+	if req.Method == "POST" {
+		ok, sent := p.checkOrigin(req)
+		if !sent {
+			ok = t.CSRFToken != "" && hmac.Equal([]byte(req.FormValue("csrf_token")), []byte(t.CSRFToken))
+		}
+		if !ok {
+			log.Printf("%s device approval without a valid origin or csrf token, potential attack", getRemoteAddr(req))
+			p.errorPage(rw, req, 403, "Permission Denied", "Invalid Origin")
+			return
+		}
+		t.Message, t.Done = p.approveDevice(req, session, t.Identity, normalizeUserCode(t.UserCode), req.FormValue("approve") != "")
+	}
+	t.CSPNonce = p.setContentSecurityPolicy(rw)
+	if req.Method == "POST" && !t.Done {
+		rw.WriteHeader(http.StatusBadRequest)
+	}
+	p.executeTemplate(rw, req, "device.html", t)
+}
+
+// approveDevice approves or denies, as the user of session, the pending
+// device sign in with userCode and returns the message to show, and whether
+// it succeeded. The user code is taken out of the store first, so that it is
+// only approved or denied once.
+func (p *OAuthProxy) approveDevice(req *http.Request, session *providers.SessionState, identity, userCode string, approve bool) (string, bool) {
+	if userCode == "" {
+		return "The code is invalid or has expired; check the code shown by the device, or restart signing in on it.", false
+	}
+	deviceCode, err := p.deviceStore.Take(userCodeKey(userCode))
+	if err == store.ErrNotFound {
+		return "The code is invalid or has expired; check the code shown by the device, or restart signing in on it.", false
+	} else if err != nil {
+		log.Printf("%s error loading device sign in %s", getRemoteAddr(req), err)
+		return "The device could not be signed in; please try again.", false
+	}
+	d := deviceAuthorization{UserCode: userCode, Denied: !approve}
+	if approve {
+		// the device gets a session of its own with the identity of the user,
+		// but none of their tokens
+		device := &providers.SessionState{Email: session.Email, User: session.User, Groups: session.Groups}
+		value, err := p.cookieForSession(p.providerFor(req), device)
+		if err == nil {
+			value, err = p.storeLargeSession(value, "")
+		}
+		if err != nil {
+			log.Printf("%s error signing in device %s", getRemoteAddr(req), err)
+			return "The device could not be signed in; restart signing in on it.", false
+		}
+		d.Cookie = p.MakeSessionCookie(req, value, p.CookieExpire, time.Now()).Value
+	}
+	value, _ := json.Marshal(&d)
+	if err := p.deviceStore.Set(deviceKey(string(deviceCode)), value, deviceCodeExpiration); err != nil {
+		log.Printf("%s error saving device sign in %s", getRemoteAddr(req), err)
+		return "The device could not be signed in; restart signing in on it.", false
+	}
+	if !approve {
+		log.Printf("%s device sign in %s denied by %s", getRemoteAddr(req), userCode, identity)
+		return "The device was not signed in.", true
+	}
+	log.Printf("%s device sign in %s approved by %s", getRemoteAddr(req), userCode, identity)
+	p.logSecurityEvent(req, eventDeviceApproved, identity, "user code "+userCode)
+	return "The device is now signed in; you can return to it.", true
+}
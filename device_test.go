@@ -0,0 +1,162 @@
+package oauth2proxy
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/bitly/oauth2_proxy/providers"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestNormalizeUserCode(t *testing.T) {
+	assert.Equal(t, "BCDF-GHJK", normalizeUserCode("bcdf-ghjk"))
+	assert.Equal(t, "BCDF-GHJK", normalizeUserCode("BCDF GHJK"))
+	assert.Equal(t, "BCDF-GHJK", normalizeUserCode("bcdfghjk"))
+	assert.Equal(t, "", normalizeUserCode("BCDF-GHJ"))
+}
+
+func TestDeviceFlow(t *testing.T) {
+	opts := testOptions()
+	opts.DeviceFlow = true
+	assert.Equal(t, errorMsg([]string{
+		"device-flow requires session-store, so that devices can be approved on any replica"}), opts.Validate().Error())
+	opts.SessionStore = "memory"
+	opts.CookieSecret = "xyzzyplughxyzzyplughxyzzyplughxp"
+	opts.PassAccessToken = true
+	assert.Equal(t, nil, opts.Validate())
+	proxy := newOAuthProxy(opts, func(string) bool { return true })
+	nonce := &http.Cookie{Name: "_oauth2_proxy_session_nonce", Value: "0123456789abcdef"}
+
+	post := func(path string, form url.Values, session *providers.SessionState) *httptest.ResponseRecorder {
+		rw := httptest.NewRecorder()
+		req, _ := http.NewRequest("POST", path, strings.NewReader(form.Encode()))
+		req.Host = "proxy.example.com"
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		if session != nil {
+			value, _ := session.EncodeSessionState(proxy.CookieCipher)
+			req.AddCookie(proxy.MakeSessionCookie(req, value, opts.CookieExpire, time.Now()))
+			req.AddCookie(nonce)
+		}
+		proxy.ServeHTTP(rw, req)
+		return rw
+	}
+	start := func() (deviceCode, userCode string) {
+		rw := post("/oauth2/device/code", nil, nil)
+		assert.Equal(t, 200, rw.Code)
+		var resp map[string]interface{}
+		assert.Equal(t, nil, json.Unmarshal(rw.Body.Bytes(), &resp))
+		assert.Equal(t, "https://proxy.example.com/oauth2/device", resp["verification_uri"])
+		assert.NotContains(t, resp, "verification_uri_complete")
+		assert.Equal(t, float64(600), resp["expires_in"])
+		assert.Regexp(t, "^[A-Z]{4}-[A-Z]{4}$", resp["user_code"])
+		return resp["device_code"].(string), resp["user_code"].(string)
+	}
+	poll := func(deviceCode string) (int, map[string]interface{}) {
+		rw := post("/oauth2/device/token", url.Values{"device_code": {deviceCode}}, nil)
+		var resp map[string]interface{}
+		assert.Equal(t, nil, json.Unmarshal(rw.Body.Bytes(), &resp))
+		return rw.Code, resp
+	}
+
+	deviceCode, userCode := start()
+	code, resp := poll(deviceCode)
+	assert.Equal(t, 400, code)
+	assert.Equal(t, "authorization_pending", resp["error"])
+
+	// the pairing page requires signing in
+	rw := httptest.NewRecorder()
+	req, _ := http.NewRequest("GET", "/oauth2/device", nil)
+	proxy.ServeHTTP(rw, req)
+	assert.Equal(t, 302, rw.Code)
+	assert.Equal(t, "/oauth2/sign_in?rd="+url.QueryEscape("/oauth2/device"), rw.Header().Get("Location"))
+
+	session := &providers.SessionState{Email: "jane@example.com", AccessToken: "access", RefreshToken: "refresh"}
+	rw = httptest.NewRecorder()
+	value, _ := session.EncodeSessionState(proxy.CookieCipher)
+	req.AddCookie(proxy.MakeSessionCookie(req, value, opts.CookieExpire, time.Now()))
+	req.AddCookie(nonce)
+	csrfToken := proxy.CSRFToken(req, session)
+	proxy.ServeHTTP(rw, req)
+	assert.Equal(t, 200, rw.Code)
+	assert.Contains(t, rw.Body.String(), `<input type="text" name="user_code" value=""`)
+	assert.Contains(t, rw.Body.String(), `<input type="hidden" name="csrf_token" value="`+csrfToken+`">`)
+
+	// approving requires the csrf token
+	rw = post("/oauth2/device", url.Values{"user_code": {userCode}, "approve": {"1"}}, session)
+	assert.Equal(t, 403, rw.Code)
+	rw = post("/oauth2/device", url.Values{"user_code": {"BBBB-BBBB"}, "approve": {"1"}, "csrf_token": {csrfToken}}, session)
+	assert.Equal(t, 400, rw.Code)
+	assert.Contains(t, rw.Body.String(), "The code is invalid or has expired")
+	rw = post("/oauth2/device", url.Values{"user_code": {strings.ToLower(userCode)}, "approve": {"1"}, "csrf_token": {csrfToken}}, session)
+	assert.Equal(t, 200, rw.Code)
+	assert.Contains(t, rw.Body.String(), "The device is now signed in")
+
+	// the device gets a session cookie for the user without their tokens, once
+	code, resp = poll(deviceCode)
+	assert.Equal(t, 200, code)
+	assert.Equal(t, "_oauth2_proxy", resp["cookie_name"])
+	req, _ = http.NewRequest("GET", "/", nil)
+	req.AddCookie(&http.Cookie{Name: resp["cookie_name"].(string), Value: resp["cookie_value"].(string)})
+	deviceSession, _, err := proxy.LoadCookiedSession(req)
+	assert.Equal(t, nil, err)
+	assert.Equal(t, "jane@example.com", deviceSession.Email)
+	assert.Equal(t, "", deviceSession.AccessToken)
+	assert.Equal(t, "", deviceSession.RefreshToken)
+	code, resp = poll(deviceCode)
+	assert.Equal(t, "expired_token", resp["error"])
+
+	// a code can't be used twice, and denied devices are told so
+	rw = post("/oauth2/device", url.Values{"user_code": {userCode}, "approve": {"1"}, "csrf_token": {csrfToken}}, session)
+	assert.Equal(t, 400, rw.Code)
+	deviceCode, userCode = start()
+	rw = post("/oauth2/device", url.Values{"user_code": {userCode}, "deny": {"1"}, "csrf_token": {csrfToken}}, session)
+	assert.Equal(t, 200, rw.Code)
+	assert.Contains(t, rw.Body.String(), "The device was not signed in.")
+	code, resp = poll(deviceCode)
+	assert.Equal(t, 400, code)
+	assert.Equal(t, "access_denied", resp["error"])
+
+	// an approval and a denial submitted together, e.g. from two tabs, only
+	// apply once
+	deviceCode, userCode = start()
+	req, _ = http.NewRequest("POST", "/oauth2/device", nil)
+	done := make(chan bool, 2)
+	for _, approve := range []bool{true, false} {
+		go func(approve bool) {
+			_, ok := proxy.approveDevice(req, session, "jane@example.com", userCode, approve)
+			done <- ok
+		}(approve)
+	}
+	applied := 0
+	for i := 0; i < 2; i++ {
+		if <-done {
+			applied++
+		}
+	}
+	assert.Equal(t, 1, applied)
+
+	// each client address may request a few codes a minute
+	for i := 3; i < deviceCodesPerMinute; i++ {
+		start()
+	}
+	rw = post("/oauth2/device/code", nil, nil)
+	assert.Equal(t, 429, rw.Code)
+	assert.Equal(t, "60", rw.Header().Get("Retry-After"))
+	assert.Contains(t, rw.Body.String(), "slow_down")
+}
+
+func TestDeviceFlowDisabled(t *testing.T) {
+	opts := testOptions()
+	assert.Equal(t, nil, opts.Validate())
+	proxy := newOAuthProxy(opts, func(string) bool { return true })
+
+	rw := httptest.NewRecorder()
+	req, _ := http.NewRequest("POST", "/oauth2/device/code", nil)
+	proxy.ServeHTTP(rw, req)
+	assert.Equal(t, 403, rw.Code)
+}
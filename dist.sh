@@ -26,7 +26,7 @@ for os in windows linux darwin; do
     TARGET="oauth2_proxy-$version.$os-$arch.$goversion"
     FILENAME="oauth2_proxy-$version.$os-$arch$EXT"
     GOOS=$os GOARCH=$arch CGO_ENABLED=0 \
-        go build -ldflags="-s -w" -o $BUILD/$TARGET/$FILENAME || exit 1
+        go build -ldflags="-s -w" -o $BUILD/$TARGET/$FILENAME ./cmd/oauth2_proxy || exit 1
     pushd $BUILD/$TARGET
     sha256sum+=("$(shasum -a 256 $FILENAME || exit 1)")
     cd .. && tar czvf $TARGET.tar.gz $TARGET
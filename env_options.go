@@ -1,9 +1,14 @@
-package main
+package oauth2proxy
 
 import (
+	"fmt"
+	"io/ioutil"
 	"os"
 	"reflect"
+	"regexp"
 	"strings"
+
+	"github.com/BurntSushi/toml"
 )
 
 type EnvOptions map[string]interface{}
@@ -33,3 +38,85 @@ func (cfg EnvOptions) LoadEnvForStruct(options interface{}) {
 		}
 	}
 }
+
+var configEnvRegexp = regexp.MustCompile(`\$\{([A-Za-z_][A-Za-z0-9_]*)(:-([^}]*))?\}`)
+
+// ExpandConfigEnv replaces ${VAR} and ${VAR:-default} references in a config
+// value with values from the environment. A reference to an unset variable
+// without a default is an error.
+func ExpandConfigEnv(value string) (string, error) {
+	var missing []string
+	expanded := expandEnv(value, &missing)
+	if len(missing) != 0 {
+		return "", missingEnvError(missing)
+	}
+	return expanded, nil
+}
+
+func expandEnv(value string, missing *[]string) string {
+	return configEnvRegexp.ReplaceAllStringFunc(value, func(ref string) string {
+		m := configEnvRegexp.FindStringSubmatch(ref)
+		v, ok := os.LookupEnv(m[1])
+		if ok && (v != "" || m[2] == "") {
+			return v
+		}
+		if m[2] != "" {
+			return m[3]
+		}
+		*missing = append(*missing, m[1])
+		return ""
+	})
+}
+
+func missingEnvError(missing []string) error {
+	return fmt.Errorf("undefined environment variable(s) referenced in config: %s",
+		strings.Join(missing, ", "))
+}
+
+// expandEnvValues expands the environment variable references in the
+// strings of a decoded config value, including those in lists and tables.
+func expandEnvValues(v interface{}, missing *[]string) interface{} {
+	switch v := v.(type) {
+	case string:
+		return expandEnv(v, missing)
+	case []string:
+		for i := range v {
+			v[i] = expandEnv(v[i], missing)
+		}
+	case []interface{}:
+		for i := range v {
+			v[i] = expandEnvValues(v[i], missing)
+		}
+	case map[string]interface{}:
+		for k := range v {
+			v[k] = expandEnvValues(v[k], missing)
+		}
+	case []map[string]interface{}:
+		for _, m := range v {
+			expandEnvValues(m, missing)
+		}
+	}
+	return v
+}
+
+// LoadConfigFile decodes a TOML config file into cfg and expands environment
+// variable references in its values. Values are expanded after parsing, so
+// that they may contain quotes, and references in comments are ignored.
+func (cfg EnvOptions) LoadConfigFile(filename string) error {
+	b, err := ioutil.ReadFile(filename)
+	if err != nil {
+		return err
+	}
+	decoded := make(EnvOptions)
+	if _, err = toml.Decode(string(b), &decoded); err != nil {
+		return err
+	}
+	var missing []string
+	for k, v := range decoded {
+		cfg[k] = expandEnvValues(v, &missing)
+	}
+	if len(missing) != 0 {
+		return missingEnvError(missing)
+	}
+	return nil
+}
@@ -1,6 +1,7 @@
-package main
+package oauth2proxy
 
 import (
+	"io/ioutil"
 	"os"
 	"testing"
 
@@ -24,3 +25,40 @@ func TestLoadEnvForStruct(t *testing.T) {
 	v := cfg["target_field"]
 	assert.Equal(t, v, "1234abcd")
 }
+
+func TestExpandConfigEnv(t *testing.T) {
+	os.Setenv("TEST_CONFIG_SECRET", "s3cr3t")
+	os.Unsetenv("TEST_CONFIG_UNSET")
+
+	expanded, err := ExpandConfigEnv("${TEST_CONFIG_SECRET}")
+	assert.Equal(t, nil, err)
+	assert.Equal(t, "s3cr3t", expanded)
+	expanded, err = ExpandConfigEnv("${TEST_CONFIG_UNSET:-.example.com}")
+	assert.Equal(t, nil, err)
+	assert.Equal(t, ".example.com", expanded)
+
+	_, err = ExpandConfigEnv("${TEST_CONFIG_UNSET}")
+	assert.Equal(t, "undefined environment variable(s) referenced in config: TEST_CONFIG_UNSET", err.Error())
+}
+
+func TestLoadConfigFileExpandsParsedValues(t *testing.T) {
+	os.Setenv("TEST_CONFIG_SECRET", `s3"cr3t`)
+	os.Unsetenv("TEST_CONFIG_UNSET")
+	f, err := ioutil.TempFile("", "oauth2_proxy.cfg")
+	assert.Equal(t, nil, err)
+	defer os.Remove(f.Name())
+	f.WriteString(`# client_secret = "${TEST_CONFIG_UNSET}"
+client_secret = "${TEST_CONFIG_SECRET}"
+email_domains = ["${TEST_CONFIG_UNSET:-example.com}"]
+
+[[tenant]]
+cookie_secret = "${TEST_CONFIG_SECRET}"
+`)
+	f.Close()
+
+	cfg := make(EnvOptions)
+	assert.Equal(t, nil, cfg.LoadConfigFile(f.Name()))
+	assert.Equal(t, `s3"cr3t`, cfg["client_secret"])
+	assert.Equal(t, []interface{}{"example.com"}, cfg["email_domains"])
+	assert.Equal(t, `s3"cr3t`, cfg["tenant"].([]map[string]interface{})[0]["cookie_secret"])
+}
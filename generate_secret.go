@@ -0,0 +1,46 @@
+package oauth2proxy
+
+import (
+	"crypto/rand"
+	"encoding/base64"
+	"flag"
+	"fmt"
+	"os"
+)
+
+// generateSecret returns size random bytes as URL-safe base64, the encoding
+// expected for cookie-secret.
+func generateSecret(size int) (string, error) {
+	switch size {
+	case 16, 24, 32:
+	default:
+		return "", fmt.Errorf("invalid secret size %d; must be 16, 24 or 32 bytes", size)
+	}
+	b := make([]byte, size)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return base64.URLEncoding.EncodeToString(b), nil
+}
+
+func generateSecretCommand(args []string) int {
+	flagSet := flag.NewFlagSet("oauth2_proxy generate-secret", flag.ExitOnError)
+	size := flagSet.Int("bytes", 32, "secret size in bytes: 16, 24 or 32 for AES-128, AES-192 or AES-256")
+	kmsKey := flagSet.String("kms-key", "", "print the secret wrapped with this KMS key, for use with cookie-secret-kms-key")
+	region := flagSet.String("aws-region", "", "AWS region of an aws-kms: key that is not given as an ARN")
+	flagSet.Parse(args)
+
+	secret, err := generateSecret(*size)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 2
+	}
+	if *kmsKey != "" {
+		if secret, err = wrapSecret(*kmsKey, secret, *region); err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			return 1
+		}
+	}
+	fmt.Println(secret)
+	return 0
+}
@@ -0,0 +1,23 @@
+package oauth2proxy
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestGenerateSecret(t *testing.T) {
+	for _, size := range []int{16, 24, 32} {
+		secret, err := generateSecret(size)
+		assert.Equal(t, nil, err)
+		assert.Equal(t, size, len(secretBytes(secret)))
+
+		o := testOptions()
+		o.CookieSecret = secret
+		o.CookieRefresh = o.CookieExpire / 2
+		assert.Equal(t, nil, o.Validate())
+	}
+
+	_, err := generateSecret(20)
+	assert.Equal(t, "invalid secret size 20; must be 16, 24 or 32 bytes", err.Error())
+}
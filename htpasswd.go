@@ -1,4 +1,4 @@
-package main
+package oauth2proxy
 
 import (
 	"crypto/sha1"
@@ -7,6 +7,7 @@ import (
 	"io"
 	"log"
 	"os"
+	"sync"
 )
 
 // lookup passwords in a htpasswd file
@@ -14,6 +15,7 @@ import (
 
 type HtpasswdFile struct {
 	Users map[string]string
+	mu    sync.RWMutex
 }
 
 func NewHtpasswdFromFile(path string) (*HtpasswdFile, error) {
@@ -42,8 +44,26 @@ func NewHtpasswd(file io.Reader) (*HtpasswdFile, error) {
 	return h, nil
 }
 
+// WatchForUpdates reloads the entries whenever path changes; an update that
+// fails to parse keeps the previous entries.
+func (h *HtpasswdFile) WatchForUpdates(path string, done <-chan bool) error {
+	return WatchForUpdates(path, done, func() {
+		updated, err := NewHtpasswdFromFile(path)
+		if err != nil {
+			log.Printf("error reloading htpasswd file %s: %s", path, err)
+			return
+		}
+		h.mu.Lock()
+		h.Users = updated.Users
+		h.mu.Unlock()
+		log.Printf("reloaded htpasswd file %s", path)
+	})
+}
+
 func (h *HtpasswdFile) Validate(user string, password string) bool {
+	h.mu.RLock()
 	realPassword, exists := h.Users[user]
+	h.mu.RUnlock()
 	if !exists {
 		return false
 	}
@@ -1,28 +1,137 @@
-package main
+package oauth2proxy
 
 import (
+	"context"
 	"crypto/tls"
+	"fmt"
+	"io"
 	"log"
 	"net"
 	"net/http"
+	"net/url"
+	"os"
+	"strconv"
 	"strings"
+	"sync"
 	"time"
+
+	"github.com/quic-go/quic-go/http3"
+	"golang.org/x/net/http2"
 )
 
+// listenFDsEnv holds the number of listening sockets passed on to a new
+// process during a restart; they start at file descriptor 3.
+const listenFDsEnv = "OAUTH2_PROXY_LISTEN_FDS"
+
 type Server struct {
 	Handler http.Handler
 	Opts    *Options
+	// Metrics is served on the metrics-address, if set.
+	Metrics http.Handler
+
+	mu sync.Mutex
+	// sockets holds the listeners and packet conns in the order they were
+	// opened, which is the order restart passes them on in.
+	sockets   []io.Closer
+	servers   []*http.Server
+	quicConns []net.PacketConn
+	quic      *http3.Server
+	stopped   chan struct{}
+	stopOnce  sync.Once
+	// stopping is set once Shutdown starts; listeners served after that are
+	// closed right away.
+	stopping bool
+	// watchdogPID is the pid systemd expects watchdog notifications from.
+	watchdogPID string
+
+	// the listening sockets passed by a restart or by systemd socket
+	// activation, counted when the server first listens
+	inheritOnce     sync.Once
+	inheritedFDs    int
+	nextInheritedFD int
+}
+
+// NewServer returns a server for handler configured by opts. metrics is
+// served on the metrics-address, if set.
+func NewServer(handler http.Handler, opts *Options, metrics http.Handler) *Server {
+	return &Server{
+		Handler: handler,
+		Opts:    opts,
+		Metrics: metrics,
+		stopped: make(chan struct{}),
+	}
 }
 
 func (s *Server) ListenAndServe() {
-	if s.Opts.TLSKeyFile != "" || s.Opts.TLSCertFile != "" {
+	s.handleSignals()
+	if s.Opts.TLSKeyFile == "" && s.Opts.TLSCertFile == "" {
+		s.ServeHTTP()
+	} else if s.Opts.HttpWithTLS == "" {
 		s.ServeHTTPS()
 	} else {
-		s.ServeHTTP()
+		s.ServeHTTPAndHTTPS()
 	}
 }
 
 func (s *Server) ServeHTTP() {
+	lns := s.listenHTTP()
+	s.ready()
+	s.serveHTTP(lns, s.Handler)
+}
+
+func (s *Server) ServeHTTPS() {
+	lns, config := s.listenHTTPS()
+	s.ready()
+	s.serveHTTPS(lns, config)
+}
+
+// ServeHTTPAndHTTPS serves HTTPS and, depending on http-with-tls, either
+// serves the same handler over HTTP or redirects HTTP requests to HTTPS.
+func (s *Server) ServeHTTPAndHTTPS() {
+	httpLns := s.listenHTTP()
+	httpsLns, config := s.listenHTTPS()
+	s.ready()
+
+	handler := s.Handler
+	if s.Opts.HttpWithTLS == "redirect" {
+		_, port, _ := net.SplitHostPort(httpsLns[0].Addr().String())
+		handler = httpsRedirectHandler(port, s.Handler)
+	}
+	done := make(chan struct{})
+	go func() {
+		s.serveHTTP(httpLns, handler)
+		close(done)
+	}()
+	s.serveHTTPS(httpsLns, config)
+	select {
+	case <-done:
+	case <-s.stopped:
+	}
+}
+
+// httpsRedirectHandler permanently redirects requests to the same URL on
+// HTTPS on port, except for /ping, which is passed to handler so load
+// balancer health checks over HTTP keep working.
+func httpsRedirectHandler(port string, handler http.Handler) http.Handler {
+	return http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		if req.URL.Path == "/ping" {
+			handler.ServeHTTP(rw, req)
+			return
+		}
+		host := req.Host
+		if h, _, err := net.SplitHostPort(host); err == nil {
+			host = h
+		}
+		if port != "443" {
+			host = net.JoinHostPort(host, port)
+		}
+		u := url.URL{Scheme: "https", Host: host, Path: req.URL.Path, RawQuery: req.URL.RawQuery}
+		http.Redirect(rw, req, u.String(), http.StatusMovedPermanently)
+	})
+}
+
+// listenHTTP listens on http-address and, if set, http-address-ipv6.
+func (s *Server) listenHTTP() []net.Listener {
 	httpAddress := s.Opts.HttpAddress
 	scheme := ""
 
@@ -42,61 +151,329 @@ func (s *Server) ServeHTTP() {
 	slice := strings.SplitN(httpAddress, "//", 2)
 	listenAddr := slice[len(slice)-1]
 
-	listener, err := net.Listen(networkType, listenAddr)
+	listener, err := s.listen(networkType, listenAddr)
 	if err != nil {
 		log.Fatalf("FATAL: listen (%s, %s) failed - %s", networkType, listenAddr, err)
 	}
 	log.Printf("HTTP: listening on %s", listenAddr)
+	listeners := []net.Listener{listener}
+	if s.Opts.HttpAddressIPv6 != "" {
+		listeners = append(listeners, s.listenIPv6("HTTP", s.Opts.HttpAddressIPv6))
+	}
+	return listeners
+}
 
-	server := &http.Server{Handler: s.Handler}
-	err = server.Serve(listener)
-	if err != nil && !strings.Contains(err.Error(), "use of closed network connection") {
-		log.Printf("ERROR: http.Serve() - %s", err)
+// listenIPv6 listens on an IPv6-only socket, so addr may share its port with
+// an IPv4 address of http-address or https-address.
+func (s *Server) listenIPv6(proto, addr string) net.Listener {
+	ln, err := s.listen("tcp6", addr)
+	if err != nil {
+		log.Fatalf("FATAL: listen (tcp6, %s) failed - %s", addr, err)
 	}
+	log.Printf("%s: listening on %s", proto, ln.Addr())
+	return ln
+}
 
-	log.Printf("HTTP: closing %s", listener.Addr())
+func (s *Server) serveHTTP(listeners []net.Listener, handler http.Handler) {
+	for i, ln := range listeners {
+		if tl, ok := ln.(*net.TCPListener); ok {
+			listeners[i] = tcpKeepAliveListener{tl, s.Opts.TCPKeepAlive}
+		}
+	}
+	s.serveListeners(s.newServer(handler), listeners, "HTTP")
 }
 
-func (s *Server) ServeHTTPS() {
+// listenHTTPS listens on https-address and, if set, https-address-ipv6.
+func (s *Server) listenHTTPS() ([]net.Listener, *tls.Config) {
 	addr := s.Opts.HttpsAddress
 	config := &tls.Config{
-		MinVersion: tls.VersionTLS12,
-		MaxVersion: tls.VersionTLS12,
+		MinVersion:       s.Opts.tlsMinVersion,
+		MaxVersion:       s.Opts.tlsMaxVersion,
+		CipherSuites:     s.Opts.tlsCipherSuites,
+		CurvePreferences: s.Opts.tlsCurves,
+	}
+	if len(config.CipherSuites) != 0 {
+		config.PreferServerCipherSuites = true
+	}
+	if s.Opts.tlsClientCAs != nil {
+		config.ClientCAs = s.Opts.tlsClientCAs
+		config.ClientAuth = tls.VerifyClientCertIfGiven
+		if s.Opts.TLSClientCertRequired {
+			config.ClientAuth = tls.RequireAndVerifyClientCert
+		}
 	}
 	if config.NextProtos == nil {
 		config.NextProtos = []string{"http/1.1"}
+		if s.Opts.HTTP2 {
+			if http2CipherSuites(config.CipherSuites) {
+				config.NextProtos = []string{http2.NextProtoTLS, "http/1.1"}
+			} else {
+				log.Printf("HTTPS: HTTP/2 disabled, it requires tls-cipher-suite TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256 or TLS_ECDHE_ECDSA_WITH_AES_128_GCM_SHA256")
+			}
+		}
 	}
 
 	var err error
-	config.Certificates = make([]tls.Certificate, 1)
-	config.Certificates[0], err = tls.LoadX509KeyPair(s.Opts.TLSCertFile, s.Opts.TLSKeyFile)
+	if s.Opts.WatchFiles {
+		var reloader *certificateReloader
+		reloader, err = newCertificateReloader(s.Opts.TLSCertFile, s.Opts.TLSKeyFile)
+		config.GetCertificate = reloader.GetCertificate
+	} else {
+		config.Certificates = make([]tls.Certificate, 1)
+		config.Certificates[0], err = tls.LoadX509KeyPair(s.Opts.TLSCertFile, s.Opts.TLSKeyFile)
+	}
 	if err != nil {
 		log.Fatalf("FATAL: loading tls config (%s, %s) failed - %s", s.Opts.TLSCertFile, s.Opts.TLSKeyFile, err)
 	}
 
-	ln, err := net.Listen("tcp", addr)
+	ln, err := s.listen("tcp", addr)
 	if err != nil {
 		log.Fatalf("FATAL: listen (%s) failed - %s", addr, err)
 	}
 	log.Printf("HTTPS: listening on %s", ln.Addr())
+	listeners := []net.Listener{ln}
+	if s.Opts.HttpsAddressIPv6 != "" {
+		listeners = append(listeners, s.listenIPv6("HTTPS", s.Opts.HttpsAddressIPv6))
+	}
+	if s.Opts.HTTP3 {
+		s.listenHTTP3("udp", s.Opts.HttpsAddress, listeners[0])
+		if len(listeners) > 1 {
+			s.listenHTTP3("udp6", s.Opts.HttpsAddressIPv6, listeners[1])
+		}
+	}
+	return listeners, config
+}
 
-	tlsListener := tls.NewListener(tcpKeepAliveListener{ln.(*net.TCPListener)}, config)
-	srv := &http.Server{Handler: s.Handler}
-	err = srv.Serve(tlsListener)
+func (s *Server) serveHTTPS(listeners []net.Listener, config *tls.Config) {
+	tlsListeners := make([]net.Listener, len(listeners))
+	for i, ln := range listeners {
+		tlsListeners[i] = tls.NewListener(tcpKeepAliveListener{ln.(*net.TCPListener), s.Opts.TCPKeepAlive}, config)
+	}
+	handler := s.Handler
+	if s.Opts.HTTP3 {
+		go s.serveHTTP3(handler, config)
+		handler = altSvcHandler(handler)
+	}
+	srv := s.newServer(handler)
+	if config.NextProtos[0] == http2.NextProtoTLS {
+		srv.TLSConfig = config
+		h2 := &http2.Server{MaxConcurrentStreams: uint32(s.Opts.HTTP2MaxStreams)}
+		if err := http2.ConfigureServer(srv, h2); err != nil {
+			log.Fatalf("FATAL: configuring HTTP/2 failed - %s", err)
+		}
+	}
+	s.serveListeners(srv, tlsListeners, "HTTPS")
+}
 
-	if err != nil && !strings.Contains(err.Error(), "use of closed network connection") {
-		log.Printf("ERROR: https.Serve() - %s", err)
+// serveListeners serves srv on all listeners until they are closed.
+func (s *Server) serveListeners(srv *http.Server, listeners []net.Listener, proto string) {
+	var wg sync.WaitGroup
+	for _, ln := range listeners {
+		wg.Add(1)
+		go func(ln net.Listener) {
+			defer wg.Done()
+			err := s.serve(srv, ln)
+			if err != nil && !strings.Contains(err.Error(), "use of closed network connection") {
+				log.Printf("ERROR: %s.Serve() - %s", strings.ToLower(proto), err)
+			}
+			log.Printf("%s: closing %s", proto, ln.Addr())
+		}(ln)
 	}
+	wg.Wait()
+}
 
-	log.Printf("HTTPS: closing %s", tlsListener.Addr())
+// newServer returns a server for handler with the timeouts and header size
+// limit of the options; zero timeouts are unlimited.
+func (s *Server) newServer(handler http.Handler) *http.Server {
+	return &http.Server{
+		Handler:           handler,
+		ReadTimeout:       s.Opts.ReadTimeout,
+		ReadHeaderTimeout: s.Opts.ReadHeaderTimeout,
+		WriteTimeout:      s.Opts.WriteTimeout,
+		IdleTimeout:       s.Opts.IdleTimeout,
+		MaxHeaderBytes:    s.Opts.MaxHeaderBytes,
+	}
+}
+
+// listen returns the next listening socket inherited from the process that
+// started this one during a restart, or a new listener.
+func (s *Server) listen(network, addr string) (net.Listener, error) {
+	ln, err := s.inheritedListener()
+	if err == nil && ln == nil {
+		if network == "unix" {
+			removeStaleSocket(addr)
+			ln, err = listenUnix(addr, s.Opts.unixSocketMode)
+		} else {
+			ln, err = net.Listen(network, addr)
+		}
+	}
+	if err != nil {
+		return nil, err
+	}
+	s.mu.Lock()
+	s.sockets = append(s.sockets, ln)
+	s.mu.Unlock()
+	return ln, nil
+}
+
+// listenPacket returns the next socket inherited from the process that
+// started this one during a restart, or a new packet conn.
+func (s *Server) listenPacket(network, addr string) (net.PacketConn, error) {
+	var conn net.PacketConn
+	var err error
+	f := s.inheritedFile()
+	if f != nil {
+		defer f.Close()
+		conn, err = net.FilePacketConn(f)
+	} else {
+		conn, err = net.ListenPacket(network, addr)
+	}
+	if err != nil {
+		return nil, err
+	}
+	s.mu.Lock()
+	s.sockets = append(s.sockets, conn)
+	s.mu.Unlock()
+	return conn, nil
+}
+
+// removeStaleSocket removes a unix socket left behind by a process that did
+// not shut down cleanly; a socket that still accepts connections is kept.
+func removeStaleSocket(path string) {
+	fi, err := os.Stat(path)
+	if err != nil || fi.Mode()&os.ModeSocket == 0 {
+		return
+	}
+	if conn, err := net.Dial("unix", path); err == nil {
+		conn.Close()
+		return
+	}
+	log.Printf("removing stale socket %s", path)
+	os.Remove(path)
+}
+
+func inheritedFDCount() int {
+	if n, err := strconv.Atoi(os.Getenv(listenFDsEnv)); err == nil {
+		return n
+	}
+	return systemdListenFDs()
+}
+
+// inheritedListener returns the next listening socket passed by a restart or
+// by systemd socket activation, or nil once all of them are used.
+func (s *Server) inheritedListener() (net.Listener, error) {
+	f := s.inheritedFile()
+	if f == nil {
+		return nil, nil
+	}
+	defer f.Close()
+	return net.FileListener(f)
+}
+
+// inheritedFile returns the file of the next socket passed by a restart or
+// by systemd socket activation, or nil once all of them are used.
+func (s *Server) inheritedFile() *os.File {
+	s.inheritOnce.Do(func() {
+		s.inheritedFDs = inheritedFDCount()
+		s.nextInheritedFD = 3
+	})
+	if s.nextInheritedFD >= 3+s.inheritedFDs {
+		return nil
+	}
+	f := os.NewFile(uintptr(s.nextInheritedFD), "socket")
+	s.nextInheritedFD++
+	return f
+}
+
+// serveMetrics listens on the metrics-address, if set, and serves the
+// Metrics handler on it in the background.
+func (s *Server) serveMetrics() {
+	if s.Opts.MetricsAddress == "" || s.Metrics == nil {
+		return
+	}
+	ln, err := s.listen("tcp", s.Opts.MetricsAddress)
+	if err != nil {
+		log.Fatalf("FATAL: listen (tcp, %s) failed - %s", s.Opts.MetricsAddress, err)
+	}
+	log.Printf("metrics: listening on %s", ln.Addr())
+	go s.serveListeners(s.newServer(s.Metrics), []net.Listener{ln}, "metrics")
+}
+
+// ready is called once the server is listening; it takes over from the
+// process that started this one and notifies systemd.
+func (s *Server) ready() {
+	s.serveMetrics()
+	s.mu.Lock()
+	s.watchdogPID = os.Getenv("WATCHDOG_PID")
+	s.mu.Unlock()
+	s.takeOver()
+	if err := sdNotify(fmt.Sprintf("MAINPID=%d\nREADY=1", os.Getpid())); err != nil {
+		log.Printf("ERROR: systemd notification failed - %s", err)
+	}
+	s.mu.Lock()
+	watchdogPID := s.watchdogPID
+	s.mu.Unlock()
+	go sdWatchdog(s.stopped, watchdogPID)
+}
+
+// serve runs srv until it fails or is shut down; after a shutdown it waits
+// for active requests to complete.
+func (s *Server) serve(srv *http.Server, ln net.Listener) error {
+	s.mu.Lock()
+	if s.stopping {
+		s.mu.Unlock()
+		ln.Close()
+		return nil
+	}
+	s.servers = append(s.servers, srv)
+	s.mu.Unlock()
+
+	err := srv.Serve(ln)
+	if err == http.ErrServerClosed {
+		<-s.stopped
+		return nil
+	}
+	return err
+}
+
+// Shutdown stops accepting connections and waits up to shutdown-timeout for
+// active requests to complete. It may be called before ListenAndServe, which
+// then returns without serving, and more than once.
+func (s *Server) Shutdown() {
+	s.stopOnce.Do(s.shutdown)
+}
+
+func (s *Server) shutdown() {
+	ctx, cancel := context.WithTimeout(context.Background(), s.Opts.ShutdownTimeout)
+	defer cancel()
+
+	s.mu.Lock()
+	s.stopping = true
+	servers := s.servers
+	quic, quicConns := s.quic, s.quicConns
+	s.mu.Unlock()
+	for _, srv := range servers {
+		if err := srv.Shutdown(ctx); err != nil {
+			log.Printf("ERROR: shutdown - %s", err)
+		}
+	}
+	// HTTP/3 requests in flight are cut off
+	if quic != nil {
+		quic.Close()
+	}
+	for _, conn := range quicConns {
+		conn.Close()
+	}
+	close(s.stopped)
 }
 
 // tcpKeepAliveListener sets TCP keep-alive timeouts on accepted
 // connections. It's used by ListenAndServe and ListenAndServeTLS so
 // dead TCP connections (e.g. closing laptop mid-download) eventually
-// go away.
+// go away. A zero period turns keep-alives off.
 type tcpKeepAliveListener struct {
 	*net.TCPListener
+	period time.Duration
 }
 
 func (ln tcpKeepAliveListener) Accept() (c net.Conn, err error) {
@@ -104,7 +481,59 @@ func (ln tcpKeepAliveListener) Accept() (c net.Conn, err error) {
 	if err != nil {
 		return
 	}
-	tc.SetKeepAlive(true)
-	tc.SetKeepAlivePeriod(3 * time.Minute)
+	tc.SetKeepAlive(ln.period > 0)
+	if ln.period > 0 {
+		tc.SetKeepAlivePeriod(ln.period)
+	}
 	return tc, nil
 }
+
+// certificateReloader serves the current TLS key pair and re-reads it when
+// the certificate or key file changes, so renewed certificates are picked up
+// without a restart.
+type certificateReloader struct {
+	certFile string
+	keyFile  string
+	mu       sync.RWMutex
+	cert     *tls.Certificate
+}
+
+func newCertificateReloader(certFile, keyFile string) (*certificateReloader, error) {
+	r := &certificateReloader{certFile: certFile, keyFile: keyFile}
+	if err := r.reload(); err != nil {
+		return nil, err
+	}
+	if err := WatchForUpdates(certFile, nil, r.reloadLogged); err != nil {
+		return nil, err
+	}
+	if err := WatchForUpdates(keyFile, nil, r.reloadLogged); err != nil {
+		return nil, err
+	}
+	return r, nil
+}
+
+func (r *certificateReloader) reload() error {
+	cert, err := tls.LoadX509KeyPair(r.certFile, r.keyFile)
+	if err != nil {
+		return err
+	}
+	r.mu.Lock()
+	r.cert = &cert
+	r.mu.Unlock()
+	return nil
+}
+
+func (r *certificateReloader) reloadLogged() {
+	if err := r.reload(); err != nil {
+		// the certificate and key are often updated one after the other
+		log.Printf("error reloading tls config (%s, %s) - %s", r.certFile, r.keyFile, err)
+		return
+	}
+	log.Printf("reloaded tls config (%s, %s)", r.certFile, r.keyFile)
+}
+
+func (r *certificateReloader) GetCertificate(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	return r.cert, nil
+}
@@ -0,0 +1,85 @@
+package oauth2proxy
+
+import (
+	"crypto/tls"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+
+	"github.com/quic-go/quic-go/http3"
+)
+
+// altSvcMaxAge is how long, in seconds, clients may remember that HTTP/3 is
+// offered.
+const altSvcMaxAge = 86400
+
+// listenHTTP3 opens the UDP socket for HTTP/3 on the host of httpsAddr and
+// the port of the HTTPS listener ln. Like the TCP listeners it is passed on
+// during a restart.
+func (s *Server) listenHTTP3(network, httpsAddr string, ln net.Listener) {
+	host, _, _ := net.SplitHostPort(httpsAddr)
+	_, port, _ := net.SplitHostPort(ln.Addr().String())
+	addr := net.JoinHostPort(host, port)
+	conn, err := s.listenPacket(network, addr)
+	if err != nil {
+		log.Fatalf("FATAL: listen (%s, %s) failed - %s", network, addr, err)
+	}
+	log.Printf("HTTP/3: listening on %s", conn.LocalAddr())
+	s.mu.Lock()
+	s.quicConns = append(s.quicConns, conn)
+	s.mu.Unlock()
+}
+
+// serveHTTP3 serves handler over QUIC with a copy of the HTTPS TLS config;
+// QUIC always uses TLS 1.3, which Validate makes sure tls-max-version allows.
+func (s *Server) serveHTTP3(handler http.Handler, config *tls.Config) {
+	config = config.Clone()
+	config.MinVersion = tls.VersionTLS13
+	config.MaxVersion = tls.VersionTLS13
+	config.CipherSuites = nil
+	config.NextProtos = nil
+	srv := &http3.Server{
+		Handler:   handler,
+		TLSConfig: http3.ConfigureTLSConfig(config),
+	}
+
+	s.mu.Lock()
+	conns := s.quicConns
+	if s.stopping {
+		s.mu.Unlock()
+		return
+	}
+	s.quic = srv
+	s.mu.Unlock()
+	var wg sync.WaitGroup
+	for _, conn := range conns {
+		wg.Add(1)
+		go func(conn net.PacketConn) {
+			defer wg.Done()
+			err := srv.Serve(conn)
+			if err != nil && err != http.ErrServerClosed && !strings.Contains(err.Error(), "use of closed network connection") {
+				log.Printf("ERROR: http3.Serve() - %s", err)
+			}
+			log.Printf("HTTP/3: closing %s", conn.LocalAddr())
+		}(conn)
+	}
+	wg.Wait()
+}
+
+// altSvcHandler advertises HTTP/3 in the Alt-Svc header of responses so
+// browsers switch to it for later requests. The UDP port is the port the
+// request was received on, as https-address-ipv6 may use another port than
+// https-address.
+func altSvcHandler(handler http.Handler) http.Handler {
+	return http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		if addr, ok := req.Context().Value(http.LocalAddrContextKey).(net.Addr); ok {
+			if _, port, err := net.SplitHostPort(addr.String()); err == nil {
+				rw.Header().Set("Alt-Svc", fmt.Sprintf("h3=\":%s\"; ma=%d", port, altSvcMaxAge))
+			}
+		}
+		handler.ServeHTTP(rw, req)
+	})
+}
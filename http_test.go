@@ -0,0 +1,300 @@
+package oauth2proxy
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/pem"
+	"io"
+	"io/ioutil"
+	"math/big"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestServerShutdownWaitsForActiveRequests(t *testing.T) {
+	started := make(chan bool)
+	s := &Server{
+		Handler: http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+			started <- true
+			time.Sleep(100 * time.Millisecond)
+			rw.Write([]byte("done"))
+		}),
+		Opts:    &Options{ShutdownTimeout: time.Second},
+		stopped: make(chan struct{}),
+	}
+	ln, err := s.listen("tcp", "127.0.0.1:0")
+	assert.Equal(t, nil, err)
+
+	served := make(chan error)
+	go func() {
+		served <- s.serve(&http.Server{Handler: s.Handler}, ln)
+	}()
+
+	body := make(chan string)
+	go func() {
+		resp, err := http.Get("http://" + ln.Addr().String() + "/")
+		assert.Equal(t, nil, err)
+		b, _ := ioutil.ReadAll(resp.Body)
+		resp.Body.Close()
+		body <- string(b)
+	}()
+
+	<-started
+	s.Shutdown()
+	assert.Equal(t, "done", <-body)
+	assert.Equal(t, nil, <-served)
+
+	_, err = net.Dial("tcp", ln.Addr().String())
+	assert.NotEqual(t, nil, err)
+}
+
+func TestServerShutdownBeforeListenAndServe(t *testing.T) {
+	s := NewServer(http.NotFoundHandler(), &Options{HttpAddress: "127.0.0.1:0", ShutdownTimeout: time.Second}, nil)
+	s.Shutdown()
+	s.Shutdown()
+
+	done := make(chan bool)
+	go func() {
+		s.ListenAndServe()
+		done <- true
+	}()
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("ListenAndServe did not return after Shutdown")
+	}
+}
+
+func TestServerReadHeaderTimeout(t *testing.T) {
+	s := &Server{
+		Handler: http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+			rw.Write([]byte("done"))
+		}),
+		Opts:    &Options{ReadHeaderTimeout: 100 * time.Millisecond, IdleTimeout: time.Minute, ShutdownTimeout: time.Second},
+		stopped: make(chan struct{}),
+	}
+	srv := s.newServer(s.Handler)
+	assert.Equal(t, 100*time.Millisecond, srv.ReadHeaderTimeout)
+	assert.Equal(t, time.Minute, srv.IdleTimeout)
+	ln, err := s.listen("tcp", "127.0.0.1:0")
+	assert.Equal(t, nil, err)
+	go s.serve(srv, ln)
+	defer s.Shutdown()
+
+	// a client sending its headers too slowly is disconnected
+	conn, err := net.Dial("tcp", ln.Addr().String())
+	assert.Equal(t, nil, err)
+	defer conn.Close()
+	conn.Write([]byte("GET / HTTP/1.1\r\nHost: example.com\r\n"))
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	start := time.Now()
+	_, err = ioutil.ReadAll(conn)
+	assert.Equal(t, nil, err)
+	assert.True(t, time.Since(start) < 5*time.Second)
+}
+
+func TestServerTimeoutsOptions(t *testing.T) {
+	o := testOptions()
+	o.ReadHeaderTimeout = -time.Second
+	assert.Equal(t, errorMsg([]string{
+		"read-timeout, read-header-timeout, write-timeout, idle-timeout and tcp-keepalive must not be negative",
+	}), o.Validate().Error())
+}
+
+func TestServeHTTPOnIPv4AndIPv6(t *testing.T) {
+	if ln, err := net.Listen("tcp6", "[::1]:0"); err != nil {
+		t.Skip("IPv6 is not available")
+	} else {
+		ln.Close()
+	}
+	s := &Server{
+		Handler: http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+			rw.Write([]byte(clientIP(req)))
+		}),
+		Opts: &Options{
+			HttpAddress:     "127.0.0.1:0",
+			HttpAddressIPv6: "[::1]:0",
+			ShutdownTimeout: time.Second,
+		},
+		stopped: make(chan struct{}),
+	}
+	lns := s.listenHTTP()
+	assert.Equal(t, 2, len(lns))
+	go s.serveHTTP(lns, s.Handler)
+	defer s.Shutdown()
+
+	for i, ip := range []string{"127.0.0.1", "::1"} {
+		resp, err := http.Get("http://" + lns[i].Addr().String() + "/")
+		assert.Equal(t, nil, err)
+		body, _ := ioutil.ReadAll(resp.Body)
+		resp.Body.Close()
+		assert.Equal(t, ip, string(body))
+	}
+}
+
+func TestHTTPSRedirectHandler(t *testing.T) {
+	for port, location := range map[string]string{
+		"443":  "https://example.com/foo/bar?a=b",
+		"8443": "https://example.com:8443/foo/bar?a=b",
+	} {
+		rw := httptest.NewRecorder()
+		req, _ := http.NewRequest("GET", "http://example.com:8080/foo/bar?a=b", nil)
+		httpsRedirectHandler(port, http.NotFoundHandler()).ServeHTTP(rw, req)
+		assert.Equal(t, http.StatusMovedPermanently, rw.Code)
+		assert.Equal(t, location, rw.Header().Get("Location"))
+	}
+
+	rw := httptest.NewRecorder()
+	req, _ := http.NewRequest("GET", "http://example.com:8080/ping", nil)
+	httpsRedirectHandler("443", http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		rw.Write([]byte("OK"))
+	})).ServeHTTP(rw, req)
+	assert.Equal(t, http.StatusOK, rw.Code)
+	assert.Equal(t, "OK", rw.Body.String())
+}
+
+func TestAltSvcHandler(t *testing.T) {
+	rw := httptest.NewRecorder()
+	req, _ := http.NewRequest("GET", "https://example.com/foo", nil)
+	req = req.WithContext(context.WithValue(req.Context(), http.LocalAddrContextKey, &net.TCPAddr{IP: net.IPv6loopback, Port: 8443}))
+	altSvcHandler(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		rw.WriteHeader(http.StatusAccepted)
+	})).ServeHTTP(rw, req)
+	assert.Equal(t, http.StatusAccepted, rw.Code)
+	assert.Equal(t, `h3=":8443"; ma=86400`, rw.Header().Get("Alt-Svc"))
+}
+
+func TestListenUnixSocketMode(t *testing.T) {
+	dir, err := ioutil.TempDir("", "oauth2_proxy")
+	assert.Equal(t, nil, err)
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "oauth2_proxy.sock")
+
+	// a socket left behind by a process that did not shut down cleanly
+	stale, err := net.Listen("unix", path)
+	assert.Equal(t, nil, err)
+	stale.(*net.UnixListener).SetUnlinkOnClose(false)
+	stale.Close()
+
+	s := &Server{Opts: &Options{unixSocketMode: 0660}}
+	ln, err := s.listen("unix", path)
+	assert.Equal(t, nil, err)
+	defer ln.Close()
+	fi, err := os.Stat(path)
+	assert.Equal(t, nil, err)
+	assert.Equal(t, os.FileMode(0660), fi.Mode().Perm())
+}
+
+// writeTestCert writes a self-signed certificate for 127.0.0.1 and its key to
+// dir.
+func writeTestCert(t *testing.T, dir string) (certFile, keyFile string) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	assert.Equal(t, nil, err)
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		IPAddresses:  []net.IP{net.ParseIP("127.0.0.1")},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	assert.Equal(t, nil, err)
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	assert.Equal(t, nil, err)
+
+	certFile = filepath.Join(dir, "cert.pem")
+	keyFile = filepath.Join(dir, "key.pem")
+	ioutil.WriteFile(certFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0600)
+	ioutil.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER}), 0600)
+	return
+}
+
+func TestServeHTTPSWithHTTP2(t *testing.T) {
+	dir, err := ioutil.TempDir("", "oauth2_proxy")
+	assert.Equal(t, nil, err)
+	defer os.RemoveAll(dir)
+	certFile, keyFile := writeTestCert(t, dir)
+
+	for _, test := range []struct {
+		http2        bool
+		cipherSuites []uint16
+		proto        string
+	}{
+		{true, nil, "HTTP/2.0"},
+		{true, []uint16{tls.TLS_ECDHE_ECDSA_WITH_AES_128_GCM_SHA256}, "HTTP/2.0"},
+		// without the cipher suite HTTP/2 requires, HTTP/1.1 is served
+		{true, []uint16{tls.TLS_ECDHE_ECDSA_WITH_AES_256_GCM_SHA384}, "HTTP/1.1"},
+		{false, nil, "HTTP/1.1"},
+	} {
+		s := &Server{
+			Handler: http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+				rw.Write([]byte(req.Proto))
+			}),
+			Opts: &Options{
+				HttpsAddress:    "127.0.0.1:0",
+				TLSCertFile:     certFile,
+				TLSKeyFile:      keyFile,
+				HTTP2:           test.http2,
+				HTTP2MaxStreams: 100,
+				ShutdownTimeout: time.Second,
+				tlsMinVersion:   tls.VersionTLS12,
+				tlsMaxVersion:   tls.VersionTLS12,
+				tlsCipherSuites: test.cipherSuites,
+			},
+			stopped: make(chan struct{}),
+		}
+		lns, config := s.listenHTTPS()
+		go s.serveHTTPS(lns, config)
+
+		client := &http.Client{Transport: &http.Transport{
+			TLSClientConfig:   &tls.Config{InsecureSkipVerify: true},
+			ForceAttemptHTTP2: true,
+		}}
+		resp, err := client.Get("https://" + lns[0].Addr().String() + "/")
+		assert.Equal(t, nil, err)
+		body, _ := ioutil.ReadAll(resp.Body)
+		resp.Body.Close()
+		assert.Equal(t, test.proto, resp.Proto)
+		assert.Equal(t, test.proto, string(body))
+		s.Shutdown()
+	}
+}
+
+func TestListenHTTP3OnHTTPSPort(t *testing.T) {
+	dir, err := ioutil.TempDir("", "oauth2_proxy")
+	assert.Equal(t, nil, err)
+	defer os.RemoveAll(dir)
+	certFile, keyFile := writeTestCert(t, dir)
+
+	s := &Server{
+		Opts: &Options{
+			HttpsAddress:  "127.0.0.1:0",
+			TLSCertFile:   certFile,
+			TLSKeyFile:    keyFile,
+			HTTP3:         true,
+			tlsMinVersion: tls.VersionTLS12,
+			tlsMaxVersion: tls.VersionTLS12,
+		},
+		stopped: make(chan struct{}),
+	}
+	lns, _ := s.listenHTTPS()
+	defer lns[0].Close()
+	assert.Equal(t, 1, len(s.quicConns))
+	defer s.quicConns[0].Close()
+
+	_, tcpPort, _ := net.SplitHostPort(lns[0].Addr().String())
+	_, udpPort, _ := net.SplitHostPort(s.quicConns[0].LocalAddr().String())
+	assert.Equal(t, tcpPort, udpPort)
+	// the UDP socket is passed on during a restart, after the TCP listener
+	assert.Equal(t, []io.Closer{lns[0], s.quicConns[0]}, s.sockets)
+}
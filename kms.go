@@ -0,0 +1,222 @@
+package oauth2proxy
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/kms"
+	"golang.org/x/oauth2/google"
+	"google.golang.org/api/cloudkms/v1"
+)
+
+// A cookie-secret-kms-key names the key that the cookie secret is wrapped
+// (encrypted) with, e.g.
+//
+//	aws-kms:arn:aws:kms:us-east-1:123456789012:key/1234abcd-12ab-34cd-56ef-1234567890ab
+//	gcp-kms:projects/my-project/locations/global/keyRings/oauth2-proxy/cryptoKeys/cookie-secret
+//	azure-keyvault:https://my-vault.vault.azure.net/keys/cookie-secret/0123456789abcdef0123456789abcdef
+const (
+	awsKMSPrefix        = "aws-kms:"
+	gcpKMSPrefix        = "gcp-kms:"
+	azureKeyVaultPrefix = "azure-keyvault:"
+)
+
+// kmsTimeout bounds each request to a key management service, which are made
+// while validating the options at startup.
+const kmsTimeout = 10 * time.Second
+
+// kmsClient makes the requests to Azure Key Vault and its managed identity
+// endpoint.
+var kmsClient = &http.Client{Timeout: kmsTimeout}
+
+// azureIMDSTokenURL is the managed identity endpoint of Azure VMs, App
+// Service and AKS pod identity, used to authenticate to Key Vault.
+var azureIMDSTokenURL = "http://169.254.169.254/metadata/identity/oauth2/token?api-version=2018-02-01&resource=" +
+	url.QueryEscape("https://vault.azure.net")
+
+// wrapSecret encrypts secret with the KMS key and returns the wrapped secret
+// as base64.
+func wrapSecret(keyRef, secret, region string) (string, error) {
+	switch {
+	case strings.HasPrefix(keyRef, awsKMSPrefix):
+		id := strings.TrimPrefix(keyRef, awsKMSPrefix)
+		sess, err := awsSession(arnRegionOr(id, region))
+		if err != nil {
+			return "", err
+		}
+		out, err := kms.New(sess).Encrypt(&kms.EncryptInput{
+			KeyId:     aws.String(id),
+			Plaintext: []byte(secret),
+		})
+		if err != nil {
+			return "", err
+		}
+		return base64.StdEncoding.EncodeToString(out.CiphertextBlob), nil
+	case strings.HasPrefix(keyRef, gcpKMSPrefix):
+		keys, err := gcpCryptoKeys()
+		if err != nil {
+			return "", err
+		}
+		out, err := keys.Encrypt(strings.TrimPrefix(keyRef, gcpKMSPrefix), &cloudkms.EncryptRequest{
+			Plaintext: base64.StdEncoding.EncodeToString([]byte(secret)),
+		}).Do()
+		if err != nil {
+			return "", err
+		}
+		return out.Ciphertext, nil
+	case strings.HasPrefix(keyRef, azureKeyVaultPrefix):
+		value := base64.RawURLEncoding.EncodeToString([]byte(secret))
+		wrapped, err := azureKeyOperation(strings.TrimPrefix(keyRef, azureKeyVaultPrefix), "wrapkey", value)
+		if err != nil {
+			return "", err
+		}
+		b, err := base64.RawURLEncoding.DecodeString(wrapped)
+		if err != nil {
+			return "", err
+		}
+		return base64.StdEncoding.EncodeToString(b), nil
+	}
+	return "", fmt.Errorf("unsupported KMS key %q; must start with %s, %s or %s",
+		keyRef, awsKMSPrefix, gcpKMSPrefix, azureKeyVaultPrefix)
+}
+
+// unwrapSecret decrypts a secret wrapped by wrapSecret; it is a variable so
+// tests can replace it.
+var unwrapSecret = func(keyRef, wrapped, region string) (string, error) {
+	ciphertext, err := base64.StdEncoding.DecodeString(wrapped)
+	if err != nil {
+		return "", fmt.Errorf("wrapped secret is not base64: %s", err)
+	}
+	switch {
+	case strings.HasPrefix(keyRef, awsKMSPrefix):
+		id := strings.TrimPrefix(keyRef, awsKMSPrefix)
+		sess, err := awsSession(arnRegionOr(id, region))
+		if err != nil {
+			return "", err
+		}
+		out, err := kms.New(sess).Decrypt(&kms.DecryptInput{CiphertextBlob: ciphertext})
+		if err != nil {
+			return "", err
+		}
+		return string(out.Plaintext), nil
+	case strings.HasPrefix(keyRef, gcpKMSPrefix):
+		keys, err := gcpCryptoKeys()
+		if err != nil {
+			return "", err
+		}
+		out, err := keys.Decrypt(strings.TrimPrefix(keyRef, gcpKMSPrefix), &cloudkms.DecryptRequest{
+			Ciphertext: wrapped,
+		}).Do()
+		if err != nil {
+			return "", err
+		}
+		b, err := base64.StdEncoding.DecodeString(out.Plaintext)
+		return string(b), err
+	case strings.HasPrefix(keyRef, azureKeyVaultPrefix):
+		value := base64.RawURLEncoding.EncodeToString(ciphertext)
+		plain, err := azureKeyOperation(strings.TrimPrefix(keyRef, azureKeyVaultPrefix), "unwrapkey", value)
+		if err != nil {
+			return "", err
+		}
+		b, err := base64.RawURLEncoding.DecodeString(plain)
+		return string(b), err
+	}
+	return "", fmt.Errorf("unsupported KMS key %q; must start with %s, %s or %s",
+		keyRef, awsKMSPrefix, gcpKMSPrefix, azureKeyVaultPrefix)
+}
+
+func arnRegionOr(id, region string) string {
+	if r := arnRegion(id); r != "" {
+		return r
+	}
+	return region
+}
+
+func gcpCryptoKeys() (*cloudkms.ProjectsLocationsKeyRingsCryptoKeysService, error) {
+	client, err := google.DefaultClient(context.Background(), cloudkms.CloudPlatformScope)
+	if err != nil {
+		return nil, err
+	}
+	client.Timeout = kmsTimeout
+	svc, err := cloudkms.New(client)
+	if err != nil {
+		return nil, err
+	}
+	return svc.Projects.Locations.KeyRings.CryptoKeys, nil
+}
+
+// azureKeyOperation runs the wrapkey or unwrapkey operation of the Key Vault
+// key at keyURL with RSA-OAEP-256, authenticating with the managed identity.
+func azureKeyOperation(keyURL, operation, value string) (string, error) {
+	token, err := azureManagedIdentityToken()
+	if err != nil {
+		return "", err
+	}
+	body, _ := json.Marshal(map[string]string{"alg": "RSA-OAEP-256", "value": value})
+	req, err := http.NewRequest("POST", strings.TrimSuffix(keyURL, "/")+"/"+operation+"?api-version=7.0", bytes.NewReader(body))
+	if err != nil {
+		return "", err
+	}
+	req.Header.Set("Authorization", "Bearer "+token)
+	req.Header.Set("Content-Type", "application/json")
+	var result struct {
+		Value string `json:"value"`
+	}
+	if err := doJSON(req, &result); err != nil {
+		return "", fmt.Errorf("key vault %s: %s", operation, err)
+	}
+	return result.Value, nil
+}
+
+func azureManagedIdentityToken() (string, error) {
+	req, err := http.NewRequest("GET", azureIMDSTokenURL, nil)
+	if err != nil {
+		return "", err
+	}
+	req.Header.Set("Metadata", "true")
+	var result struct {
+		AccessToken string `json:"access_token"`
+	}
+	if err := doJSON(req, &result); err != nil {
+		return "", fmt.Errorf("managed identity token: %s", err)
+	}
+	return result.AccessToken, nil
+}
+
+func doJSON(req *http.Request, v interface{}) error {
+	resp, err := kmsClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return err
+	}
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("got %d %s", resp.StatusCode, body)
+	}
+	return json.Unmarshal(body, v)
+}
+
+func unwrapCookieSecret(o *Options, msgs []string) []string {
+	if o.CookieSecretKMSKey == "" || o.CookieSecret == "" || o.CookieSecret == o.kmsCookieSecret {
+		return msgs
+	}
+	secret, err := unwrapSecret(o.CookieSecretKMSKey, o.CookieSecret, o.AWSRegion)
+	if err != nil {
+		return append(msgs, fmt.Sprintf("unable to unwrap cookie-secret with %q: %s", o.CookieSecretKMSKey, err))
+	}
+	o.CookieSecret = strings.TrimSpace(secret)
+	o.kmsCookieSecret = o.CookieSecret
+	return msgs
+}
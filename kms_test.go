@@ -0,0 +1,75 @@
+package oauth2proxy
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestUnwrapCookieSecret(t *testing.T) {
+	orig := unwrapSecret
+	defer func() { unwrapSecret = orig }()
+	unwraps := 0
+	unwrapSecret = func(keyRef, wrapped, region string) (string, error) {
+		unwraps++
+		if keyRef == "aws-kms:alias/oauth2-proxy" && wrapped == "d3JhcHBlZA==" {
+			return "0123456789abcdefghijklmnopqrstuv\n", nil
+		}
+		return "", errors.New("InvalidCiphertextException")
+	}
+
+	o := testOptions()
+	o.CookieSecret = "d3JhcHBlZA=="
+	o.CookieSecretKMSKey = "aws-kms:alias/oauth2-proxy"
+	o.CookieRefresh = o.CookieExpire / 2
+	assert.Equal(t, nil, o.Validate())
+	assert.Equal(t, "0123456789abcdefghijklmnopqrstuv", o.CookieSecret)
+	// validating again does not unwrap the secret twice
+	assert.Equal(t, nil, o.Validate())
+	assert.Equal(t, 1, unwraps)
+
+	o = testOptions()
+	o.CookieSecret = "Zm9v"
+	o.CookieSecretKMSKey = "aws-kms:alias/oauth2-proxy"
+	err := o.Validate()
+	assert.Equal(t, errorMsg([]string{
+		"unable to unwrap cookie-secret with \"aws-kms:alias/oauth2-proxy\": InvalidCiphertextException"}), err.Error())
+}
+
+func TestAzureKeyVaultUnwrap(t *testing.T) {
+	vault := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch {
+		case r.URL.Path == "/token" && r.Header.Get("Metadata") == "true":
+			w.Write([]byte(`{"access_token": "vault_token"}`))
+		case r.URL.Path == "/keys/cookie-secret/1/unwrapkey" && r.Header.Get("Authorization") == "Bearer vault_token":
+			var body map[string]string
+			json.NewDecoder(r.Body).Decode(&body)
+			assert.Equal(t, "RSA-OAEP-256", body["alg"])
+			assert.Equal(t, base64.RawURLEncoding.EncodeToString([]byte("wrapped")), body["value"])
+			w.Write([]byte(`{"value": "` + base64.RawURLEncoding.EncodeToString([]byte("secret")) + `"}`))
+		default:
+			http.Error(w, "Forbidden", http.StatusForbidden)
+		}
+	}))
+	defer vault.Close()
+	orig := azureIMDSTokenURL
+	defer func() { azureIMDSTokenURL = orig }()
+	azureIMDSTokenURL = vault.URL + "/token"
+
+	wrapped := base64.StdEncoding.EncodeToString([]byte("wrapped"))
+	secret, err := unwrapSecret("azure-keyvault:"+vault.URL+"/keys/cookie-secret/1", wrapped, "")
+	assert.Equal(t, nil, err)
+	assert.Equal(t, "secret", secret)
+
+	_, err = unwrapSecret("azure-keyvault:"+vault.URL+"/keys/other/1", wrapped, "")
+	assert.True(t, strings.HasPrefix(err.Error(), "key vault unwrapkey: got 403"))
+
+	_, err = unwrapSecret("vault:key", wrapped, "")
+	assert.NotEqual(t, nil, err)
+}
@@ -0,0 +1,72 @@
+// Package oauth2proxy is the oauth2_proxy reverse proxy, which can also be
+// embedded in Go services: NewHandler returns the proxy for a set of
+// Options, and NewMiddleware puts authentication in front of a handler of
+// the service instead of upstreams.
+//
+// The options are the ones of the command line, and are most easily started
+// from NewOptions:
+//
+//	opts := oauth2proxy.NewOptions()
+//	opts.ClientID = "..."
+//	opts.ClientSecret = "..."
+//	opts.CookieSecret = "..."
+//	opts.EmailDomains = []string{"example.com"}
+//	auth, stop, err := oauth2proxy.NewMiddleware(opts)
+//	if err != nil {
+//		log.Fatal(err)
+//	}
+//	defer stop()
+//	http.ListenAndServe(":4180", auth(app))
+package oauth2proxy
+
+import (
+	"context"
+	"net/http"
+)
+
+// NewHandler validates opts and returns the proxy, with its background
+// refreshes started. It serves the endpoints under the proxy-prefix and
+// proxies the requests that pass authentication to the upstreams of opts.
+// Its Close stops the background refreshes.
+func NewHandler(opts *Options) (*OAuthProxy, error) {
+	if err := opts.Validate(); err != nil {
+		return nil, err
+	}
+	p, err := newOAuthProxyForOptions(opts)
+	if err != nil {
+		return nil, err
+	}
+	return p, nil
+}
+
+// nextHandlerKey is the request context key of the handler wrapped by the
+// middleware the request is served by.
+type nextHandlerKey struct{}
+
+// NewMiddleware validates opts and returns a middleware that serves the
+// endpoints under the proxy-prefix and passes the requests that pass
+// authentication to the wrapped handler instead of upstreams, which opts
+// need not have. The user's identity is passed in the request headers that
+// opts pass to upstreams, such as X-Forwarded-User and X-Forwarded-Email with
+// pass-user-headers.
+//
+// The proxy is started once, by NewMiddleware, and shared by all the
+// handlers the middleware wraps. stop stops its background refreshes, once
+// the handlers no longer serve requests.
+func NewMiddleware(opts *Options) (middleware func(http.Handler) http.Handler, stop func(), err error) {
+	if err := opts.Validate(); err != nil {
+		return nil, nil, err
+	}
+	p, err := newOAuthProxyForOptions(opts)
+	if err != nil {
+		return nil, nil, err
+	}
+	p.serveMux = http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		req.Context().Value(nextHandlerKey{}).(http.Handler).ServeHTTP(rw, req)
+	})
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+			p.ServeHTTP(rw, req.WithContext(context.WithValue(req.Context(), nextHandlerKey{}, next)))
+		})
+	}, p.Close, nil
+}
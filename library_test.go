@@ -0,0 +1,66 @@
+package oauth2proxy
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/bitly/oauth2_proxy/providers"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestNewHandlerValidatesOptions(t *testing.T) {
+	opts := NewOptions()
+	handler, err := NewHandler(opts)
+	assert.Nil(t, handler)
+	assert.Contains(t, err.Error(), "missing setting: cookie-secret")
+
+	_, _, err = NewMiddleware(opts)
+	assert.Contains(t, err.Error(), "missing setting: cookie-secret")
+}
+
+func TestNewHandlerClose(t *testing.T) {
+	handler, err := NewHandler(testOptions())
+	assert.Equal(t, nil, err)
+	handler.Close()
+	// closing again doesn't panic
+	handler.Close()
+}
+
+func TestNewMiddleware(t *testing.T) {
+	opts := testOptions()
+	opts.Upstreams = nil
+	auth, stop, err := NewMiddleware(opts)
+	assert.Equal(t, nil, err)
+	defer stop()
+	greeter := func(greeting string) http.Handler {
+		return auth(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.Write([]byte(greeting + " " + r.Header.Get("X-Forwarded-Email")))
+		}))
+	}
+	hello, bye := greeter("hello"), greeter("bye")
+	cookies := newOAuthProxy(opts, nil)
+
+	request := func(handler http.Handler, path string, session *providers.SessionState) *httptest.ResponseRecorder {
+		rw := httptest.NewRecorder()
+		req, _ := http.NewRequest("GET", path, nil)
+		if session != nil {
+			value, _ := session.EncodeSessionState(nil)
+			req.AddCookie(cookies.MakeSessionCookie(req, value, opts.CookieExpire, time.Now()))
+		}
+		handler.ServeHTTP(rw, req)
+		return rw
+	}
+
+	assert.Equal(t, 200, request(hello, "/ping", nil).Code)
+	assert.Equal(t, 403, request(hello, "/app", nil).Code)
+	jane := &providers.SessionState{User: "jane", Email: "jane@example.com"}
+	rw := request(hello, "/app", jane)
+	assert.Equal(t, 200, rw.Code)
+	assert.Equal(t, "hello jane@example.com", rw.Body.String())
+	// the wrapped handlers share the proxy, but each gets its own requests
+	rw = request(bye, "/app", jane)
+	assert.Equal(t, 200, rw.Code)
+	assert.Equal(t, "bye jane@example.com", rw.Body.String())
+}
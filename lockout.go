@@ -0,0 +1,236 @@
+package oauth2proxy
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"log"
+	"math"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/bitly/oauth2_proxy/store"
+)
+
+// maxLockoutDelay caps the back off after failed sign ins.
+const maxLockoutDelay = 30 * time.Second
+
+// lockout counts the recent sign in failures of a client address or of a
+// user from a client address.
+type lockout struct {
+	Key         string     `json:"key"`
+	Failures    int        `json:"failures"`
+	LockedUntil *time.Time `json:"locked_until,omitempty"`
+}
+
+// lockoutKey holds the number of recent failures of key; blockedKey holds
+// until when key is blocked, during the back off after a failure or the
+// lockout after lockout-threshold failures.
+func lockoutKey(key string) string {
+	return "lockout:" + strings.ToLower(key)
+}
+
+func blockedKey(key string) string {
+	return "lockout-until:" + strings.ToLower(key)
+}
+
+// userLockoutKey counts the failures of user from the client address of req,
+// so that failures elsewhere can't lock the user out.
+func (p *OAuthProxy) userLockoutKey(req *http.Request, user string) string {
+	return "user:" + user + "/" + p.clientKey(req)
+}
+
+func (p *OAuthProxy) loadLockout(key string) (*lockout, error) {
+	l := &lockout{Key: key}
+	value, err := p.lockoutStore.Get(lockoutKey(key))
+	if err == store.ErrNotFound {
+		return l, nil
+	} else if err != nil {
+		return nil, err
+	}
+	l.Failures, _ = strconv.Atoi(string(value))
+	until, err := p.blockedUntil(key)
+	if err != nil {
+		return nil, err
+	}
+	if !until.IsZero() {
+		l.LockedUntil = &until
+	}
+	return l, nil
+}
+
+// blockedUntil returns until when key is blocked, or the zero time.
+func (p *OAuthProxy) blockedUntil(key string) (time.Time, error) {
+	value, err := p.lockoutStore.Get(blockedKey(key))
+	if err == store.ErrNotFound {
+		return time.Time{}, nil
+	} else if err != nil {
+		return time.Time{}, err
+	}
+	until, _ := strconv.ParseInt(string(value), 10, 64)
+	return time.Unix(0, until), nil
+}
+
+// lockedOut returns until when the client address of req, or the user
+// signing in from it, is blocked from signing in.
+func (p *OAuthProxy) lockedOut(req *http.Request) (time.Time, bool) {
+	if p.lockoutThreshold == 0 {
+		return time.Time{}, false
+	}
+	keys := []string{p.clientKey(req)}
+	if req.Method == "POST" && req.FormValue("username") != "" {
+		keys = append(keys, p.userLockoutKey(req, req.FormValue("username")))
+	}
+	now := time.Now()
+	var blocked time.Time
+	for _, key := range keys {
+		until, err := p.blockedUntil(key)
+		if err != nil {
+			// don't turn a store outage into an outage of sign ins
+			log.Printf("%s error checking lockout %s", getRemoteAddr(req), err)
+			continue
+		}
+		if until.After(now) && until.After(blocked) {
+			blocked = until
+		}
+	}
+	return blocked, !blocked.IsZero()
+}
+
+// recordSignInFailure counts a failed sign in against the client address
+// and the user from it, if known. It blocks them for lockout-delay, doubled
+// for each previous failure, and for lockout-duration once they reach
+// lockout-threshold failures; blocked sign ins get 429 Too Many Requests.
+// The failures are counted atomically, so concurrent attempts all count.
+func (p *OAuthProxy) recordSignInFailure(req *http.Request, user string) {
+	if p.lockoutThreshold == 0 {
+		return
+	}
+	keys := []string{p.clientKey(req)}
+	if user != "" {
+		keys = append(keys, p.userLockoutKey(req, user))
+	}
+	now := time.Now()
+	for _, key := range keys {
+		failures, err := p.lockoutStore.Incr(lockoutKey(key), p.lockoutDuration)
+		if err != nil {
+			log.Printf("%s error counting sign in failure %s", getRemoteAddr(req), err)
+			continue
+		}
+		var block time.Duration
+		if failures >= int64(p.lockoutThreshold) {
+			log.Printf("%s locking out %s for %s after %d failed sign ins", getRemoteAddr(req), key, p.lockoutDuration, failures)
+			block = p.lockoutDuration
+		} else if p.lockoutDelay > 0 {
+			block = time.Duration(math.Min(
+				float64(p.lockoutDelay)*math.Pow(2, float64(failures-1)),
+				float64(maxLockoutDelay)))
+		}
+		if block == 0 {
+			continue
+		}
+		until := strconv.FormatInt(now.Add(block).UnixNano(), 10)
+		if err := p.lockoutStore.Set(blockedKey(key), []byte(until), block); err != nil {
+			log.Printf("%s error saving lockout %s", getRemoteAddr(req), err)
+		}
+	}
+}
+
+// clearSignInFailures forgets the failures of user from the client address
+// of req after a successful sign in.
+func (p *OAuthProxy) clearSignInFailures(req *http.Request, user string) {
+	if p.lockoutThreshold == 0 || user == "" {
+		return
+	}
+	if err := p.clearLockout(p.userLockoutKey(req, user)); err != nil {
+		log.Printf("error clearing lockout of %s: %s", user, err)
+	}
+}
+
+func (p *OAuthProxy) clearLockout(key string) error {
+	if err := p.lockoutStore.Del(lockoutKey(key)); err != nil {
+		return err
+	}
+	return p.lockoutStore.Del(blockedKey(key))
+}
+
+// denyLockedOut responds 429 Too Many Requests to sign ins from a locked out
+// client address or user.
+func (p *OAuthProxy) denyLockedOut(rw http.ResponseWriter, req *http.Request) bool {
+	until, ok := p.lockedOut(req)
+	if !ok {
+		return false
+	}
+	log.Printf("%s sign in blocked until %s after failed sign ins", getRemoteAddr(req), until.Format(time.RFC3339))
+	rw.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(time.Until(until).Seconds()))))
+	http.Error(rw, "Too Many Requests", http.StatusTooManyRequests)
+	return true
+}
+
+// hasToken reports whether req is authorized with token in the
+// Authorization header, either as is or as a bearer token.
+func hasToken(req *http.Request, token string) bool {
+	auth := req.Header.Get("Authorization")
+	return subtle.ConstantTimeCompare([]byte(auth), []byte(token)) == 1 ||
+		subtle.ConstantTimeCompare([]byte(auth), []byte("Bearer "+token)) == 1
+}
+
+// authorizeAdmin reports whether req may use the admin endpoints. Otherwise
+// it responds 404 Not Found if there is no admin-token, so the endpoints
+// don't exist, and 401 Unauthorized to requests without the token.
+func (p *OAuthProxy) authorizeAdmin(rw http.ResponseWriter, req *http.Request) bool {
+	if p.adminToken == "" {
+		http.NotFound(rw, req)
+		return false
+	}
+	if !hasToken(req, p.adminToken) {
+		log.Printf("%s invalid admin token", getRemoteAddr(req))
+		http.Error(rw, "Unauthorized", http.StatusUnauthorized)
+		return false
+	}
+	return true
+}
+
+// Lockouts lists the client addresses and users with recent sign in
+// failures (GET) or clears them (DELETE, for all or the given key).
+func (p *OAuthProxy) Lockouts(rw http.ResponseWriter, req *http.Request) {
+	if !p.authorizeAdmin(rw, req) {
+		return
+	}
+
+	keys, err := p.lockoutStore.Keys(lockoutKey(""))
+	if err != nil {
+		log.Printf("error listing lockouts %s", err)
+		http.Error(rw, "Internal Error", http.StatusInternalServerError)
+		return
+	}
+	switch req.Method {
+	case "GET":
+		lockouts := []*lockout{}
+		for _, key := range keys {
+			l, err := p.loadLockout(strings.TrimPrefix(key, lockoutKey("")))
+			if err == nil && l.Failures > 0 {
+				lockouts = append(lockouts, l)
+			}
+		}
+		rw.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(rw).Encode(lockouts)
+	case "DELETE":
+		if key := req.FormValue("key"); key != "" {
+			keys = []string{lockoutKey(key)}
+		}
+		for _, key := range keys {
+			key = strings.TrimPrefix(key, lockoutKey(""))
+			if err := p.clearLockout(key); err != nil {
+				log.Printf("error clearing lockout %s", err)
+				http.Error(rw, "Internal Error", http.StatusInternalServerError)
+				return
+			}
+			log.Printf("%s cleared lockout %s", getRemoteAddr(req), key)
+		}
+		rw.WriteHeader(http.StatusNoContent)
+	default:
+		http.Error(rw, "Method Not Allowed", http.StatusMethodNotAllowed)
+	}
+}
@@ -1,17 +1,16 @@
 // largely adapted from https://github.com/gorilla/handlers/blob/master/handlers.go
 // to add logging of request duration as last value (and drop referrer)
 
-package main
+package oauth2proxy
 
 import (
 	"bytes"
 	"fmt"
 	"io"
-	"io/ioutil"
-	"net"
 	"net/http"
 	"net/url"
 	"strings"
+	"sync"
 	"text/template"
 	"time"
 )
@@ -20,6 +19,13 @@ const (
 	defaultRequestLoggingFormat = "{{.Client}} - {{.Username}} [{{.Timestamp}}] {{.Host}} {{.RequestMethod}} {{.Upstream}} {{.RequestURI}} {{.Protocol}} {{.UserAgent}} {{.StatusCode}} {{.ResponseSize}} {{.RequestDuration}}"
 )
 
+// requestLogQueue is how many log lines may wait for the request logging
+// workers; beyond that, requests wait for room in the queue.
+const requestLogQueue = 1024
+
+// maxLoggedBody is how much of a request body is logged.
+const maxLoggedBody = 500
+
 // responseLogger is wrapper of http.ResponseWriter that keeps track of its HTTP status
 // code and body size
 type responseLogger struct {
@@ -90,6 +96,41 @@ type logMessageData struct {
 	Username string
 }
 
+// logEntry is a request to log: its formatted values, and the part of the
+// body that is logged, which is only put on one line when the line is
+// rendered.
+type logEntry struct {
+	data logMessageData
+	body []byte
+}
+
+// bodyCapture passes a request body on to the handler, keeping a copy of the
+// first maxLoggedBody bytes it reads.
+type bodyCapture struct {
+	io.ReadCloser
+	logged []byte
+}
+
+func (c *bodyCapture) Read(p []byte) (int, error) {
+	n, err := c.ReadCloser.Read(p)
+	if room := maxLoggedBody - len(c.logged); room > 0 {
+		if room > n {
+			room = n
+		}
+		c.logged = append(c.logged, p[:room]...)
+	}
+	return n, err
+}
+
+// captured returns the part of the body that is logged, reading it if the
+// handler didn't.
+func (c *bodyCapture) captured() []byte {
+	if len(c.logged) < maxLoggedBody {
+		io.ReadFull(c, make([]byte, maxLoggedBody-len(c.logged)))
+	}
+	return c.logged
+}
+
 // loggingHandler is the http.Handler implementation for LoggingHandlerTo and its friends
 type loggingHandler struct {
 	writer      io.Writer
@@ -97,31 +138,74 @@ type loggingHandler struct {
 	enabled     bool
 	bodyEnabled bool
 	logTemplate *template.Template
+
+	// with workers, log lines are rendered and written by a bounded pool
+	// of goroutines instead of on the request goroutine
+	mu        sync.Mutex
+	entries   chan logEntry
+	workers   sync.WaitGroup
+	done      chan bool
+	closeOnce sync.Once
 }
 
+// LoggingHandler logs the requests to h to out.
 func LoggingHandler(out io.Writer, h http.Handler, v, rbl bool, requestLoggingTpl string) http.Handler {
-	return loggingHandler{
+	return newLoggingHandler(out, h, v, rbl, requestLoggingTpl, 0)
+}
+
+// newLoggingHandler logs the requests to h to out. With workers, the log
+// lines are rendered and written in the background by that many goroutines;
+// Close then waits for the queued ones.
+func newLoggingHandler(out io.Writer, h http.Handler, v, rbl bool, requestLoggingTpl string, workers int) *loggingHandler {
+	handler := &loggingHandler{
 		writer:      out,
 		handler:     h,
 		enabled:     v,
 		bodyEnabled: rbl,
 		logTemplate: template.Must(template.New("request-log").Parse(requestLoggingTpl)),
+		done:        make(chan bool),
+	}
+	if v && workers > 0 {
+		handler.entries = make(chan logEntry, requestLogQueue)
+		for i := 0; i < workers; i++ {
+			handler.workers.Add(1)
+			go handler.work()
+		}
+	}
+	return handler
+}
+
+// work writes the queued log lines until the handler is closed, and then
+// those still queued.
+func (h *loggingHandler) work() {
+	defer h.workers.Done()
+	for {
+		select {
+		case entry := <-h.entries:
+			h.writeLogLine(entry)
+		case <-h.done:
+			for {
+				select {
+				case entry := <-h.entries:
+					h.writeLogLine(entry)
+				default:
+					return
+				}
+			}
+		}
 	}
 }
 
-func (h loggingHandler) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+func (h *loggingHandler) ServeHTTP(w http.ResponseWriter, req *http.Request) {
 	t := time.Now()
 	url := *req.URL
 
-	var body string
-	if h.enabled && h.bodyEnabled {
-		if req.Body != nil {
-			bodyBytes, err := ioutil.ReadAll(req.Body)
-			if err == nil {
-				req.Body = ioutil.NopCloser(bytes.NewBuffer(bodyBytes))
-				body = strings.Replace(strings.Trim(string(bodyBytes), "\n"), "\n", " ", -1)
-			}
-		}
+	var body *bodyCapture
+	if h.enabled && h.bodyEnabled && req.Body != nil && req.Body != http.NoBody {
+		// the body is passed on as the handler reads it, and only the part
+		// that is logged is copied
+		body = &bodyCapture{ReadCloser: req.Body}
+		req.Body = body
 	}
 
 	logger := &responseLogger{w: w}
@@ -129,14 +213,43 @@ func (h loggingHandler) ServeHTTP(w http.ResponseWriter, req *http.Request) {
 	if !h.enabled {
 		return
 	}
-	h.writeLogLine(logger.authInfo, logger.upstream, req, body, url, t, logger.Status(), logger.Size())
+	entry := logEntry{
+		data: newLogMessageData(logger.authInfo, logger.upstream, req, url, t, logger.Status(), logger.Size()),
+	}
+	if body != nil {
+		entry.body = body.captured()
+	}
+	if h.entries != nil {
+		// blocks while the queue is full, so that a burst of requests
+		// can't queue up unbounded memory; requests that are still served
+		// once the handler is closed log their own lines
+		select {
+		case h.entries <- entry:
+			return
+		case <-h.done:
+		}
+	}
+	h.writeLogLine(entry)
+}
+
+// Close waits for the log lines queued for the workers to be written.
+func (h *loggingHandler) Close() {
+	h.closeOnce.Do(func() {
+		close(h.done)
+		h.workers.Wait()
+	})
+}
+
+// logBody returns the part of a request body that is logged, on one line.
+func logBody(b []byte) string {
+	b = bytes.Trim(b, "\n")
+	return strings.Replace(string(b), "\n", " ", -1)
 }
 
 // Log entry for req similar to Apache Common Log Format.
-// rbl is a flag to specify if request body logging is enabled.
 // ts is the timestamp with which the entry should be logged.
 // status, size are used to provide the response HTTP status and size.
-func (h loggingHandler) writeLogLine(username, upstream string, req *http.Request, body string, url url.URL, ts time.Time, status int, size int) {
+func newLogMessageData(username, upstream string, req *http.Request, url url.URL, ts time.Time, status int, size int) logMessageData {
 	if username == "" {
 		username = "-"
 	}
@@ -153,32 +266,37 @@ func (h loggingHandler) writeLogLine(username, upstream string, req *http.Reques
 	if client == "" {
 		client = req.RemoteAddr
 	}
-
-	if c, _, err := net.SplitHostPort(client); err == nil {
-		client = c
-	}
-
-	if len(body) > 500 {
-		body = body[:500]
-	}
+	client = normalizeIP(client)
 
 	duration := float64(time.Now().Sub(ts)) / float64(time.Second)
 
-	h.logTemplate.Execute(h.writer, logMessageData{
+	return logMessageData{
 		Client:          client,
 		Host:            req.Host,
 		Protocol:        req.Proto,
 		RequestDuration: fmt.Sprintf("%0.3f", duration),
 		RequestMethod:   req.Method,
 		RequestURI:      fmt.Sprintf("%q", url.RequestURI()),
-		RequestBody:     body,
 		ResponseSize:    fmt.Sprintf("%d", size),
 		StatusCode:      fmt.Sprintf("%d", status),
 		Timestamp:       ts.Format("02/Jan/2006:15:04:05 -0700"),
 		Upstream:        upstream,
 		UserAgent:       fmt.Sprintf("%q", req.UserAgent()),
 		Username:        username,
-	})
+	}
+}
 
-	h.writer.Write([]byte("\n"))
+// writeLogLine renders the log line of entry into a pooled buffer and writes
+// it at once, so that lines written by several workers don't interleave.
+func (h *loggingHandler) writeLogLine(entry logEntry) {
+	if entry.body != nil {
+		entry.data.RequestBody = logBody(entry.body)
+	}
+	buf := getBuffer()
+	h.logTemplate.Execute(buf, entry.data)
+	buf.WriteByte('\n')
+	h.mu.Lock()
+	h.writer.Write(buf.Bytes())
+	h.mu.Unlock()
+	putBuffer(buf)
 }
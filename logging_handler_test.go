@@ -1,10 +1,13 @@
-package main
+package oauth2proxy
 
 import (
 	"bytes"
 	"fmt"
+	"io/ioutil"
 	"net/http"
 	"net/http/httptest"
+	"strings"
+	"sync"
 	"testing"
 	"time"
 )
@@ -40,3 +43,64 @@ func TestLoggingHandler_ServeHTTP(t *testing.T) {
 		}
 	}
 }
+
+func TestLoggingHandlerWorkers(t *testing.T) {
+	buf := bytes.NewBuffer(nil)
+	handler := func(w http.ResponseWriter, req *http.Request) {
+		ioutil.ReadAll(req.Body)
+		w.Write([]byte("test"))
+	}
+	h := newLoggingHandler(buf, http.HandlerFunc(handler), true, true, "{{.RequestMethod}} {{.RequestURI}} {{.RequestBody}}", 4)
+
+	var wg sync.WaitGroup
+	for i := 0; i < 100; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			r, _ := http.NewRequest("POST", fmt.Sprintf("/foo/%d", i), strings.NewReader("a=1\nb=2\n"))
+			h.ServeHTTP(httptest.NewRecorder(), r)
+		}(i)
+	}
+	wg.Wait()
+	h.Close()
+
+	lines := strings.Split(strings.TrimSuffix(buf.String(), "\n"), "\n")
+	if len(lines) != 100 {
+		t.Fatalf("%d log lines instead of 100", len(lines))
+	}
+	for _, line := range lines {
+		if !strings.HasPrefix(line, "POST \"/foo/") || !strings.HasSuffix(line, "\" a=1 b=2") {
+			t.Errorf("unexpected log line %q", line)
+		}
+	}
+}
+
+func TestLoggingHandlerBody(t *testing.T) {
+	buf := bytes.NewBuffer(nil)
+	var read string
+	handler := func(w http.ResponseWriter, req *http.Request) {
+		b, _ := ioutil.ReadAll(req.Body)
+		read = string(b)
+	}
+	h := newLoggingHandler(buf, http.HandlerFunc(handler), true, true, "{{.RequestBody}}", 1)
+	body := strings.Repeat("x", 1000)
+	r, _ := http.NewRequest("POST", "/", strings.NewReader(body))
+	h.ServeHTTP(httptest.NewRecorder(), r)
+	h.Close()
+	// the handler gets the whole body, the log only its start
+	if read != body {
+		t.Errorf("handler read %d bytes instead of %d", len(read), len(body))
+	}
+	if buf.String() != body[:maxLoggedBody]+"\n" {
+		t.Errorf("logged %d bytes instead of %d", buf.Len()-1, maxLoggedBody)
+	}
+
+	// requests after Close are logged on their own goroutine
+	buf.Reset()
+	r, _ = http.NewRequest("POST", "/", strings.NewReader("a=1"))
+	h.ServeHTTP(httptest.NewRecorder(), r)
+	h.Close()
+	if buf.String() != "a=1\n" {
+		t.Errorf("unexpected log line %q", buf.String())
+	}
+}
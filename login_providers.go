@@ -0,0 +1,274 @@
+package oauth2proxy
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/url"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/bitly/oauth2_proxy/cookie"
+	"github.com/bitly/oauth2_proxy/providers"
+)
+
+// defaultLoginProvider names the provider configured with -provider among
+// the login providers.
+const defaultLoginProvider = "default"
+
+// lastProviderExpiration is how long a browser remembers the provider it
+// signed in with last.
+const lastProviderExpiration = 365 * 24 * time.Hour
+
+var loginProviderNameRegex = regexp.MustCompile(`^[a-z0-9][a-z0-9_-]*$`)
+
+// A loginProvider is offered on the sign in page when users may sign in
+// with one of several providers.
+type loginProvider struct {
+	Name     string
+	Label    string
+	IconURL  string
+	provider providers.Provider
+}
+
+// parseLoginProviders configures the providers offered on the sign in page
+// besides -provider. Each login-provider has the form
+// name=provider:client-id:client-secret-file and uses the default endpoints of
+// the provider; login-provider-label and login-provider-icon set the
+// name=label and name=icon-url shown for it (or for "default").
+func parseLoginProviders(o *Options, msgs []string) []string {
+	o.loginProviders = nil
+	if len(o.LoginProviders) == 0 {
+		if len(o.LoginProviderLabels) != 0 || len(o.LoginProviderIcons) != 0 || len(o.LoginProviderOrder) != 0 {
+			msgs = append(msgs, "login-provider-label, login-provider-icon and login-provider-order require login-provider")
+		}
+		return msgs
+	}
+	if len(o.HostProviders) != 0 {
+		msgs = append(msgs, "login-provider cannot be used with host-provider")
+	}
+
+	byName := map[string]*loginProvider{
+		defaultLoginProvider: {Name: defaultLoginProvider, provider: o.provider},
+	}
+	order := []string{defaultLoginProvider}
+	for _, lp := range o.LoginProviders {
+		s := strings.SplitN(lp, "=", 2)
+		var c []string
+		if len(s) == 2 {
+			c = strings.SplitN(s[1], ":", 3)
+		}
+		if len(c) != 3 || !loginProviderNameRegex.MatchString(s[0]) || c[1] == "" || c[2] == "" {
+			msgs = append(msgs, fmt.Sprintf("invalid login-provider %q; expected name=provider:client-id:client-secret-file", lp))
+			continue
+		}
+		name := s[0]
+		if c[0] == "oidc" {
+			msgs = append(msgs, fmt.Sprintf("invalid login-provider %q; oidc is only supported as -provider", lp))
+			continue
+		}
+		if _, ok := byName[name]; ok {
+			msgs = append(msgs, fmt.Sprintf("duplicate login-provider %q", name))
+			continue
+		}
+		var secret string
+		if secret, msgs = readProviderSecretFile("login-provider", lp, c[2], msgs); secret == "" {
+			continue
+		}
+		var provider providers.Provider
+		provider, msgs = configureProvider(o, c[0], defaultEndpointsData(o, c[1], secret), msgs)
+		byName[name] = &loginProvider{Name: name, provider: provider}
+		order = append(order, name)
+	}
+
+	for _, spec := range []struct {
+		flag   string
+		values []string
+		set    func(*loginProvider, string)
+	}{
+		{"login-provider-label", o.LoginProviderLabels, func(lp *loginProvider, v string) { lp.Label = v }},
+		{"login-provider-icon", o.LoginProviderIcons, func(lp *loginProvider, v string) { lp.IconURL = v }},
+	} {
+		for _, value := range spec.values {
+			s := strings.SplitN(value, "=", 2)
+			if len(s) != 2 || s[1] == "" {
+				msgs = append(msgs, fmt.Sprintf("invalid %s %q; expected name=value", spec.flag, value))
+				continue
+			}
+			lp, ok := byName[s[0]]
+			if !ok {
+				msgs = append(msgs, fmt.Sprintf("invalid %s %q; unknown login-provider %q", spec.flag, value, s[0]))
+				continue
+			}
+			spec.set(lp, s[1])
+		}
+	}
+
+	// providers missing from login-provider-order follow those in it
+	seen := make(map[string]bool)
+	for _, name := range o.LoginProviderOrder {
+		if _, ok := byName[name]; !ok {
+			msgs = append(msgs, fmt.Sprintf("invalid login-provider-order; unknown login-provider %q", name))
+			continue
+		}
+		if !seen[name] {
+			seen[name] = true
+			o.loginProviders = append(o.loginProviders, byName[name])
+		}
+	}
+	for _, name := range order {
+		if !seen[name] {
+			o.loginProviders = append(o.loginProviders, byName[name])
+		}
+	}
+
+	for _, lp := range o.loginProviders {
+		if lp.Label == "" && lp.provider != nil {
+			lp.Label = lp.provider.Data().ProviderName
+		}
+		if lp.IconURL != "" && !validURL(lp.IconURL) {
+			msgs = append(msgs, fmt.Sprintf("invalid login-provider-icon for %q; must be an http(s) URL or a path", lp.Name))
+		}
+	}
+	return msgs
+}
+
+// defaultEndpointsData returns the settings of a provider that uses its
+// default endpoints with the given client.
+func defaultEndpointsData(o *Options, clientID, clientSecret string) *providers.ProviderData {
+	return &providers.ProviderData{
+		Scope:             o.Scope,
+		ClientID:          clientID,
+		ClientSecret:      clientSecret,
+		Prompt:            o.Prompt,
+		MaxAge:            o.MaxAge,
+		LoginURL:          &url.URL{},
+		RedeemURL:         &url.URL{},
+		ProfileURL:        &url.URL{},
+		ValidateURL:       &url.URL{},
+		ProtectedResource: &url.URL{},
+	}
+}
+
+// validURL reports whether u is an absolute http(s) URL or a path, as for
+// images and links on the built-in pages.
+func validURL(u string) bool {
+	parsed, err := url.Parse(u)
+	if err != nil {
+		return false
+	}
+	if parsed.Scheme == "http" || parsed.Scheme == "https" {
+		return parsed.Host != ""
+	}
+	return parsed.Scheme == "" && parsed.Host == "" && strings.HasPrefix(parsed.Path, "/")
+}
+
+// imageOrigin returns the origin an image is loaded from, if it is not
+// served by the proxy.
+func imageOrigin(u string) string {
+	parsed, err := url.Parse(u)
+	if err != nil || parsed.Host == "" {
+		return ""
+	}
+	return parsed.Scheme + "://" + parsed.Host
+}
+
+func (p *OAuthProxy) loginProvider(name string) *loginProvider {
+	for _, lp := range p.loginProviders {
+		if lp.Name == name {
+			return lp
+		}
+	}
+	return nil
+}
+
+type providerContextKey struct{}
+
+// withLoginProvider selects the login provider name for the rest of the
+// handling of req, e.g. for the callback of an OAuth flow started with it.
+func withLoginProvider(req *http.Request, name string) *http.Request {
+	return req.WithContext(context.WithValue(req.Context(), providerContextKey{}, name))
+}
+
+// loginProviderFor returns the login provider selected for req, or else the
+// one the browser signed in with last, if any.
+func (p *OAuthProxy) loginProviderFor(req *http.Request) *loginProvider {
+	if len(p.loginProviders) == 0 {
+		return nil
+	}
+	if name, ok := req.Context().Value(providerContextKey{}).(string); ok {
+		return p.loginProvider(name)
+	}
+	return p.loginProvider(p.lastLoginProvider(req))
+}
+
+func (p *OAuthProxy) lastProviderCookieName() string {
+	return p.CookieName + "_provider"
+}
+
+// lastLoginProvider returns the name of the login provider the browser
+// signed in with last.
+func (p *OAuthProxy) lastLoginProvider(req *http.Request) string {
+	c, err := req.Cookie(p.lastProviderCookieName())
+	if err != nil {
+		return ""
+	}
+	name, _, ok := cookie.Validate(c, p.CookieSeed, lastProviderExpiration)
+	if !ok {
+		return ""
+	}
+	return name
+}
+
+// setLastLoginProvider remembers the login provider the browser signed in
+// with, which then handles its session.
+func (p *OAuthProxy) setLastLoginProvider(rw http.ResponseWriter, req *http.Request, name string) {
+	if len(p.loginProviders) == 0 {
+		return
+	}
+	now := time.Now()
+	value := cookie.SignedValue(p.CookieSeed, p.lastProviderCookieName(), name, now)
+	http.SetCookie(rw, p.makeCookie(req, p.lastProviderCookieName(), value, lastProviderExpiration, now))
+}
+
+// choosingProvider reports whether the user asked to choose a login provider
+// instead of the one the browser signed in with last.
+func choosingProvider(req *http.Request) bool {
+	return req.FormValue("choose_provider") != ""
+}
+
+// rememberedLoginProvider returns the login provider the browser signed in
+// with last, unless the user asked to choose another. The sign in page only
+// offers this one, and skip-provider-button starts it right away.
+func (p *OAuthProxy) rememberedLoginProvider(req *http.Request) *loginProvider {
+	if choosingProvider(req) {
+		return nil
+	}
+	return p.loginProvider(p.lastLoginProvider(req))
+}
+
+// providerButton is a login provider on the sign in page.
+type providerButton struct {
+	Name    string
+	Label   string
+	IconURL string
+}
+
+// providerButtons returns the login providers offered on the sign in page:
+// just the remembered one, if any (and remembered is true).
+func (p *OAuthProxy) providerButtons(req *http.Request) (buttons []providerButton, remembered bool) {
+	offered := p.loginProviders
+	if lp := p.rememberedLoginProvider(req); lp != nil {
+		offered = []*loginProvider{lp}
+		remembered = true
+	}
+	for _, lp := range offered {
+		buttons = append(buttons, providerButton{
+			Name:    lp.Name,
+			Label:   lp.Label,
+			IconURL: lp.IconURL,
+		})
+	}
+	return buttons, remembered
+}
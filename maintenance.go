@@ -0,0 +1,338 @@
+package oauth2proxy
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/bitly/oauth2_proxy/providers"
+	"github.com/bitly/oauth2_proxy/store"
+)
+
+// maintenanceFileRefresh is how often the maintenance-file is checked.
+const maintenanceFileRefresh = 5 * time.Second
+
+// maintenanceRetryAfter is the Retry-After of maintenance responses, in
+// seconds.
+const maintenanceRetryAfter = 300
+
+// The message of the maintenance mode switched on with the admin endpoint is
+// kept under maintenanceKey in the session store until it's switched off.
+const (
+	maintenanceKey        = "maintenance"
+	maintenanceExpiration = 365 * 24 * time.Hour
+)
+
+// denyMaintenance is the reason /oauth2/auth denies requests in maintenance
+// mode with.
+const denyMaintenance = "maintenance"
+
+// A maintenanceMode responds to the requests for upstreams with a 503
+// maintenance page while the maintenance-file exists or maintenance was
+// switched on with the admin endpoint. The proxy's own endpoints, such as
+// /ping, the admin endpoints and sign in and out, keep working, and clients
+// in maintenance-allow-cidr and users in maintenance-allow-user or
+// maintenance-allow-group still get through, e.g. to check a deployment
+// before it is opened up again. With a session store, the admin endpoint
+// switches all replicas.
+type maintenanceMode struct {
+	path        string
+	allowNets   []*net.IPNet
+	allowUsers  []string
+	allowGroups []string
+	store       store.Store
+
+	mu       sync.RWMutex
+	fileOn   bool
+	fileMsg  string
+	adminOn  bool
+	adminMsg string
+}
+
+// maintenanceStatus is the state reported by the maintenance admin endpoint.
+type maintenanceStatus struct {
+	Enabled bool   `json:"enabled"`
+	File    bool   `json:"file"`
+	Admin   bool   `json:"admin"`
+	Message string `json:"message,omitempty"`
+}
+
+// parseMaintenance sets up maintenance mode if a maintenance-file or an
+// admin-token to switch it on with is given. The file need not exist yet.
+// It must run after parseSessionStore.
+func parseMaintenance(o *Options, msgs []string) []string {
+	o.maintenance = nil
+	var nets []*net.IPNet
+	nets, msgs = parseCIDRs(o.MaintenanceAllowCIDRs, "maintenance-allow-cidr", msgs)
+	if o.MaintenanceFile == "" && o.AdminToken == "" {
+		if len(nets) != 0 || len(o.MaintenanceAllowUsers) != 0 || len(o.MaintenanceAllowGroups) != 0 {
+			msgs = append(msgs, "maintenance-allow-cidr, maintenance-allow-user and maintenance-allow-group require maintenance-file or admin-token")
+		}
+		return msgs
+	}
+	m := &maintenanceMode{path: o.MaintenanceFile, allowNets: nets, store: o.sessionStore}
+	for _, u := range o.MaintenanceAllowUsers {
+		m.allowUsers = append(m.allowUsers, strings.ToLower(strings.TrimSpace(u)))
+	}
+	for _, g := range o.MaintenanceAllowGroups {
+		m.allowGroups = append(m.allowGroups, strings.TrimSpace(g))
+	}
+	if err := m.loadFile(); err != nil {
+		return append(msgs, fmt.Sprintf("error reading maintenance-file %q: %s", o.MaintenanceFile, err))
+	}
+	o.maintenance = m
+	return msgs
+}
+
+// load re-reads the maintenance-file and the maintenance mode switched on
+// by the admin endpoint of any replica.
+func (m *maintenanceMode) load() error {
+	if err := m.loadFile(); err != nil {
+		return fmt.Errorf("error reading maintenance-file %s: %s", m.path, err)
+	}
+	if err := m.loadAdmin(); err != nil {
+		return fmt.Errorf("error reading maintenance mode from the session store: %s", err)
+	}
+	return nil
+}
+
+// loadFile checks whether the maintenance-file exists and re-reads the
+// message in it.
+func (m *maintenanceMode) loadFile() error {
+	if m.path == "" {
+		return nil
+	}
+	data, err := ioutil.ReadFile(m.path)
+	on := err == nil
+	if os.IsNotExist(err) {
+		err = nil
+	} else if err != nil {
+		return err
+	} else if len(data) > maxBannerMessageBytes {
+		return fmt.Errorf("larger than %d bytes", maxBannerMessageBytes)
+	}
+	m.mu.Lock()
+	changed := on != m.fileOn
+	m.fileOn, m.fileMsg = on, strings.TrimSpace(string(data))
+	m.mu.Unlock()
+	if changed && on {
+		log.Printf("maintenance mode on: %s exists", m.path)
+	} else if changed {
+		log.Printf("maintenance mode off: %s removed", m.path)
+	}
+	return nil
+}
+
+// loadAdmin reads the maintenance mode switched on by the admin endpoint
+// from the session store.
+func (m *maintenanceMode) loadAdmin() error {
+	if m.store == nil {
+		return nil
+	}
+	data, err := m.store.Get(maintenanceKey)
+	on := err == nil
+	if err == store.ErrNotFound {
+		err = nil
+	} else if err != nil {
+		return err
+	}
+	m.mu.Lock()
+	changed := on != m.adminOn
+	m.adminOn, m.adminMsg = on, string(data)
+	m.mu.Unlock()
+	if changed && on {
+		log.Printf("maintenance mode on: switched on at the admin endpoint")
+	} else if changed {
+		log.Printf("maintenance mode off: switched off at the admin endpoint")
+	}
+	return nil
+}
+
+// RefreshEvery checks the maintenance-file and the session store at interval
+// until done is closed; errors keep the previous state.
+func (m *maintenanceMode) RefreshEvery(interval time.Duration, done <-chan bool) {
+	if m.path == "" && m.store == nil {
+		return
+	}
+	ticker := time.NewTicker(interval)
+	go func() {
+		defer ticker.Stop()
+		if err := m.loadAdmin(); err != nil {
+			log.Printf("error reading maintenance mode from the session store: %s", err)
+		}
+		for {
+			select {
+			case <-done:
+				return
+			case <-ticker.C:
+				if err := m.load(); err != nil {
+					log.Print(err)
+				}
+			}
+		}
+	}()
+}
+
+// Status returns whether maintenance mode is on, and why.
+func (m *maintenanceMode) Status() maintenanceStatus {
+	if m == nil {
+		return maintenanceStatus{}
+	}
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	s := maintenanceStatus{Enabled: m.fileOn || m.adminOn, File: m.fileOn, Admin: m.adminOn}
+	if m.adminOn && m.adminMsg != "" {
+		s.Message = m.adminMsg
+	} else if m.fileOn {
+		s.Message = m.fileMsg
+	}
+	return s
+}
+
+// set switches maintenance mode on or off with the admin endpoint; the
+// maintenance-file keeps it on while it exists. Other replicas follow when
+// they next check the session store.
+func (m *maintenanceMode) set(on bool, message string) error {
+	if m.store != nil {
+		var err error
+		if on {
+			err = m.store.Set(maintenanceKey, []byte(message), maintenanceExpiration)
+		} else {
+			err = m.store.Del(maintenanceKey)
+		}
+		if err != nil {
+			return err
+		}
+	}
+	m.mu.Lock()
+	m.adminOn, m.adminMsg = on, message
+	m.mu.Unlock()
+	return nil
+}
+
+// allowsUsers reports whether some users still get through, so that users
+// have to sign in to be let through or not.
+func (m *maintenanceMode) allowsUsers() bool {
+	return m != nil && (len(m.allowUsers) != 0 || len(m.allowGroups) != 0)
+}
+
+// blocks reports whether req, from the user of session if signed in, gets
+// the maintenance page instead of its upstream.
+func (m *maintenanceMode) blocks(req *http.Request, session *providers.SessionState) bool {
+	if !m.Status().Enabled {
+		return false
+	}
+	if ip := net.ParseIP(clientIP(req)); ip != nil {
+		for _, n := range m.allowNets {
+			if n.Contains(ip) {
+				return false
+			}
+		}
+	}
+	if session == nil {
+		return true
+	}
+	user := session.Email
+	if user == "" {
+		user = session.User
+	}
+	user = strings.ToLower(user)
+	for _, allowed := range m.allowUsers {
+		if user != "" && (user == allowed || (strings.HasPrefix(allowed, "@") && strings.HasSuffix(user, allowed))) {
+			return false
+		}
+	}
+	return !inGroups(session.Groups, m.allowGroups)
+}
+
+// serveUpstream proxies req to its upstream, recording the status code and
+// latency of the response, or responds with the maintenance page. session
+// is that of the signed in user, if any.
+func (p *OAuthProxy) serveUpstream(rw http.ResponseWriter, req *http.Request, session *providers.SessionState) {
+	if p.maintenance.blocks(req, session) {
+		p.MaintenancePage(rw, req)
+		return
+	}
+	start := time.Now()
+	w := &metricsWriter{ResponseWriter: rw}
+	p.serveMux.ServeHTTP(w, req)
+	w.record(http.StatusOK)
+	p.requestMetrics.observe(w.upstream, w.status, time.Since(start))
+}
+
+// MaintenancePage responds 503 Service Unavailable with the maintenance.html
+// page.
+func (p *OAuthProxy) MaintenancePage(rw http.ResponseWriter, req *http.Request) {
+	nonce := p.setContentSecurityPolicy(rw)
+	rw.Header().Set("Retry-After", fmt.Sprint(maintenanceRetryAfter))
+	rw.WriteHeader(http.StatusServiceUnavailable)
+	t := struct {
+		Title       string
+		Message     string
+		ProxyPrefix string
+		CSPNonce    string
+		Brand       branding
+	}{
+		Title:       "503 Down for Maintenance",
+		Message:     p.maintenance.Status().Message,
+		ProxyPrefix: p.ProxyPrefix,
+		CSPNonce:    nonce,
+		Brand:       p.brand,
+	}
+	p.executeTemplate(rw, req, "maintenance.html", t)
+}
+
+// maintenanceDenied tells requests of /oauth2/auth that the upstreams are
+// down for maintenance, with 403 Forbidden like other denials, as nginx
+// treats any other status of the subrequest as an error.
+func maintenanceDenied(rw http.ResponseWriter) {
+	rw.Header().Set(deniedReasonHeader, denyMaintenance)
+	rw.Header().Set("Retry-After", fmt.Sprint(maintenanceRetryAfter))
+	http.Error(rw, "Forbidden: down for maintenance", http.StatusForbidden)
+}
+
+// Maintenance reports whether maintenance mode is on (GET), switches it on
+// with an optional message (PUT or POST) or switches it off (DELETE).
+func (p *OAuthProxy) Maintenance(rw http.ResponseWriter, req *http.Request) {
+	if p.maintenance == nil {
+		http.NotFound(rw, req)
+		return
+	}
+	if !p.authorizeAdmin(rw, req) {
+		return
+	}
+	switch req.Method {
+	case "GET":
+	case "PUT", "POST":
+		message := strings.TrimSpace(req.FormValue("message"))
+		if len(message) > maxBannerMessageBytes {
+			http.Error(rw, "Message Too Long", http.StatusBadRequest)
+			return
+		}
+		if err := p.maintenance.set(true, message); err != nil {
+			log.Printf("%s error switching maintenance mode on %s", getRemoteAddr(req), err)
+			http.Error(rw, "Internal Error", http.StatusInternalServerError)
+			return
+		}
+		log.Printf("%s switched maintenance mode on", getRemoteAddr(req))
+	case "DELETE":
+		if err := p.maintenance.set(false, ""); err != nil {
+			log.Printf("%s error switching maintenance mode off %s", getRemoteAddr(req), err)
+			http.Error(rw, "Internal Error", http.StatusInternalServerError)
+			return
+		}
+		log.Printf("%s switched maintenance mode off", getRemoteAddr(req))
+	default:
+		http.Error(rw, "Method Not Allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	rw.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(rw).Encode(p.maintenance.Status())
+}
@@ -0,0 +1,164 @@
+package oauth2proxy
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/bitly/oauth2_proxy/providers"
+	"github.com/bitly/oauth2_proxy/store"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestMaintenanceOptions(t *testing.T) {
+	o := testOptions()
+	o.MaintenanceAllowUsers = []string{"admin@example.com"}
+	assert.Equal(t, errorMsg([]string{
+		"maintenance-allow-cidr, maintenance-allow-user and maintenance-allow-group require maintenance-file or admin-token",
+	}), o.Validate().Error())
+
+	o = testOptions()
+	o.AdminToken = "token"
+	o.MaintenanceAllowCIDRs = []string{"10.0.0.0/8", "10.0.0"}
+	assert.Equal(t, errorMsg([]string{
+		`invalid maintenance-allow-cidr "10.0.0"`,
+	}), o.Validate().Error())
+
+	o = testOptions()
+	assert.Equal(t, nil, o.Validate())
+	assert.Equal(t, (*maintenanceMode)(nil), o.maintenance)
+}
+
+func TestMaintenanceFile(t *testing.T) {
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("upstream"))
+	}))
+	defer upstream.Close()
+	dir, _ := ioutil.TempDir("", "maintenance")
+	defer os.RemoveAll(dir)
+	file := filepath.Join(dir, "maintenance")
+
+	opts := testOptions()
+	opts.Upstreams = []string{upstream.URL}
+	opts.MaintenanceFile = file
+	opts.MaintenanceAllowCIDRs = []string{"10.0.0.0/8"}
+	opts.MaintenanceAllowUsers = []string{"admin@example.com"}
+	opts.MaintenanceAllowGroups = []string{"release-managers"}
+	assert.Equal(t, nil, opts.Validate())
+	proxy := newOAuthProxy(opts, func(string) bool { return true })
+
+	request := func(path, email, remoteAddr string, groups ...string) *httptest.ResponseRecorder {
+		rw := httptest.NewRecorder()
+		req, _ := http.NewRequest("GET", path, nil)
+		req.RemoteAddr = remoteAddr
+		if email != "" {
+			value, _ := (&providers.SessionState{Email: email, Groups: groups}).EncodeSessionState(nil)
+			req.AddCookie(proxy.MakeSessionCookie(req, value, opts.CookieExpire, time.Now()))
+		}
+		proxy.ServeHTTP(rw, req)
+		return rw
+	}
+
+	rw := request("/app", "jane@example.com", "192.0.2.1:1234")
+	assert.Equal(t, 200, rw.Code)
+	assert.Equal(t, "upstream", rw.Body.String())
+
+	ioutil.WriteFile(file, []byte("Back at 10:00 UTC\n"), 0644)
+	assert.Equal(t, nil, opts.maintenance.load())
+	rw = request("/app", "jane@example.com", "192.0.2.1:1234")
+	assert.Equal(t, 503, rw.Code)
+	assert.Equal(t, "300", rw.Header().Get("Retry-After"))
+	assert.Contains(t, rw.Body.String(), "Back at 10:00 UTC")
+
+	// allowed users and clients still get through, the proxy's own endpoints
+	// keep working
+	assert.Equal(t, 200, request("/app", "admin@example.com", "192.0.2.1:1234").Code)
+	assert.Equal(t, 200, request("/app", "jane@example.com", "192.0.2.1:1234", "release-managers").Code)
+	assert.Equal(t, 503, request("/app", "jane@example.com", "192.0.2.1:1234", "developers").Code)
+	assert.Equal(t, 200, request("/app", "jane@example.com", "10.1.2.3:1234").Code)
+
+	// /oauth2/auth denies with 403, which nginx accepts from auth_request
+	rw = request("/oauth2/auth", "jane@example.com", "192.0.2.1:1234")
+	assert.Equal(t, 403, rw.Code)
+	assert.Equal(t, "maintenance", rw.Header().Get("X-Auth-Request-Denied-Reason"))
+	assert.Equal(t, 202, request("/oauth2/auth", "jane@example.com", "192.0.2.1:1234", "release-managers").Code)
+	assert.Equal(t, 200, request("/ping", "", "192.0.2.1:1234").Code)
+	assert.Equal(t, 200, request("/oauth2/sign_in", "", "192.0.2.1:1234").Code)
+
+	os.Remove(file)
+	assert.Equal(t, nil, opts.maintenance.load())
+	assert.Equal(t, 200, request("/app", "jane@example.com", "192.0.2.1:1234").Code)
+}
+
+func TestMaintenanceEndpoint(t *testing.T) {
+	opts := testOptions()
+	opts.AdminToken = "token"
+	assert.Equal(t, nil, opts.Validate())
+	proxy := newOAuthProxy(opts, func(string) bool { return true })
+
+	request := func(method, path, token string) *httptest.ResponseRecorder {
+		rw := httptest.NewRecorder()
+		req, _ := http.NewRequest(method, path, strings.NewReader("message=Upgrading"))
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		if token != "" {
+			req.Header.Set("Authorization", "Bearer "+token)
+		}
+		proxy.ServeHTTP(rw, req)
+		return rw
+	}
+
+	assert.Equal(t, 401, request("PUT", "/oauth2/admin/maintenance", "wrong").Code)
+	assert.Equal(t, false, proxy.maintenance.Status().Enabled)
+
+	rw := request("PUT", "/oauth2/admin/maintenance", "token")
+	assert.Equal(t, 200, rw.Code)
+	var status maintenanceStatus
+	json.Unmarshal(rw.Body.Bytes(), &status)
+	assert.Equal(t, maintenanceStatus{Enabled: true, Admin: true, Message: "Upgrading"}, status)
+
+	// without allowed users, there is no need to sign in first
+	rw = request("GET", "/app", "")
+	assert.Equal(t, 503, rw.Code)
+	assert.Contains(t, rw.Body.String(), "Upgrading")
+
+	assert.Equal(t, 200, request("DELETE", "/oauth2/admin/maintenance", "token").Code)
+	assert.Equal(t, false, proxy.maintenance.Status().Enabled)
+	assert.Equal(t, 403, request("GET", "/app", "").Code)
+}
+
+func TestMaintenanceEndpointSwitchesAllReplicas(t *testing.T) {
+	shared := store.NewMemoryStore()
+	newProxy := func() *OAuthProxy {
+		opts := testOptions()
+		opts.AdminToken = "token"
+		assert.Equal(t, nil, opts.Validate())
+		opts.maintenance.store = shared
+		return newOAuthProxy(opts, func(string) bool { return true })
+	}
+	replica1, replica2 := newProxy(), newProxy()
+
+	rw := httptest.NewRecorder()
+	req, _ := http.NewRequest("PUT", "/oauth2/admin/maintenance", strings.NewReader("message=Upgrading"))
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	req.Header.Set("Authorization", "Bearer token")
+	replica1.ServeHTTP(rw, req)
+	assert.Equal(t, 200, rw.Code)
+
+	assert.Equal(t, false, replica2.maintenance.Status().Enabled)
+	assert.Equal(t, nil, replica2.maintenance.load())
+	assert.Equal(t, maintenanceStatus{Enabled: true, Admin: true, Message: "Upgrading"}, replica2.maintenance.Status())
+
+	rw = httptest.NewRecorder()
+	req, _ = http.NewRequest("DELETE", "/oauth2/admin/maintenance", nil)
+	req.Header.Set("Authorization", "Bearer token")
+	replica2.ServeHTTP(rw, req)
+	assert.Equal(t, 200, rw.Code)
+	assert.Equal(t, nil, replica1.maintenance.load())
+	assert.Equal(t, false, replica1.maintenance.Status().Enabled)
+}
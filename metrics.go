@@ -0,0 +1,132 @@
+package oauth2proxy
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// A metricsCollector writes its metrics as of now.
+type metricsCollector interface {
+	collect(w *promWriter, now time.Time)
+}
+
+// metricsRegistry serves the metrics of its collectors, the request,
+// refresh, session and security event metrics of a proxy, in the Prometheus
+// text format.
+type metricsRegistry struct {
+	collectors []metricsCollector
+}
+
+func newMetricsRegistry(collectors ...metricsCollector) *metricsRegistry {
+	return &metricsRegistry{collectors: collectors}
+}
+
+func (r *metricsRegistry) register(c metricsCollector) {
+	r.collectors = append(r.collectors, c)
+}
+
+// write writes the metrics of all the collectors as of now.
+func (r *metricsRegistry) write(w io.Writer, now time.Time) {
+	pw := &promWriter{w: w}
+	for _, c := range r.collectors {
+		c.collect(pw, now)
+	}
+}
+
+func (r *metricsRegistry) ServeHTTP(rw http.ResponseWriter, req *http.Request) {
+	rw.Header().Set("Content-Type", "text/plain; version=0.0.4")
+	r.write(rw, time.Now())
+}
+
+// promWriter writes metrics in the Prometheus text format.
+type promWriter struct {
+	w io.Writer
+}
+
+// family starts the metric name of type typ, e.g. counter, with its help.
+func (p *promWriter) family(name, typ, help string) {
+	fmt.Fprintf(p.w, "# HELP %s %s\n# TYPE %s %s\n", name, help, name, typ)
+}
+
+// sample writes a sample of the metric name with labels, given as pairs of
+// label names and values.
+func (p *promWriter) sample(name string, value interface{}, labels ...string) {
+	fmt.Fprintf(p.w, "%s%s %v\n", name, formatLabels(labels), value)
+}
+
+// histogram writes the series of the histogram h of the metric name with
+// labels.
+func (p *promWriter) histogram(name string, h *histogram, labels ...string) {
+	// the full slice expression makes append copy the labels
+	labels = labels[:len(labels):len(labels)]
+	for i, le := range h.bounds {
+		p.sample(name+"_bucket", h.buckets[i], append(labels, "le", fmt.Sprintf("%g", le))...)
+	}
+	p.sample(name+"_bucket", h.count, append(labels, "le", "+Inf")...)
+	p.sample(name+"_sum", h.sum, labels...)
+	p.sample(name+"_count", h.count, labels...)
+}
+
+// formatLabels returns the label set of pairs of label names and values,
+// e.g. {upstream="app:8080",code="200"}, or "" without labels.
+func formatLabels(labels []string) string {
+	if len(labels) == 0 {
+		return ""
+	}
+	pairs := make([]string, 0, len(labels)/2)
+	for i := 0; i+1 < len(labels); i += 2 {
+		pairs = append(pairs, fmt.Sprintf("%s=%q", labels[i], labels[i+1]))
+	}
+	return "{" + strings.Join(pairs, ",") + "}"
+}
+
+// A histogram counts observed durations into buckets with upper bounds, in
+// seconds, as a Prometheus histogram.
+type histogram struct {
+	bounds  []float64
+	count   uint64
+	sum     float64
+	buckets []uint64
+}
+
+func newHistogram(bounds []float64) *histogram {
+	return &histogram{bounds: bounds, buckets: make([]uint64, len(bounds))}
+}
+
+func (h *histogram) observe(d time.Duration) {
+	h.count++
+	h.sum += d.Seconds()
+	for i, le := range h.bounds {
+		if d.Seconds() <= le {
+			h.buckets[i]++
+		}
+	}
+}
+
+// Metrics serves the metrics in the Prometheus text format to holders of
+// the admin token.
+func (p *OAuthProxy) Metrics(rw http.ResponseWriter, req *http.Request) {
+	if !p.authorizeAdmin(rw, req) {
+		return
+	}
+	p.metrics.ServeHTTP(rw, req)
+}
+
+// metricsHandler serves the metrics at path without authentication, for the
+// metrics-address, which only Prometheus should be able to reach.
+func (p *OAuthProxy) metricsHandler(path string) http.Handler {
+	return http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		if req.URL.Path != path {
+			http.NotFound(rw, req)
+			return
+		}
+		if req.Method != "GET" && req.Method != "HEAD" {
+			http.Error(rw, "Method Not Allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		p.metrics.ServeHTTP(rw, req)
+	})
+}
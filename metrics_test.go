@@ -0,0 +1,39 @@
+package oauth2proxy
+
+import (
+	"bytes"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+type testCollector struct{}
+
+func (testCollector) collect(w *promWriter, now time.Time) {
+	h := newHistogram([]float64{0.1, 1})
+	h.observe(50 * time.Millisecond)
+	h.observe(2 * time.Second)
+	w.family("test_requests_total", "counter", "Test requests.")
+	w.sample("test_requests_total", 3)
+	w.sample("test_requests_total", 1, "path", `/a "b"`, "code", "200")
+	w.family("test_duration_seconds", "histogram", "Test latency.")
+	w.histogram("test_duration_seconds", h, "path", "/")
+}
+
+func TestMetricsRegistry(t *testing.T) {
+	var b bytes.Buffer
+	newMetricsRegistry(testCollector{}).write(&b, time.Now())
+	assert.Equal(t, `# HELP test_requests_total Test requests.
+# TYPE test_requests_total counter
+test_requests_total 3
+test_requests_total{path="/a \"b\"",code="200"} 1
+# HELP test_duration_seconds Test latency.
+# TYPE test_duration_seconds histogram
+test_duration_seconds_bucket{path="/",le="0.1"} 1
+test_duration_seconds_bucket{path="/",le="1"} 1
+test_duration_seconds_bucket{path="/",le="+Inf"} 2
+test_duration_seconds_sum{path="/"} 2.05
+test_duration_seconds_count{path="/"} 2
+`, b.String())
+}
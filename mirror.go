@@ -0,0 +1,146 @@
+package oauth2proxy
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"math/rand"
+	"net/http"
+	"net/url"
+	"time"
+)
+
+const (
+	// mirrorMaxBody is the largest request body that is mirrored; requests
+	// with larger bodies are only proxied.
+	mirrorMaxBody = 1 << 20
+	// mirrorMaxInFlight caps the mirrored requests in progress, so that a
+	// slow shadow upstream can't pile up goroutines and memory; requests
+	// over it aren't mirrored.
+	mirrorMaxInFlight = 100
+	// mirrorTimeout bounds each mirrored request.
+	mirrorTimeout = 30 * time.Second
+)
+
+// A mirror sends copies of mirror-percent of the requests for the path of an
+// upstream to a shadow upstream, e.g. a new version of a backend to be
+// tested with real traffic. Copies are sent in the background with the
+// headers the upstream gets, including the user's identity and signature,
+// and their responses are discarded.
+type mirror struct {
+	target   *url.URL
+	percent  int
+	passHost bool
+	inFlight chan struct{}
+	client   *http.Client
+}
+
+// parseMirrorUpstreams checks that each mirror upstream has an upstream for
+// the same path and sets up its mirror.
+func parseMirrorUpstreams(o *Options, msgs []string) []string {
+	o.mirrors = nil
+	if len(o.MirrorUpstreams) == 0 {
+		return msgs
+	}
+	if o.MirrorPercent < 1 || o.MirrorPercent > 100 {
+		msgs = append(msgs, "mirror-percent must be between 1 and 100")
+	}
+	proxied := make(map[string]bool)
+	for _, u := range o.proxyURLs {
+		proxied[u.Path] = u.Scheme != "file"
+	}
+	o.mirrors = make(map[string]*mirror)
+	for _, m := range o.MirrorUpstreams {
+		u, err := url.Parse(m)
+		if err != nil {
+			msgs = append(msgs, fmt.Sprintf("error parsing mirror-upstream: %s", err))
+			continue
+		}
+		if u.Path == "" {
+			u.Path = "/"
+		}
+		if (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			msgs = append(msgs, fmt.Sprintf("invalid mirror-upstream %q: must be an http(s) URL", m))
+			continue
+		}
+		if !proxied[u.Path] {
+			msgs = append(msgs, fmt.Sprintf("invalid mirror-upstream %q: no upstream proxying path %q", m, u.Path))
+			continue
+		}
+		if o.mirrors[u.Path] != nil {
+			msgs = append(msgs, fmt.Sprintf("invalid mirror-upstream %q: path %q has a mirror-upstream already", m, u.Path))
+			continue
+		}
+		o.mirrors[u.Path] = &mirror{
+			target:   &url.URL{Scheme: u.Scheme, Host: u.Host},
+			percent:  o.MirrorPercent,
+			passHost: o.PassHostHeader,
+			inFlight: make(chan struct{}, mirrorMaxInFlight),
+			client: &http.Client{
+				Transport: newUpstreamTransport(),
+				Timeout:   mirrorTimeout,
+				CheckRedirect: func(*http.Request, []*http.Request) error {
+					return http.ErrUseLastResponse
+				},
+			},
+		}
+	}
+	return msgs
+}
+
+// Handler mirrors a sample of the requests before passing them on to next.
+func (m *mirror) Handler(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		if rand.Intn(100) < m.percent {
+			m.send(req)
+		}
+		next.ServeHTTP(rw, req)
+	})
+}
+
+// send starts sending a copy of req to the shadow upstream, unless too many
+// copies are in progress or the body is too large. The body of req is read
+// to be copied and replaced by one with the same content.
+func (m *mirror) send(req *http.Request) {
+	select {
+	case m.inFlight <- struct{}{}:
+	default:
+		return
+	}
+	var body []byte
+	if req.Body != nil {
+		var err error
+		body, err = ioutil.ReadAll(io.LimitReader(req.Body, mirrorMaxBody+1))
+		req.Body = ioutil.NopCloser(io.MultiReader(bytes.NewReader(body), req.Body))
+		if err != nil || len(body) > mirrorMaxBody {
+			<-m.inFlight
+			return
+		}
+	}
+
+	uri := req.RequestURI
+	if uri == "" {
+		uri = req.URL.RequestURI()
+	}
+	shadow, err := http.NewRequest(req.Method, m.target.String()+uri, bytes.NewReader(body))
+	if err != nil {
+		<-m.inFlight
+		return
+	}
+	shadow.Header = cloneHeader(req.Header)
+	if m.passHost {
+		shadow.Host = req.Host
+	}
+	go func() {
+		defer func() { <-m.inFlight }()
+		resp, err := m.client.Do(shadow)
+		if err != nil {
+			log.Printf("error mirroring %s %s to %s: %s", req.Method, uri, m.target.Host, err)
+			return
+		}
+		io.Copy(ioutil.Discard, resp.Body)
+		resp.Body.Close()
+	}()
+}
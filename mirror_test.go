@@ -0,0 +1,77 @@
+package oauth2proxy
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestMirrorUpstreamOptions(t *testing.T) {
+	o := testOptions()
+	o.Upstreams = []string{"http://127.0.0.1:8080/", "file:///var/www/static/#/static/"}
+	o.MirrorUpstreams = []string{"http://127.0.0.1:8081/", "srv://web/", "http://127.0.0.1:8082/static/", "http://127.0.0.1:8083/"}
+	o.MirrorPercent = 0
+	assert.Equal(t, errorMsg([]string{
+		"mirror-percent must be between 1 and 100",
+		`invalid mirror-upstream "srv://web/": must be an http(s) URL`,
+		`invalid mirror-upstream "http://127.0.0.1:8082/static/": no upstream proxying path "/static/"`,
+		`invalid mirror-upstream "http://127.0.0.1:8083/": path "/" has a mirror-upstream already`,
+	}), o.Validate().Error())
+	assert.Equal(t, 1, len(o.mirrors))
+}
+
+func TestMirrorUpstream(t *testing.T) {
+	type copied struct {
+		method, uri, body, user string
+	}
+	copies := make(chan copied, 1)
+	shadow := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := ioutil.ReadAll(r.Body)
+		copies <- copied{r.Method, r.RequestURI, string(body), r.Header.Get("X-Forwarded-User")}
+		w.Write([]byte("shadow"))
+	}))
+	defer shadow.Close()
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := ioutil.ReadAll(r.Body)
+		w.Write([]byte("upstream got " + string(body)))
+	}))
+	defer upstream.Close()
+
+	opts := testOptions()
+	opts.Upstreams = []string{upstream.URL + "/"}
+	opts.MirrorUpstreams = []string{shadow.URL + "/"}
+	assert.Equal(t, nil, opts.Validate())
+	proxy := newOAuthProxy(opts, func(string) bool { return true })
+
+	rw := httptest.NewRecorder()
+	req, _ := http.NewRequest("POST", "/foo?bar=baz", strings.NewReader("payload"))
+	req.RequestURI = "/foo?bar=baz"
+	req.Header.Set("X-Forwarded-User", "user")
+	proxy.serveMux.ServeHTTP(rw, req)
+	assert.Equal(t, 200, rw.Code)
+	assert.Equal(t, "upstream got payload", rw.Body.String())
+
+	select {
+	case c := <-copies:
+		assert.Equal(t, copied{"POST", "/foo?bar=baz", "payload", "user"}, c)
+	case <-time.After(5 * time.Second):
+		t.Fatal("request wasn't mirrored")
+	}
+}
+
+func TestMirrorSkipsLargeBodies(t *testing.T) {
+	m := &mirror{inFlight: make(chan struct{}, 1)}
+	body := strings.Repeat("x", mirrorMaxBody+1)
+	req, _ := http.NewRequest("POST", "/", strings.NewReader(body))
+	m.send(req)
+	assert.Equal(t, 0, len(m.inFlight))
+
+	// the request still has all of its body
+	read, _ := ioutil.ReadAll(req.Body)
+	assert.Equal(t, body, string(read))
+}
@@ -1,26 +1,42 @@
-package main
+package oauth2proxy
 
 import (
+	"crypto/hmac"
+	"crypto/sha256"
 	b64 "encoding/base64"
+	"encoding/hex"
 	"errors"
 	"fmt"
 	"html/template"
 	"log"
+	"math"
 	"net"
 	"net/http"
 	"net/http/httputil"
 	"net/url"
+	"path"
 	"regexp"
+	"strconv"
 	"strings"
+	"sync"
 	"time"
 
 	"github.com/bitly/oauth2_proxy/cookie"
 	"github.com/bitly/oauth2_proxy/providers"
+	"github.com/bitly/oauth2_proxy/store"
 	"github.com/mbland/hmacauth"
 )
 
 const SignatureHeader = "GAP-Signature"
 
+// stateExpiration limits how long an OAuth flow kept in the session store may
+// take to complete.
+const stateExpiration = 15 * time.Minute
+
+// refreshLockExpiration bounds how long other requests wait for a refresh of
+// the same session in progress elsewhere, and how long its result is kept.
+const refreshLockExpiration = 10 * time.Second
+
 var SignatureHeaders []string = []string{
 	"Content-Length",
 	"Content-Md5",
@@ -43,18 +59,84 @@ type OAuthProxy struct {
 	CookieHttpOnly bool
 	CookieExpire   time.Duration
 	CookieRefresh  time.Duration
+	CookieCompress bool
 	Validator      func(string) bool
+	AuditOnly      bool
 
 	RobotsPath        string
 	PingPath          string
+	ReadyPath         string
 	SignInPath        string
 	SignOutPath       string
 	OAuthStartPath    string
 	OAuthCallbackPath string
 	AuthOnlyPath      string
+	RevokePath        string
+	LockoutsPath      string
+	ConsentsPath      string
+	MetricsPath       string
+	SessionStatsPath  string
+	StaticPath        string
+	JWKSPath          string
+	ResubmitPath      string
+	SessionPath       string
+	RefreshPath       string
+	DevicePath        string
+	DeviceCodePath    string
+	DeviceTokenPath   string
+	TermsPath         string
+	MaintenancePath   string
 
 	redirectURL         *url.URL // the url to receive requests at
 	provider            providers.Provider
+	hostProviders       map[string]providers.Provider
+	loginProviders      []*loginProvider
+	store               store.Store
+	callbackStore       store.Store
+	revocationStore     store.Store
+	revocationToken     string
+	adminToken          string
+	lockoutStore        store.Store
+	resubmitStore       store.Store
+	deviceStore         store.Store
+	deviceFlow          bool
+	terms               *terms
+	termsStore          store.Store
+	consentStore        store.Store
+	termsInterval       time.Duration
+	validationStore     store.Store
+	validationCache     time.Duration
+	refreshAhead        time.Duration
+	refreshQueue        *refreshQueue
+	refreshFlights      *refreshFlights
+	requestMetrics      *requestMetrics
+	refreshMetrics      *refreshMetrics
+	sessionMetrics      *sessionMetrics
+	metrics             *metricsRegistry
+	cookieMaxSize       int
+	lockoutThreshold    int
+	lockoutDuration     time.Duration
+	lockoutDelay        time.Duration
+	securityEvents      *SecurityEventLogger
+	maxHeaderBytes      int
+	maxHeaderCount      int
+	maxURILength        int
+	allowNets           []*net.IPNet
+	denyNets            []*net.IPNet
+	rateLimitStore      store.Store
+	rateLimitPerIP      int
+	rateLimitPerUser    int
+	rateLimitV6Prefix   int
+	upstreamResolvers   []*upstreamResolver
+	srvUpstreams        []*srvUpstream
+	consul              *consulCatalog
+	consulWatches       []consulWatch
+	upstreamDNSRefresh  time.Duration
+	readyURLs           []string
+	ready               readyCheck
+	corsAllowedOrigins  []string
+	corsAllowedHeaders  []string
+	corsCredentials     bool
 	ProxyPrefix         string
 	SignInMessage       string
 	HtpasswdFile        *HtpasswdFile
@@ -66,12 +148,36 @@ type OAuthProxy struct {
 	PassUserHeaders     bool
 	BasicAuthPassword   string
 	PassAccessToken     bool
+	identitySigner      *identitySigner
+	identityHeader      string
+	identityIssuer      string
+	upstreamMux         *http.ServeMux
+	upstreamAudiences   map[string]string
+	trustedIdentity     *trustedIdentity
 	CookieCipher        *cookie.Cipher
+	stateCipher         *cookie.Cipher
 	skipAuthRegex       []string
+	whitelistDomains    []string
+	redirectSchemes     []string
 	skipAuthPreflight   bool
 	compiledRegex       []*regexp.Regexp
 	templates           *template.Template
+	templatesMu         sync.RWMutex
+	hostTemplates       map[string]*template.Template
+	hostStaticDirs      map[string]string
+	staticDir           string
+	Banner              string
+	bannerMessage       *bannerMessage
+	bannerHeader        string
+	maintenance         *maintenanceMode
 	Footer              string
+	brand               branding
+	strictCSP           bool
+	SignOutConfirm      bool
+	SignOutRedirect     string
+	sessionNonceCookie  string
+	done                chan bool
+	closeOnce           sync.Once
 }
 
 type UpstreamProxy struct {
@@ -90,7 +196,9 @@ func (u *UpstreamProxy) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 }
 
 func NewReverseProxy(target *url.URL) (proxy *httputil.ReverseProxy) {
-	return httputil.NewSingleHostReverseProxy(target)
+	proxy = httputil.NewSingleHostReverseProxy(target)
+	proxy.BufferPool = proxyBufferPool
+	return proxy
 }
 func setProxyUpstreamHostHeader(proxy *httputil.ReverseProxy, target *url.URL) {
 	director := proxy.Director
@@ -115,27 +223,79 @@ func NewFileServer(path string, filesystemPath string) (proxy http.Handler) {
 	return http.StripPrefix(path, http.FileServer(http.Dir(filesystemPath)))
 }
 
-func NewOAuthProxy(opts *Options, validator func(string) bool) *OAuthProxy {
+// newOAuthProxy returns the proxy for opts, which must have been validated.
+// NewHandler and NewMiddleware are the constructors for other packages.
+func newOAuthProxy(opts *Options, validator func(string) bool) *OAuthProxy {
 	serveMux := http.NewServeMux()
 	var auth hmacauth.HmacAuth
 	if sigData := opts.signatureData; sigData != nil {
 		auth = hmacauth.NewHmacAuth(sigData.hash, []byte(sigData.key),
 			SignatureHeader, SignatureHeaders)
 	}
-	for _, u := range opts.proxyURLs {
+	var resolvers []*upstreamResolver
+	var srvUpstreams []*srvUpstream
+	var consulWatches []consulWatch
+	audiences := make(map[string]string)
+	// canaries are set up first to be split off their stable upstreams
+	canaries := make(map[string]http.Handler)
+	for i, u := range append(append([]*url.URL{}, opts.canaryURLs...), opts.proxyURLs...) {
 		path := u.Path
 		switch u.Scheme {
-		case "http", "https":
+		case "http", "https", "srv", "srv+https", "consul", "consul+https":
 			u.Path = ""
 			log.Printf("mapping path %q => upstream %q", path, u)
-			proxy := NewReverseProxy(u)
+			target := u
+			var srv *srvUpstream
+			switch u.Scheme {
+			case "srv", "srv+https":
+				srv = newSRVUpstream(u.Host)
+				srvUpstreams = append(srvUpstreams, srv)
+			case "consul", "consul+https":
+				w := consulWatch{tag: u.Query().Get("tag")}
+				w.upstream, w.index = opts.consul.newConsulUpstream(u.Host, w.tag)
+				srv = w.upstream
+				consulWatches = append(consulWatches, w)
+			}
+			if srv != nil {
+				target = &url.URL{Scheme: "http", Host: u.Host}
+				if strings.HasSuffix(u.Scheme, "+https") {
+					target.Scheme = "https"
+				}
+			}
+			proxy := NewReverseProxy(target)
 			if !opts.PassHostHeader {
-				setProxyUpstreamHostHeader(proxy, u)
+				setProxyUpstreamHostHeader(proxy, target)
 			} else {
 				setProxyDirector(proxy)
 			}
-			serveMux.Handle(path,
-				&UpstreamProxy{u.Host, proxy, auth})
+			if srv != nil {
+				proxy.Transport = srv
+			} else if opts.UpstreamDNSRefresh > 0 && net.ParseIP(u.Hostname()) == nil {
+				r := newUpstreamResolver(u.Hostname())
+				proxy.Transport = r
+				resolvers = append(resolvers, r)
+			}
+			var handler http.Handler = proxy
+			if opts.concurrency != nil {
+				handler = opts.concurrency.Handler(handler)
+			}
+			if opts.upstreamCache != nil {
+				handler = opts.upstreamCache.Handler(handler)
+			}
+			if m := opts.mirrors[path]; m != nil {
+				handler = m.Handler(handler)
+			}
+			var upstream http.Handler = &UpstreamProxy{u.Host, handler, auth}
+			if i < len(opts.canaryURLs) {
+				canaries[path] = upstream
+				continue
+			}
+			audiences[path] = (&url.URL{Scheme: u.Scheme, Host: u.Host, Path: path}).String()
+			if canary, ok := canaries[path]; ok {
+				log.Printf("sending %d%% of requests for path %q to the canary upstream", opts.CanaryPercent, path)
+				upstream = &canaryHandler{upstream, canary, opts.CanaryPercent, opts.CanaryByUser}
+			}
+			serveMux.Handle(path, upstream)
 		case "file":
 			if u.Fragment != "" {
 				path = u.Fragment
@@ -162,13 +322,34 @@ func NewOAuthProxy(opts *Options, validator func(string) bool) *OAuthProxy {
 
 	log.Printf("Cookie settings: name:%s secure(https):%v httponly:%v expiry:%s domain:%s refresh:%s", opts.CookieName, opts.CookieSecure, opts.CookieHttpOnly, opts.CookieExpire, opts.CookieDomain, refresh)
 
-	var cipher *cookie.Cipher
-	if opts.PassAccessToken || (opts.CookieRefresh != time.Duration(0)) {
-		var err error
-		cipher, err = cookie.NewCipher(secretBytes(opts.CookieSecret))
-		if err != nil {
-			log.Fatal("cookie-secret error: ", err)
-		}
+	// callbacks, session revocations, lockouts, forms to re-submit and
+	// session validations are kept in the session store to apply across
+	// replicas, or in memory for a single instance
+	var sharedStore store.Store = store.NewMemoryStore()
+	if opts.sessionStore != nil {
+		sharedStore = opts.sessionStore
+	}
+
+	var queue *refreshQueue
+	if opts.RefreshAhead > 0 && opts.sessionStore != nil {
+		queue = newRefreshQueue()
+	}
+
+	if opts.CustomTemplatesDir != "" {
+		log.Printf("using custom template directory %q", opts.CustomTemplatesDir)
+	}
+	hostTemplates := make(map[string]*template.Template)
+	hostStaticDirs := make(map[string]string)
+	for host, dir := range opts.templateDirs {
+		log.Printf("using custom template directory %q for %s", dir, host)
+		hostTemplates[host] = opts.hostTemplates[host]
+		hostStaticDirs[host] = customStaticDir(dir)
+	}
+
+	requests, refreshes, sessions := newRequestMetrics(), newRefreshMetrics(), newSessionMetrics()
+	metrics := newMetricsRegistry(requests, refreshes, sessions)
+	if opts.securityEvents != nil {
+		metrics.register(opts.securityEvents)
 	}
 
 	return &OAuthProxy{
@@ -180,21 +361,88 @@ func NewOAuthProxy(opts *Options, validator func(string) bool) *OAuthProxy {
 		CookieHttpOnly: opts.CookieHttpOnly,
 		CookieExpire:   opts.CookieExpire,
 		CookieRefresh:  opts.CookieRefresh,
+		CookieCompress: opts.CookieCompress,
 		Validator:      validator,
+		AuditOnly:      opts.AuthorizationAuditOnly,
 
 		RobotsPath:        "/robots.txt",
 		PingPath:          "/ping",
+		ReadyPath:         "/ready",
 		SignInPath:        fmt.Sprintf("%s/sign_in", opts.ProxyPrefix),
 		SignOutPath:       fmt.Sprintf("%s/sign_out", opts.ProxyPrefix),
 		OAuthStartPath:    fmt.Sprintf("%s/start", opts.ProxyPrefix),
 		OAuthCallbackPath: fmt.Sprintf("%s/callback", opts.ProxyPrefix),
 		AuthOnlyPath:      fmt.Sprintf("%s/auth", opts.ProxyPrefix),
+		RevokePath:        fmt.Sprintf("%s/revoke", opts.ProxyPrefix),
+		LockoutsPath:      fmt.Sprintf("%s/admin/lockouts", opts.ProxyPrefix),
+		ConsentsPath:      fmt.Sprintf("%s/admin/consents", opts.ProxyPrefix),
+		MetricsPath:       fmt.Sprintf("%s/admin/metrics", opts.ProxyPrefix),
+		SessionStatsPath:  fmt.Sprintf("%s/admin/sessions", opts.ProxyPrefix),
+		StaticPath:        fmt.Sprintf("%s/static/", opts.ProxyPrefix),
+		JWKSPath:          fmt.Sprintf("%s/.well-known/jwks.json", opts.ProxyPrefix),
+		ResubmitPath:      fmt.Sprintf("%s/resubmit", opts.ProxyPrefix),
+		SessionPath:       fmt.Sprintf("%s/session", opts.ProxyPrefix),
+		RefreshPath:       fmt.Sprintf("%s/refresh", opts.ProxyPrefix),
+		DevicePath:        fmt.Sprintf("%s/device", opts.ProxyPrefix),
+		DeviceCodePath:    fmt.Sprintf("%s/device/code", opts.ProxyPrefix),
+		DeviceTokenPath:   fmt.Sprintf("%s/device/token", opts.ProxyPrefix),
+		TermsPath:         fmt.Sprintf("%s/terms", opts.ProxyPrefix),
+		MaintenancePath:   fmt.Sprintf("%s/admin/maintenance", opts.ProxyPrefix),
 
 		ProxyPrefix:        opts.ProxyPrefix,
 		provider:           opts.provider,
+		hostProviders:      opts.hostProviders,
+		loginProviders:     opts.loginProviders,
+		store:              opts.sessionStore,
+		callbackStore:      sharedStore,
+		revocationStore:    sharedStore,
+		revocationToken:    opts.RevocationWebhookToken,
+		adminToken:         opts.AdminToken,
+		lockoutStore:       sharedStore,
+		resubmitStore:      sharedStore,
+		deviceStore:        sharedStore,
+		deviceFlow:         opts.DeviceFlow,
+		terms:              opts.terms,
+		termsStore:         sharedStore,
+		consentStore:       sharedStore,
+		termsInterval:      opts.TermsInterval,
+		validationStore:    sharedStore,
+		validationCache:    opts.SessionValidationCache,
+		refreshAhead:       opts.RefreshAhead,
+		refreshQueue:       queue,
+		refreshFlights:     newRefreshFlights(),
+		requestMetrics:     requests,
+		refreshMetrics:     refreshes,
+		sessionMetrics:     sessions,
+		metrics:            metrics,
+		cookieMaxSize:      opts.CookieMaxSize,
+		lockoutThreshold:   opts.LockoutThreshold,
+		lockoutDuration:    opts.LockoutDuration,
+		lockoutDelay:       opts.LockoutDelay,
+		securityEvents:     opts.securityEvents,
+		maxHeaderBytes:     opts.MaxHeaderBytes,
+		maxHeaderCount:     opts.MaxHeaderCount,
+		maxURILength:       opts.MaxURILength,
+		allowNets:          opts.allowNets,
+		denyNets:           opts.denyNets,
+		corsAllowedOrigins: opts.CORSAllowedOrigins,
+		corsAllowedHeaders: opts.CORSAllowedHeaders,
+		corsCredentials:    opts.CORSAllowCredentials,
+		rateLimitStore:     opts.rateLimitStore,
+		rateLimitPerIP:     opts.RateLimitPerIP,
+		rateLimitPerUser:   opts.RateLimitPerUser,
+		rateLimitV6Prefix:  opts.RateLimitIPv6Prefix,
+		upstreamResolvers:  resolvers,
+		srvUpstreams:       srvUpstreams,
+		consul:             opts.consul,
+		consulWatches:      consulWatches,
+		upstreamDNSRefresh: opts.UpstreamDNSRefresh,
+		readyURLs:          readyURLs(opts),
 		serveMux:           serveMux,
 		redirectURL:        redirectURL,
 		skipAuthRegex:      opts.SkipAuthRegex,
+		whitelistDomains:   opts.WhitelistDomains,
+		redirectSchemes:    opts.redirectSchemes,
 		skipAuthPreflight:  opts.SkipAuthPreflight,
 		compiledRegex:      opts.CompiledRegex,
 		SetXAuthRequest:    opts.SetXAuthRequest,
@@ -202,13 +450,39 @@ func NewOAuthProxy(opts *Options, validator func(string) bool) *OAuthProxy {
 		PassUserHeaders:    opts.PassUserHeaders,
 		BasicAuthPassword:  opts.BasicAuthPassword,
 		PassAccessToken:    opts.PassAccessToken,
+		identitySigner:     opts.jwtSigner,
+		identityHeader:     opts.UpstreamJWTHeader,
+		identityIssuer:     opts.UpstreamJWTIssuer,
+		upstreamMux:        serveMux,
+		upstreamAudiences:  audiences,
+		trustedIdentity:    opts.trustedIdentity,
 		SkipProviderButton: opts.SkipProviderButton,
-		CookieCipher:       cipher,
-		templates:          loadTemplates(opts.CustomTemplatesDir),
+		CookieCipher:       opts.cookieCipher,
+		stateCipher:        opts.stateCipher,
+		templates:          opts.templates,
+		staticDir:          customStaticDir(opts.CustomTemplatesDir),
+		hostTemplates:      hostTemplates,
+		hostStaticDirs:     hostStaticDirs,
+		strictCSP:          opts.CustomTemplatesCSP || (opts.CustomTemplatesDir == "" && len(opts.HostTemplatesDirs) == 0),
+		Banner:             opts.Banner,
+		bannerMessage:      opts.bannerMessage,
+		bannerHeader:       opts.BannerMessageHeader,
+		maintenance:        opts.maintenance,
 		Footer:             opts.Footer,
+		brand:              newBranding(opts),
+		SignOutConfirm:     opts.SignOutConfirm,
+		SignOutRedirect:    opts.SignOutRedirect,
+		sessionNonceCookie: fmt.Sprintf("%v_%v", opts.CookieName, "session_nonce"),
+		done:               make(chan bool),
 	}
 }
 
+// Close stops the background refreshes started for the proxy, once it no
+// longer serves requests. It may be called more than once.
+func (p *OAuthProxy) Close() {
+	p.closeOnce.Do(func() { close(p.done) })
+}
+
 func (p *OAuthProxy) GetRedirectURI(host string) string {
 	// default to the request Host if not set
 	if p.redirectURL.Host != "" {
@@ -227,26 +501,65 @@ func (p *OAuthProxy) GetRedirectURI(host string) string {
 	return u.String()
 }
 
+// issuer returns the URL identifying the proxy for host in upstream JWTs;
+// their keys are published at issuer + "/.well-known/jwks.json".
+func (p *OAuthProxy) issuer(host string) string {
+	scheme := "http"
+	if p.CookieSecure {
+		scheme = "https"
+	}
+	return scheme + "://" + host + p.ProxyPrefix
+}
+
+// upstreamAudience returns the upstream a request is passed to, as the
+// audience of its upstream JWT, or "" for the proxy's own endpoints.
+func (p *OAuthProxy) upstreamAudience(req *http.Request) string {
+	if strings.HasPrefix(req.URL.Path, p.ProxyPrefix+"/") {
+		return ""
+	}
+	_, pattern := p.upstreamMux.Handler(req)
+	return p.upstreamAudiences[pattern]
+}
+
 func (p *OAuthProxy) displayCustomLoginForm() bool {
 	return p.HtpasswdFile != nil && p.DisplayHtpasswdForm
 }
 
-func (p *OAuthProxy) redeemCode(host, code string) (s *providers.SessionState, err error) {
+// providerFor returns the provider configured for the request host, falling
+// back to the default provider.
+func (p *OAuthProxy) providerFor(req *http.Request) providers.Provider {
+	if lp := p.loginProviderFor(req); lp != nil {
+		return lp.provider
+	}
+	if len(p.hostProviders) != 0 {
+		host := req.Host
+		if h, _, err := net.SplitHostPort(host); err == nil {
+			host = h
+		}
+		if provider, ok := p.hostProviders[strings.ToLower(host)]; ok {
+			return provider
+		}
+	}
+	return p.provider
+}
+
+func (p *OAuthProxy) redeemCode(req *http.Request, code string) (s *providers.SessionState, err error) {
 	if code == "" {
 		return nil, errors.New("missing code")
 	}
-	redirectURI := p.GetRedirectURI(host)
-	s, err = p.provider.Redeem(redirectURI, code)
+	provider := p.providerFor(req)
+	redirectURI := p.GetRedirectURI(req.Host)
+	s, err = provider.Redeem(redirectURI, code)
 	if err != nil {
 		return
 	}
 
 	if s.Email == "" {
-		s.Email, err = p.provider.GetEmailAddress(s)
+		s.Email, err = provider.GetEmailAddress(s)
 	}
 
 	if s.User == "" {
-		s.User, err = p.provider.GetUserName(s)
+		s.User, err = provider.GetUserName(s)
 		if err != nil && err.Error() == "not implemented" {
 			err = nil
 		}
@@ -257,8 +570,9 @@ func (p *OAuthProxy) redeemCode(host, code string) (s *providers.SessionState, e
 func (p *OAuthProxy) MakeSessionCookie(req *http.Request, value string, expiration time.Duration, now time.Time) *http.Cookie {
 	if value != "" {
 		value = cookie.SignedValue(p.CookieSeed, p.CookieName, value, now)
-		if len(value) > 4096 {
-			// Cookies cannot be larger than 4kb
+		// Cookies cannot be larger than 4kb; sessions moved to the session
+		// store only leave their ticket in the cookie
+		if len(value) > 4096 || (p.cookieMaxSize != 0 && len(value) > p.cookieMaxSize) {
 			log.Printf("WARNING - Cookie Size: %d bytes", len(value))
 		}
 	}
@@ -299,9 +613,209 @@ func (p *OAuthProxy) SetCSRFCookie(rw http.ResponseWriter, req *http.Request, va
 	http.SetCookie(rw, p.MakeCSRFCookie(req, val, p.CookieExpire, time.Now()))
 }
 
+// saveState records the nonce of a new OAuth flow for the callback to check
+// in the CSRF cookie, which binds the flow to the browser that started it,
+// and in the session store if one is configured, so that the state can be
+// used only once whichever replica handles the callback.
+func (p *OAuthProxy) saveState(rw http.ResponseWriter, req *http.Request, nonce string) error {
+	p.SetCSRFCookie(rw, req, nonce)
+	if p.store == nil {
+		return nil
+	}
+	return p.store.Set(stateKey(nonce), []byte(getRemoteAddr(req)), stateExpiration)
+}
+
+func stateKey(nonce string) string {
+	return "state:" + nonce
+}
+
+// encodeState returns the OAuth state parameter for a nonce, the login
+// provider (if several are offered) and the redirect after sign in: the
+// encrypted values, signed along with the time so that the callback can
+// enforce its age.
+func (p *OAuthProxy) encodeState(nonce, provider, redirect string, now time.Time) (string, error) {
+	value, err := p.stateCipher.Encrypt(nonce + ":" + provider + ":" + redirect)
+	if err != nil {
+		return "", err
+	}
+	return cookie.SignedValue(p.CookieSeed, "state", value, now), nil
+}
+
+// decodeState verifies the signature and age of an OAuth state parameter and
+// returns its nonce, login provider and redirect.
+func (p *OAuthProxy) decodeState(state string) (nonce, provider, redirect string, err error) {
+	value, _, ok := cookie.Validate(&http.Cookie{Name: "state", Value: state}, p.CookieSeed, stateExpiration)
+	if !ok {
+		return "", "", "", errors.New("invalid or expired state")
+	}
+	decrypted, err := p.stateCipher.Decrypt(value)
+	if err != nil {
+		return "", "", "", err
+	}
+	s := strings.SplitN(decrypted, ":", 3)
+	if len(s) != 3 {
+		return "", "", "", errors.New("invalid state")
+	}
+	return s[0], s[1], s[2], nil
+}
+
+// refreshFlights runs each refresh once for all the requests of a session
+// that need it at the same time, which then share its result.
+type refreshFlights struct {
+	mu      sync.Mutex
+	flights map[string]*refreshFlight
+}
+
+type refreshFlight struct {
+	done    chan struct{}
+	session *providers.SessionState
+	ok      bool
+	err     error
+}
+
+func newRefreshFlights() *refreshFlights {
+	return &refreshFlights{flights: make(map[string]*refreshFlight)}
+}
+
+// do calls refresh, unless a refresh under key is in flight already, in which
+// case it waits for that one and returns its result.
+func (f *refreshFlights) do(key string, refresh func() (*providers.SessionState, bool, error)) (*providers.SessionState, bool, error) {
+	f.mu.Lock()
+	if flight, ok := f.flights[key]; ok {
+		f.mu.Unlock()
+		<-flight.done
+		return flight.session, flight.ok, flight.err
+	}
+	flight := &refreshFlight{done: make(chan struct{})}
+	f.flights[key] = flight
+	f.mu.Unlock()
+
+	flight.session, flight.ok, flight.err = refresh()
+	f.mu.Lock()
+	delete(f.flights, key)
+	f.mu.Unlock()
+	close(flight.done)
+	return flight.session, flight.ok, flight.err
+}
+
+// refreshSession refreshes the session tokens if they expired. Concurrent
+// refreshes of the same session are coordinated so that only one of them
+// redeems the refresh token at the provider; the others wait for and use its
+// result. Within this instance they share the refresh in flight, and with a
+// session store, across replicas too.
+func (p *OAuthProxy) refreshSession(provider providers.Provider, s *providers.SessionState) (bool, error) {
+	if s == nil || s.RefreshToken == "" || s.ExpiresOn.After(time.Now()) {
+		return p.redeemRefreshToken(provider, s)
+	}
+
+	key := refreshKey(s.RefreshToken)
+	refreshed, ok, err := p.refreshFlights.do(key, func() (*providers.SessionState, bool, error) {
+		refreshed := *s
+		ok, err := p.refreshSharedSession(provider, &refreshed, key)
+		return &refreshed, ok, err
+	})
+	if ok {
+		*s = *refreshed
+	}
+	return ok, err
+}
+
+// refreshSharedSession refreshes s, waiting for the result of a refresh in
+// progress on another replica instead, if there is one. A refresh token is
+// never redeemed twice: if the other replica fails, or takes longer than
+// refreshLockExpiration, the refresh fails.
+func (p *OAuthProxy) refreshSharedSession(provider providers.Provider, s *providers.SessionState, key string) (bool, error) {
+	if p.store == nil || p.CookieCipher == nil {
+		return p.redeemRefreshToken(provider, s)
+	}
+
+	if ok, err := p.loadRefreshedSession(provider, s, key); ok || err != nil {
+		return ok, err
+	}
+	locked, err := p.store.SetNX(key+":lock", []byte("1"), refreshLockExpiration)
+	if err != nil {
+		return false, err
+	}
+	if !locked {
+		deadline := time.Now().Add(refreshLockExpiration)
+		for time.Now().Before(deadline) {
+			time.Sleep(100 * time.Millisecond)
+			if ok, err := p.loadRefreshedSession(provider, s, key); ok || err != nil {
+				return ok, err
+			}
+			// a successful refresh keeps the lock, a failed one releases it
+			// without a result
+			if _, err := p.store.Get(key + ":lock"); err == store.ErrNotFound {
+				if ok, err := p.loadRefreshedSession(provider, s, key); ok || err != nil {
+					return ok, err
+				}
+				return false, errors.New("the refresh on another replica failed")
+			} else if err != nil {
+				return false, err
+			}
+		}
+		return false, errors.New("timed out waiting for the refresh on another replica")
+	}
+
+	ok, err := p.redeemRefreshToken(provider, s)
+	if err == nil && ok {
+		var value string
+		value, err = p.cookieForSession(provider, s)
+		if err == nil {
+			err = p.store.Set(key, []byte(value), refreshLockExpiration)
+		}
+		if err != nil {
+			log.Printf("error saving refreshed session %s", err)
+		}
+		return true, nil
+	}
+	p.store.Del(key + ":lock")
+	return ok, err
+}
+
+// loadRefreshedSession replaces s with the session refreshed under key by
+// another request, if there is one.
+func (p *OAuthProxy) loadRefreshedSession(provider providers.Provider, s *providers.SessionState, key string) (bool, error) {
+	value, err := p.store.Get(key)
+	if err == store.ErrNotFound {
+		return false, nil
+	} else if err != nil {
+		return false, err
+	}
+	refreshed, err := provider.SessionFromCookie(string(value), p.CookieCipher)
+	if err != nil {
+		return false, err
+	}
+	*s = *refreshed
+	return true, nil
+}
+
+// validateSession checks the access token of s with the provider. With
+// session-validation-cache, a successful validation is reused for that long,
+// so that a burst of requests by one user makes a single provider call.
+func (p *OAuthProxy) validateSession(provider providers.Provider, s *providers.SessionState) bool {
+	if p.validationCache == 0 {
+		return provider.ValidateSessionState(s)
+	}
+	sum := sha256.Sum256([]byte(s.AccessToken))
+	key := "validated:" + hex.EncodeToString(sum[:])
+	if _, err := p.validationStore.Get(key); err == nil {
+		return true
+	}
+	if !provider.ValidateSessionState(s) {
+		return false
+	}
+	if err := p.validationStore.Set(key, []byte("1"), p.validationCache); err != nil {
+		log.Printf("error caching session validation %s", err)
+	}
+	return true
+}
+
 func (p *OAuthProxy) ClearSessionCookie(rw http.ResponseWriter, req *http.Request) {
+	p.deleteStoredSession(req)
 	clr := p.MakeSessionCookie(req, "", time.Hour*-1, time.Now())
 	http.SetCookie(rw, clr)
+	http.SetCookie(rw, p.makeCookie(req, p.sessionNonceCookie, "", time.Hour*-1, time.Now()))
 
 	// ugly hack because default domain changed
 	if p.CookieDomain == "" {
@@ -326,8 +840,12 @@ func (p *OAuthProxy) LoadCookiedSession(req *http.Request) (*providers.SessionSt
 	if !ok {
 		return nil, age, errors.New("Cookie Signature not valid")
 	}
+	val, err = p.loadStoredSession(val)
+	if err != nil {
+		return nil, age, err
+	}
 
-	session, err := p.provider.SessionFromCookie(val, p.CookieCipher)
+	session, err := p.providerFor(req).SessionFromCookie(val, p.CookieCipher)
 	if err != nil {
 		return nil, age, err
 	}
@@ -336,12 +854,47 @@ func (p *OAuthProxy) LoadCookiedSession(req *http.Request) (*providers.SessionSt
 	return session, age, nil
 }
 
+// cookieForSession serializes the session for the cookie, compressing it with
+// cookie-compress when it carries tokens.
+func (p *OAuthProxy) cookieForSession(provider providers.Provider, s *providers.SessionState) (string, error) {
+	if p.CookieCompress && p.CookieCipher != nil && s.AccessToken != "" {
+		value, err := s.EncodeCompressedSessionState(p.CookieCipher)
+		if err != nil {
+			log.Printf("error encoding session for %s: %s", s.Email, err)
+		}
+		return value, err
+	}
+	return provider.CookieForSession(s, p.CookieCipher)
+}
+
 func (p *OAuthProxy) SaveSession(rw http.ResponseWriter, req *http.Request, s *providers.SessionState) error {
-	value, err := p.provider.CookieForSession(s, p.CookieCipher)
+	return p.saveSession(rw, req, s, time.Now())
+}
+
+// saveNewSession saves the session of a user who just signed in. It never
+// reuses the ticket of the session cookie sent, which may have been planted
+// by someone else or left behind by the previous user of the browser, but
+// deletes it and stores a large session under a new ticket.
+func (p *OAuthProxy) saveNewSession(rw http.ResponseWriter, req *http.Request, s *providers.SessionState) error {
+	p.deleteStoredSession(req)
+	return p.storeSession(rw, req, s, time.Now(), "")
+}
+
+// saveSession saves s in the session cookie as signed in at signedIn, which
+// cookie-expire counts from.
+func (p *OAuthProxy) saveSession(rw http.ResponseWriter, req *http.Request, s *providers.SessionState, signedIn time.Time) error {
+	return p.storeSession(rw, req, s, signedIn, p.sessionTicket(req))
+}
+
+func (p *OAuthProxy) storeSession(rw http.ResponseWriter, req *http.Request, s *providers.SessionState, signedIn time.Time, ticket string) error {
+	value, err := p.cookieForSession(p.providerFor(req), s)
 	if err != nil {
 		return err
 	}
-	p.SetSessionCookie(rw, req, value)
+	if value, err = p.storeLargeSession(value, ticket); err != nil {
+		return err
+	}
+	http.SetCookie(rw, p.MakeSessionCookie(req, value, p.CookieExpire, signedIn))
 	return nil
 }
 
@@ -355,32 +908,251 @@ func (p *OAuthProxy) PingPage(rw http.ResponseWriter) {
 	fmt.Fprintf(rw, "OK")
 }
 
+// JWKS serves the public key that upstream JWTs are signed with.
+func (p *OAuthProxy) JWKS(rw http.ResponseWriter) {
+	if p.identitySigner == nil {
+		http.NotFound(rw, nil)
+		return
+	}
+	rw.Header().Set("Content-Type", "application/json")
+	rw.Header().Set("Cache-Control", "public, max-age=300")
+	rw.Write(p.identitySigner.jwks)
+}
+
+// readyTimeout bounds each check of the readiness endpoint.
+const readyTimeout = 5 * time.Second
+
+// readyCacheTTL is how long the result of a readiness check is reused, so
+// frequent probes don't each reach the session store and the provider.
+const readyCacheTTL = 10 * time.Second
+
+// readyCheck keeps the result of the last readiness check.
+type readyCheck struct {
+	mu      sync.Mutex
+	checked time.Time
+	err     error
+}
+
+// readyURLs returns the provider endpoints that must be reachable to complete
+// a login: the redeem URL of each provider and the OIDC JWKS URL.
+func readyURLs(opts *Options) []string {
+	var urls []string
+	seen := make(map[string]bool)
+	add := func(u string) {
+		if u != "" && !seen[u] {
+			seen[u] = true
+			urls = append(urls, u)
+		}
+	}
+	addRedeemURL := func(provider providers.Provider) {
+		if provider != nil && provider.Data().RedeemURL != nil {
+			add(provider.Data().RedeemURL.String())
+		}
+	}
+	addRedeemURL(opts.provider)
+	for _, provider := range opts.hostProviders {
+		addRedeemURL(provider)
+	}
+	for _, lp := range opts.loginProviders {
+		addRedeemURL(lp.provider)
+	}
+	add(opts.oidcJWKSURL)
+	return urls
+}
+
+// ReadyPage responds 200 OK if the session store and the provider endpoints
+// are reachable and 503 Service Unavailable otherwise. The reason is only
+// logged, since the endpoint is not authenticated.
+func (p *OAuthProxy) ReadyPage(rw http.ResponseWriter) {
+	if err := p.cachedReady(time.Now()); err != nil {
+		rw.WriteHeader(http.StatusServiceUnavailable)
+		fmt.Fprintf(rw, "not ready")
+		return
+	}
+	rw.WriteHeader(http.StatusOK)
+	fmt.Fprintf(rw, "OK")
+}
+
+// cachedReady returns the result of the last readiness check if it is recent
+// and otherwise checks again; concurrent probes wait for a single check.
+func (p *OAuthProxy) cachedReady(now time.Time) error {
+	p.ready.mu.Lock()
+	defer p.ready.mu.Unlock()
+	if !p.ready.checked.IsZero() && now.Sub(p.ready.checked) < readyCacheTTL {
+		return p.ready.err
+	}
+	p.ready.err = p.checkReady()
+	p.ready.checked = now
+	if p.ready.err != nil {
+		log.Printf("not ready: %s", p.ready.err)
+	}
+	return p.ready.err
+}
+
+func (p *OAuthProxy) checkReady() error {
+	if p.store != nil {
+		if err := p.store.Ping(); err != nil {
+			return fmt.Errorf("session store: %s", err)
+		}
+	}
+	client := &http.Client{Timeout: readyTimeout}
+	for _, u := range p.readyURLs {
+		// any response shows the endpoint is reachable; a token endpoint
+		// typically rejects a GET without parameters
+		resp, err := client.Get(u)
+		if err != nil {
+			return err
+		}
+		resp.Body.Close()
+	}
+	return nil
+}
+
+// ServeStatic serves the assets of the sign in and error pages: files in the
+// static directory of the host-templates-dir of the request host or else of
+// custom-templates-dir, then the built-in assets.
+func (p *OAuthProxy) ServeStatic(rw http.ResponseWriter, req *http.Request) {
+	name := path.Clean("/" + strings.TrimPrefix(req.URL.Path, p.StaticPath))
+	staticDir, ok := p.hostStaticDirs[requestHost(req)]
+	if !ok {
+		staticDir = p.staticDir
+	}
+	if staticDir != "" {
+		if f, err := http.Dir(staticDir).Open(name); err == nil {
+			defer f.Close()
+			if fi, err := f.Stat(); err == nil && !fi.IsDir() {
+				http.ServeContent(rw, req, fi.Name(), fi.ModTime(), f)
+				return
+			}
+		}
+	}
+	asset, ok := staticAssets[name[1:]]
+	if !ok {
+		http.NotFound(rw, req)
+		return
+	}
+	// the built-in assets only change on upgrades, which the ETag catches
+	// once the cached copy expires
+	sum := sha256.Sum256([]byte(asset))
+	rw.Header().Set("Cache-Control", "public, max-age=86400")
+	rw.Header().Set("ETag", fmt.Sprintf(`"%x"`, sum[:8]))
+	http.ServeContent(rw, req, name, time.Time{}, strings.NewReader(asset))
+}
+
+// setContentSecurityPolicy restricts a page to the assets served by the proxy
+// (and the brand-logo-url) and to inline scripts and styles carrying the
+// returned nonce. With custom templates, which may predate the policy, it is
+// only sent with custom-templates-csp.
+func (p *OAuthProxy) setContentSecurityPolicy(rw http.ResponseWriter) string {
+	nonce, err := cookie.Nonce()
+	if err != nil {
+		log.Printf("error generating CSP nonce %s", err)
+	}
+	if !p.strictCSP {
+		return nonce
+	}
+	imgSrc := "'self'"
+	origins := []string{imageOrigin(p.brand.LogoURL)}
+	for _, lp := range p.loginProviders {
+		origins = append(origins, imageOrigin(lp.IconURL))
+	}
+	for _, origin := range origins {
+		if origin != "" && !strings.Contains(imgSrc, " "+origin) {
+			imgSrc += " " + origin
+		}
+	}
+	rw.Header().Set("Content-Security-Policy", fmt.Sprintf("default-src 'none'; script-src 'nonce-%s'; style-src 'self' 'nonce-%s'; img-src %s; base-uri 'none'; frame-ancestors 'none'", nonce, nonce, imgSrc))
+	return nonce
+}
+
 func (p *OAuthProxy) ErrorPage(rw http.ResponseWriter, code int, title string, message string) {
+	p.errorPage(rw, nil, code, title, message)
+}
+
+// errorPage renders the error page with the custom templates of the request
+// host, if any; without a request, the default templates are used.
+func (p *OAuthProxy) errorPage(rw http.ResponseWriter, req *http.Request, code int, title string, message string) {
 	log.Printf("ErrorPage %d %s %s", code, title, message)
+	nonce := p.setContentSecurityPolicy(rw)
 	rw.WriteHeader(code)
 	t := struct {
 		Title       string
 		Message     string
 		ProxyPrefix string
+		CSPNonce    string
+		Brand       branding
 	}{
 		Title:       fmt.Sprintf("%d %s", code, title),
 		Message:     message,
 		ProxyPrefix: p.ProxyPrefix,
+		CSPNonce:    nonce,
+		Brand:       p.brand,
 	}
-	p.templates.ExecuteTemplate(rw, "error.html", t)
+	p.executeTemplate(rw, req, "error.html", t)
 }
 
-func (p *OAuthProxy) SignInPage(rw http.ResponseWriter, req *http.Request, code int) {
-	p.ClearSessionCookie(rw, req)
-	rw.WriteHeader(code)
+// deniedReasonHeader gives the reason code of a 403 Forbidden response to a
+// signed in user, for automation.
+const deniedReasonHeader = "X-Auth-Request-Denied-Reason"
 
-	redirect_url := req.URL.RequestURI()
-	if req.Header.Get("X-Auth-Request-Redirect") != "" {
-		redirect_url = req.Header.Get("X-Auth-Request-Redirect")
+// Reason codes for denying a signed in user.
+const (
+	denyEmailNotAllowed = "email_not_allowed"
+	denyGroupNotAllowed = "group_not_allowed"
+)
+
+var denyMessages = map[string]string{
+	denyEmailNotAllowed: "This account's email address is not allowed to access this site.",
+	denyGroupNotAllowed: "This account is not a member of a group allowed to access this site.",
+}
+
+// A denial is why a signed in user was denied access.
+type denial struct {
+	Identity string
+	Reason   string
+}
+
+// ForbiddenPage tells a signed in user which identity was denied and why.
+func (p *OAuthProxy) ForbiddenPage(rw http.ResponseWriter, req *http.Request, d *denial) {
+	log.Printf("ForbiddenPage %s %s", d.Identity, d.Reason)
+	rw.Header().Set(deniedReasonHeader, d.Reason)
+	nonce := p.setContentSecurityPolicy(rw)
+	rw.WriteHeader(http.StatusForbidden)
+	t := struct {
+		Title       string
+		Identity    string
+		Reason      string
+		Message     string
+		ProxyPrefix string
+		CSPNonce    string
+		Brand       branding
+	}{
+		Title:       "403 Permission Denied",
+		Identity:    d.Identity,
+		Reason:      d.Reason,
+		Message:     denyMessages[d.Reason],
+		ProxyPrefix: p.ProxyPrefix,
+		CSPNonce:    nonce,
+		Brand:       p.brand,
 	}
-	if redirect_url == p.SignInPath {
-		redirect_url = "/"
+	p.executeTemplate(rw, req, "forbidden.html", t)
+}
+
+func (p *OAuthProxy) SignInPage(rw http.ResponseWriter, req *http.Request, code int) {
+	if code != http.StatusOK {
+		// the session was rejected; a plain GET of the sign in page must not
+		// sign users out, see SignOut
+		p.ClearSessionCookie(rw, req)
 	}
+	var redirect_url string
+	if req.URL.Path == p.SignInPath {
+		redirect_url, _ = p.GetRedirect(req)
+	} else {
+		redirect_url = p.signInRedirect(rw, req)
+	}
+	nonce := p.setContentSecurityPolicy(rw)
+	rw.WriteHeader(code)
+	buttons, remembered := p.providerButtons(req)
 
 	t := struct {
 		ProviderName  string
@@ -389,17 +1161,31 @@ func (p *OAuthProxy) SignInPage(rw http.ResponseWriter, req *http.Request, code
 		Redirect      string
 		Version       string
 		ProxyPrefix   string
+		Banner        template.HTML
+		Notice        string
 		Footer        template.HTML
+		CSPNonce      string
+		Brand         branding
+		Providers     []providerButton
+		Remembered    bool
+		Error         string
 	}{
-		ProviderName:  p.provider.Data().ProviderName,
+		ProviderName:  p.providerFor(req).Data().ProviderName,
 		SignInMessage: p.SignInMessage,
 		CustomLogin:   p.displayCustomLoginForm(),
 		Redirect:      redirect_url,
 		Version:       VERSION,
 		ProxyPrefix:   p.ProxyPrefix,
+		Banner:        template.HTML(p.Banner),
+		Notice:        p.bannerMessage.Text(),
 		Footer:        template.HTML(p.Footer),
+		CSPNonce:      nonce,
+		Brand:         p.brand,
+		Providers:     buttons,
+		Remembered:    remembered,
+		Error:         signInError(req),
 	}
-	p.templates.ExecuteTemplate(rw, "sign_in.html", t)
+	p.executeTemplate(rw, req, "sign_in.html", t)
 }
 
 func (p *OAuthProxy) ManualSignIn(rw http.ResponseWriter, req *http.Request) (string, bool) {
@@ -414,8 +1200,13 @@ func (p *OAuthProxy) ManualSignIn(rw http.ResponseWriter, req *http.Request) (st
 	// check auth
 	if p.HtpasswdFile.Validate(user, passwd) {
 		log.Printf("authenticated %q via HtpasswdFile", user)
+		p.logSecurityEvent(req, eventLogin, user, "")
+		p.sessionMetrics.login("htpasswd", user, time.Now())
+		p.clearSignInFailures(req, user)
 		return user, true
 	}
+	p.logSecurityEvent(req, eventLoginDenied, user, "invalid password")
+	p.recordSignInFailure(req, user)
 	return "", false
 }
 
@@ -426,13 +1217,65 @@ func (p *OAuthProxy) GetRedirect(req *http.Request) (redirect string, err error)
 	}
 
 	redirect = req.Form.Get("rd")
-	if redirect == "" || !strings.HasPrefix(redirect, "/") || strings.HasPrefix(redirect, "//") {
+	if !p.IsValidRedirect(req, redirect) {
 		redirect = "/"
 	}
 
 	return
 }
 
+// IsValidRedirect reports whether redirect may be used after sign in: a path
+// on the request host, an absolute http(s) URL for the request host or a
+// domain in whitelist-domain, or a URL with a scheme in redirect-scheme.
+func (p *OAuthProxy) IsValidRedirect(req *http.Request, redirect string) bool {
+	switch {
+	case strings.HasPrefix(redirect, "//"), strings.HasPrefix(redirect, "/\\"):
+		return false
+	case strings.HasPrefix(redirect, "/"):
+		return true
+	}
+	u, err := url.Parse(redirect)
+	if err == nil && p.isAppRedirect(u) {
+		return true
+	}
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return false
+	}
+	host := stripPort(u.Host)
+	if strings.EqualFold(host, stripPort(req.Host)) {
+		return true
+	}
+	for _, domain := range p.whitelistDomains {
+		if strings.HasPrefix(domain, ".") {
+			if strings.HasSuffix(strings.ToLower(host), strings.ToLower(domain)) || strings.EqualFold(host, domain[1:]) {
+				return true
+			}
+		} else if strings.EqualFold(host, domain) {
+			return true
+		}
+	}
+	return false
+}
+
+// isAppRedirect reports whether u has one of the custom schemes of the native
+// apps in redirect-scheme.
+func (p *OAuthProxy) isAppRedirect(u *url.URL) bool {
+	for _, scheme := range p.redirectSchemes {
+		if u.Scheme == scheme {
+			return true
+		}
+	}
+	return false
+}
+
+// stripPort removes the port, if any, from host.
+func stripPort(host string) string {
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		return h
+	}
+	return host
+}
+
 func (p *OAuthProxy) IsWhitelistedRequest(req *http.Request) (ok bool) {
 	isPreflightRequestAllowed := p.skipAuthPreflight && req.Method == "OPTIONS"
 	return isPreflightRequestAllowed || p.IsWhitelistedPath(req.URL.Path)
@@ -456,14 +1299,95 @@ func getRemoteAddr(req *http.Request) (s string) {
 	return
 }
 
+// IsAllowedClient reports whether the client address is in allow-cidr, if
+// given, and not in deny-cidr.
+func (p *OAuthProxy) IsAllowedClient(req *http.Request) bool {
+	if len(p.allowNets) == 0 && len(p.denyNets) == 0 {
+		return true
+	}
+	ip := net.ParseIP(clientIP(req))
+	if ip == nil {
+		return false
+	}
+	for _, n := range p.denyNets {
+		if n.Contains(ip) {
+			return false
+		}
+	}
+	if len(p.allowNets) == 0 {
+		return true
+	}
+	for _, n := range p.allowNets {
+		if n.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// CheckRequestSize returns the status to reject the request with when its
+// URI or headers exceed max-uri-length, max-header-count or max-header-bytes,
+// or 0 if it is within the limits.
+func (p *OAuthProxy) CheckRequestSize(req *http.Request) int {
+	uri := req.RequestURI
+	if uri == "" {
+		uri = req.URL.RequestURI()
+	}
+	if p.maxURILength > 0 && len(uri) > p.maxURILength {
+		return http.StatusRequestURITooLong
+	}
+	if p.maxHeaderCount <= 0 && p.maxHeaderBytes <= 0 {
+		return 0
+	}
+	count, size := 0, 0
+	for name, values := range req.Header {
+		for _, v := range values {
+			count++
+			size += len(name) + len(v) + len(": \r\n")
+		}
+	}
+	if p.maxHeaderCount > 0 && count > p.maxHeaderCount {
+		return http.StatusRequestHeaderFieldsTooLarge
+	}
+	if p.maxHeaderBytes > 0 && size > p.maxHeaderBytes {
+		return http.StatusRequestHeaderFieldsTooLarge
+	}
+	return 0
+}
+
 func (p *OAuthProxy) ServeHTTP(rw http.ResponseWriter, req *http.Request) {
+	if !p.IsAllowedClient(req) {
+		log.Printf("%s client address not allowed", getRemoteAddr(req))
+		p.requestMetrics.reject(rejectClientNotAllowed)
+		http.Error(rw, "Forbidden", http.StatusForbidden)
+		return
+	}
+	if status := p.CheckRequestSize(req); status != 0 {
+		log.Printf("%s %s", getRemoteAddr(req), http.StatusText(status))
+		p.requestMetrics.reject(rejectRequestTooLarge)
+		http.Error(rw, http.StatusText(status), status)
+		return
+	}
+	p.setBannerMessageHeader(req)
 	switch path := req.URL.Path; {
 	case path == p.RobotsPath:
 		p.RobotsTxt(rw)
 	case path == p.PingPath:
 		p.PingPage(rw)
+	case path == p.ReadyPath:
+		p.ReadyPage(rw)
+	case path == p.JWKSPath:
+		p.JWKS(rw)
+	case strings.HasPrefix(path, p.StaticPath):
+		p.ServeStatic(rw, req)
+	case !p.rateLimit(rw, req, p.clientKey(req), p.rateLimitPerIP):
+		// rate limited
+	case p.isCORSPath(path) && p.handleCORS(rw, req):
+		// preflight request
 	case p.IsWhitelistedRequest(req):
-		p.serveMux.ServeHTTP(rw, req)
+		p.serveUpstream(rw, req, nil)
+	case (path == p.SignInPath || path == p.OAuthCallbackPath) && p.denyLockedOut(rw, req):
+		// locked out
 	case path == p.SignInPath:
 		p.SignIn(rw, req)
 	case path == p.SignOutPath:
@@ -472,8 +1396,34 @@ func (p *OAuthProxy) ServeHTTP(rw http.ResponseWriter, req *http.Request) {
 		p.OAuthStart(rw, req)
 	case path == p.OAuthCallbackPath:
 		p.OAuthCallback(rw, req)
+	case path == p.RevokePath:
+		p.RevocationWebhook(rw, req)
+	case path == p.LockoutsPath:
+		p.Lockouts(rw, req)
+	case path == p.ConsentsPath:
+		p.Consents(rw, req)
+	case path == p.MetricsPath:
+		p.Metrics(rw, req)
+	case path == p.SessionStatsPath:
+		p.SessionStats(rw, req)
+	case path == p.MaintenancePath:
+		p.Maintenance(rw, req)
 	case path == p.AuthOnlyPath:
 		p.AuthenticateOnly(rw, req)
+	case path == p.ResubmitPath:
+		p.Resubmit(rw, req)
+	case path == p.SessionPath:
+		p.SessionInfo(rw, req)
+	case path == p.RefreshPath:
+		p.RefreshSession(rw, req)
+	case p.deviceFlow && path == p.DevicePath:
+		p.DevicePage(rw, req)
+	case p.deviceFlow && path == p.DeviceCodePath:
+		p.DeviceCode(rw, req)
+	case p.deviceFlow && path == p.DeviceTokenPath:
+		p.DeviceToken(rw, req)
+	case p.terms != nil && path == p.TermsPath:
+		p.TermsPage(rw, req)
 	default:
 		p.Proxy(rw, req)
 	}
@@ -482,17 +1432,24 @@ func (p *OAuthProxy) ServeHTTP(rw http.ResponseWriter, req *http.Request) {
 func (p *OAuthProxy) SignIn(rw http.ResponseWriter, req *http.Request) {
 	redirect, err := p.GetRedirect(req)
 	if err != nil {
-		p.ErrorPage(rw, 500, "Internal Error", err.Error())
+		p.errorPage(rw, req, 500, "Internal Error", err.Error())
+		return
+	}
+
+	if ok, sent := p.checkOrigin(req); req.Method == "POST" && sent && !ok {
+		log.Printf("%s sign in from foreign origin %q, potential attack", getRemoteAddr(req), req.Header.Get("Origin")+req.Header.Get("Referer"))
+		p.errorPage(rw, req, 403, "Permission Denied", "Invalid Origin")
 		return
 	}
 
 	user, ok := p.ManualSignIn(rw, req)
 	if ok {
 		session := &providers.SessionState{User: user}
-		p.SaveSession(rw, req, session)
+		p.saveNewSession(rw, req, session)
+		p.startSessionNonce(rw, req)
 		http.Redirect(rw, req, redirect, 302)
 	} else {
-		if p.SkipProviderButton {
+		if p.skipSignInPage(req) {
 			p.OAuthStart(rw, req)
 		} else {
 			p.SignInPage(rw, req, http.StatusOK)
@@ -500,25 +1457,287 @@ func (p *OAuthProxy) SignIn(rw http.ResponseWriter, req *http.Request) {
 	}
 }
 
+// skipSignInPage reports whether users are sent straight to the provider
+// instead of the sign in page, which is still needed to choose one of
+// several login providers if the browser didn't sign in with one before, or
+// to explain why signing in failed. htpasswd users post to the sign in page
+// from their own form.
+func (p *OAuthProxy) skipSignInPage(req *http.Request) bool {
+	if !p.SkipProviderButton || signInError(req) != "" {
+		return false
+	}
+	if len(p.loginProviders) == 0 {
+		return true
+	}
+	return p.rememberedLoginProvider(req) != nil
+}
+
+// SignOut clears the session on a POST from a page of the proxied sites, so
+// that a hostile page cannot sign users out with an image tag or a form.
+// With sign-out-confirm, the default, a GET asks users to confirm signing
+// out instead, so that existing sign out links keep working.
 func (p *OAuthProxy) SignOut(rw http.ResponseWriter, req *http.Request) {
+	if req.Method == "GET" && p.SignOutConfirm {
+		p.SignOutPage(rw, req)
+		return
+	}
+	if req.Method != "POST" {
+		if p.SignOutConfirm {
+			rw.Header().Set("Allow", "GET, POST")
+		} else {
+			rw.Header().Set("Allow", "POST")
+		}
+		http.Error(rw, "Method Not Allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	session, _, _ := p.LoadCookiedSession(req)
+	ok, sent := p.checkOrigin(req)
+	if !sent && session != nil {
+		token := req.Header.Get("X-CSRF-Token")
+		if token == "" {
+			token = req.FormValue("csrf_token")
+		}
+		csrfToken := p.CSRFToken(req, session)
+		ok = csrfToken != "" && hmac.Equal([]byte(token), []byte(csrfToken))
+	} else if !sent {
+		// without a session there is nothing to protect
+		ok = true
+	}
+	if !ok {
+		log.Printf("%s sign out without a valid origin or csrf token, potential attack", getRemoteAddr(req))
+		p.errorPage(rw, req, 403, "Permission Denied", "Invalid Origin")
+		return
+	}
+
+	if session != nil {
+		p.logSecurityEvent(req, eventSignOut, session.Email, "")
+	}
 	p.ClearSessionCookie(rw, req)
-	http.Redirect(rw, req, "/", 302)
+	if redirect := req.FormValue("rd"); redirect != "" && p.IsValidRedirect(req, redirect) {
+		http.Redirect(rw, req, redirect, 302)
+	} else if p.SignOutRedirect != "" {
+		http.Redirect(rw, req, p.SignOutRedirect, 302)
+	} else {
+		p.SignedOutPage(rw, req)
+	}
+}
+
+// SignOutPage asks users to confirm signing out with a form posted to
+// SignOut. Users without a session are told they are signed out.
+func (p *OAuthProxy) SignOutPage(rw http.ResponseWriter, req *http.Request) {
+	session, _, _ := p.LoadCookiedSession(req)
+	if session == nil {
+		p.SignedOutPage(rw, req)
+		return
+	}
+	redirect := req.FormValue("rd")
+	if !p.IsValidRedirect(req, redirect) {
+		redirect = ""
+	}
+	cancel := redirect
+	if cancel == "" {
+		cancel = "/"
+	}
+	nonce := p.setContentSecurityPolicy(rw)
+	t := struct {
+		Identity    string
+		CSRFToken   string
+		Redirect    string
+		Cancel      string
+		ProxyPrefix string
+		CSPNonce    string
+		Brand       branding
+	}{
+		Identity:    session.Email,
+		CSRFToken:   p.pageCSRFToken(rw, req, session),
+		Redirect:    redirect,
+		Cancel:      cancel,
+		ProxyPrefix: p.ProxyPrefix,
+		CSPNonce:    nonce,
+		Brand:       p.brand,
+	}
+	if t.Identity == "" {
+		t.Identity = session.User
+	}
+	p.executeTemplate(rw, req, "sign_out.html", t)
+}
+
+// SignedOutPage tells users they were signed out, with a link to sign in
+// again.
+func (p *OAuthProxy) SignedOutPage(rw http.ResponseWriter, req *http.Request) {
+	nonce := p.setContentSecurityPolicy(rw)
+	t := struct {
+		ProxyPrefix string
+		CSPNonce    string
+		Brand       branding
+	}{
+		ProxyPrefix: p.ProxyPrefix,
+		CSPNonce:    nonce,
+		Brand:       p.brand,
+	}
+	p.executeTemplate(rw, req, "signed_out.html", t)
+}
+
+// checkOrigin reports whether the Origin header of req, or its Referer
+// without one, is the requested host or a whitelist-domain, and whether
+// either header was sent.
+func (p *OAuthProxy) checkOrigin(req *http.Request) (ok, sent bool) {
+	origin := req.Header.Get("Origin")
+	if origin == "" {
+		origin = req.Header.Get("Referer")
+	}
+	if origin == "" {
+		return false, false
+	}
+	if p.isCORSPath(req.URL.Path) && p.corsOriginTrusted(req.Header.Get("Origin")) {
+		return true, true
+	}
+	if u, err := url.Parse(origin); err != nil || p.isAppRedirect(u) {
+		return false, true
+	}
+	return !strings.HasPrefix(origin, "/") && p.IsValidRedirect(req, origin), true
+}
+
+// CSRFToken returns the token that authorizes posts of the session of req
+// without an Origin or Referer header, such as a sign out. It is derived from
+// the session nonce, which is new for each sign in, so that the token is
+// useless once the user signs out; it is empty without a session nonce.
+func (p *OAuthProxy) CSRFToken(req *http.Request, session *providers.SessionState) string {
+	c, err := req.Cookie(p.sessionNonceCookie)
+	if err != nil || c.Value == "" {
+		return ""
+	}
+	return p.csrfToken(c.Value, session)
+}
+
+func (p *OAuthProxy) csrfToken(nonce string, session *providers.SessionState) string {
+	mac := hmac.New(sha256.New, []byte(p.CookieSeed))
+	if session.Email != "" {
+		mac.Write([]byte("csrf:" + nonce + ":email:" + session.Email))
+	} else {
+		mac.Write([]byte("csrf:" + nonce + ":user:" + session.User))
+	}
+	return b64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+}
+
+// pageCSRFToken returns the CSRF token for the forms of a page, starting a
+// session nonce for sessions that were signed in without one.
+func (p *OAuthProxy) pageCSRFToken(rw http.ResponseWriter, req *http.Request, session *providers.SessionState) string {
+	if token := p.CSRFToken(req, session); token != "" {
+		return token
+	}
+	nonce := p.startSessionNonce(rw, req)
+	if nonce == "" {
+		return ""
+	}
+	return p.csrfToken(nonce, session)
+}
+
+// startSessionNonce sets a new session nonce, at each sign in, so that the
+// CSRF tokens of earlier sessions in the browser no longer apply.
+func (p *OAuthProxy) startSessionNonce(rw http.ResponseWriter, req *http.Request) string {
+	nonce, err := cookie.Nonce()
+	if err != nil {
+		log.Printf("%s error creating session nonce %s", getRemoteAddr(req), err)
+		return ""
+	}
+	http.SetCookie(rw, p.makeCookie(req, p.sessionNonceCookie, nonce, p.CookieExpire, time.Now()))
+	return nonce
 }
 
 func (p *OAuthProxy) OAuthStart(rw http.ResponseWriter, req *http.Request) {
+	redirect, err := p.GetRedirect(req)
+	if err != nil {
+		p.errorPage(rw, req, 500, "Internal Error", err.Error())
+		return
+	}
+	p.redirectToProvider(rw, req, redirect, req.Form.Get("provider"))
+}
+
+// redirectToProvider starts the OAuth flow with the named login provider, or
+// else the one the browser signed in with last, which returns to redirect
+// after sign in.
+func (p *OAuthProxy) redirectToProvider(rw http.ResponseWriter, req *http.Request, redirect, providerName string) {
+	if !p.IsValidRedirect(req, redirect) {
+		redirect = "/"
+	}
+	if len(p.loginProviders) != 0 {
+		lp := p.loginProvider(providerName)
+		if lp == nil {
+			lp = p.loginProviderFor(req)
+		}
+		if lp == nil {
+			lp = p.loginProvider(defaultLoginProvider)
+		}
+		providerName = lp.Name
+		req = withLoginProvider(req, providerName)
+	} else {
+		providerName = ""
+	}
 	nonce, err := cookie.Nonce()
 	if err != nil {
-		p.ErrorPage(rw, 500, "Internal Error", err.Error())
+		p.errorPage(rw, req, 500, "Internal Error", err.Error())
 		return
 	}
-	p.SetCSRFCookie(rw, req, nonce)
-	redirect, err := p.GetRedirect(req)
+	if err := p.saveState(rw, req, nonce); err != nil {
+		log.Printf("%s error saving state %s", getRemoteAddr(req), err)
+		p.errorPage(rw, req, 500, "Internal Error", "Internal Error")
+		return
+	}
+	state, err := p.encodeState(nonce, providerName, redirect, time.Now())
 	if err != nil {
-		p.ErrorPage(rw, 500, "Internal Error", err.Error())
+		p.errorPage(rw, req, 500, "Internal Error", err.Error())
 		return
 	}
 	redirectURI := p.GetRedirectURI(req.Host)
-	http.Redirect(rw, req, p.provider.GetLoginURL(redirectURI, fmt.Sprintf("%v:%v", nonce, redirect)), 302)
+	http.Redirect(rw, req, p.providerFor(req).GetLoginURL(redirectURI, state), 302)
+}
+
+// Reasons for a failed sign in, shown on the sign in page.
+const (
+	signInStateInvalid   = "state_invalid"
+	signInProviderDenied = "provider_denied"
+	signInProviderError  = "provider_error"
+	signInRedeemFailed   = "redeem_failed"
+)
+
+var signInMessages = map[string]string{
+	signInStateInvalid:   "Your sign in expired or was started in another browser window. Please try again.",
+	signInProviderDenied: "The sign in was cancelled, or the provider did not grant access.",
+	signInProviderError:  "The provider could not sign you in. Please try again.",
+	signInRedeemFailed:   "The sign in could not be completed with the provider. Please try again.",
+}
+
+// signInFailed sends the user back to the sign in page, which explains the
+// reason for the failure without revealing its details, to try again.
+func (p *OAuthProxy) signInFailed(rw http.ResponseWriter, req *http.Request, reason, redirect string) {
+	p.requestMetrics.signInFailed(p.providerFor(req).Data().ProviderName, reason)
+	q := url.Values{"error": {reason}}
+	if redirect != "" {
+		q.Set("rd", redirect)
+	}
+	http.Redirect(rw, req, p.SignInPath+"?"+q.Encode(), 302)
+}
+
+// signInError returns the message for the reason of a failed sign in given to
+// the sign in page, if any.
+func signInError(req *http.Request) string {
+	return signInMessages[req.FormValue("error")]
+}
+
+// firstCallback records the state nonce and authorization code of a callback
+// for as long as the state is valid, and reports whether neither was seen
+// before. A replayed callback URL, or a leaked code presented with another
+// state, is thereby rejected.
+func (p *OAuthProxy) firstCallback(nonce, code string) (bool, error) {
+	sum := sha256.Sum256([]byte(code))
+	for _, key := range []string{"callback:state:" + nonce, "callback:code:" + hex.EncodeToString(sum[:])} {
+		ok, err := p.callbackStore.SetNX(key, []byte("1"), stateExpiration)
+		if err != nil || !ok {
+			return false, err
+		}
+	}
+	return true, nil
 }
 
 func (p *OAuthProxy) OAuthCallback(rw http.ResponseWriter, req *http.Request) {
@@ -527,101 +1746,289 @@ func (p *OAuthProxy) OAuthCallback(rw http.ResponseWriter, req *http.Request) {
 	// finish the oauth cycle
 	err := req.ParseForm()
 	if err != nil {
-		p.ErrorPage(rw, 500, "Internal Error", err.Error())
+		p.errorPage(rw, req, 500, "Internal Error", err.Error())
 		return
 	}
 	errorString := req.Form.Get("error")
 	if errorString != "" {
-		p.ErrorPage(rw, 403, "Permission Denied", errorString)
+		log.Printf("%s provider error %q", remoteAddr, errorString)
+		p.logSecurityEvent(req, eventLoginDenied, "", errorString)
+		p.recordSignInFailure(req, "")
+		_, _, redirect, _ := p.decodeState(req.Form.Get("state"))
+		if errorString == "access_denied" {
+			p.signInFailed(rw, req, signInProviderDenied, redirect)
+		} else {
+			p.signInFailed(rw, req, signInProviderError, redirect)
+		}
 		return
 	}
 
-	session, err := p.redeemCode(req.Host, req.Form.Get("code"))
+	nonce, providerName, redirect, err := p.decodeState(req.Form.Get("state"))
+	if err == nil && providerName != "" && p.loginProvider(providerName) == nil {
+		err = fmt.Errorf("unknown login provider %q", providerName)
+	}
 	if err != nil {
-		log.Printf("%s error redeeming code %s", remoteAddr, err)
-		p.ErrorPage(rw, 500, "Internal Error", "Internal Error")
+		log.Printf("%s %s, potential attack", remoteAddr, err)
+		p.logSecurityEvent(req, eventLoginDenied, "", "invalid state")
+		p.recordSignInFailure(req, "")
+		p.signInFailed(rw, req, signInStateInvalid, "")
 		return
 	}
-
-	s := strings.SplitN(req.Form.Get("state"), ":", 2)
-	if len(s) != 2 {
-		p.ErrorPage(rw, 500, "Internal Error", "Invalid State")
-		return
+	if providerName != "" {
+		req = withLoginProvider(req, providerName)
 	}
-	nonce := s[0]
-	redirect := s[1]
 	c, err := req.Cookie(p.CSRFCookieName)
 	if err != nil {
-		p.ErrorPage(rw, 403, "Permission Denied", err.Error())
+		log.Printf("%s %s", remoteAddr, err)
+		p.signInFailed(rw, req, signInStateInvalid, redirect)
 		return
 	}
 	p.ClearCSRFCookie(rw, req)
 	if c.Value != nonce {
 		log.Printf("%s csrf token mismatch, potential attack", remoteAddr)
-		p.ErrorPage(rw, 403, "Permission Denied", "csrf failed")
+		p.logSecurityEvent(req, eventLoginDenied, "", "csrf failed")
+		p.recordSignInFailure(req, "")
+		p.signInFailed(rw, req, signInStateInvalid, redirect)
 		return
 	}
+	if p.store != nil {
+		_, err = p.store.Take(stateKey(nonce))
+		if err == store.ErrNotFound {
+			log.Printf("%s unknown or expired state, potential attack", remoteAddr)
+			p.logSecurityEvent(req, eventLoginDenied, "", "csrf failed")
+			p.recordSignInFailure(req, "")
+			p.signInFailed(rw, req, signInStateInvalid, redirect)
+			return
+		} else if err != nil {
+			log.Printf("%s error loading state %s", remoteAddr, err)
+			p.errorPage(rw, req, 500, "Internal Error", "Internal Error")
+			return
+		}
+	}
 
-	if !strings.HasPrefix(redirect, "/") || strings.HasPrefix(redirect, "//") {
+	if !p.IsValidRedirect(req, redirect) {
 		redirect = "/"
 	}
 
+	first, err := p.firstCallback(nonce, req.Form.Get("code"))
+	if err != nil {
+		log.Printf("%s error recording callback %s", remoteAddr, err)
+		p.errorPage(rw, req, 500, "Internal Error", "Internal Error")
+		return
+	} else if !first {
+		log.Printf("%s state or code already used, potential replay", remoteAddr)
+		p.logSecurityEvent(req, eventLoginDenied, "", "replayed callback")
+		p.recordSignInFailure(req, "")
+		p.signInFailed(rw, req, signInStateInvalid, redirect)
+		return
+	}
+
+	session, err := p.redeemCode(req, req.Form.Get("code"))
+	if err != nil {
+		log.Printf("%s error redeeming code %s", remoteAddr, err)
+		p.signInFailed(rw, req, signInRedeemFailed, redirect)
+		return
+	}
+
 	// set cookie, or deny
-	if p.Validator(session.Email) && p.provider.ValidateGroup(session.Email) {
+	reason := p.denyReason(req, session, true)
+	if reason == "" {
 		log.Printf("%s authentication complete %s", remoteAddr, session)
-		err := p.SaveSession(rw, req, session)
+		p.logSecurityEvent(req, eventLogin, session.Email, "")
+		p.sessionMetrics.login(p.providerFor(req).Data().ProviderName, session.Email, time.Now())
+		p.setLastLoginProvider(rw, req, providerName)
+		err := p.saveNewSession(rw, req, session)
 		if err != nil {
 			log.Printf("%s %s", remoteAddr, err)
-			p.ErrorPage(rw, 500, "Internal Error", "Internal Error")
+			p.errorPage(rw, req, 500, "Internal Error", "Internal Error")
 			return
 		}
-		http.Redirect(rw, req, redirect, 302)
+		p.startSessionNonce(rw, req)
+		http.Redirect(rw, req, p.termsRedirect(session.Email, redirect), 302)
 	} else {
-		log.Printf("%s Permission Denied: %q is unauthorized", remoteAddr, session.Email)
-		p.ErrorPage(rw, 403, "Permission Denied", "Invalid Account")
+		log.Printf("%s Permission Denied: %q is unauthorized, %s", remoteAddr, session.Email, reason)
+		p.logSecurityEvent(req, eventLoginDenied, session.Email, reason)
+		p.recordSignInFailure(req, "")
+		p.requestMetrics.signInFailed(p.providerFor(req).Data().ProviderName, reason)
+		p.ForbiddenPage(rw, req, &denial{Identity: session.Email, Reason: reason})
 	}
 }
 
+// IsAuthorized reports whether email is authorized by email-domain and
+// authenticated-emails-file and, with checkGroup, the provider's group
+// restrictions. With authorization-audit-only, an unauthorized email is logged
+// as "would deny" and allowed.
+func (p *OAuthProxy) IsAuthorized(req *http.Request, email string, checkGroup bool) bool {
+	return p.denyReason(req, &providers.SessionState{Email: email}, checkGroup) == ""
+}
+
+// denyReason returns the reason code for denying the user of session s, as
+// IsAuthorized, or "" if they are authorized. Providers that know the groups
+// of users, such as Okta, check the groups in the session.
+func (p *OAuthProxy) denyReason(req *http.Request, s *providers.SessionState, checkGroup bool) string {
+	reason := ""
+	provider := p.providerFor(req)
+	if !p.Validator(s.Email) {
+		reason = denyEmailNotAllowed
+	} else if checkGroup && !provider.ValidateGroup(s.Email) {
+		reason = denyGroupNotAllowed
+	} else if v, ok := provider.(providers.SessionGroupValidator); ok && checkGroup && !v.ValidateSessionGroups(s) {
+		reason = denyGroupNotAllowed
+	}
+	if reason != "" && p.AuditOnly {
+		log.Printf("%s would deny: %q is unauthorized, %s (authorization-audit-only)", getRemoteAddr(req), s.Email, reason)
+		return ""
+	}
+	return reason
+}
+
 func (p *OAuthProxy) AuthenticateOnly(rw http.ResponseWriter, req *http.Request) {
-	status := p.Authenticate(rw, req)
+	if !p.maintenance.allowsUsers() && p.maintenance.blocks(req, nil) {
+		maintenanceDenied(rw)
+		return
+	}
+	status, _, session := p.authenticate(rw, req)
 	if status == http.StatusAccepted {
+		if ok, _ := p.termsAccepted(rw.Header().Get("GAP-Auth")); !ok {
+			termsNotAccepted(rw)
+			return
+		}
+		if p.maintenance.blocks(req, session) {
+			maintenanceDenied(rw)
+			return
+		}
 		rw.WriteHeader(http.StatusAccepted)
 	} else {
 		http.Error(rw, "unauthorized request", http.StatusUnauthorized)
 	}
 }
 
+// clientIP returns the address of the client; behind a reverse proxy on the
+// same host, the address it reports in X-Real-IP.
+func clientIP(req *http.Request) string {
+	host := normalizeIP(req.RemoteAddr)
+	if ip := net.ParseIP(host); ip != nil && ip.IsLoopback() && req.Header.Get("X-Real-IP") != "" {
+		return normalizeIP(req.Header.Get("X-Real-IP"))
+	}
+	return host
+}
+
+// normalizeIP strips the port, brackets and zone from a client address such
+// as [fe80::1%eth0]:4180, and formats IPv4-mapped IPv6 addresses as IPv4, so
+// the same client is always logged and counted under the same address.
+func normalizeIP(addr string) string {
+	host := addr
+	if h, _, err := net.SplitHostPort(addr); err == nil {
+		host = h
+	}
+	host = strings.TrimSuffix(strings.TrimPrefix(host, "["), "]")
+	if i := strings.LastIndex(host, "%"); i != -1 {
+		host = host[:i]
+	}
+	if ip := net.ParseIP(host); ip != nil {
+		return ip.String()
+	}
+	return host
+}
+
+// clientKey returns the key that rate limits and lockouts of the client
+// address are counted under. IPv6 addresses are counted by their
+// rate-limit-ipv6-prefix network, as one client usually has a whole /64.
+func (p *OAuthProxy) clientKey(req *http.Request) string {
+	addr := clientIP(req)
+	ip := net.ParseIP(addr)
+	if ip == nil || ip.To4() != nil || p.rateLimitV6Prefix == 0 || p.rateLimitV6Prefix >= 128 {
+		return "ip:" + addr
+	}
+	mask := net.CIDRMask(p.rateLimitV6Prefix, 128)
+	return "ip:" + (&net.IPNet{IP: ip.Mask(mask), Mask: mask}).String()
+}
+
+// rateLimit takes a token from the rate limit bucket for key, which allows
+// limit requests per minute in bursts of up to limit requests, and responds
+// 429 Too Many Requests if there is none left.
+func (p *OAuthProxy) rateLimit(rw http.ResponseWriter, req *http.Request, key string, limit int) bool {
+	if limit == 0 {
+		return true
+	}
+	ok, remaining, err := p.rateLimitStore.TakeToken("ratelimit:"+key, float64(limit)/60, limit)
+	if err != nil {
+		// don't turn a store outage into an outage of the upstreams
+		log.Printf("%s error checking rate limit %s", getRemoteAddr(req), err)
+		return true
+	}
+	rw.Header().Set("X-RateLimit-Limit", strconv.Itoa(limit))
+	rw.Header().Set("X-RateLimit-Remaining", strconv.Itoa(remaining))
+	if !ok {
+		log.Printf("%s rate limit exceeded for %s", getRemoteAddr(req), key)
+		p.requestMetrics.reject(rejectRateLimited)
+		rw.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(60/float64(limit)))))
+		http.Error(rw, "Too Many Requests", http.StatusTooManyRequests)
+		return false
+	}
+	return true
+}
+
 func (p *OAuthProxy) Proxy(rw http.ResponseWriter, req *http.Request) {
-	status := p.Authenticate(rw, req)
+	if !p.maintenance.allowsUsers() && p.maintenance.blocks(req, nil) {
+		// no need to sign in to be turned away
+		p.MaintenancePage(rw, req)
+		return
+	}
+	status, denied, session := p.authenticate(rw, req)
 	if status == http.StatusInternalServerError {
-		p.ErrorPage(rw, http.StatusInternalServerError,
+		p.errorPage(rw, req, http.StatusInternalServerError,
 			"Internal Error", "Internal Error")
+	} else if status == http.StatusForbidden && denied != nil {
+		p.ForbiddenPage(rw, req, denied)
 	} else if status == http.StatusForbidden {
-		if p.SkipProviderButton {
-			p.OAuthStart(rw, req)
+		if p.skipSignInPage(req) {
+			p.ClearSessionCookie(rw, req)
+			p.redirectToProvider(rw, req, p.signInRedirect(rw, req), "")
 		} else {
 			p.SignInPage(rw, req, http.StatusForbidden)
 		}
-	} else {
-		p.serveMux.ServeHTTP(rw, req)
+	} else if !p.checkTerms(rw, req) {
+		// sent to accept the terms
+	} else if p.rateLimit(rw, req, "user:"+rw.Header().Get("GAP-Auth"), p.rateLimitPerUser) {
+		p.serveUpstream(rw, req, session)
 	}
 }
 
 func (p *OAuthProxy) Authenticate(rw http.ResponseWriter, req *http.Request) int {
+	status, _, _ := p.authenticate(rw, req)
+	return status
+}
+
+// authenticate is Authenticate, which also returns why a signed in user was
+// denied, if they were, or else the session of the authenticated user.
+func (p *OAuthProxy) authenticate(rw http.ResponseWriter, req *http.Request) (int, *denial, *providers.SessionState) {
 	var saveSession, clearSession, revalidated bool
+	var denied *denial
 	remoteAddr := getRemoteAddr(req)
 
 	session, sessionAge, err := p.LoadCookiedSession(req)
 	if err != nil {
 		log.Printf("%s %s", remoteAddr, err)
 	}
+	if session != nil && p.IsRevoked(session.Email, sessionAge) {
+		log.Printf("%s removing session. revoked by the identity provider %s", remoteAddr, session)
+		p.logSecurityEvent(req, eventSessionRevoked, session.Email, "revoked by the identity provider")
+		session = nil
+		clearSession = true
+	}
 	if session != nil && sessionAge > p.CookieRefresh && p.CookieRefresh != time.Duration(0) {
 		log.Printf("%s refreshing %s old session cookie for %s (refresh after %s)", remoteAddr, sessionAge, session, p.CookieRefresh)
 		saveSession = true
 	}
 
-	if ok, err := p.provider.RefreshSessionIfNeeded(session); err != nil {
+	provider := p.providerFor(req)
+	if p.refreshedAhead(provider, session) {
+		saveSession = true
+		revalidated = true
+	} else if ok, err := p.refreshSession(provider, session); err != nil {
 		log.Printf("%s removing session. error refreshing access token %s %s", remoteAddr, err, session)
+		p.logSecurityEvent(req, eventRefreshFailed, session.Email, err.Error())
 		clearSession = true
 		session = nil
 	} else if ok {
@@ -637,7 +2044,7 @@ func (p *OAuthProxy) Authenticate(rw http.ResponseWriter, req *http.Request) int
 	}
 
 	if saveSession && !revalidated && session != nil && session.AccessToken != "" {
-		if !p.provider.ValidateSessionState(session) {
+		if !p.validateSession(provider, session) {
 			log.Printf("%s removing session. error validating %s", remoteAddr, session)
 			saveSession = false
 			session = nil
@@ -645,8 +2052,14 @@ func (p *OAuthProxy) Authenticate(rw http.ResponseWriter, req *http.Request) int
 		}
 	}
 
-	if session != nil && session.Email != "" && !p.Validator(session.Email) {
-		log.Printf("%s Permission Denied: removing session %s", remoteAddr, session)
+	if session != nil && session.Email != "" {
+		if reason := p.denyReason(req, session, false); reason != "" {
+			denied = &denial{Identity: session.Email, Reason: reason}
+		}
+	}
+	if denied != nil {
+		log.Printf("%s Permission Denied: removing session %s, %s", remoteAddr, session, denied.Reason)
+		p.logSecurityEvent(req, eventAccessDenied, session.Email, denied.Reason)
 		session = nil
 		saveSession = false
 		clearSession = true
@@ -656,7 +2069,7 @@ func (p *OAuthProxy) Authenticate(rw http.ResponseWriter, req *http.Request) int
 		err := p.SaveSession(rw, req, session)
 		if err != nil {
 			log.Printf("%s %s", remoteAddr, err)
-			return http.StatusInternalServerError
+			return http.StatusInternalServerError, nil, nil
 		}
 	}
 
@@ -664,15 +2077,39 @@ func (p *OAuthProxy) Authenticate(rw http.ResponseWriter, req *http.Request) int
 		p.ClearSessionCookie(rw, req)
 	}
 
+	source := provider.Data().ProviderName
+	if session == nil {
+		session, err = p.CheckTrustedIdentity(req)
+		source = "trusted-identity"
+		if err != nil {
+			log.Printf("%s %s", remoteAddr, err)
+		}
+	}
+
 	if session == nil {
 		session, err = p.CheckBasicAuth(req)
+		source = "htpasswd"
+		if err != nil {
+			log.Printf("%s %s", remoteAddr, err)
+		}
+	}
+
+	if session == nil {
+		session, err = p.CheckClientCert(req)
+		source = "client-cert"
 		if err != nil {
 			log.Printf("%s %s", remoteAddr, err)
 		}
 	}
 
 	if session == nil {
-		return http.StatusForbidden
+		if denied != nil {
+			rw.Header().Set(deniedReasonHeader, denied.Reason)
+			p.requestMetrics.reject(denied.Reason)
+		} else {
+			p.requestMetrics.reject(rejectUnauthenticated)
+		}
+		return http.StatusForbidden, denied, nil
 	}
 
 	// At this point, the user is authenticated. proxy normally
@@ -683,27 +2120,47 @@ func (p *OAuthProxy) Authenticate(rw http.ResponseWriter, req *http.Request) int
 			req.Header["X-Forwarded-Email"] = []string{session.Email}
 		}
 	}
+	// never pass on groups sent by the client
+	req.Header.Del("X-Forwarded-Groups")
 	if p.PassUserHeaders {
 		req.Header["X-Forwarded-User"] = []string{session.User}
 		if session.Email != "" {
 			req.Header["X-Forwarded-Email"] = []string{session.Email}
 		}
+		if len(session.Groups) != 0 {
+			req.Header["X-Forwarded-Groups"] = []string{strings.Join(session.Groups, ",")}
+		}
 	}
 	if p.SetXAuthRequest {
 		rw.Header().Set("X-Auth-Request-User", session.User)
 		if session.Email != "" {
 			rw.Header().Set("X-Auth-Request-Email", session.Email)
 		}
+		if len(session.Groups) != 0 {
+			rw.Header().Set("X-Auth-Request-Groups", strings.Join(session.Groups, ","))
+		}
 	}
 	if p.PassAccessToken && session.AccessToken != "" {
 		req.Header["X-Forwarded-Access-Token"] = []string{session.AccessToken}
 	}
+	if p.identitySigner != nil {
+		token, err := p.identitySigner.Sign(session, p.identityIssuer, p.upstreamAudience(req), time.Now())
+		if err != nil {
+			log.Printf("%s error signing upstream JWT %s", remoteAddr, err)
+			return http.StatusInternalServerError, nil, nil
+		}
+		req.Header.Set(p.identityHeader, token)
+		if p.SetXAuthRequest {
+			rw.Header().Set(p.identityHeader, token)
+		}
+	}
 	if session.Email == "" {
 		rw.Header().Set("GAP-Auth", session.User)
 	} else {
 		rw.Header().Set("GAP-Auth", session.Email)
 	}
-	return http.StatusAccepted
+	p.sessionMetrics.seen(source, rw.Header().Get("GAP-Auth"), time.Now())
+	return http.StatusAccepted, nil, session
 }
 
 func (p *OAuthProxy) CheckBasicAuth(req *http.Request) (*providers.SessionState, error) {
@@ -732,3 +2189,27 @@ func (p *OAuthProxy) CheckBasicAuth(req *http.Request) (*providers.SessionState,
 	}
 	return nil, fmt.Errorf("%s not in HtpasswdFile", pair[0])
 }
+
+// CheckClientCert authenticates a request by the client certificate verified
+// by the HTTPS listener (see tls-client-ca). The first email address in the
+// subject alternative names is the email, which must be authorized like a
+// signed in user's; the subject common name is the user. Certificates without
+// an email address are rejected, since there is nothing to authorize.
+func (p *OAuthProxy) CheckClientCert(req *http.Request) (*providers.SessionState, error) {
+	if req.TLS == nil || len(req.TLS.VerifiedChains) == 0 {
+		return nil, nil
+	}
+	cert := req.TLS.VerifiedChains[0][0]
+	if len(cert.EmailAddresses) == 0 {
+		return nil, fmt.Errorf("client certificate %s (%q) has no email address", cert.SerialNumber, cert.Subject.CommonName)
+	}
+	s := &providers.SessionState{User: cert.Subject.CommonName, Email: cert.EmailAddresses[0]}
+	if !p.IsAuthorized(req, s.Email, false) {
+		return nil, fmt.Errorf("client certificate for %s not authorized", s.Email)
+	}
+	if s.User == "" {
+		s.User = strings.Split(s.Email, "@")[0]
+	}
+	log.Printf("authenticated %q via client certificate", s.User)
+	return s, nil
+}
@@ -1,8 +1,13 @@
-package main
+package oauth2proxy
 
 import (
 	"crypto"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
 	"encoding/base64"
+	"encoding/json"
+	"errors"
 	"io"
 	"io/ioutil"
 	"log"
@@ -10,12 +15,15 @@ import (
 	"net/http"
 	"net/http/httptest"
 	"net/url"
+	"os"
 	"regexp"
 	"strings"
+	"sync"
 	"testing"
 	"time"
 
 	"github.com/bitly/oauth2_proxy/providers"
+	"github.com/bitly/oauth2_proxy/store"
 	"github.com/mbland/hmacauth"
 	"github.com/stretchr/testify/assert"
 )
@@ -81,10 +89,10 @@ func TestRobotsTxt(t *testing.T) {
 	opts := NewOptions()
 	opts.ClientID = "bazquux"
 	opts.ClientSecret = "foobar"
-	opts.CookieSecret = "xyzzyplugh"
+	opts.CookieSecret = "xyzzyplughxyzzyplughxyzzyplughxp"
 	opts.Validate()
 
-	proxy := NewOAuthProxy(opts, func(string) bool { return true })
+	proxy := newOAuthProxy(opts, func(string) bool { return true })
 	rw := httptest.NewRecorder()
 	req, _ := http.NewRequest("GET", "/robots.txt", nil)
 	proxy.ServeHTTP(rw, req)
@@ -166,12 +174,13 @@ func TestBasicAuthPassword(t *testing.T) {
 	const user_name = "michael.bland"
 
 	opts.provider = NewTestProvider(provider_url, email_address)
-	proxy := NewOAuthProxy(opts, func(email string) bool {
+	proxy := newOAuthProxy(opts, func(email string) bool {
 		return email == email_address
 	})
 
 	rw := httptest.NewRecorder()
-	req, _ := http.NewRequest("GET", "/oauth2/callback?code=callback_code&state=nonce:",
+	state, _ := proxy.encodeState("nonce", "", "", time.Now())
+	req, _ := http.NewRequest("GET", "/oauth2/callback?code=callback_code&state="+url.QueryEscape(state),
 		strings.NewReader(""))
 	req.AddCookie(proxy.MakeCSRFCookie(req, "nonce", proxy.CookieExpire, time.Now()))
 	proxy.ServeHTTP(rw, req)
@@ -257,7 +266,7 @@ func NewPassAccessTokenTest(opts PassAccessTokenTestOptions) *PassAccessTokenTes
 	const email_address = "michael.bland@gsa.gov"
 
 	t.opts.provider = NewTestProvider(provider_url, email_address)
-	t.proxy = NewOAuthProxy(t.opts, func(email string) bool {
+	t.proxy = newOAuthProxy(t.opts, func(email string) bool {
 		return email == email_address
 	})
 	return t
@@ -270,7 +279,8 @@ func (pat_test *PassAccessTokenTest) Close() {
 func (pat_test *PassAccessTokenTest) getCallbackEndpoint() (http_code int,
 	cookie string) {
 	rw := httptest.NewRecorder()
-	req, err := http.NewRequest("GET", "/oauth2/callback?code=callback_code&state=nonce:",
+	state, _ := pat_test.proxy.encodeState("nonce", "", "", time.Now())
+	req, err := http.NewRequest("GET", "/oauth2/callback?code=callback_code&state="+url.QueryEscape(state),
 		strings.NewReader(""))
 	if err != nil {
 		return 0, ""
@@ -373,13 +383,13 @@ func NewSignInPageTest(skipProvider bool) *SignInPageTest {
 	var sip_test SignInPageTest
 
 	sip_test.opts = NewOptions()
-	sip_test.opts.CookieSecret = "foobar"
+	sip_test.opts.CookieSecret = "xyzzyplughxyzzyplughxyzzyplughxp"
 	sip_test.opts.ClientID = "bazquux"
 	sip_test.opts.ClientSecret = "xyzzyplugh"
 	sip_test.opts.SkipProviderButton = skipProvider
 	sip_test.opts.Validate()
 
-	sip_test.proxy = NewOAuthProxy(sip_test.opts, func(email string) bool {
+	sip_test.proxy = newOAuthProxy(sip_test.opts, func(email string) bool {
 		return true
 	})
 	sip_test.sign_in_regexp = regexp.MustCompile(signInRedirectPattern)
@@ -456,6 +466,29 @@ func TestSignInPageSkipProviderDirect(t *testing.T) {
 	}
 }
 
+func TestSignInPageSkipProviderKeepsTarget(t *testing.T) {
+	sip_test := NewSignInPageTest(true)
+	rw := httptest.NewRecorder()
+	req, _ := http.NewRequest("GET", "/some/random/endpoint?a=b", nil)
+	sip_test.proxy.ServeHTTP(rw, req)
+	assert.Equal(t, 302, rw.Code)
+
+	location, _ := url.Parse(rw.Header().Get("Location"))
+	_, _, redirect, err := sip_test.proxy.decodeState(location.Query().Get("state"))
+	assert.Equal(t, nil, err)
+	assert.Equal(t, "/some/random/endpoint?a=b", redirect)
+}
+
+func TestSignInPageSkipProviderWithHtpasswdForm(t *testing.T) {
+	sip_test := NewSignInPageTest(true)
+	sip_test.proxy.HtpasswdFile = &HtpasswdFile{Users: map[string]string{}}
+	sip_test.proxy.DisplayHtpasswdForm = true
+
+	// the htpasswd form doesn't keep users from being sent to the provider
+	code, _ := sip_test.GetEndpoint("/some/random/endpoint")
+	assert.Equal(t, 302, code)
+}
+
 type ProcessCookieTest struct {
 	opts          *Options
 	proxy         *OAuthProxy
@@ -482,7 +515,7 @@ func NewProcessCookieTest(opts ProcessCookieTestOpts) *ProcessCookieTest {
 	pc_test.opts.CookieRefresh = time.Hour
 	pc_test.opts.Validate()
 
-	pc_test.proxy = NewOAuthProxy(pc_test.opts, func(email string) bool {
+	pc_test.proxy = newOAuthProxy(pc_test.opts, func(email string) bool {
 		return pc_test.validate_user
 	})
 	pc_test.proxy.provider = &TestProvider{
@@ -644,6 +677,18 @@ func TestAuthOnlyEndpointUnauthorizedOnEmailValidationFailure(t *testing.T) {
 	assert.Equal(t, "unauthorized request\n", string(bodyBytes))
 }
 
+func TestAuthOnlyEndpointAuditOnlyAllowsUnauthorizedEmail(t *testing.T) {
+	test := NewAuthOnlyEndpointTest()
+	startSession := &providers.SessionState{
+		Email: "michael.bland@gsa.gov", AccessToken: "my_access_token"}
+	test.SaveSession(startSession, time.Now())
+	test.validate_user = false
+	test.proxy.AuditOnly = true
+
+	test.proxy.ServeHTTP(test.rw, test.req)
+	assert.Equal(t, http.StatusAccepted, test.rw.Code)
+}
+
 func TestAuthOnlyEndpointSetXAuthRequestHeaders(t *testing.T) {
 	var pc_test ProcessCookieTest
 
@@ -651,7 +696,7 @@ func TestAuthOnlyEndpointSetXAuthRequestHeaders(t *testing.T) {
 	pc_test.opts.SetXAuthRequest = true
 	pc_test.opts.Validate()
 
-	pc_test.proxy = NewOAuthProxy(pc_test.opts, func(email string) bool {
+	pc_test.proxy = newOAuthProxy(pc_test.opts, func(email string) bool {
 		return pc_test.validate_user
 	})
 	pc_test.proxy.provider = &TestProvider{
@@ -674,6 +719,50 @@ func TestAuthOnlyEndpointSetXAuthRequestHeaders(t *testing.T) {
 	assert.Equal(t, "oauth_user@example.com", pc_test.rw.HeaderMap["X-Auth-Request-Email"][0])
 }
 
+func TestAuthOnlyEndpointPassesGroups(t *testing.T) {
+	var pc_test ProcessCookieTest
+
+	pc_test.opts = NewOptions()
+	pc_test.opts.SetXAuthRequest = true
+	pc_test.opts.Validate()
+
+	pc_test.proxy = newOAuthProxy(pc_test.opts, func(email string) bool {
+		return pc_test.validate_user
+	})
+	pc_test.proxy.provider = &TestProvider{
+		ValidToken: true,
+	}
+
+	pc_test.validate_user = true
+
+	pc_test.rw = httptest.NewRecorder()
+	pc_test.req, _ = http.NewRequest("GET",
+		pc_test.opts.ProxyPrefix+"/auth", nil)
+	pc_test.req.Header.Set("X-Forwarded-Groups", "admins")
+
+	startSession := &providers.SessionState{
+		User: "oauth_user", Email: "oauth_user@example.com", AccessToken: "oauth_token",
+		Groups: []string{"Engineering", "Ops"}}
+	pc_test.SaveSession(startSession, time.Now())
+
+	pc_test.proxy.ServeHTTP(pc_test.rw, pc_test.req)
+	assert.Equal(t, http.StatusAccepted, pc_test.rw.Code)
+	assert.Equal(t, "Engineering,Ops", pc_test.rw.HeaderMap.Get("X-Auth-Request-Groups"))
+	assert.Equal(t, []string{"Engineering,Ops"}, pc_test.req.Header["X-Forwarded-Groups"])
+
+	// groups sent by the client are dropped without pass-user-headers too
+	pc_test.proxy.PassUserHeaders = false
+	pc_test.rw = httptest.NewRecorder()
+	pc_test.req, _ = http.NewRequest("GET",
+		pc_test.opts.ProxyPrefix+"/auth", nil)
+	pc_test.req.Header.Set("X-Forwarded-Groups", "admins")
+	pc_test.SaveSession(startSession, time.Now())
+
+	pc_test.proxy.ServeHTTP(pc_test.rw, pc_test.req)
+	assert.Equal(t, http.StatusAccepted, pc_test.rw.Code)
+	assert.Equal(t, "", pc_test.req.Header.Get("X-Forwarded-Groups"))
+}
+
 func TestAuthSkippedForPreflightRequests(t *testing.T) {
 	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		w.WriteHeader(200)
@@ -685,14 +774,14 @@ func TestAuthSkippedForPreflightRequests(t *testing.T) {
 	opts.Upstreams = append(opts.Upstreams, upstream.URL)
 	opts.ClientID = "bazquux"
 	opts.ClientSecret = "foobar"
-	opts.CookieSecret = "xyzzyplugh"
+	opts.CookieSecret = "xyzzyplughxyzzyplughxyzzyplughxp"
 	opts.SkipAuthPreflight = true
 	opts.Validate()
 
 	upstream_url, _ := url.Parse(upstream.URL)
 	opts.provider = NewTestProvider(upstream_url, "")
 
-	proxy := NewOAuthProxy(opts, func(string) bool { return false })
+	proxy := newOAuthProxy(opts, func(string) bool { return false })
 	rw := httptest.NewRecorder()
 	req, _ := http.NewRequest("OPTIONS", "/preflight-request", nil)
 	proxy.ServeHTTP(rw, req)
@@ -732,7 +821,7 @@ type SignatureTest struct {
 
 func NewSignatureTest() *SignatureTest {
 	opts := NewOptions()
-	opts.CookieSecret = "cookie secret"
+	opts.CookieSecret = "xyzzyplughxyzzyplughxyzzyplughxp"
 	opts.ClientID = "client ID"
 	opts.ClientSecret = "client secret"
 	opts.EmailDomains = []string{"acm.org"}
@@ -787,7 +876,7 @@ func (st *SignatureTest) MakeRequestWithExpectedKey(method, body, key string) {
 	if err != nil {
 		panic(err)
 	}
-	proxy := NewOAuthProxy(st.opts, func(email string) bool { return true })
+	proxy := newOAuthProxy(st.opts, func(email string) bool { return true })
 
 	var bodyBuf io.ReadCloser
 	if body != "" {
@@ -836,3 +925,1213 @@ func TestRequestSignaturePostRequest(t *testing.T) {
 	assert.Equal(t, 200, st.rw.Code)
 	assert.Equal(t, st.rw.Body.String(), "signatures match")
 }
+
+func TestOAuthStartUsesHostProvider(t *testing.T) {
+	secretFile := writeSecretFile(t, "app-secret")
+	defer os.Remove(secretFile)
+	opts := testOptions()
+	opts.HostProviders = []string{"app.example.com=github:app-id:" + secretFile}
+	assert.Equal(t, nil, opts.Validate())
+	proxy := newOAuthProxy(opts, func(string) bool { return true })
+
+	for host, loginURL := range map[string]string{
+		"app.example.com:8443": "https://github.com/login/oauth/authorize?",
+		"other.example.com":    "https://accounts.google.com/o/oauth2/auth?",
+	} {
+		rw := httptest.NewRecorder()
+		req, _ := http.NewRequest("GET", "http://"+host+"/oauth2/start", nil)
+		proxy.ServeHTTP(rw, req)
+		assert.Equal(t, 302, rw.Code)
+		assert.True(t, strings.HasPrefix(rw.Header().Get("Location"), loginURL),
+			rw.Header().Get("Location"))
+	}
+}
+
+func TestLoginProviderPicker(t *testing.T) {
+	provider := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(`{"access_token": "my_auth_token"}`))
+	}))
+	defer provider.Close()
+	provider_url, _ := url.Parse(provider.URL)
+
+	secretFile := writeSecretFile(t, "gh-secret")
+	defer os.Remove(secretFile)
+	opts := testOptions()
+	opts.SkipProviderButton = true
+	opts.LoginProviders = []string{"github=github:gh-id:" + secretFile}
+	opts.LoginProviderIcons = []string{"github=https://static.example.com/github.png"}
+	assert.Equal(t, nil, opts.Validate())
+	proxy := newOAuthProxy(opts, func(string) bool { return true })
+
+	// the picker is shown despite skip-provider-button
+	rw := httptest.NewRecorder()
+	req, _ := http.NewRequest("GET", "/oauth2/sign_in", nil)
+	proxy.ServeHTTP(rw, req)
+	assert.Equal(t, 200, rw.Code)
+	body := rw.Body.String()
+	assert.Contains(t, body, `value="default"`)
+	assert.Contains(t, body, "Sign in with Google")
+	assert.Contains(t, body, `value="github"`)
+	assert.Contains(t, body, "Sign in with GitHub")
+	assert.NotContains(t, body, "Use a different account")
+	assert.Contains(t, rw.Header().Get("Content-Security-Policy"), "img-src 'self' https://static.example.com;")
+
+	rw = httptest.NewRecorder()
+	req, _ = http.NewRequest("GET", "/oauth2/start?provider=github&rd=/foo", nil)
+	proxy.ServeHTTP(rw, req)
+	assert.Equal(t, 302, rw.Code)
+	loginURL, _ := url.Parse(rw.Header().Get("Location"))
+	assert.Equal(t, "github.com", loginURL.Host)
+	assert.Equal(t, "gh-id", loginURL.Query().Get("client_id"))
+	_, providerName, _, err := proxy.decodeState(loginURL.Query().Get("state"))
+	assert.Equal(t, nil, err)
+	assert.Equal(t, "github", providerName)
+
+	// the callback is redeemed with the provider of the state, which is then
+	// remembered
+	proxy.loginProvider("github").provider = NewTestProvider(provider_url, "michael.bland@gsa.gov")
+	state, _ := proxy.encodeState("nonce", "github", "/foo", time.Now())
+	rw = httptest.NewRecorder()
+	req, _ = http.NewRequest("GET", "/oauth2/callback?code=callback_code&state="+url.QueryEscape(state), nil)
+	req.AddCookie(proxy.MakeCSRFCookie(req, "nonce", proxy.CookieExpire, time.Now()))
+	proxy.ServeHTTP(rw, req)
+	assert.Equal(t, 302, rw.Code)
+	assert.Equal(t, "/foo", rw.Header().Get("Location"))
+	var last *http.Cookie
+	for _, c := range (&http.Response{Header: rw.HeaderMap}).Cookies() {
+		if c.Name == proxy.lastProviderCookieName() {
+			last = c
+		}
+	}
+	if last == nil {
+		t.Fatal("last provider cookie not set")
+	}
+
+	// without a choice, the last used provider is preselected
+	rw = httptest.NewRecorder()
+	req, _ = http.NewRequest("GET", "/oauth2/start", nil)
+	req.AddCookie(last)
+	proxy.ServeHTTP(rw, req)
+	loginURL, _ = url.Parse(rw.Header().Get("Location"))
+	assert.Equal(t, provider_url.Host, loginURL.Host)
+
+	// a state naming an unknown provider is rejected
+	state, _ = proxy.encodeState("nonce", "gitlab", "/foo", time.Now())
+	rw = httptest.NewRecorder()
+	req, _ = http.NewRequest("GET", "/oauth2/callback?code=other_code&state="+url.QueryEscape(state), nil)
+	req.AddCookie(proxy.MakeCSRFCookie(req, "nonce", proxy.CookieExpire, time.Now()))
+	proxy.ServeHTTP(rw, req)
+	assert.Equal(t, "/oauth2/sign_in?error=state_invalid", rw.Header().Get("Location"))
+}
+
+func TestRememberedLoginProvider(t *testing.T) {
+	secretFile := writeSecretFile(t, "gh-secret")
+	defer os.Remove(secretFile)
+	opts := testOptions()
+	opts.LoginProviders = []string{"github=github:gh-id:" + secretFile}
+	assert.Equal(t, nil, opts.Validate())
+	proxy := newOAuthProxy(opts, func(string) bool { return true })
+
+	rw := httptest.NewRecorder()
+	req, _ := http.NewRequest("GET", "/", nil)
+	proxy.setLastLoginProvider(rw, req, "github")
+	last := (&http.Response{Header: rw.HeaderMap}).Cookies()[0]
+
+	// only the remembered provider is offered, with a way to choose another
+	rw = httptest.NewRecorder()
+	req, _ = http.NewRequest("GET", "/oauth2/sign_in?rd=/foo", nil)
+	req.AddCookie(last)
+	proxy.ServeHTTP(rw, req)
+	assert.Equal(t, 200, rw.Code)
+	body := rw.Body.String()
+	assert.Contains(t, body, `value="github"`)
+	assert.NotContains(t, body, `value="default"`)
+	assert.Contains(t, body, `href="/oauth2/sign_in?choose_provider=1&amp;rd=%2ffoo">Use a different account</a>`)
+
+	rw = httptest.NewRecorder()
+	req, _ = http.NewRequest("GET", "/oauth2/sign_in?choose_provider=1&rd=/foo", nil)
+	req.AddCookie(last)
+	proxy.ServeHTTP(rw, req)
+	body = rw.Body.String()
+	assert.Contains(t, body, `value="github"`)
+	assert.Contains(t, body, `value="default"`)
+	assert.Contains(t, body, `name="rd" value="/foo"`)
+	assert.NotContains(t, body, "Use a different account")
+
+	// with skip-provider-button, the remembered provider is started directly
+	proxy.SkipProviderButton = true
+	rw = httptest.NewRecorder()
+	req, _ = http.NewRequest("GET", "/oauth2/sign_in?rd=/foo", nil)
+	req.AddCookie(last)
+	proxy.ServeHTTP(rw, req)
+	assert.Equal(t, 302, rw.Code)
+	loginURL, _ := url.Parse(rw.Header().Get("Location"))
+	assert.Equal(t, "github.com", loginURL.Host)
+
+	rw = httptest.NewRecorder()
+	req, _ = http.NewRequest("GET", "/oauth2/sign_in?choose_provider=1", nil)
+	req.AddCookie(last)
+	proxy.ServeHTTP(rw, req)
+	assert.Equal(t, 200, rw.Code)
+
+	// a forged cookie is ignored
+	rw = httptest.NewRecorder()
+	req, _ = http.NewRequest("GET", "/oauth2/sign_in", nil)
+	req.AddCookie(&http.Cookie{Name: proxy.lastProviderCookieName(), Value: "github"})
+	proxy.ServeHTTP(rw, req)
+	assert.Equal(t, 200, rw.Code)
+	assert.Contains(t, rw.Body.String(), `value="default"`)
+}
+
+func TestSignInFailureFeedback(t *testing.T) {
+	provider := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.Error(w, `{"error": "invalid_grant"}`, 400)
+	}))
+	defer provider.Close()
+	provider_url, _ := url.Parse(provider.URL)
+
+	opts := testOptions()
+	opts.SkipProviderButton = true
+	assert.Equal(t, nil, opts.Validate())
+	opts.provider = NewTestProvider(provider_url, "michael.bland@gsa.gov")
+	proxy := newOAuthProxy(opts, func(string) bool { return true })
+
+	state, _ := proxy.encodeState("nonce", "", "/foo", time.Now())
+	rw := httptest.NewRecorder()
+	req, _ := http.NewRequest("GET", "/oauth2/callback?error=access_denied&state="+url.QueryEscape(state), nil)
+	proxy.ServeHTTP(rw, req)
+	assert.Equal(t, 302, rw.Code)
+	assert.Equal(t, "/oauth2/sign_in?error=provider_denied&rd=%2Ffoo", rw.Header().Get("Location"))
+
+	// the sign in page is shown despite skip-provider-button, so that users
+	// aren't sent straight back to the provider
+	rw = httptest.NewRecorder()
+	req, _ = http.NewRequest("GET", "/oauth2/sign_in?error=provider_denied&rd=%2Ffoo", nil)
+	proxy.ServeHTTP(rw, req)
+	assert.Equal(t, 200, rw.Code)
+	body := rw.Body.String()
+	assert.Contains(t, body, `<p class="alert" role="alert">The sign in was cancelled, or the provider did not grant access.</p>`)
+	assert.Contains(t, body, `name="rd" value="/foo"`)
+
+	// unknown reasons are not shown
+	rw = httptest.NewRecorder()
+	req, _ = http.NewRequest("GET", "/oauth2/sign_in?error=%3Cscript%3E", nil)
+	proxy.ServeHTTP(rw, req)
+	assert.Equal(t, 302, rw.Code)
+
+	// the code couldn't be redeemed
+	rw = httptest.NewRecorder()
+	req, _ = http.NewRequest("GET", "/oauth2/callback?code=callback_code&state="+url.QueryEscape(state), nil)
+	req.AddCookie(proxy.MakeCSRFCookie(req, "nonce", proxy.CookieExpire, time.Now()))
+	proxy.ServeHTTP(rw, req)
+	assert.Equal(t, 302, rw.Code)
+	assert.Equal(t, "/oauth2/sign_in?error=redeem_failed&rd=%2Ffoo", rw.Header().Get("Location"))
+}
+
+// groupDenyingProvider is a TestProvider whose users are in no allowed group.
+type groupDenyingProvider struct {
+	*TestProvider
+}
+
+func (groupDenyingProvider) ValidateGroup(string) bool {
+	return false
+}
+
+func TestForbiddenPage(t *testing.T) {
+	provider := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(`{"access_token": "my_auth_token"}`))
+	}))
+	defer provider.Close()
+	provider_url, _ := url.Parse(provider.URL)
+
+	opts := testOptions()
+	opts.SkipProviderButton = true
+	assert.Equal(t, nil, opts.Validate())
+	opts.provider = NewTestProvider(provider_url, "michael.bland@gsa.gov")
+	allowed := false
+	proxy := newOAuthProxy(opts, func(string) bool { return allowed })
+
+	callback := func(nonce string) *httptest.ResponseRecorder {
+		state, _ := proxy.encodeState(nonce, "", "/foo", time.Now())
+		rw := httptest.NewRecorder()
+		req, _ := http.NewRequest("GET", "/oauth2/callback?code=code_"+nonce+"&state="+url.QueryEscape(state), nil)
+		req.AddCookie(proxy.MakeCSRFCookie(req, nonce, proxy.CookieExpire, time.Now()))
+		proxy.ServeHTTP(rw, req)
+		return rw
+	}
+
+	rw := callback("nonce1")
+	assert.Equal(t, 403, rw.Code)
+	assert.Equal(t, "email_not_allowed", rw.Header().Get("X-Auth-Request-Denied-Reason"))
+	body := rw.Body.String()
+	assert.Contains(t, body, "You are signed in as <b>michael.bland@gsa.gov</b>.")
+	assert.Contains(t, body, "<code>email_not_allowed</code>")
+
+	allowed = true
+	proxy.provider = groupDenyingProvider{opts.provider.(*TestProvider)}
+	rw = callback("nonce2")
+	assert.Equal(t, 403, rw.Code)
+	assert.Equal(t, "group_not_allowed", rw.Header().Get("X-Auth-Request-Denied-Reason"))
+	assert.Contains(t, rw.Body.String(), "not a member of a group allowed")
+
+	// a session that is no longer allowed is denied, rather than sent back
+	// to the provider
+	allowed = false
+	value, _ := (&providers.SessionState{Email: "michael.bland@gsa.gov"}).EncodeSessionState(nil)
+	for _, path := range []string{"/", "/oauth2/auth"} {
+		rw = httptest.NewRecorder()
+		req, _ := http.NewRequest("GET", path, nil)
+		req.AddCookie(proxy.MakeSessionCookie(req, value, time.Hour, time.Now()))
+		proxy.ServeHTTP(rw, req)
+		assert.Equal(t, "email_not_allowed", rw.Header().Get("X-Auth-Request-Denied-Reason"))
+		if path == "/" {
+			assert.Equal(t, 403, rw.Code)
+			assert.Contains(t, rw.Body.String(), "You are signed in as <b>michael.bland@gsa.gov</b>.")
+		} else {
+			assert.Equal(t, 401, rw.Code)
+		}
+	}
+
+	// users who aren't signed in are not given a reason
+	rw = httptest.NewRecorder()
+	req, _ := http.NewRequest("GET", "/", nil)
+	proxy.ServeHTTP(rw, req)
+	assert.Equal(t, 302, rw.Code)
+	assert.Equal(t, "", rw.Header().Get("X-Auth-Request-Denied-Reason"))
+}
+
+func TestOAuthStateInSessionStore(t *testing.T) {
+	provider := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(`{"access_token": "my_auth_token"}`))
+	}))
+	defer provider.Close()
+	provider_url, _ := url.Parse(provider.URL)
+
+	// two replicas sharing the session store
+	var replicas []*OAuthProxy
+	s := store.NewMemoryStore()
+	for i := 0; i < 2; i++ {
+		opts := testOptions()
+		opts.SessionStore = "memory"
+		assert.Equal(t, nil, opts.Validate())
+		opts.sessionStore = s
+		opts.provider = NewTestProvider(provider_url, "michael.bland@gsa.gov")
+		replicas = append(replicas, newOAuthProxy(opts, func(string) bool { return true }))
+	}
+	start, callback := replicas[0], replicas[1]
+
+	rw := httptest.NewRecorder()
+	req, _ := http.NewRequest("GET", "/oauth2/start?rd=/foo", nil)
+	start.ServeHTTP(rw, req)
+	assert.Equal(t, 302, rw.Code)
+	csrf := rw.Result().Cookies()
+	assert.Equal(t, 1, len(csrf))
+	assert.Equal(t, start.CSRFCookieName, csrf[0].Name)
+	loginURL, _ := url.Parse(rw.Header().Get("Location"))
+	state := loginURL.Query().Get("state")
+	_, _, redirect, err := start.decodeState(state)
+	assert.Equal(t, nil, err)
+	assert.Equal(t, "/foo", redirect)
+
+	// the state is bound to the browser that started the sign in
+	callbackURL := "/oauth2/callback?code=callback_code&state=" + url.QueryEscape(state)
+	rw = httptest.NewRecorder()
+	req, _ = http.NewRequest("GET", callbackURL, nil)
+	callback.ServeHTTP(rw, req)
+	assert.Equal(t, "/oauth2/sign_in?error=state_invalid&rd=%2Ffoo", rw.Header().Get("Location"))
+
+	rw = httptest.NewRecorder()
+	req, _ = http.NewRequest("GET", callbackURL, nil)
+	req.AddCookie(csrf[0])
+	callback.ServeHTTP(rw, req)
+	assert.Equal(t, 302, rw.Code)
+	assert.Equal(t, "/foo", rw.Header().Get("Location"))
+
+	// the state may only be used once
+	rw = httptest.NewRecorder()
+	req, _ = http.NewRequest("GET", callbackURL, nil)
+	req.AddCookie(csrf[0])
+	callback.ServeHTTP(rw, req)
+	assert.Equal(t, "/oauth2/sign_in?error=state_invalid&rd=%2Ffoo", rw.Header().Get("Location"))
+}
+
+func TestOAuthCallbackReplay(t *testing.T) {
+	provider := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(`{"access_token": "my_auth_token"}`))
+	}))
+	defer provider.Close()
+	provider_url, _ := url.Parse(provider.URL)
+
+	opts := testOptions()
+	assert.Equal(t, nil, opts.Validate())
+	opts.provider = NewTestProvider(provider_url, "michael.bland@gsa.gov")
+	proxy := newOAuthProxy(opts, func(string) bool { return true })
+
+	callback := func(nonce, code string) string {
+		state, _ := proxy.encodeState(nonce, "", "/", time.Now())
+		rw := httptest.NewRecorder()
+		req, _ := http.NewRequest("GET", "/oauth2/callback?code="+code+"&state="+url.QueryEscape(state), nil)
+		req.AddCookie(proxy.MakeCSRFCookie(req, nonce, proxy.CookieExpire, time.Now()))
+		proxy.ServeHTTP(rw, req)
+		assert.Equal(t, 302, rw.Code)
+		return rw.Header().Get("Location")
+	}
+	assert.Equal(t, "/", callback("nonce1", "code1"))
+	// the same state, or the same code with a new state, is rejected
+	assert.Equal(t, "/oauth2/sign_in?error=state_invalid&rd=%2F", callback("nonce1", "code2"))
+	assert.Equal(t, "/oauth2/sign_in?error=state_invalid&rd=%2F", callback("nonce2", "code1"))
+	assert.Equal(t, "/", callback("nonce3", "code3"))
+}
+
+type RefreshCountingProvider struct {
+	*TestProvider
+	refreshes int
+}
+
+func (p *RefreshCountingProvider) RefreshSessionIfNeeded(s *providers.SessionState) (bool, error) {
+	p.refreshes++
+	s.AccessToken = "refreshed_token"
+	s.ExpiresOn = time.Now().Add(time.Hour)
+	return true, nil
+}
+
+func TestRefreshSessionWithSessionStore(t *testing.T) {
+	provider := &RefreshCountingProvider{
+		TestProvider: NewTestProvider(&url.URL{Host: "localhost"}, "michael.bland@gsa.gov"),
+	}
+
+	// two replicas sharing the session store
+	var replicas []*OAuthProxy
+	s := store.NewMemoryStore()
+	for i := 0; i < 2; i++ {
+		opts := testOptions()
+		opts.CookieSecret = "0123456789abcdefghijklmnopqrstuv"
+		opts.PassAccessToken = true
+		opts.SessionStore = "memory"
+		assert.Equal(t, nil, opts.Validate())
+		opts.sessionStore = s
+		replicas = append(replicas, newOAuthProxy(opts, func(string) bool { return true }))
+	}
+
+	for _, p := range replicas {
+		session := &providers.SessionState{
+			Email:        "michael.bland@gsa.gov",
+			AccessToken:  "expired_token",
+			RefreshToken: "refresh_token",
+			ExpiresOn:    time.Now().Add(-time.Minute),
+		}
+		ok, err := p.refreshSession(provider, session)
+		assert.Equal(t, nil, err)
+		assert.True(t, ok)
+		assert.Equal(t, "refreshed_token", session.AccessToken)
+		assert.True(t, session.ExpiresOn.After(time.Now()))
+	}
+	assert.Equal(t, 1, provider.refreshes)
+}
+
+type FailingBlockingRefreshProvider struct {
+	*TestProvider
+	started chan bool
+	release chan bool
+}
+
+func (p *FailingBlockingRefreshProvider) RefreshSessionIfNeeded(s *providers.SessionState) (bool, error) {
+	p.started <- true
+	<-p.release
+	return false, errors.New(`got 400 from "https://idp/token" {"error": "invalid_grant"}`)
+}
+
+func TestRefreshSessionWithSessionStoreFailing(t *testing.T) {
+	provider := &FailingBlockingRefreshProvider{
+		TestProvider: NewTestProvider(&url.URL{Host: "localhost"}, "michael.bland@gsa.gov"),
+		started:      make(chan bool, 1),
+		release:      make(chan bool),
+	}
+
+	// two replicas sharing the session store
+	var replicas []*OAuthProxy
+	s := store.NewMemoryStore()
+	for i := 0; i < 2; i++ {
+		opts := testOptions()
+		opts.CookieSecret = "0123456789abcdefghijklmnopqrstuv"
+		opts.SessionStore = "memory"
+		assert.Equal(t, nil, opts.Validate())
+		opts.sessionStore = s
+		replicas = append(replicas, newOAuthProxy(opts, func(string) bool { return true }))
+	}
+	expired := func() *providers.SessionState {
+		return &providers.SessionState{
+			Email:        "michael.bland@gsa.gov",
+			AccessToken:  "expired_token",
+			RefreshToken: "refresh_token",
+			ExpiresOn:    time.Now().Add(-time.Minute),
+		}
+	}
+
+	errs := make(chan error, 2)
+	go func() {
+		_, err := replicas[0].refreshSession(provider, expired())
+		errs <- err
+	}()
+	<-provider.started
+	go func() {
+		_, err := replicas[1].refreshSession(provider, expired())
+		errs <- err
+	}()
+	time.Sleep(200 * time.Millisecond)
+	released := time.Now()
+	close(provider.release)
+
+	// the waiting replica fails as soon as the lock is released, instead of
+	// waiting for refreshLockExpiration
+	var messages []string
+	for i := 0; i < 2; i++ {
+		err := <-errs
+		assert.NotEqual(t, nil, err)
+		messages = append(messages, err.Error())
+	}
+	assert.True(t, time.Since(released) < time.Second)
+	assert.Contains(t, messages, "the refresh on another replica failed")
+}
+
+type BlockingRefreshProvider struct {
+	*RefreshCountingProvider
+	started chan bool
+	release chan bool
+}
+
+func (p *BlockingRefreshProvider) RefreshSessionIfNeeded(s *providers.SessionState) (bool, error) {
+	p.started <- true
+	<-p.release
+	return p.RefreshCountingProvider.RefreshSessionIfNeeded(s)
+}
+
+func TestRefreshSessionConcurrently(t *testing.T) {
+	provider := &BlockingRefreshProvider{
+		RefreshCountingProvider: &RefreshCountingProvider{
+			TestProvider: NewTestProvider(&url.URL{Host: "localhost"}, "michael.bland@gsa.gov"),
+		},
+		started: make(chan bool, 10),
+		release: make(chan bool),
+	}
+	opts := testOptions()
+	assert.Equal(t, nil, opts.Validate())
+	proxy := newOAuthProxy(opts, func(string) bool { return true })
+
+	// requests sharing an expired session, without a session store
+	var wg sync.WaitGroup
+	sessions := make([]*providers.SessionState, 5)
+	for i := range sessions {
+		sessions[i] = &providers.SessionState{
+			Email:        "michael.bland@gsa.gov",
+			AccessToken:  "expired_token",
+			RefreshToken: "refresh_token",
+			ExpiresOn:    time.Now().Add(-time.Minute),
+		}
+		wg.Add(1)
+		go func(s *providers.SessionState) {
+			defer wg.Done()
+			ok, err := proxy.refreshSession(provider, s)
+			assert.Equal(t, nil, err)
+			assert.True(t, ok)
+		}(sessions[i])
+	}
+	<-provider.started
+	time.Sleep(50 * time.Millisecond)
+	close(provider.release)
+	wg.Wait()
+
+	assert.Equal(t, 1, provider.refreshes)
+	for _, s := range sessions {
+		assert.Equal(t, "refreshed_token", s.AccessToken)
+	}
+
+	// a later refresh of another session goes to the provider again
+	s := &providers.SessionState{AccessToken: "expired_token", RefreshToken: "other_token",
+		ExpiresOn: time.Now().Add(-time.Minute)}
+	ok, err := proxy.refreshSession(provider, s)
+	assert.Equal(t, nil, err)
+	assert.True(t, ok)
+	assert.Equal(t, 2, provider.refreshes)
+}
+
+type ValidationCountingProvider struct {
+	*TestProvider
+	validations int
+}
+
+func (p *ValidationCountingProvider) ValidateSessionState(s *providers.SessionState) bool {
+	p.validations++
+	return p.TestProvider.ValidateSessionState(s)
+}
+
+func TestSessionValidationCache(t *testing.T) {
+	provider := &ValidationCountingProvider{
+		TestProvider: NewTestProvider(&url.URL{Host: "localhost"}, "michael.bland@gsa.gov"),
+	}
+	opts := testOptions()
+	opts.SessionValidationCache = -time.Second
+	assert.Equal(t, errorMsg([]string{"session-validation-cache must not be negative"}), opts.Validate().Error())
+	opts = testOptions()
+	opts.SessionValidationCache = time.Minute
+	assert.Equal(t, nil, opts.Validate())
+	proxy := newOAuthProxy(opts, func(string) bool { return true })
+
+	session := &providers.SessionState{Email: "michael.bland@gsa.gov", AccessToken: "access_token"}
+	other := &providers.SessionState{Email: "michael.bland@gsa.gov", AccessToken: "other_token"}
+
+	// failed validations aren't cached
+	assert.False(t, proxy.validateSession(provider, session))
+	assert.False(t, proxy.validateSession(provider, session))
+	assert.Equal(t, 2, provider.validations)
+
+	provider.ValidToken = true
+	for i := 0; i < 5; i++ {
+		assert.True(t, proxy.validateSession(provider, session))
+	}
+	assert.Equal(t, 3, provider.validations)
+	assert.True(t, proxy.validateSession(provider, other))
+	assert.Equal(t, 4, provider.validations)
+
+	// without the cache every validation reaches the provider
+	proxy.validationCache = 0
+	proxy.validateSession(provider, session)
+	proxy.validateSession(provider, session)
+	assert.Equal(t, 6, provider.validations)
+}
+
+func TestReadyPage(t *testing.T) {
+	provider := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+	}))
+	provider_url, _ := url.Parse(provider.URL)
+
+	opts := testOptions()
+	opts.SessionStore = "memory"
+	assert.Equal(t, nil, opts.Validate())
+	opts.provider = NewTestProvider(provider_url, "michael.bland@gsa.gov")
+	proxy := newOAuthProxy(opts, func(string) bool { return true })
+
+	rw := httptest.NewRecorder()
+	req, _ := http.NewRequest("GET", "/ready", nil)
+	proxy.ServeHTTP(rw, req)
+	assert.Equal(t, 200, rw.Code)
+	assert.Equal(t, "OK", rw.Body.String())
+
+	// the result is reused for a while
+	provider.Close()
+	rw = httptest.NewRecorder()
+	proxy.ServeHTTP(rw, req)
+	assert.Equal(t, 200, rw.Code)
+
+	assert.NotEqual(t, nil, proxy.cachedReady(time.Now().Add(readyCacheTTL)))
+	rw = httptest.NewRecorder()
+	proxy.ServeHTTP(rw, req)
+	assert.Equal(t, 503, rw.Code)
+	assert.Equal(t, "not ready", rw.Body.String())
+}
+
+func TestCheckClientCert(t *testing.T) {
+	opts := testOptions()
+	assert.Equal(t, nil, opts.Validate())
+	proxy := newOAuthProxy(opts, func(email string) bool {
+		return email == "build@example.com"
+	})
+	certRequest := func(cert *x509.Certificate) *http.Request {
+		req, _ := http.NewRequest("GET", "/", nil)
+		req.TLS = &tls.ConnectionState{VerifiedChains: [][]*x509.Certificate{{cert}}}
+		return req
+	}
+
+	req, _ := http.NewRequest("GET", "/", nil)
+	session, err := proxy.CheckClientCert(req)
+	assert.Equal(t, nil, err)
+	assert.Equal(t, (*providers.SessionState)(nil), session)
+
+	// a common name alone is not authorized
+	session, err = proxy.CheckClientCert(certRequest(&x509.Certificate{
+		Subject: pkix.Name{CommonName: "build-agent"},
+	}))
+	assert.NotEqual(t, nil, err)
+	assert.Equal(t, (*providers.SessionState)(nil), session)
+
+	session, err = proxy.CheckClientCert(certRequest(&x509.Certificate{
+		Subject:        pkix.Name{CommonName: "build-agent"},
+		EmailAddresses: []string{"build@example.com"},
+	}))
+	assert.Equal(t, nil, err)
+	assert.Equal(t, "build-agent", session.User)
+	assert.Equal(t, "build@example.com", session.Email)
+
+	session, err = proxy.CheckClientCert(certRequest(&x509.Certificate{
+		EmailAddresses: []string{"build@example.com"},
+	}))
+	assert.Equal(t, nil, err)
+	assert.Equal(t, "build", session.User)
+	assert.Equal(t, "build@example.com", session.Email)
+
+	session, err = proxy.CheckClientCert(certRequest(&x509.Certificate{
+		Subject:        pkix.Name{CommonName: "mallory"},
+		EmailAddresses: []string{"mallory@example.com"},
+	}))
+	assert.NotEqual(t, nil, err)
+	assert.Equal(t, (*providers.SessionState)(nil), session)
+}
+
+func TestSignInPageContentSecurityPolicy(t *testing.T) {
+	opts := testOptions()
+	assert.Equal(t, nil, opts.Validate())
+	proxy := newOAuthProxy(opts, func(string) bool { return true })
+
+	rw := httptest.NewRecorder()
+	req, _ := http.NewRequest("GET", "/oauth2/sign_in", nil)
+	proxy.ServeHTTP(rw, req)
+	assert.Equal(t, 200, rw.Code)
+	csp := rw.Header().Get("Content-Security-Policy")
+	match := regexp.MustCompile(`script-src 'nonce-([0-9a-f]+)'`).FindStringSubmatch(csp)
+	assert.Equal(t, 2, len(match), csp)
+	body := rw.Body.String()
+	assert.Contains(t, body, `<script nonce="`+match[1]+`">`)
+	assert.Contains(t, body, `<link rel="stylesheet" href="/oauth2/static/sign_in.css">`)
+	assert.Contains(t, body, `<link rel="icon" href="/oauth2/static/favicon.svg">`)
+	assert.NotContains(t, body, "<style>")
+
+	rw = httptest.NewRecorder()
+	proxy.ServeHTTP(rw, req)
+	assert.NotEqual(t, csp, rw.Header().Get("Content-Security-Policy"))
+
+	rw = httptest.NewRecorder()
+	req, _ = http.NewRequest("GET", "/oauth2/static/sign_in.css", nil)
+	proxy.ServeHTTP(rw, req)
+	assert.Equal(t, 200, rw.Code)
+	assert.Equal(t, "text/css; charset=utf-8", rw.Header().Get("Content-Type"))
+	etag := rw.Header().Get("ETag")
+	assert.NotEqual(t, "", etag)
+	assert.Equal(t, "public, max-age=86400", rw.Header().Get("Cache-Control"))
+
+	rw = httptest.NewRecorder()
+	req.Header.Set("If-None-Match", etag)
+	proxy.ServeHTTP(rw, req)
+	assert.Equal(t, 304, rw.Code)
+
+	rw = httptest.NewRecorder()
+	req, _ = http.NewRequest("GET", "/oauth2/static/favicon.svg", nil)
+	proxy.ServeHTTP(rw, req)
+	assert.Equal(t, 200, rw.Code)
+	assert.Equal(t, "image/svg+xml", rw.Header().Get("Content-Type"))
+
+	rw = httptest.NewRecorder()
+	req, _ = http.NewRequest("GET", "/oauth2/static/../oauthproxy.go", nil)
+	proxy.ServeHTTP(rw, req)
+	assert.Equal(t, 404, rw.Code)
+}
+
+func TestCustomTemplatesContentSecurityPolicy(t *testing.T) {
+	dir, _ := ioutil.TempDir("", "templates")
+	defer os.RemoveAll(dir)
+	ioutil.WriteFile(dir+"/sign_in.html", []byte(`<style>body { color: red }</style>{{.CSPNonce}}`), 0644)
+
+	opts := testOptions()
+	opts.CustomTemplatesDir = dir
+	assert.Equal(t, nil, opts.Validate())
+	proxy := newOAuthProxy(opts, func(string) bool { return true })
+	rw := httptest.NewRecorder()
+	req, _ := http.NewRequest("GET", "/oauth2/sign_in", nil)
+	proxy.ServeHTTP(rw, req)
+	assert.Equal(t, 200, rw.Code)
+	assert.Equal(t, "", rw.Header().Get("Content-Security-Policy"))
+
+	opts.CustomTemplatesCSP = true
+	proxy = newOAuthProxy(opts, func(string) bool { return true })
+	rw = httptest.NewRecorder()
+	proxy.ServeHTTP(rw, req)
+	assert.Contains(t, rw.Header().Get("Content-Security-Policy"), "script-src 'nonce-"+rw.Body.String()[len("<style>body { color: red }</style>"):]+"'")
+}
+
+func TestOAuthState(t *testing.T) {
+	opts := testOptions()
+	assert.Equal(t, nil, opts.Validate())
+	proxy := newOAuthProxy(opts, func(string) bool { return true })
+
+	state, err := proxy.encodeState("nonce", "", "/foo?bar=baz", time.Now())
+	assert.Equal(t, nil, err)
+	assert.NotContains(t, state, "/foo")
+	nonce, _, redirect, err := proxy.decodeState(state)
+	assert.Equal(t, nil, err)
+	assert.Equal(t, "nonce", nonce)
+	assert.Equal(t, "/foo?bar=baz", redirect)
+
+	// expired
+	state, _ = proxy.encodeState("nonce", "", "/foo", time.Now().Add(-stateExpiration-time.Minute))
+	_, _, _, err = proxy.decodeState(state)
+	assert.NotEqual(t, nil, err)
+
+	// not issued by the proxy
+	_, _, _, err = proxy.decodeState("nonce:/foo")
+	assert.NotEqual(t, nil, err)
+	state, _ = proxy.encodeState("nonce", "", "/foo", time.Now())
+	_, _, _, err = proxy.decodeState(strings.Replace(state, "|", "x|", 1))
+	assert.NotEqual(t, nil, err)
+
+	// the state is checked before the code is redeemed
+	rw := httptest.NewRecorder()
+	req, _ := http.NewRequest("GET", "/oauth2/callback?code=callback_code&state=nonce:/foo", nil)
+	req.AddCookie(proxy.MakeCSRFCookie(req, "nonce", proxy.CookieExpire, time.Now()))
+	proxy.ServeHTTP(rw, req)
+	assert.Equal(t, 302, rw.Code)
+	assert.Equal(t, "/oauth2/sign_in?error=state_invalid", rw.Header().Get("Location"))
+}
+
+func TestRateLimit(t *testing.T) {
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(200)
+	}))
+	defer upstream.Close()
+
+	opts := testOptions()
+	opts.Upstreams = []string{upstream.URL}
+	opts.SkipAuthRegex = []string{"^/public"}
+	opts.RateLimitPerIP = 2
+	opts.RateLimitPerUser = 1
+	assert.Equal(t, nil, opts.Validate())
+	proxy := newOAuthProxy(opts, func(string) bool { return true })
+	proxy.HtpasswdFile = &HtpasswdFile{Users: map[string]string{
+		// htpasswd -s: "password"
+		"alice": "{SHA}W6ph5Mm5Pz8GgiULbPgzG37mj9g=",
+		"bob":   "{SHA}W6ph5Mm5Pz8GgiULbPgzG37mj9g=",
+	}}
+
+	request := func(path, remoteAddr, user string) *httptest.ResponseRecorder {
+		rw := httptest.NewRecorder()
+		req, _ := http.NewRequest("GET", path, nil)
+		req.RemoteAddr = remoteAddr
+		if user != "" {
+			req.SetBasicAuth(user, "password")
+		}
+		proxy.ServeHTTP(rw, req)
+		return rw
+	}
+
+	rw := request("/public", "10.0.0.1:1234", "")
+	assert.Equal(t, 200, rw.Code)
+	assert.Equal(t, "2", rw.Header().Get("X-RateLimit-Limit"))
+	assert.Equal(t, "1", rw.Header().Get("X-RateLimit-Remaining"))
+	assert.Equal(t, 200, request("/public", "10.0.0.1:1234", "").Code)
+	rw = request("/public", "10.0.0.1:1234", "")
+	assert.Equal(t, 429, rw.Code)
+	assert.Equal(t, "30", rw.Header().Get("Retry-After"))
+
+	// health checks are not limited
+	assert.Equal(t, 200, request("/ping", "10.0.0.1:1234", "").Code)
+
+	assert.Equal(t, 200, request("/private", "10.0.0.2:1234", "alice").Code)
+	assert.Equal(t, 429, request("/private", "10.0.0.3:1234", "alice").Code)
+	assert.Equal(t, 200, request("/private", "10.0.0.3:1234", "bob").Code)
+
+	// behind a reverse proxy on the same host
+	rw = httptest.NewRecorder()
+	req, _ := http.NewRequest("GET", "/public", nil)
+	req.RemoteAddr = "127.0.0.1:1234"
+	req.Header.Set("X-Real-IP", "10.0.0.1")
+	proxy.ServeHTTP(rw, req)
+	assert.Equal(t, 429, rw.Code)
+
+	// IPv6 clients are counted by their /64
+	assert.Equal(t, 200, request("/public", "[2001:db8::1]:1234", "").Code)
+	assert.Equal(t, 200, request("/public", "[2001:db8::2]:1234", "").Code)
+	assert.Equal(t, 429, request("/public", "[2001:db8::3]:1234", "").Code)
+	assert.Equal(t, 200, request("/public", "[2001:db8:0:1::1]:1234", "").Code)
+}
+
+func TestClientIP(t *testing.T) {
+	for remoteAddr, ip := range map[string]string{
+		"10.0.0.1:1234":          "10.0.0.1",
+		"[2001:DB8::1]:1234":     "2001:db8::1",
+		"[fe80::1%eth0]:1234":    "fe80::1",
+		"[::ffff:10.0.0.1]:1234": "10.0.0.1",
+		"not an address":         "not an address",
+	} {
+		req, _ := http.NewRequest("GET", "/", nil)
+		req.RemoteAddr = remoteAddr
+		assert.Equal(t, ip, clientIP(req), remoteAddr)
+	}
+
+	req, _ := http.NewRequest("GET", "/", nil)
+	req.RemoteAddr = "[::1]:1234"
+	req.Header.Set("X-Real-IP", "[2001:db8::1]:4321")
+	assert.Equal(t, "2001:db8::1", clientIP(req))
+}
+
+func TestClientKey(t *testing.T) {
+	for prefix, key := range map[int]string{
+		64:  "ip:2001:db8::/64",
+		48:  "ip:2001:db8::/48",
+		128: "ip:2001:db8::1:2:3:4",
+	} {
+		proxy := &OAuthProxy{rateLimitV6Prefix: prefix}
+		req, _ := http.NewRequest("GET", "/", nil)
+		req.RemoteAddr = "[2001:db8::1:2:3:4]:1234"
+		assert.Equal(t, key, proxy.clientKey(req))
+		req.RemoteAddr = "10.0.0.1:1234"
+		assert.Equal(t, "ip:10.0.0.1", proxy.clientKey(req))
+	}
+}
+
+func TestIsAllowedClient(t *testing.T) {
+	opts := testOptions()
+	opts.AllowCIDRs = []string{"10.0.0.0/8", "2001:db8::/32"}
+	opts.DenyCIDRs = []string{"10.1.0.0/16"}
+	assert.Equal(t, nil, opts.Validate())
+	proxy := newOAuthProxy(opts, func(string) bool { return true })
+
+	for remoteAddr, allowed := range map[string]bool{
+		"10.0.0.1:1234":       true,
+		"10.1.0.1:1234":       false,
+		"192.168.1.1:1234":    false,
+		"[2001:db8::1]:1234":  true,
+		"[2001:db9::1]:1234":  false,
+		"[::ffff:10.0.0.1]:1": true,
+		"not an address:1234": false,
+	} {
+		req, _ := http.NewRequest("GET", "/", nil)
+		req.RemoteAddr = remoteAddr
+		assert.Equal(t, allowed, proxy.IsAllowedClient(req), remoteAddr)
+	}
+
+	rw := httptest.NewRecorder()
+	req, _ := http.NewRequest("GET", "/ping", nil)
+	req.RemoteAddr = "192.168.1.1:1234"
+	proxy.ServeHTTP(rw, req)
+	assert.Equal(t, 403, rw.Code)
+}
+
+func TestCheckRequestSize(t *testing.T) {
+	opts := testOptions()
+	opts.MaxHeaderBytes = 100
+	opts.MaxHeaderCount = 3
+	opts.MaxURILength = 20
+	assert.Equal(t, nil, opts.Validate())
+	proxy := newOAuthProxy(opts, func(string) bool { return true })
+
+	req, _ := http.NewRequest("GET", "/ping?a=b", nil)
+	req.Header.Set("Accept", "*/*")
+	assert.Equal(t, 0, proxy.CheckRequestSize(req))
+
+	req, _ = http.NewRequest("GET", "/ping?a=0123456789abcdef", nil)
+	assert.Equal(t, 414, proxy.CheckRequestSize(req))
+
+	req, _ = http.NewRequest("GET", "/ping", nil)
+	req.Header.Add("X-Many", "1")
+	req.Header.Add("X-Many", "2")
+	req.Header.Add("X-Many", "3")
+	req.Header.Add("X-Many", "4")
+	assert.Equal(t, 431, proxy.CheckRequestSize(req))
+
+	rw := httptest.NewRecorder()
+	req, _ = http.NewRequest("GET", "/ping", nil)
+	req.Header.Set("Cookie", strings.Repeat("a", 100))
+	proxy.ServeHTTP(rw, req)
+	assert.Equal(t, 431, rw.Code)
+}
+
+func TestCustomProxyPrefix(t *testing.T) {
+	opts := testOptions()
+	opts.ProxyPrefix = "/_auth/"
+	assert.Equal(t, nil, opts.Validate())
+	proxy := newOAuthProxy(opts, func(string) bool { return true })
+	assert.Equal(t, "/_auth/callback", proxy.redirectURL.Path)
+
+	rw := httptest.NewRecorder()
+	req, _ := http.NewRequest("GET", "/_auth/sign_in", nil)
+	proxy.ServeHTTP(rw, req)
+	assert.Equal(t, 200, rw.Code)
+	assert.Contains(t, rw.Body.String(), `action="/_auth/start"`)
+	assert.Contains(t, rw.Body.String(), `href="/_auth/static/sign_in.css"`)
+
+	// the default prefix belongs to the upstream
+	rw = httptest.NewRecorder()
+	req, _ = http.NewRequest("GET", "/oauth2/sign_in", nil)
+	proxy.ServeHTTP(rw, req)
+	assert.Equal(t, 403, rw.Code)
+	assert.Contains(t, rw.Body.String(), `name="rd" value="/oauth2/sign_in"`)
+}
+
+func TestIsValidRedirect(t *testing.T) {
+	opts := testOptions()
+	opts.WhitelistDomains = []string{"other.example.com", ".example.org"}
+	opts.RedirectSchemes = []string{"MyApp", "com.example.app://"}
+	assert.Equal(t, nil, opts.Validate())
+	proxy := newOAuthProxy(opts, func(string) bool { return true })
+
+	req, _ := http.NewRequest("GET", "/oauth2/start", nil)
+	req.Host = "app.example.com:8443"
+	for redirect, valid := range map[string]bool{
+		"/foo?bar=baz":                    true,
+		"//evil.com/foo":                  false,
+		"/\\evil.com/foo":                 false,
+		"https://app.example.com/foo":     true,
+		"http://APP.example.com:8080/foo": true,
+		"https://other.example.com/foo":   true,
+		"https://sub.other.example.com/":  false,
+		"https://example.org/foo":         true,
+		"https://a.b.example.org/foo":     true,
+		"https://evilexample.org/foo":     false,
+		"https://evil.com/foo":            false,
+		"https://evil.com@evil.com/foo":   false,
+		"javascript:alert(1)":             false,
+		"":                                false,
+		"myapp://callback?x=1":            true,
+		"MYAPP:/callback":                 true,
+		"com.example.app://oauth":         true,
+		"otherapp://callback":             false,
+	} {
+		assert.Equal(t, valid, proxy.IsValidRedirect(req, redirect), redirect)
+	}
+
+	// custom schemes are not origins of the proxied site
+	req, _ = http.NewRequest("POST", "/oauth2/sign_out", nil)
+	req.Header.Set("Origin", "myapp://callback")
+	ok, sent := proxy.checkOrigin(req)
+	assert.False(t, ok)
+	assert.True(t, sent)
+}
+
+func TestRedirectSchemesOptions(t *testing.T) {
+	o := testOptions()
+	o.RedirectSchemes = []string{"myapp", "https", "JavaScript", "my app", "1app"}
+	assert.Equal(t, errorMsg([]string{
+		"redirect-scheme \"https\" is not a custom scheme",
+		"redirect-scheme \"JavaScript\" is not a custom scheme",
+		"invalid redirect-scheme \"my app\"; must be a URL scheme such as myapp",
+		"invalid redirect-scheme \"1app\"; must be a URL scheme such as myapp",
+	}), o.Validate().Error())
+}
+
+func TestRevocationWebhook(t *testing.T) {
+	opts := testOptions()
+	opts.RevocationWebhookToken = "hook_token"
+	err := opts.Validate()
+	assert.NotEqual(t, nil, err)
+	assert.Equal(t, errorMsg([]string{
+		"revocation-webhook-token requires session-store, so that revocations apply to all replicas"}), err.Error())
+	opts.SessionStore = "memory"
+	assert.Equal(t, nil, opts.Validate())
+	proxy := newOAuthProxy(opts, func(string) bool { return true })
+
+	// Okta verifies the event hook
+	rw := httptest.NewRecorder()
+	req, _ := http.NewRequest("GET", "/oauth2/revoke", nil)
+	req.Header.Set("Authorization", "hook_token")
+	req.Header.Set("X-Okta-Verification-Challenge", "challenge")
+	proxy.ServeHTTP(rw, req)
+	assert.Equal(t, 200, rw.Code)
+	assert.Equal(t, "{\"verification\":\"challenge\"}\n", rw.Body.String())
+
+	rw = httptest.NewRecorder()
+	req, _ = http.NewRequest("POST", "/oauth2/revoke", strings.NewReader(`{"emails": ["jane@example.com"]}`))
+	req.Header.Set("Authorization", "Bearer wrong_token")
+	proxy.ServeHTTP(rw, req)
+	assert.Equal(t, 401, rw.Code)
+	assert.Equal(t, false, proxy.IsRevoked("jane@example.com", time.Minute))
+
+	rw = httptest.NewRecorder()
+	req, _ = http.NewRequest("POST", "/oauth2/revoke", strings.NewReader(`{"data": {"events": [
+		{"eventType": "user.session.start", "target": [{"type": "User", "alternateId": "john@example.com"}]},
+		{"eventType": "user.account.update_password", "target": [{"type": "User", "alternateId": "Jane@example.com"}]}]}}`))
+	req.Header.Set("Authorization", "Bearer hook_token")
+	proxy.ServeHTTP(rw, req)
+	assert.Equal(t, 204, rw.Code)
+	assert.Equal(t, true, proxy.IsRevoked("jane@example.com", time.Minute))
+	assert.Equal(t, false, proxy.IsRevoked("john@example.com", time.Minute))
+	// sessions issued after the revocation stay valid
+	assert.Equal(t, false, proxy.IsRevoked("jane@example.com", -time.Minute))
+
+	rw = httptest.NewRecorder()
+	req, _ = http.NewRequest("GET", "/", nil)
+	value, _ := (&providers.SessionState{Email: "jane@example.com"}).EncodeSessionState(nil)
+	req.AddCookie(proxy.MakeSessionCookie(req, value, time.Hour, time.Now().Add(-time.Minute)))
+	assert.Equal(t, http.StatusForbidden, proxy.Authenticate(rw, req))
+}
+
+func TestLockout(t *testing.T) {
+	opts := testOptions()
+	opts.LockoutThreshold = 2
+	opts.LockoutDelay = 50 * time.Millisecond
+	opts.AdminToken = "admin_token"
+	assert.Equal(t, nil, opts.Validate())
+	proxy := newOAuthProxy(opts, func(string) bool { return true })
+	proxy.HtpasswdFile = &HtpasswdFile{Users: map[string]string{
+		// htpasswd -s: "password"
+		"alice": "{SHA}W6ph5Mm5Pz8GgiULbPgzG37mj9g=",
+		"bob":   "{SHA}W6ph5Mm5Pz8GgiULbPgzG37mj9g=",
+	}}
+
+	signIn := func(remoteAddr, user, password string) *httptest.ResponseRecorder {
+		rw := httptest.NewRecorder()
+		body := url.Values{"username": {user}, "password": {password}}.Encode()
+		req, _ := http.NewRequest("POST", "/oauth2/sign_in", strings.NewReader(body))
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		req.RemoteAddr = remoteAddr
+		proxy.ServeHTTP(rw, req)
+		return rw
+	}
+	admin := func(method, path string) *httptest.ResponseRecorder {
+		rw := httptest.NewRecorder()
+		req, _ := http.NewRequest(method, path, nil)
+		req.Header.Set("Authorization", "Bearer admin_token")
+		proxy.ServeHTTP(rw, req)
+		return rw
+	}
+
+	assert.Equal(t, 200, signIn("10.0.0.1:1234", "alice", "wrong").Code)
+	// retries are answered with 429 until the back off is over
+	rw := signIn("10.0.0.1:1234", "alice", "password")
+	assert.Equal(t, 429, rw.Code)
+	assert.NotEqual(t, "", rw.Header().Get("Retry-After"))
+	time.Sleep(60 * time.Millisecond)
+	assert.Equal(t, 200, signIn("10.0.0.1:1234", "alice", "wrong").Code)
+
+	// the address and alice from it are locked out, even with the right
+	// password, but alice can still sign in from elsewhere
+	assert.Equal(t, 429, signIn("10.0.0.1:1234", "alice", "password").Code)
+	assert.Equal(t, 429, signIn("10.0.0.1:1234", "bob", "password").Code)
+	assert.Equal(t, 302, signIn("10.0.0.2:1234", "alice", "password").Code)
+
+	rw = admin("GET", "/oauth2/admin/lockouts")
+	assert.Equal(t, 200, rw.Code)
+	var lockouts []lockout
+	assert.Equal(t, nil, json.Unmarshal(rw.Body.Bytes(), &lockouts))
+	assert.Equal(t, 2, len(lockouts))
+	for _, l := range lockouts {
+		assert.Equal(t, 2, l.Failures, l.Key)
+		assert.NotEqual(t, (*time.Time)(nil), l.LockedUntil, l.Key)
+	}
+
+	assert.Equal(t, 204, admin("DELETE", "/oauth2/admin/lockouts?key=ip:10.0.0.1").Code)
+	assert.Equal(t, 204, admin("DELETE", "/oauth2/admin/lockouts?key=user:alice/ip:10.0.0.1").Code)
+	assert.Equal(t, 302, signIn("10.0.0.1:1234", "alice", "password").Code)
+
+	rw = httptest.NewRecorder()
+	req, _ := http.NewRequest("GET", "/oauth2/admin/lockouts", nil)
+	proxy.ServeHTTP(rw, req)
+	assert.Equal(t, 401, rw.Code)
+}
+
+func TestSignOut(t *testing.T) {
+	opts := testOptions()
+	assert.Equal(t, nil, opts.Validate())
+	proxy := newOAuthProxy(opts, func(string) bool { return true })
+	session := &providers.SessionState{Email: "jane@example.com"}
+	nonce := &http.Cookie{Name: "_oauth2_proxy_session_nonce", Value: "0123456789abcdef"}
+
+	signOut := func(method string, header http.Header, body string) *httptest.ResponseRecorder {
+		rw := httptest.NewRecorder()
+		req, _ := http.NewRequest(method, "http://app.example.com/oauth2/sign_out", strings.NewReader(body))
+		for k, v := range header {
+			req.Header[k] = v
+		}
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		value, _ := session.EncodeSessionState(nil)
+		req.AddCookie(proxy.MakeSessionCookie(req, value, time.Hour, time.Now()))
+		req.AddCookie(nonce)
+		proxy.ServeHTTP(rw, req)
+		return rw
+	}
+	csrfToken := func(nonce *http.Cookie, session *providers.SessionState) string {
+		req, _ := http.NewRequest("GET", "/", nil)
+		if nonce != nil {
+			req.AddCookie(nonce)
+		}
+		return proxy.CSRFToken(req, session)
+	}
+
+	// sign out links get a confirmation page, other methods are refused
+	assert.Equal(t, 200, signOut("GET", nil, "").Code)
+	rw := signOut("PUT", nil, "")
+	assert.Equal(t, 405, rw.Code)
+	assert.Equal(t, "GET, POST", rw.Header().Get("Allow"))
+
+	rw = signOut("POST", http.Header{"Origin": {"https://app.example.com"}}, "")
+	assert.Equal(t, 200, rw.Code)
+	// the session nonce is cleared with the session
+	cleared := false
+	for _, c := range rw.Header()["Set-Cookie"] {
+		cleared = cleared || strings.HasPrefix(c, "_oauth2_proxy_session_nonce=;")
+	}
+	assert.True(t, cleared)
+	assert.Equal(t, 200, signOut("POST", http.Header{"Referer": {"https://app.example.com/account"}}, "").Code)
+	assert.Equal(t, 403, signOut("POST", http.Header{"Origin": {"https://evil.com"}}, "").Code)
+	assert.Equal(t, 403, signOut("POST", http.Header{"Origin": {"null"}}, "").Code)
+
+	// without Origin and Referer, the csrf token of the session is required
+	assert.Equal(t, 403, signOut("POST", nil, "").Code)
+	assert.Equal(t, 403, signOut("POST", nil, "csrf_token=wrong").Code)
+	assert.Equal(t, 200, signOut("POST", nil, "csrf_token="+csrfToken(nonce, session)).Code)
+	assert.Equal(t, 200, signOut("POST", http.Header{"X-Csrf-Token": {csrfToken(nonce, session)}}, "").Code)
+	assert.NotEqual(t, csrfToken(nonce, session), csrfToken(nonce, &providers.SessionState{Email: "john@example.com"}))
+	// tokens of other sign ins don't apply, and there are none without a nonce
+	assert.NotEqual(t, csrfToken(nonce, session), csrfToken(&http.Cookie{Name: nonce.Name, Value: "fedcba9876543210"}, session))
+	assert.Equal(t, "", csrfToken(nil, session))
+
+	// sign ins posted from other sites are rejected too
+	rw = httptest.NewRecorder()
+	req, _ := http.NewRequest("POST", "http://app.example.com/oauth2/sign_in", strings.NewReader("username=jane&password=secret"))
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	req.Header.Set("Origin", "https://evil.com")
+	proxy.ServeHTTP(rw, req)
+	assert.Equal(t, 403, rw.Code)
+}
+
+func TestSignOutConfirmAndLanding(t *testing.T) {
+	opts := testOptions()
+	assert.Equal(t, nil, opts.Validate())
+	proxy := newOAuthProxy(opts, func(string) bool { return true })
+	session := &providers.SessionState{Email: "jane@example.com"}
+	nonce := &http.Cookie{Name: "_oauth2_proxy_session_nonce", Value: "0123456789abcdef"}
+
+	signOut := func(method, target string, body string) *httptest.ResponseRecorder {
+		rw := httptest.NewRecorder()
+		req, _ := http.NewRequest(method, "http://app.example.com"+target, strings.NewReader(body))
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		req.Header.Set("Origin", "https://app.example.com")
+		value, _ := session.EncodeSessionState(nil)
+		req.AddCookie(proxy.MakeSessionCookie(req, value, time.Hour, time.Now()))
+		req.AddCookie(nonce)
+		proxy.ServeHTTP(rw, req)
+		return rw
+	}
+
+	rw := signOut("GET", "/oauth2/sign_out?rd=/bye", "")
+	assert.Equal(t, 200, rw.Code)
+	body := rw.Body.String()
+	assert.Contains(t, body, "You are signed in as <b>jane@example.com</b>.")
+	req, _ := http.NewRequest("GET", "/", nil)
+	req.AddCookie(nonce)
+	assert.Contains(t, body, `<input type="hidden" name="csrf_token" value="`+proxy.CSRFToken(req, session)+`">`)
+	assert.Contains(t, body, `<input type="hidden" name="rd" value="/bye">`)
+	assert.Contains(t, body, `<a href="/bye">Cancel</a>`)
+	// the sign out itself still takes a POST
+	assert.Equal(t, "", rw.Header().Get("Set-Cookie"))
+	assert.Equal(t, "GET, POST", signOut("PUT", "/oauth2/sign_out", "").Header().Get("Allow"))
+
+	rw = signOut("POST", "/oauth2/sign_out", "")
+	assert.Equal(t, 200, rw.Code)
+	assert.Contains(t, rw.Body.String(), "You have been signed out.")
+	assert.Contains(t, rw.Header().Get("Set-Cookie"), "_oauth2_proxy=;")
+
+	rw = signOut("POST", "/oauth2/sign_out", "rd=/bye")
+	assert.Equal(t, 302, rw.Code)
+	assert.Equal(t, "/bye", rw.Header().Get("Location"))
+	rw = signOut("POST", "/oauth2/sign_out", "rd=https://evil.com/")
+	assert.Equal(t, 200, rw.Code)
+
+	proxy.SignOutRedirect = "https://accounts.example.com/logout"
+	rw = signOut("POST", "/oauth2/sign_out", "")
+	assert.Equal(t, 302, rw.Code)
+	assert.Equal(t, "https://accounts.example.com/logout", rw.Header().Get("Location"))
+
+	opts.SignOutRedirect = "javascript:alert(1)"
+	err := opts.Validate()
+	assert.NotEqual(t, nil, err)
+	assert.Contains(t, err.Error(), "invalid sign-out-redirect")
+}
@@ -1,35 +1,76 @@
-package main
+package oauth2proxy
 
 import (
 	"context"
 	"crypto"
+	"crypto/sha256"
 	"crypto/tls"
+	"crypto/x509"
 	"encoding/base64"
+	"errors"
 	"fmt"
+	"html/template"
+	"io/ioutil"
+	"net"
 	"net/http"
 	"net/url"
 	"os"
 	"regexp"
+	"strconv"
 	"strings"
+	texttemplate "text/template"
 	"time"
 
+	"github.com/bitly/oauth2_proxy/cookie"
 	"github.com/bitly/oauth2_proxy/providers"
+	"github.com/bitly/oauth2_proxy/store"
 	oidc "github.com/coreos/go-oidc"
 	"github.com/mbland/hmacauth"
 )
 
 // Configuration Options that can be set by Command Line Flag, or Config File
 type Options struct {
-	ProxyPrefix  string `flag:"proxy-prefix" cfg:"proxy-prefix"`
-	HttpAddress  string `flag:"http-address" cfg:"http_address"`
-	HttpsAddress string `flag:"https-address" cfg:"https_address"`
-	RedirectURL  string `flag:"redirect-url" cfg:"redirect_url"`
-	ClientID     string `flag:"client-id" cfg:"client_id" env:"OAUTH2_PROXY_CLIENT_ID"`
-	ClientSecret string `flag:"client-secret" cfg:"client_secret" env:"OAUTH2_PROXY_CLIENT_SECRET"`
-	TLSCertFile  string `flag:"tls-cert" cfg:"tls_cert_file"`
-	TLSKeyFile   string `flag:"tls-key" cfg:"tls_key_file"`
+	ProxyPrefix      string `flag:"proxy-prefix" cfg:"proxy-prefix"`
+	HttpAddress      string `flag:"http-address" cfg:"http_address"`
+	HttpsAddress     string `flag:"https-address" cfg:"https_address"`
+	HttpAddressIPv6  string `flag:"http-address-ipv6" cfg:"http_address_ipv6"`
+	HttpsAddressIPv6 string `flag:"https-address-ipv6" cfg:"https_address_ipv6"`
+	MetricsAddress   string `flag:"metrics-address" cfg:"metrics_address"`
+	MetricsPath      string `flag:"metrics-path" cfg:"metrics_path"`
+	RedirectURL      string `flag:"redirect-url" cfg:"redirect_url"`
+	ClientID         string `flag:"client-id" cfg:"client_id" env:"OAUTH2_PROXY_CLIENT_ID"`
+	ClientSecret     string `flag:"client-secret" cfg:"client_secret" env:"OAUTH2_PROXY_CLIENT_SECRET"`
+	ClientSecretFile string `flag:"client-secret-file" cfg:"client_secret_file" env:"OAUTH2_PROXY_CLIENT_SECRET_FILE"`
+	TLSCertFile      string `flag:"tls-cert" cfg:"tls_cert_file"`
+	TLSKeyFile       string `flag:"tls-key" cfg:"tls_key_file"`
+	HttpWithTLS      string `flag:"http-with-tls" cfg:"http_with_tls"`
+	UnixSocketMode   string `flag:"unix-socket-mode" cfg:"unix_socket_mode"`
+
+	TLSMinVersion   string   `flag:"tls-min-version" cfg:"tls_min_version"`
+	TLSMaxVersion   string   `flag:"tls-max-version" cfg:"tls_max_version"`
+	TLSCipherSuites []string `flag:"tls-cipher-suite" cfg:"tls_cipher_suites"`
+	TLSCurves       []string `flag:"tls-curve" cfg:"tls_curves"`
+
+	TLSClientCAFile       string `flag:"tls-client-ca" cfg:"tls_client_ca_file"`
+	TLSClientCertRequired bool   `flag:"tls-client-cert-required" cfg:"tls_client_cert_required"`
+
+	HTTP2           bool `flag:"http2" cfg:"http2"`
+	HTTP2MaxStreams int  `flag:"http2-max-concurrent-streams" cfg:"http2_max_concurrent_streams"`
+	HTTP3           bool `flag:"http3" cfg:"http3"`
+
+	ShutdownTimeout time.Duration `flag:"shutdown-timeout" cfg:"shutdown_timeout"`
+
+	ReadTimeout       time.Duration `flag:"read-timeout" cfg:"read_timeout"`
+	ReadHeaderTimeout time.Duration `flag:"read-header-timeout" cfg:"read_header_timeout"`
+	WriteTimeout      time.Duration `flag:"write-timeout" cfg:"write_timeout"`
+	IdleTimeout       time.Duration `flag:"idle-timeout" cfg:"idle_timeout"`
+	TCPKeepAlive      time.Duration `flag:"tcp-keepalive" cfg:"tcp_keepalive"`
+
+	AWSRegion                string        `flag:"aws-region" cfg:"aws_region"`
+	AWSSecretRefreshInterval time.Duration `flag:"aws-secret-refresh-interval" cfg:"aws_secret_refresh_interval"`
 
 	AuthenticatedEmailsFile  string   `flag:"authenticated-emails-file" cfg:"authenticated_emails_file"`
+	AuthorizationAuditOnly   bool     `flag:"authorization-audit-only" cfg:"authorization_audit_only"`
 	AzureTenant              string   `flag:"azure-tenant" cfg:"azure_tenant"`
 	EmailDomains             []string `flag:"email-domain" cfg:"email_domains"`
 	GitHubOrg                string   `flag:"github-org" cfg:"github_org"`
@@ -38,18 +79,76 @@ type Options struct {
 	GoogleAdminEmail         string   `flag:"google-admin-email" cfg:"google_admin_email"`
 	GoogleServiceAccountJSON string   `flag:"google-service-account-json" cfg:"google_service_account_json"`
 	OktaDomain               string   `flag:"okta-domain" cfg:"okta_domain"`
+	OktaGroups               []string `flag:"okta-group" cfg:"okta_groups"`
 	HtpasswdFile             string   `flag:"htpasswd-file" cfg:"htpasswd_file"`
 	DisplayHtpasswdForm      bool     `flag:"display-htpasswd-form" cfg:"display_htpasswd_form"`
 	CustomTemplatesDir       string   `flag:"custom-templates-dir" cfg:"custom_templates_dir"`
+	HostTemplatesDirs        []string `flag:"host-templates-dir" cfg:"host_templates_dirs"`
+	Banner                   string   `flag:"banner" cfg:"banner"`
 	Footer                   string   `flag:"footer" cfg:"footer"`
-
-	CookieName     string        `flag:"cookie-name" cfg:"cookie_name" env:"OAUTH2_PROXY_COOKIE_NAME"`
-	CookieSecret   string        `flag:"cookie-secret" cfg:"cookie_secret" env:"OAUTH2_PROXY_COOKIE_SECRET"`
-	CookieDomain   string        `flag:"cookie-domain" cfg:"cookie_domain" env:"OAUTH2_PROXY_COOKIE_DOMAIN"`
-	CookieExpire   time.Duration `flag:"cookie-expire" cfg:"cookie_expire" env:"OAUTH2_PROXY_COOKIE_EXPIRE"`
-	CookieRefresh  time.Duration `flag:"cookie-refresh" cfg:"cookie_refresh" env:"OAUTH2_PROXY_COOKIE_REFRESH"`
-	CookieSecure   bool          `flag:"cookie-secure" cfg:"cookie_secure"`
-	CookieHttpOnly bool          `flag:"cookie-httponly" cfg:"cookie_httponly"`
+	BrandName                string   `flag:"brand-name" cfg:"brand_name"`
+	BrandLogoURL             string   `flag:"brand-logo-url" cfg:"brand_logo_url"`
+	BrandColor               string   `flag:"brand-color" cfg:"brand_color"`
+	BrandSupportContact      string   `flag:"brand-support-contact" cfg:"brand_support_contact"`
+	SignOutConfirm           bool     `flag:"sign-out-confirm" cfg:"sign_out_confirm"`
+	SignOutRedirect          string   `flag:"sign-out-redirect" cfg:"sign_out_redirect"`
+	DeviceFlow               bool     `flag:"device-flow" cfg:"device_flow"`
+	WatchFiles               bool     `flag:"watch-files" cfg:"watch_files"`
+	TemplatesWatch           bool     `flag:"templates-watch" cfg:"templates_watch"`
+	CustomTemplatesCSP       bool     `flag:"custom-templates-csp" cfg:"custom_templates_csp"`
+
+	BannerMessageFile    string        `flag:"banner-message-file" cfg:"banner_message_file"`
+	BannerMessageRefresh time.Duration `flag:"banner-message-refresh" cfg:"banner_message_refresh"`
+	BannerMessageHeader  string        `flag:"banner-message-header" cfg:"banner_message_header"`
+
+	MaintenanceFile        string   `flag:"maintenance-file" cfg:"maintenance_file"`
+	MaintenanceAllowCIDRs  []string `flag:"maintenance-allow-cidr" cfg:"maintenance_allow_cidrs"`
+	MaintenanceAllowUsers  []string `flag:"maintenance-allow-user" cfg:"maintenance_allow_users"`
+	MaintenanceAllowGroups []string `flag:"maintenance-allow-group" cfg:"maintenance_allow_groups"`
+
+	TermsFile     string        `flag:"terms-file" cfg:"terms_file"`
+	TermsVersion  string        `flag:"terms-version" cfg:"terms_version"`
+	TermsInterval time.Duration `flag:"terms-interval" cfg:"terms_interval"`
+
+	CookieName       string        `flag:"cookie-name" cfg:"cookie_name" env:"OAUTH2_PROXY_COOKIE_NAME"`
+	CookieSecret     string        `flag:"cookie-secret" cfg:"cookie_secret" env:"OAUTH2_PROXY_COOKIE_SECRET"`
+	CookieSecretFile string        `flag:"cookie-secret-file" cfg:"cookie_secret_file" env:"OAUTH2_PROXY_COOKIE_SECRET_FILE"`
+	CookieDomain     string        `flag:"cookie-domain" cfg:"cookie_domain" env:"OAUTH2_PROXY_COOKIE_DOMAIN"`
+	CookieExpire     time.Duration `flag:"cookie-expire" cfg:"cookie_expire" env:"OAUTH2_PROXY_COOKIE_EXPIRE"`
+	CookieRefresh    time.Duration `flag:"cookie-refresh" cfg:"cookie_refresh" env:"OAUTH2_PROXY_COOKIE_REFRESH"`
+	CookieSecure     bool          `flag:"cookie-secure" cfg:"cookie_secure"`
+	CookieHttpOnly   bool          `flag:"cookie-httponly" cfg:"cookie_httponly"`
+	CookieCompress   bool          `flag:"cookie-compress" cfg:"cookie_compress"`
+	CookieMaxSize    int           `flag:"cookie-max-size" cfg:"cookie_max_size"`
+
+	CookieSecretKMSKey string `flag:"cookie-secret-kms-key" cfg:"cookie_secret_kms_key" env:"OAUTH2_PROXY_COOKIE_SECRET_KMS_KEY"`
+
+	SessionStore string `flag:"session-store" cfg:"session_store" env:"OAUTH2_PROXY_SESSION_STORE"`
+
+	SessionValidationCache time.Duration `flag:"session-validation-cache" cfg:"session_validation_cache"`
+	RefreshAhead           time.Duration `flag:"refresh-ahead" cfg:"refresh_ahead"`
+
+	RevocationWebhookToken string `flag:"revocation-webhook-token" cfg:"revocation_webhook_token" env:"OAUTH2_PROXY_REVOCATION_WEBHOOK_TOKEN"`
+	AdminToken             string `flag:"admin-token" cfg:"admin_token" env:"OAUTH2_PROXY_ADMIN_TOKEN"`
+
+	MaxHeaderBytes int `flag:"max-header-bytes" cfg:"max_header_bytes"`
+	MaxHeaderCount int `flag:"max-header-count" cfg:"max_header_count"`
+	MaxURILength   int `flag:"max-uri-length" cfg:"max_uri_length"`
+
+	AllowCIDRs []string `flag:"allow-cidr" cfg:"allow_cidrs"`
+	DenyCIDRs  []string `flag:"deny-cidr" cfg:"deny_cidrs"`
+
+	RateLimitPerIP      int `flag:"rate-limit-per-ip" cfg:"rate_limit_per_ip"`
+	RateLimitPerUser    int `flag:"rate-limit-per-user" cfg:"rate_limit_per_user"`
+	RateLimitIPv6Prefix int `flag:"rate-limit-ipv6-prefix" cfg:"rate_limit_ipv6_prefix"`
+
+	MaxConcurrentRequests int           `flag:"max-concurrent-requests" cfg:"max_concurrent_requests"`
+	MaxQueuedRequests     int           `flag:"max-queued-requests" cfg:"max_queued_requests"`
+	QueueTimeout          time.Duration `flag:"queue-timeout" cfg:"queue_timeout"`
+
+	LockoutThreshold int           `flag:"lockout-threshold" cfg:"lockout_threshold"`
+	LockoutDuration  time.Duration `flag:"lockout-duration" cfg:"lockout_duration"`
+	LockoutDelay     time.Duration `flag:"lockout-delay" cfg:"lockout_delay"`
 
 	Upstreams             []string      `flag:"upstream" cfg:"upstreams"`
 	SkipAuthRegex         []string      `flag:"skip-auth-regex" cfg:"skip_auth_regex"`
@@ -63,32 +162,111 @@ type Options struct {
 	SetXAuthRequest       bool          `flag:"set-xauthrequest" cfg:"set_xauthrequest"`
 	SkipAuthPreflight     bool          `flag:"skip-auth-preflight" cfg:"skip_auth_preflight"`
 	MaxAge                time.Duration `flag:"max-age" cfg:"max_age"`
+	WhitelistDomains      []string      `flag:"whitelist-domain" cfg:"whitelist_domains"`
+	RedirectSchemes       []string      `flag:"redirect-scheme" cfg:"redirect_schemes"`
+
+	CORSAllowedOrigins   []string `flag:"cors-allowed-origin" cfg:"cors_allowed_origins"`
+	CORSAllowCredentials bool     `flag:"cors-allow-credentials" cfg:"cors_allow_credentials"`
+	CORSAllowedHeaders   []string `flag:"cors-allowed-header" cfg:"cors_allowed_headers"`
 
 	// These options allow for other providers besides Google, with
 	// potential overrides.
-	Provider          string `flag:"provider" cfg:"provider"`
-	OIDCIssuerURL     string `flag:"oidc-issuer-url" cfg:"oidc_issuer_url"`
-	LoginURL          string `flag:"login-url" cfg:"login_url"`
-	RedeemURL         string `flag:"redeem-url" cfg:"redeem_url"`
-	ProfileURL        string `flag:"profile-url" cfg:"profile_url"`
-	ProtectedResource string `flag:"resource" cfg:"resource"`
-	ValidateURL       string `flag:"validate-url" cfg:"validate_url"`
-	Scope             string `flag:"scope" cfg:"scope"`
-	Prompt            string `flag:"prompt" cfg:"prompt"`
+	Provider          string   `flag:"provider" cfg:"provider"`
+	HostProviders     []string `flag:"host-provider" cfg:"host_providers"`
+	OIDCIssuerURL     string   `flag:"oidc-issuer-url" cfg:"oidc_issuer_url"`
+	LoginURL          string   `flag:"login-url" cfg:"login_url"`
+	RedeemURL         string   `flag:"redeem-url" cfg:"redeem_url"`
+	ProfileURL        string   `flag:"profile-url" cfg:"profile_url"`
+	ProtectedResource string   `flag:"resource" cfg:"resource"`
+	ValidateURL       string   `flag:"validate-url" cfg:"validate_url"`
+	Scope             string   `flag:"scope" cfg:"scope"`
+	Prompt            string   `flag:"prompt" cfg:"prompt"`
+
+	LoginProviders      []string `flag:"login-provider" cfg:"login_providers"`
+	LoginProviderLabels []string `flag:"login-provider-label" cfg:"login_provider_labels"`
+	LoginProviderIcons  []string `flag:"login-provider-icon" cfg:"login_provider_icons"`
+	LoginProviderOrder  []string `flag:"login-provider-order" cfg:"login_provider_order"`
 
 	RequestLogging       bool   `flag:"request-logging" cfg:"request_logging"`
 	RequestBodyLogging   bool   `flag:"request-body-logging" cfg:"request_body_logging"`
 	RequestLoggingFormat string `flag:"request-logging-format" cfg:"request_logging_format"`
+	RequestLogWorkers    int    `flag:"request-logging-workers" cfg:"request_logging_workers"`
+
+	SecurityEventSyslog string `flag:"security-event-syslog" cfg:"security_event_syslog"`
+	SecurityEventFormat string `flag:"security-event-format" cfg:"security_event_format"`
 
 	SignatureKey string `flag:"signature-key" cfg:"signature_key" env:"OAUTH2_PROXY_SIGNATURE_KEY"`
 
+	UpstreamJWTHeader     string        `flag:"upstream-jwt-header" cfg:"upstream_jwt_header"`
+	UpstreamJWTKeyFile    string        `flag:"upstream-jwt-key-file" cfg:"upstream_jwt_key_file"`
+	UpstreamJWTIssuer     string        `flag:"upstream-jwt-issuer" cfg:"upstream_jwt_issuer"`
+	UpstreamJWTExpiration time.Duration `flag:"upstream-jwt-expiration" cfg:"upstream_jwt_expiration"`
+
+	TrustedIdentityHeader   string `flag:"trusted-identity-header" cfg:"trusted_identity_header"`
+	TrustedIdentityKeyFile  string `flag:"trusted-identity-key-file" cfg:"trusted_identity_key_file"`
+	TrustedIdentityIssuer   string `flag:"trusted-identity-issuer" cfg:"trusted_identity_issuer"`
+	TrustedIdentityAudience string `flag:"trusted-identity-audience" cfg:"trusted_identity_audience"`
+
+	UpstreamCacheSize         int      `flag:"upstream-cache-size" cfg:"upstream_cache_size"`
+	UpstreamCachePaths        []string `flag:"upstream-cache-path" cfg:"upstream_cache_paths"`
+	UpstreamCacheContentTypes []string `flag:"upstream-cache-content-type" cfg:"upstream_cache_content_types"`
+
+	UpstreamDNSRefresh time.Duration `flag:"upstream-dns-refresh" cfg:"upstream_dns_refresh"`
+
+	CanaryUpstreams []string `flag:"canary-upstream" cfg:"canary_upstreams"`
+	CanaryPercent   int      `flag:"canary-percent" cfg:"canary_percent"`
+	CanaryByUser    bool     `flag:"canary-by-user" cfg:"canary_by_user"`
+
+	MirrorUpstreams []string `flag:"mirror-upstream" cfg:"mirror_upstreams"`
+	MirrorPercent   int      `flag:"mirror-percent" cfg:"mirror_percent"`
+
+	ConsulAddress    string `flag:"consul-address" cfg:"consul_address"`
+	ConsulToken      string `flag:"consul-token" cfg:"consul_token" env:"OAUTH2_PROXY_CONSUL_TOKEN"`
+	ConsulDatacenter string `flag:"consul-datacenter" cfg:"consul_datacenter"`
+
 	// internal values that are set after config validation
-	redirectURL   *url.URL
-	proxyURLs     []*url.URL
-	CompiledRegex []*regexp.Regexp
-	provider      providers.Provider
-	signatureData *SignatureData
-	oidcVerifier  *oidc.IDTokenVerifier
+	clientSecretRef string
+	kmsCookieSecret string
+	redirectURL     *url.URL
+	proxyURLs       []*url.URL
+	canaryURLs      []*url.URL
+	mirrors         map[string]*mirror
+	CompiledRegex   []*regexp.Regexp
+	provider        providers.Provider
+	hostProviders   map[string]providers.Provider
+	loginProviders  []*loginProvider
+	bannerMessage   *bannerMessage
+	maintenance     *maintenanceMode
+	terms           *terms
+	templateDirs    map[string]string
+	templates       *template.Template
+	hostTemplates   map[string]*template.Template
+	cookieCipher    *cookie.Cipher
+	stateCipher     *cookie.Cipher
+	sessionStore    store.Store
+	rateLimitStore  store.Store
+	redirectSchemes []string
+	allowNets       []*net.IPNet
+	denyNets        []*net.IPNet
+	signatureData   *SignatureData
+	jwtSigner       *identitySigner
+	trustedIdentity *trustedIdentity
+	upstreamCache   *upstreamCache
+	concurrency     *concurrencyLimit
+	consul          *consulCatalog
+	securityEvents  *SecurityEventLogger
+	oidcVerifier    *oidc.IDTokenVerifier
+	oidcJWKSURL     string
+	// offline skips the checks that reach other services, such as the OIDC
+	// discovery and the AWS and KMS secret lookups, when only the form of the
+	// configuration is checked.
+	offline         bool
+	unixSocketMode  os.FileMode
+	tlsMinVersion   uint16
+	tlsMaxVersion   uint16
+	tlsCipherSuites []uint16
+	tlsCurves       []tls.CurveID
+	tlsClientCAs    *x509.CertPool
 }
 
 type SignatureData struct {
@@ -100,13 +278,19 @@ func NewOptions() *Options {
 	return &Options{
 		ProxyPrefix:          "/oauth2",
 		HttpAddress:          "127.0.0.1:4180",
+		MetricsPath:          "/metrics",
 		HttpsAddress:         ":443",
+		TLSMinVersion:        "1.2",
+		HTTP2MaxStreams:      250,
+		ShutdownTimeout:      time.Duration(30) * time.Second,
+		TCPKeepAlive:         3 * time.Minute,
 		DisplayHtpasswdForm:  true,
 		CookieName:           "_oauth2_proxy",
 		CookieSecure:         true,
 		CookieHttpOnly:       true,
 		CookieExpire:         time.Duration(168) * time.Hour,
 		CookieRefresh:        time.Duration(0),
+		CookieMaxSize:        4096,
 		SetXAuthRequest:      false,
 		SkipAuthPreflight:    false,
 		MaxAge:               time.Duration(0),
@@ -114,10 +298,19 @@ func NewOptions() *Options {
 		PassUserHeaders:      true,
 		PassAccessToken:      false,
 		PassHostHeader:       true,
+		SignOutConfirm:       true,
 		Prompt:               "login",
 		RequestLogging:       true,
 		RequestBodyLogging:   false,
 		RequestLoggingFormat: defaultRequestLoggingFormat,
+		BannerMessageRefresh: time.Minute,
+		SecurityEventFormat:  "cef",
+		LockoutDuration:      15 * time.Minute,
+		LockoutDelay:         time.Second,
+		RateLimitIPv6Prefix:  64,
+		QueueTimeout:         5 * time.Second,
+		ConsulAddress:        "http://127.0.0.1:8500",
+		MirrorPercent:        100,
 	}
 }
 
@@ -130,8 +323,48 @@ func parseURL(to_parse string, urltype string, msgs []string) (*url.URL, []strin
 	return parsed, msgs
 }
 
+// parseProviderURL parses a provider endpoint, which must be an absolute
+// http(s) URL, unless it is left out for the provider's default.
+func parseProviderURL(to_parse string, urltype string, msgs []string) (*url.URL, []string) {
+	parsed, msgs := parseURL(to_parse, urltype, msgs)
+	if parsed != nil && to_parse != "" && ((parsed.Scheme != "http" && parsed.Scheme != "https") || parsed.Host == "") {
+		msgs = append(msgs, fmt.Sprintf("invalid %s-url=%q; must be an absolute http(s) URL", urltype, to_parse))
+	}
+	return parsed, msgs
+}
+
+// validateUpstream checks that an upstream can be proxied to or served.
+func validateUpstream(u *url.URL) error {
+	switch u.Scheme {
+	case "http", "https":
+		if u.Host == "" {
+			return errors.New("missing host")
+		}
+		return nil
+	case "srv", "srv+https":
+		if u.Host == "" {
+			return errors.New("missing SRV record name")
+		}
+		if u.Port() != "" {
+			return errors.New("SRV records give the port")
+		}
+		return nil
+	case "consul", "consul+https":
+		if u.Host == "" {
+			return errors.New("missing Consul service name")
+		}
+		if u.Port() != "" {
+			return errors.New("Consul gives the port")
+		}
+		return nil
+	case "file":
+		return nil
+	}
+	return fmt.Errorf("unknown protocol %q; must be http, https, srv, srv+https, consul, consul+https or file", u.Scheme)
+}
+
 func (o *Options) Validate() error {
-	if o.SSLInsecureSkipVerify {
+	if o.SSLInsecureSkipVerify && !o.offline {
 		// TODO: Accept a certificate bundle.
 		insecureTransport := &http.Transport{
 			TLSClientConfig: &tls.Config{InsecureSkipVerify: true},
@@ -140,6 +373,22 @@ func (o *Options) Validate() error {
 	}
 
 	msgs := make([]string, 0)
+	o.ClientSecret, msgs = loadSecretFile(o.ClientSecret, o.ClientSecretFile, "client-secret", msgs)
+	o.CookieSecret, msgs = loadSecretFile(o.CookieSecret, o.CookieSecretFile, "cookie-secret", msgs)
+	if isAWSSecretRef(o.ClientSecret) {
+		o.clientSecretRef = o.ClientSecret
+	}
+	// offline, a secret kept in AWS or wrapped with KMS is left as it is
+	// and its length is not known
+	cookieSecretKnown := !o.offline || (!isAWSSecretRef(o.CookieSecret) && o.CookieSecretKMSKey == "")
+	if !o.offline {
+		o.ClientSecret, msgs = resolveAWSSecret(o.ClientSecret, "client-secret", o.AWSRegion, msgs)
+		n := len(msgs)
+		o.CookieSecret, msgs = resolveAWSSecret(o.CookieSecret, "cookie-secret", o.AWSRegion, msgs)
+		msgs = unwrapCookieSecret(o, msgs)
+		// nor is that of a secret that couldn't be fetched or unwrapped
+		cookieSecretKnown = len(msgs) == n
+	}
 	if o.CookieSecret == "" {
 		msgs = append(msgs, "missing setting: cookie-secret")
 	}
@@ -154,7 +403,14 @@ func (o *Options) Validate() error {
 			"\n      use email-domain=* to authorize all email addresses")
 	}
 
-	if o.OIDCIssuerURL != "" {
+	if o.OIDCIssuerURL != "" && o.offline {
+		if u, err := url.Parse(o.OIDCIssuerURL); err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			msgs = append(msgs, fmt.Sprintf("invalid oidc-issuer-url=%q; must be an http(s) URL", o.OIDCIssuerURL))
+		}
+		if o.Scope == "" {
+			o.Scope = "openid email profile"
+		}
+	} else if o.OIDCIssuerURL != "" {
 		// Configure discoverable provider data.
 		provider, err := oidc.NewProvider(context.Background(), o.OIDCIssuerURL)
 		if err != nil {
@@ -165,23 +421,37 @@ func (o *Options) Validate() error {
 		})
 		o.LoginURL = provider.Endpoint().AuthURL
 		o.RedeemURL = provider.Endpoint().TokenURL
+		var claims struct {
+			JWKSURL string `json:"jwks_uri"`
+		}
+		if err := provider.Claims(&claims); err == nil {
+			o.oidcJWKSURL = claims.JWKSURL
+		}
 		if o.Scope == "" {
 			o.Scope = "openid email profile"
 		}
 	}
 
+	msgs = parseProxyPrefix(o, msgs)
 	o.redirectURL, msgs = parseURL(o.RedirectURL, "redirect", msgs)
+	if o.redirectURL != nil && o.RedirectURL != "" && !validURL(o.RedirectURL) {
+		msgs = append(msgs, fmt.Sprintf("invalid redirect-url=%q; must be an http(s) URL or a path", o.RedirectURL))
+	}
 
 	for _, u := range o.Upstreams {
 		upstreamURL, err := url.Parse(u)
 		if err != nil {
 			msgs = append(msgs, fmt.Sprintf("error parsing upstream: %s", err))
-		} else {
-			if upstreamURL.Path == "" {
-				upstreamURL.Path = "/"
-			}
-			o.proxyURLs = append(o.proxyURLs, upstreamURL)
+			continue
+		}
+		if upstreamURL.Path == "" {
+			upstreamURL.Path = "/"
 		}
+		if err := validateUpstream(upstreamURL); err != nil {
+			msgs = append(msgs, fmt.Sprintf("invalid upstream %q: %s", u, err))
+			continue
+		}
+		o.proxyURLs = append(o.proxyURLs, upstreamURL)
 	}
 
 	for _, u := range o.SkipAuthRegex {
@@ -193,8 +463,11 @@ func (o *Options) Validate() error {
 		o.CompiledRegex = append(o.CompiledRegex, CompiledRegex)
 	}
 	msgs = parseProviderInfo(o, msgs)
+	msgs = parseHostProviders(o, msgs)
+	msgs = parseLoginProviders(o, msgs)
 
-	if o.PassAccessToken || (o.CookieRefresh != time.Duration(0)) {
+	o.cookieCipher, o.stateCipher = nil, nil
+	if cookieSecretKnown && o.CookieSecret != "" {
 		valid_cookie_secret_size := false
 		for _, i := range []int{16, 24, 32} {
 			if len(secretBytes(o.CookieSecret)) == i {
@@ -212,10 +485,10 @@ func (o *Options) Validate() error {
 			}
 			msgs = append(msgs, fmt.Sprintf(
 				"cookie_secret must be 16, 24, or 32 bytes "+
-					"to create an AES cipher when "+
-					"pass_access_token == true or "+
-					"cookie_refresh != 0, but is %d bytes.%s",
+					"to create an AES cipher, but is %d bytes.%s",
 				len(secretBytes(o.CookieSecret)), suffix))
+		} else {
+			msgs = parseCookieCiphers(o, msgs)
 		}
 	}
 
@@ -226,6 +499,12 @@ func (o *Options) Validate() error {
 			o.CookieRefresh.String(),
 			o.CookieExpire.String()))
 	}
+	if o.CookieMaxSize < 0 {
+		msgs = append(msgs, "cookie-max-size must not be negative")
+	}
+	if o.SessionValidationCache < 0 {
+		msgs = append(msgs, "session-validation-cache must not be negative")
+	}
 
 	if len(o.GoogleGroups) > 0 || o.GoogleAdminEmail != "" || o.GoogleServiceAccountJSON != "" {
 		if len(o.GoogleGroups) < 1 {
@@ -238,9 +517,44 @@ func (o *Options) Validate() error {
 			msgs = append(msgs, "missing setting: google-service-account-json")
 		}
 	}
+	if len(o.OktaGroups) > 0 && o.Provider != "okta" {
+		msgs = append(msgs, "okta-group requires provider okta")
+	}
 
 	msgs = parseSignatureKey(o, msgs)
+	msgs = parseUpstreamJWT(o, msgs)
+	msgs = parseTrustedIdentity(o, msgs)
+	msgs = parseUpstreamCache(o, msgs)
+	msgs = validateRefreshAhead(o, msgs)
+	msgs = parseSecurityEvents(o, msgs)
 	msgs = validateCookieName(o, msgs)
+	msgs = validateTemplates(o, msgs)
+	msgs = parseBannerMessage(o, msgs)
+	msgs = parseTerms(o, msgs)
+	msgs = validateFiles(o, msgs)
+	msgs = parseSessionStore(o, msgs)
+	msgs = validateSharedStore(o, msgs)
+	msgs = parseMaintenance(o, msgs)
+	msgs = parseCanaryUpstreams(o, msgs)
+	msgs = parseMirrorUpstreams(o, msgs)
+	msgs = parseConsul(o, msgs)
+	msgs = validateRequestSizeLimits(o, msgs)
+	msgs = parseRateLimits(o, msgs)
+	msgs = parseConcurrencyLimit(o, msgs)
+	msgs = parseCORS(o, msgs)
+	msgs = parseRedirectSchemes(o, msgs)
+	o.allowNets, msgs = parseCIDRs(o.AllowCIDRs, "allow-cidr", msgs)
+	o.denyNets, msgs = parseCIDRs(o.DenyCIDRs, "deny-cidr", msgs)
+	msgs = validateHttpWithTLS(o, msgs)
+	msgs = validateIPv6Addresses(o, msgs)
+	msgs = validateMetricsAddress(o, msgs)
+	msgs = validateServerTimeouts(o, msgs)
+	if o.UpstreamDNSRefresh < 0 {
+		msgs = append(msgs, "upstream-dns-refresh must not be negative")
+	}
+	msgs = parseUnixSocketMode(o, msgs)
+	msgs = parseTLSOptions(o, msgs)
+	msgs = parseTLSClientCA(o, msgs)
 
 	if len(msgs) != 0 {
 		return fmt.Errorf("Invalid configuration:\n  %s",
@@ -249,6 +563,22 @@ func (o *Options) Validate() error {
 	return nil
 }
 
+// loadSecretFile returns the contents of filename (without surrounding
+// whitespace) when a -*-file variant of a secret option is set.
+func loadSecretFile(secret, filename, name string, msgs []string) (string, []string) {
+	if filename == "" {
+		return secret, msgs
+	}
+	if secret != "" {
+		return secret, append(msgs, fmt.Sprintf("only one of %s and %s-file may be set", name, name))
+	}
+	b, err := ioutil.ReadFile(filename)
+	if err != nil {
+		return secret, append(msgs, fmt.Sprintf("unable to read %s-file: %s", name, err))
+	}
+	return strings.TrimSpace(string(b)), msgs
+}
+
 func parseProviderInfo(o *Options, msgs []string) []string {
 	p := &providers.ProviderData{
 		Scope:        o.Scope,
@@ -257,14 +587,21 @@ func parseProviderInfo(o *Options, msgs []string) []string {
 		Prompt:       o.Prompt,
 		MaxAge:       o.MaxAge,
 	}
-	p.LoginURL, msgs = parseURL(o.LoginURL, "login", msgs)
-	p.RedeemURL, msgs = parseURL(o.RedeemURL, "redeem", msgs)
-	p.ProfileURL, msgs = parseURL(o.ProfileURL, "profile", msgs)
-	p.ValidateURL, msgs = parseURL(o.ValidateURL, "validate", msgs)
-	p.ProtectedResource, msgs = parseURL(o.ProtectedResource, "resource", msgs)
+	p.LoginURL, msgs = parseProviderURL(o.LoginURL, "login", msgs)
+	p.RedeemURL, msgs = parseProviderURL(o.RedeemURL, "redeem", msgs)
+	p.ProfileURL, msgs = parseProviderURL(o.ProfileURL, "profile", msgs)
+	p.ValidateURL, msgs = parseProviderURL(o.ValidateURL, "validate", msgs)
+	p.ProtectedResource, msgs = parseProviderURL(o.ProtectedResource, "resource", msgs)
+
+	o.provider, msgs = configureProvider(o, o.Provider, p, msgs)
+	return msgs
+}
 
-	o.provider = providers.New(o.Provider, p)
-	switch p := o.provider.(type) {
+// configureProvider applies the provider specific options to a new provider
+// of the given type.
+func configureProvider(o *Options, name string, data *providers.ProviderData, msgs []string) (providers.Provider, []string) {
+	provider := providers.New(name, data)
+	switch p := provider.(type) {
 	case *providers.AzureProvider:
 		p.Configure(o.AzureTenant)
 	case *providers.GitHubProvider:
@@ -279,13 +616,71 @@ func parseProviderInfo(o *Options, msgs []string) []string {
 			}
 		}
 	case *providers.OIDCProvider:
-		if o.oidcVerifier == nil {
+		if o.oidcVerifier == nil && (!o.offline || o.OIDCIssuerURL == "") {
 			msgs = append(msgs, "oidc provider requires an oidc issuer URL")
 		} else {
 			p.Verifier = o.oidcVerifier
 		}
 	case *providers.OktaProvider:
 		p.SetOktaDomain(o.OktaDomain)
+		p.SetOktaGroups(o.OktaGroups)
+	}
+	return provider, msgs
+}
+
+// readProviderSecretFile reads the client secret of a host-provider or
+// login-provider entry from the file it names, which keeps the secret off the
+// command line.
+func readProviderSecretFile(flag, entry, filename string, msgs []string) (string, []string) {
+	b, err := ioutil.ReadFile(filename)
+	if err != nil {
+		return "", append(msgs, fmt.Sprintf("unable to read client-secret-file of %s %q: %s", flag, entry, err))
+	}
+	secret := strings.TrimSpace(string(b))
+	if secret == "" {
+		msgs = append(msgs, fmt.Sprintf("empty client-secret-file of %s %q", flag, entry))
+	}
+	return secret, msgs
+}
+
+// parseHostProviders configures the providers selected by request host. Each
+// entry has the form host=provider:client-id:client-secret-file and uses the
+// default endpoints of the provider.
+func parseHostProviders(o *Options, msgs []string) []string {
+	if len(o.HostProviders) == 0 {
+		return msgs
+	}
+	if o.CookieDomain != "" {
+		msgs = append(msgs, "host-provider cannot be used with cookie-domain; sessions must not be shared between hosts")
+	}
+	if o.redirectURL != nil && o.redirectURL.Host != "" {
+		msgs = append(msgs, "host-provider requires a redirect-url without a host (e.g. /oauth2/callback)")
+	}
+	o.hostProviders = make(map[string]providers.Provider)
+	for _, hp := range o.HostProviders {
+		s := strings.SplitN(hp, "=", 2)
+		var c []string
+		if len(s) == 2 {
+			c = strings.SplitN(s[1], ":", 3)
+		}
+		if len(c) != 3 || s[0] == "" || c[1] == "" || c[2] == "" {
+			msgs = append(msgs, fmt.Sprintf("invalid host-provider %q; expected host=provider:client-id:client-secret-file", hp))
+			continue
+		}
+		host, name := strings.ToLower(s[0]), c[0]
+		if name == "oidc" {
+			msgs = append(msgs, fmt.Sprintf("invalid host-provider %q; oidc is not supported per host", hp))
+			continue
+		}
+		if _, ok := o.hostProviders[host]; ok {
+			msgs = append(msgs, fmt.Sprintf("duplicate host-provider for host %q", host))
+			continue
+		}
+		var secret string
+		if secret, msgs = readProviderSecretFile("host-provider", hp, c[2], msgs); secret == "" {
+			continue
+		}
+		o.hostProviders[host], msgs = configureProvider(o, name, defaultEndpointsData(o, c[1], secret), msgs)
 	}
 	return msgs
 }
@@ -311,6 +706,214 @@ func parseSignatureKey(o *Options, msgs []string) []string {
 	return msgs
 }
 
+func parseSessionStore(o *Options, msgs []string) []string {
+	if o.SessionStore == "" {
+		return msgs
+	}
+	var err error
+	o.sessionStore, err = store.New(o.SessionStore)
+	if err != nil {
+		msgs = append(msgs, fmt.Sprintf("invalid session-store: %s", err))
+	}
+	return msgs
+}
+
+// validateSharedStore checks that the options keeping state that must be the
+// same on all replicas have a session-store; session-store=memory is only
+// right for a single instance, and must be chosen explicitly. Consent records
+// must outlive restarts, so they can't be kept in memory at all.
+func validateSharedStore(o *Options, msgs []string) []string {
+	if o.SessionStore == "memory" && o.TermsFile != "" {
+		msgs = append(msgs, "terms-file requires a persistent session-store such as redis://, as consent records are kept for 10 years")
+	}
+	if o.SessionStore != "" {
+		return msgs
+	}
+	if o.RevocationWebhookToken != "" {
+		msgs = append(msgs, "revocation-webhook-token requires session-store, so that revocations apply to all replicas")
+	}
+	if o.DeviceFlow {
+		msgs = append(msgs, "device-flow requires session-store, so that devices can be approved on any replica")
+	}
+	if o.TermsFile != "" {
+		msgs = append(msgs, "terms-file requires session-store, so that acceptance applies to all replicas")
+	}
+	return msgs
+}
+
+func validateHttpWithTLS(o *Options, msgs []string) []string {
+	switch o.HttpWithTLS {
+	case "":
+		return msgs
+	case "serve", "redirect":
+	default:
+		return append(msgs, fmt.Sprintf("invalid http-with-tls %q; must be \"serve\" or \"redirect\"", o.HttpWithTLS))
+	}
+	if o.TLSCertFile == "" || o.TLSKeyFile == "" {
+		return append(msgs, "http-with-tls requires tls-cert and tls-key")
+	}
+	return msgs
+}
+
+// validateIPv6Addresses checks that the IPv6 addresses to listen on in
+// addition to http-address and https-address are [<addr>]:<port> with an
+// IPv6 or no address.
+func validateIPv6Addresses(o *Options, msgs []string) []string {
+	for _, a := range []struct{ name, addr string }{
+		{"http-address-ipv6", o.HttpAddressIPv6},
+		{"https-address-ipv6", o.HttpsAddressIPv6},
+	} {
+		if a.addr == "" {
+			continue
+		}
+		host, _, err := net.SplitHostPort(a.addr)
+		if ip := net.ParseIP(host); err != nil || host != "" && (ip == nil || ip.To4() != nil) {
+			msgs = append(msgs, fmt.Sprintf("invalid %s %q; must be [<IPv6 addr>]:<port>", a.name, a.addr))
+		}
+	}
+	if o.HttpsAddressIPv6 != "" && (o.TLSCertFile == "" || o.TLSKeyFile == "") {
+		msgs = append(msgs, "https-address-ipv6 requires tls-cert and tls-key")
+	}
+	return msgs
+}
+
+// validateMetricsAddress checks that the metrics-address is <addr>:<port>
+// and not one of the addresses clients are served on, and the metrics-path.
+func validateMetricsAddress(o *Options, msgs []string) []string {
+	if o.MetricsAddress == "" {
+		return msgs
+	}
+	if !strings.HasPrefix(o.MetricsPath, "/") {
+		msgs = append(msgs, fmt.Sprintf("invalid metrics-path %q; must start with /", o.MetricsPath))
+	}
+	if _, _, err := net.SplitHostPort(o.MetricsAddress); err != nil {
+		return append(msgs, fmt.Sprintf("invalid metrics-address %q; must be <addr>:<port>", o.MetricsAddress))
+	}
+	if o.MetricsAddress == strings.TrimPrefix(o.HttpAddress, "http://") || o.MetricsAddress == o.HttpsAddress {
+		msgs = append(msgs, "metrics-address must differ from http-address and https-address")
+	}
+	return msgs
+}
+
+func validateServerTimeouts(o *Options, msgs []string) []string {
+	if o.ReadTimeout < 0 || o.ReadHeaderTimeout < 0 || o.WriteTimeout < 0 || o.IdleTimeout < 0 || o.TCPKeepAlive < 0 {
+		msgs = append(msgs, "read-timeout, read-header-timeout, write-timeout, idle-timeout and tcp-keepalive must not be negative")
+	}
+	return msgs
+}
+
+func parseUnixSocketMode(o *Options, msgs []string) []string {
+	if o.UnixSocketMode == "" {
+		return msgs
+	}
+	if !strings.HasPrefix(o.HttpAddress, "unix://") {
+		return append(msgs, "unix-socket-mode requires a unix://<path> http-address")
+	}
+	mode, err := strconv.ParseUint(o.UnixSocketMode, 8, 32)
+	if err != nil || mode > 0777 {
+		return append(msgs, fmt.Sprintf("invalid unix-socket-mode %q; expected octal permissions like 0660", o.UnixSocketMode))
+	}
+	o.unixSocketMode = os.FileMode(mode)
+	return msgs
+}
+
+// parseCIDRs parses a list of CIDR blocks; a single address is a block of one.
+func parseCIDRs(cidrs []string, name string, msgs []string) ([]*net.IPNet, []string) {
+	var nets []*net.IPNet
+	for _, cidr := range cidrs {
+		// accept IPv6 addresses in brackets as they appear in URLs and logs
+		c := strings.Replace(strings.Replace(cidr, "[", "", 1), "]", "", 1)
+		if ip := net.ParseIP(c); ip != nil {
+			bits := 8 * net.IPv6len
+			if ip.To4() != nil {
+				ip, bits = ip.To4(), 8*net.IPv4len
+			}
+			nets = append(nets, &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)})
+			continue
+		}
+		_, n, err := net.ParseCIDR(c)
+		if err != nil {
+			msgs = append(msgs, fmt.Sprintf("invalid %s %q", name, cidr))
+			continue
+		}
+		nets = append(nets, n)
+	}
+	return nets, msgs
+}
+
+var redirectSchemeRegex = regexp.MustCompile(`^[a-z][a-z0-9+.-]*$`)
+
+// browserSchemes are the URL schemes that browsers open themselves rather
+// than hand over to an app.
+var browserSchemes = map[string]bool{
+	"http": true, "https": true, "javascript": true, "data": true, "vbscript": true,
+	"file": true, "blob": true, "about": true, "ftp": true, "ws": true, "wss": true,
+}
+
+// parseRedirectSchemes validates the custom URL schemes of native apps that
+// may be redirected to after sign in. Schemes that browsers handle themselves
+// are refused.
+func parseRedirectSchemes(o *Options, msgs []string) []string {
+	o.redirectSchemes = nil
+	for _, scheme := range o.RedirectSchemes {
+		s := strings.ToLower(strings.TrimSuffix(scheme, "://"))
+		switch {
+		case !redirectSchemeRegex.MatchString(s):
+			msgs = append(msgs, fmt.Sprintf("invalid redirect-scheme %q; must be a URL scheme such as myapp", scheme))
+		case browserSchemes[s]:
+			msgs = append(msgs, fmt.Sprintf("redirect-scheme %q is not a custom scheme", scheme))
+		default:
+			o.redirectSchemes = append(o.redirectSchemes, s)
+		}
+	}
+	return msgs
+}
+
+// validateRequestSizeLimits checks the limits on the size of request
+// headers and URIs; zero means the default, or no limit.
+func validateRequestSizeLimits(o *Options, msgs []string) []string {
+	if o.MaxHeaderBytes < 0 || o.MaxHeaderCount < 0 || o.MaxURILength < 0 {
+		msgs = append(msgs, "max-header-bytes, max-header-count and max-uri-length must not be negative")
+	}
+	return msgs
+}
+
+// parseRateLimits selects where rate limits are counted: in the session store
+// shared by all replicas, if there is one, or else in memory.
+func parseRateLimits(o *Options, msgs []string) []string {
+	if o.LockoutThreshold < 0 || o.LockoutDuration < 0 || o.LockoutDelay < 0 {
+		msgs = append(msgs, "lockout-threshold, lockout-duration and lockout-delay must not be negative")
+	} else if o.LockoutThreshold > 0 && o.LockoutDuration == 0 {
+		msgs = append(msgs, "lockout-threshold requires lockout-duration")
+	}
+	if o.RateLimitIPv6Prefix < 1 || o.RateLimitIPv6Prefix > 128 {
+		msgs = append(msgs, "rate-limit-ipv6-prefix must be between 1 and 128")
+	}
+	if o.RateLimitPerIP < 0 || o.RateLimitPerUser < 0 {
+		return append(msgs, "rate-limit-per-ip and rate-limit-per-user must not be negative")
+	}
+	o.rateLimitStore = nil
+	if o.RateLimitPerIP != 0 || o.RateLimitPerUser != 0 {
+		o.rateLimitStore = o.sessionStore
+		if o.rateLimitStore == nil {
+			o.rateLimitStore = store.NewMemoryStore()
+		}
+	}
+	return msgs
+}
+
+// parseProxyPrefix normalizes the path that the endpoints of the proxy are
+// served under, e.g. /_auth/ to /_auth.
+func parseProxyPrefix(o *Options, msgs []string) []string {
+	prefix := strings.TrimRight(o.ProxyPrefix, "/")
+	u, err := url.Parse(prefix)
+	if !strings.HasPrefix(prefix, "/") || err != nil || u.Path != prefix || strings.Contains(prefix, "//") {
+		return append(msgs, fmt.Sprintf("invalid proxy-prefix %q; must be a path other than / such as /oauth2", o.ProxyPrefix))
+	}
+	o.ProxyPrefix = prefix
+	return msgs
+}
+
 func validateCookieName(o *Options, msgs []string) []string {
 	cookie := &http.Cookie{Name: o.CookieName}
 	if cookie.String() == "" {
@@ -319,6 +922,54 @@ func validateCookieName(o *Options, msgs []string) []string {
 	return msgs
 }
 
+func validateTemplates(o *Options, msgs []string) []string {
+	// executed once, so that references to unknown fields fail here rather
+	// than on the first request
+	t, err := texttemplate.New("request-log").Parse(o.RequestLoggingFormat)
+	if err != nil {
+		msgs = append(msgs, fmt.Sprintf("error parsing request-logging-format: %s", err))
+	} else if err := t.Execute(ioutil.Discard, logMessageData{}); err != nil {
+		msgs = append(msgs, fmt.Sprintf("error in request-logging-format: %s", err))
+	}
+	if o.RequestLogWorkers < 0 {
+		msgs = append(msgs, "request-logging-workers must not be negative")
+	}
+	msgs = validateBranding(o, msgs)
+	if o.SignOutRedirect != "" && !validURL(o.SignOutRedirect) {
+		msgs = append(msgs, fmt.Sprintf("invalid sign-out-redirect %q; must be an http(s) URL or a path", o.SignOutRedirect))
+	}
+	o.templates = getTemplates()
+	if o.CustomTemplatesDir != "" {
+		t, err := parseCustomTemplates(o.CustomTemplatesDir)
+		if err != nil {
+			msgs = append(msgs, fmt.Sprintf("error parsing custom-templates-dir=%q: %s", o.CustomTemplatesDir, err))
+		} else {
+			o.templates = t
+		}
+	}
+	msgs = parseHostTemplatesDirs(o, msgs)
+	if o.TemplatesWatch && o.CustomTemplatesDir == "" && len(o.HostTemplatesDirs) == 0 {
+		msgs = append(msgs, "templates-watch requires custom-templates-dir or host-templates-dir")
+	}
+	return msgs
+}
+
+func validateFiles(o *Options, msgs []string) []string {
+	if o.AuthenticatedEmailsFile != "" {
+		if f, err := os.Open(o.AuthenticatedEmailsFile); err != nil {
+			msgs = append(msgs, fmt.Sprintf("unable to open authenticated-emails-file: %s", err))
+		} else {
+			f.Close()
+		}
+	}
+	if o.HtpasswdFile != "" {
+		if _, err := NewHtpasswdFromFile(o.HtpasswdFile); err != nil {
+			msgs = append(msgs, fmt.Sprintf("invalid htpasswd-file=%q: %s", o.HtpasswdFile, err))
+		}
+	}
+	return msgs
+}
+
 func addPadding(secret string) string {
 	padding := len(secret) % 4
 	switch padding {
@@ -333,6 +984,25 @@ func addPadding(secret string) string {
 	}
 }
 
+// parseCookieCiphers creates the cipher of the session cookie, which is only
+// needed with pass-access-token or cookie-refresh, and the cipher of the
+// state parameter, with a key derived from the cookie secret.
+func parseCookieCiphers(o *Options, msgs []string) []string {
+	var err error
+	if o.PassAccessToken || o.CookieRefresh != time.Duration(0) {
+		o.cookieCipher, err = cookie.NewCipher(secretBytes(o.CookieSecret))
+		if err != nil {
+			return append(msgs, fmt.Sprintf("cookie-secret error: %s", err))
+		}
+	}
+	stateSecret := sha256.Sum256([]byte(o.CookieSecret))
+	o.stateCipher, err = cookie.NewCipher(stateSecret[:])
+	if err != nil {
+		msgs = append(msgs, fmt.Sprintf("cookie-secret error: %s", err))
+	}
+	return msgs
+}
+
 // secretBytes attempts to base64 decode the secret, if that fails it treats the secret as binary
 func secretBytes(secret string) []byte {
 	b, err := base64.URLEncoding.DecodeString(addPadding(secret))
@@ -1,20 +1,24 @@
-package main
+package oauth2proxy
 
 import (
 	"crypto"
+	"crypto/tls"
 	"fmt"
+	"io/ioutil"
 	"net/url"
+	"os"
 	"strings"
 	"testing"
 	"time"
 
+	"github.com/bitly/oauth2_proxy/providers"
 	"github.com/stretchr/testify/assert"
 )
 
 func testOptions() *Options {
 	o := NewOptions()
 	o.Upstreams = append(o.Upstreams, "http://127.0.0.1:8080/")
-	o.CookieSecret = "foobar"
+	o.CookieSecret = "xyzzyplughxyzzyplughxyzzyplughxp"
 	o.ClientID = "bazquux"
 	o.ClientSecret = "xyzzyplugh"
 	o.EmailDomains = []string{"*"}
@@ -67,6 +71,20 @@ func TestGoogleGroupInvalidFile(t *testing.T) {
 	assert.Equal(t, expected, err.Error())
 }
 
+func TestOktaGroupOptions(t *testing.T) {
+	o := testOptions()
+	o.OktaGroups = []string{"engineering"}
+	err := o.Validate()
+	assert.NotEqual(t, nil, err)
+	assert.Equal(t, errorMsg([]string{"okta-group requires provider okta"}), err.Error())
+
+	o.Provider = "okta"
+	o.OktaDomain = "example.okta.com"
+	assert.Equal(t, nil, o.Validate())
+	assert.Equal(t, []string{"engineering"}, o.provider.(*providers.OktaProvider).Groups)
+	assert.Equal(t, "openid profile email offline_access groups", o.provider.Data().Scope)
+}
+
 func TestInitializedOptions(t *testing.T) {
 	o := testOptions()
 	assert.Equal(t, nil, o.Validate())
@@ -107,6 +125,57 @@ func TestProxyURLsError(t *testing.T) {
 	assert.Equal(t, expected, err.Error())
 }
 
+func TestInvalidUpstreams(t *testing.T) {
+	for upstream, msg := range map[string]string{
+		"localhost:8080":    `invalid upstream "localhost:8080": unknown protocol "localhost"; must be http, https, srv, srv+https, consul, consul+https or file`,
+		"ftp://example.com": `invalid upstream "ftp://example.com": unknown protocol "ftp"; must be http, https, srv, srv+https, consul, consul+https or file`,
+		"http:///path":      `invalid upstream "http:///path": missing host`,
+		"srv:///path":       `invalid upstream "srv:///path": missing SRV record name`,
+		"srv://web:8080/":   `invalid upstream "srv://web:8080/": SRV records give the port`,
+		"consul:///":        `invalid upstream "consul:///": missing Consul service name`,
+	} {
+		o := testOptions()
+		o.Upstreams = []string{upstream}
+		assert.Equal(t, errorMsg([]string{msg}), o.Validate().Error(), upstream)
+	}
+
+	o := testOptions()
+	o.Upstreams = []string{"file:///var/www/static/#/static/"}
+	assert.Equal(t, nil, o.Validate())
+}
+
+func TestInvalidProviderURLs(t *testing.T) {
+	o := testOptions()
+	o.LoginURL = "example.com/oauth/authorize"
+	o.RedeemURL = "https://example.com/oauth/token"
+	o.ValidateURL = "/validate"
+	o.RedirectURL = "myhost.com/oauth2/callback"
+	assert.Equal(t, errorMsg([]string{
+		`invalid redirect-url="myhost.com/oauth2/callback"; must be an http(s) URL or a path`,
+		`invalid login-url="example.com/oauth/authorize"; must be an absolute http(s) URL`,
+		`invalid validate-url="/validate"; must be an absolute http(s) URL`,
+	}), o.Validate().Error())
+
+	o = testOptions()
+	o.RedirectURL = "/oauth2/callback"
+	assert.Equal(t, nil, o.Validate())
+}
+
+func TestProxyPrefix(t *testing.T) {
+	o := testOptions()
+	o.ProxyPrefix = "/_auth/"
+	assert.Equal(t, nil, o.Validate())
+	assert.Equal(t, "/_auth", o.ProxyPrefix)
+
+	for _, prefix := range []string{"", "/", "_auth", "//_auth", "/_auth?x=1", "/_a%20uth"} {
+		o = testOptions()
+		o.ProxyPrefix = prefix
+		assert.Equal(t, errorMsg([]string{
+			fmt.Sprintf("invalid proxy-prefix %q; must be a path other than / such as /oauth2", prefix),
+		}), o.Validate().Error(), prefix)
+	}
+}
+
 func TestCompiledRegex(t *testing.T) {
 	o := testOptions()
 	regexps := []string{"/foo/.*", "/ba[rz]/quux"}
@@ -154,13 +223,16 @@ func TestDefaultProviderApiSettings(t *testing.T) {
 	assert.Equal(t, "profile email", p.Scope)
 }
 
-func TestPassAccessTokenRequiresSpecificCookieSecretLengths(t *testing.T) {
+func TestCookieSecretRequiresSpecificLengths(t *testing.T) {
 	o := testOptions()
 	assert.Equal(t, nil, o.Validate())
 
 	assert.Equal(t, false, o.PassAccessToken)
-	o.PassAccessToken = true
 	o.CookieSecret = "cookie of invalid length-"
+	assert.Equal(t, errorMsg([]string{
+		"cookie_secret must be 16, 24, or 32 bytes to create an AES cipher, but is 25 bytes."}), o.Validate().Error())
+
+	o.PassAccessToken = true
 	assert.NotEqual(t, nil, o.Validate())
 
 	o.PassAccessToken = false
@@ -251,3 +323,290 @@ func TestValidateCookieBadName(t *testing.T) {
 	assert.Equal(t, err.Error(), "Invalid configuration:\n"+
 		fmt.Sprintf("  invalid cookie name: %q", o.CookieName))
 }
+
+func TestRequestLoggingFormatError(t *testing.T) {
+	o := testOptions()
+	o.RequestLoggingFormat = "{{.Client"
+	err := o.Validate()
+	assert.NotEqual(t, nil, err)
+
+	expected := errorMsg([]string{
+		"error parsing request-logging-format: " +
+			"template: request-log:1: unclosed action"})
+	assert.Equal(t, expected, err.Error())
+}
+
+func TestRequestLoggingFormatUnknownField(t *testing.T) {
+	o := testOptions()
+	o.RequestLoggingFormat = "{{.Client}} {{.Referer}}"
+	err := o.Validate().Error()
+	assert.Contains(t, err, "error in request-logging-format: ")
+	assert.Contains(t, err, "can't evaluate field Referer")
+}
+
+func TestMissingHtpasswdFile(t *testing.T) {
+	o := testOptions()
+	o.HtpasswdFile = "file_doesnt_exist.htpasswd"
+	err := o.Validate()
+	assert.NotEqual(t, nil, err)
+
+	expected := errorMsg([]string{
+		"invalid htpasswd-file=\"file_doesnt_exist.htpasswd\": " +
+			"open file_doesnt_exist.htpasswd: no such file or directory"})
+	assert.Equal(t, expected, err.Error())
+}
+
+func TestSecretFiles(t *testing.T) {
+	f, err := ioutil.TempFile("", "oauth2_proxy_secret")
+	assert.Equal(t, nil, err)
+	defer os.Remove(f.Name())
+	f.WriteString("secret from file\n")
+	f.Close()
+
+	o := testOptions()
+	o.ClientSecret = ""
+	o.ClientSecretFile = f.Name()
+	assert.Equal(t, nil, o.Validate())
+	assert.Equal(t, "secret from file", o.ClientSecret)
+
+	o = testOptions()
+	o.CookieSecretFile = f.Name()
+	err = o.Validate()
+	assert.NotEqual(t, nil, err)
+
+	expected := errorMsg([]string{
+		"only one of cookie-secret and cookie-secret-file may be set"})
+	assert.Equal(t, expected, err.Error())
+}
+
+// writeSecretFile writes secret to a temporary file, which the caller
+// removes.
+func writeSecretFile(t *testing.T, secret string) string {
+	f, err := ioutil.TempFile("", "oauth2_proxy_secret")
+	assert.Equal(t, nil, err)
+	f.WriteString(secret + "\n")
+	f.Close()
+	return f.Name()
+}
+
+func TestHostProviders(t *testing.T) {
+	secretFile := writeSecretFile(t, "app-secret")
+	defer os.Remove(secretFile)
+	o := testOptions()
+	o.HostProviders = []string{"App.Example.com=github:app-id:" + secretFile}
+	assert.Equal(t, nil, o.Validate())
+	p := o.hostProviders["app.example.com"]
+	assert.NotEqual(t, nil, p)
+	assert.Equal(t, "GitHub", p.Data().ProviderName)
+	assert.Equal(t, "app-id", p.Data().ClientID)
+	assert.Equal(t, "app-secret", p.Data().ClientSecret)
+	assert.Equal(t, "https://github.com/login/oauth/authorize",
+		p.Data().LoginURL.String())
+}
+
+func TestHostProvidersError(t *testing.T) {
+	o := testOptions()
+	o.CookieDomain = ".example.com"
+	o.HostProviders = []string{
+		"app.example.com=github:app-id",
+		"admin.example.com=oidc:admin-id:admin-secret",
+		"docs.example.com=github:docs-id:file_doesnt_exist",
+	}
+	err := o.Validate()
+	assert.NotEqual(t, nil, err)
+
+	expected := errorMsg([]string{
+		"host-provider cannot be used with cookie-domain; sessions must not be shared between hosts",
+		"invalid host-provider \"app.example.com=github:app-id\"; expected host=provider:client-id:client-secret-file",
+		"invalid host-provider \"admin.example.com=oidc:admin-id:admin-secret\"; oidc is not supported per host",
+		"unable to read client-secret-file of host-provider \"docs.example.com=github:docs-id:file_doesnt_exist\": " +
+			"open file_doesnt_exist: no such file or directory"})
+	assert.Equal(t, expected, err.Error())
+}
+
+func TestLoginProviders(t *testing.T) {
+	secretFile := writeSecretFile(t, "gh-secret")
+	defer os.Remove(secretFile)
+	o := testOptions()
+	o.LoginProviders = []string{"github=github:gh-id:" + secretFile, "corp=azure:az-id:" + secretFile}
+	o.LoginProviderLabels = []string{"corp=Corporate Account"}
+	o.LoginProviderIcons = []string{"github=https://static.example.com/github.png"}
+	o.LoginProviderOrder = []string{"corp"}
+	assert.Equal(t, nil, o.Validate())
+
+	var names, labels []string
+	for _, lp := range o.loginProviders {
+		names = append(names, lp.Name)
+		labels = append(labels, lp.Label)
+	}
+	assert.Equal(t, []string{"corp", "default", "github"}, names)
+	assert.Equal(t, []string{"Corporate Account", "Google", "GitHub"}, labels)
+	assert.Equal(t, "https://static.example.com/github.png", o.loginProviders[2].IconURL)
+	assert.Equal(t, "gh-id", o.loginProviders[2].provider.Data().ClientID)
+	assert.Equal(t, o.provider, o.loginProviders[1].provider)
+}
+
+func TestLoginProvidersError(t *testing.T) {
+	o := testOptions()
+	o.LoginProviders = []string{
+		"github=github:gh-id",
+		"corp=oidc:corp-id:corp-secret",
+		"default=github:gh-id:gh-secret",
+	}
+	secretFile := writeSecretFile(t, "")
+	defer os.Remove(secretFile)
+	o.LoginProviders = append(o.LoginProviders, "gitlab=gitlab:gl-id:"+secretFile)
+	o.LoginProviderLabels = []string{"gitlab=GitLab"}
+	o.LoginProviderIcons = []string{"default=javascript:alert(1)"}
+	o.LoginProviderOrder = []string{"gitlab"}
+	err := o.Validate()
+	assert.NotEqual(t, nil, err)
+
+	expected := errorMsg([]string{
+		"invalid login-provider \"github=github:gh-id\"; expected name=provider:client-id:client-secret-file",
+		"invalid login-provider \"corp=oidc:corp-id:corp-secret\"; oidc is only supported as -provider",
+		"duplicate login-provider \"default\"",
+		"empty client-secret-file of login-provider \"gitlab=gitlab:gl-id:" + secretFile + "\"",
+		"invalid login-provider-label \"gitlab=GitLab\"; unknown login-provider \"gitlab\"",
+		"invalid login-provider-order; unknown login-provider \"gitlab\"",
+		"invalid login-provider-icon for \"default\"; must be an http(s) URL or a path"})
+	assert.Equal(t, expected, err.Error())
+}
+
+func TestHttpWithTLSError(t *testing.T) {
+	o := testOptions()
+	o.HttpWithTLS = "redirect"
+	err := o.Validate()
+	assert.Equal(t, errorMsg([]string{"http-with-tls requires tls-cert and tls-key"}), err.Error())
+
+	o = testOptions()
+	o.TLSCertFile = "cert.pem"
+	o.TLSKeyFile = "key.pem"
+	o.HttpWithTLS = "both"
+	err = o.Validate()
+	assert.Equal(t, errorMsg([]string{"invalid http-with-tls \"both\"; must be \"serve\" or \"redirect\""}), err.Error())
+}
+
+func TestUnixSocketMode(t *testing.T) {
+	o := testOptions()
+	o.HttpAddress = "unix:///run/oauth2_proxy.sock"
+	o.UnixSocketMode = "0660"
+	assert.Equal(t, nil, o.Validate())
+	assert.Equal(t, os.FileMode(0660), o.unixSocketMode)
+
+	o = testOptions()
+	o.UnixSocketMode = "rw-rw----"
+	err := o.Validate()
+	assert.Equal(t, errorMsg([]string{
+		"unix-socket-mode requires a unix://<path> http-address"}), err.Error())
+
+	o.HttpAddress = "unix:///run/oauth2_proxy.sock"
+	err = o.Validate()
+	assert.Equal(t, errorMsg([]string{
+		"invalid unix-socket-mode \"rw-rw----\"; expected octal permissions like 0660"}), err.Error())
+}
+
+func TestTLSOptions(t *testing.T) {
+	o := testOptions()
+	o.TLSMinVersion = "1.1"
+	o.TLSCipherSuites = []string{"TLS_ECDHE_ECDSA_WITH_AES_256_GCM_SHA384", "tls_ecdhe_rsa_with_aes_256_gcm_sha384"}
+	o.TLSCurves = []string{"X25519", "p256"}
+	assert.Equal(t, nil, o.Validate())
+	assert.Equal(t, uint16(tls.VersionTLS11), o.tlsMinVersion)
+	assert.Equal(t, uint16(0), o.tlsMaxVersion)
+	assert.Equal(t, []uint16{tls.TLS_ECDHE_ECDSA_WITH_AES_256_GCM_SHA384, tls.TLS_ECDHE_RSA_WITH_AES_256_GCM_SHA384}, o.tlsCipherSuites)
+	assert.Equal(t, []tls.CurveID{tls.X25519, tls.CurveP256}, o.tlsCurves)
+}
+
+func TestTLSOptionsError(t *testing.T) {
+	o := testOptions()
+	o.TLSMinVersion = "1.2"
+	o.TLSMaxVersion = "1.1"
+	o.TLSCipherSuites = []string{"TLS_RSA_WITH_RC4_128_SHA"}
+	o.TLSCurves = []string{"P224"}
+	err := o.Validate()
+	assert.Equal(t, errorMsg([]string{
+		"tls-max-version must not be lower than tls-min-version",
+		"unsupported tls-cipher-suite \"TLS_RSA_WITH_RC4_128_SHA\"",
+		"unsupported tls-curve \"P224\"; must be one of P256, P384, P521 or X25519"}), err.Error())
+}
+
+func TestTLSMaxVersion(t *testing.T) {
+	o := testOptions()
+	o.TLSMaxVersion = "1.3"
+	assert.Equal(t, nil, o.Validate())
+	assert.Equal(t, uint16(tls.VersionTLS13), o.tlsMaxVersion)
+
+	o.TLSMaxVersion = "1.2"
+	o.HTTP3 = true
+	o.TLSCertFile = "cert.pem"
+	o.TLSKeyFile = "key.pem"
+	err := o.Validate()
+	assert.NotEqual(t, nil, err)
+	assert.Contains(t, err.Error(), "http3 requires TLS 1.3; tls-max-version must be 1.3 or unset")
+}
+
+func TestTLSClientCAError(t *testing.T) {
+	o := testOptions()
+	o.TLSClientCertRequired = true
+	err := o.Validate()
+	assert.Equal(t, errorMsg([]string{"tls-client-cert-required requires tls-client-ca"}), err.Error())
+
+	f, _ := ioutil.TempFile("", "oauth2_proxy")
+	f.WriteString("not a certificate")
+	f.Close()
+	defer os.Remove(f.Name())
+	o = testOptions()
+	o.TLSClientCAFile = f.Name()
+	err = o.Validate()
+	assert.Equal(t, errorMsg([]string{
+		"tls-client-ca requires tls-cert and tls-key",
+		fmt.Sprintf("no PEM certificates found in tls-client-ca %s", f.Name())}), err.Error())
+}
+
+func TestHTTP3RequiresTLS(t *testing.T) {
+	o := testOptions()
+	o.HTTP3 = true
+	err := o.Validate()
+	assert.Equal(t, errorMsg([]string{"http3 requires tls-cert and tls-key"}), err.Error())
+}
+
+func TestCIDRs(t *testing.T) {
+	o := testOptions()
+	o.AllowCIDRs = []string{"10.0.0.0/8", "192.168.1.1", "fd00::/8", "[2001:db8::1]", "[2001:db8::]/32"}
+	o.DenyCIDRs = []string{"10.1.0.0/16", "not-an-address", "10.0.0.0/33"}
+	err := o.Validate()
+	assert.Equal(t, errorMsg([]string{
+		"invalid deny-cidr \"not-an-address\"",
+		"invalid deny-cidr \"10.0.0.0/33\""}), err.Error())
+	assert.Equal(t, 5, len(o.allowNets))
+	assert.Equal(t, "192.168.1.1/32", o.allowNets[1].String())
+	assert.Equal(t, "2001:db8::1/128", o.allowNets[3].String())
+	assert.Equal(t, "2001:db8::/32", o.allowNets[4].String())
+}
+
+func TestIPv6AddressesError(t *testing.T) {
+	o := testOptions()
+	o.HttpAddressIPv6 = "[::]:4180"
+	o.RateLimitIPv6Prefix = 48
+	assert.Equal(t, nil, o.Validate())
+
+	o.HttpAddressIPv6 = "0.0.0.0:4180"
+	o.HttpsAddressIPv6 = "[2001:db8::1]"
+	o.RateLimitIPv6Prefix = 0
+	err := o.Validate()
+	assert.Equal(t, errorMsg([]string{
+		"rate-limit-ipv6-prefix must be between 1 and 128",
+		"invalid http-address-ipv6 \"0.0.0.0:4180\"; must be [<IPv6 addr>]:<port>",
+		"invalid https-address-ipv6 \"[2001:db8::1]\"; must be [<IPv6 addr>]:<port>",
+		"https-address-ipv6 requires tls-cert and tls-key"}), err.Error())
+}
+
+func TestRequestSizeLimits(t *testing.T) {
+	o := testOptions()
+	o.MaxHeaderCount = -1
+	err := o.Validate()
+	assert.NotEqual(t, nil, err)
+	assert.Equal(t, errorMsg([]string{
+		"max-header-bytes, max-header-count and max-uri-length must not be negative"}), err.Error())
+}
@@ -0,0 +1,211 @@
+package oauth2proxy
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/bitly/oauth2_proxy/providers"
+)
+
+// A PolicyRequest is a hypothetical request to evaluate the authorization
+// policy against.
+type PolicyRequest struct {
+	Email    string
+	Groups   []string
+	Method   string
+	Host     string
+	Path     string
+	ClientIP string
+}
+
+// A PolicyDecision is the outcome of evaluating a PolicyRequest and the rule
+// that decided it.
+type PolicyDecision struct {
+	Allowed bool
+	Rule    string
+	Notes   []string
+}
+
+// EvaluatePolicy sends req through a proxy for opts, as if from a user who
+// signed in with req.Email and req.Groups, and reports whether it reaches
+// its upstream. The checks are those of the proxy itself: the client
+// address, maintenance mode, skip-auth-regex, the validator and the groups
+// checked at sign in. The options must have been validated.
+func EvaluatePolicy(opts *Options, req PolicyRequest, validator func(string) bool) PolicyDecision {
+	p := newOAuthProxy(opts, validator)
+	// decide as if audit-only were off, to note what it lets through, and
+	// leave the rate limits of the real clients alone
+	p.AuditOnly = false
+	p.rateLimitPerIP, p.rateLimitPerUser = 0, 0
+	var notes []string
+	if req.ClientIP == "" && (len(p.allowNets) != 0 || len(p.denyNets) != 0) {
+		p.allowNets, p.denyNets = nil, nil
+		notes = append(notes, "allow-cidr and deny-cidr are not evaluated without a client address")
+	}
+	if g, ok := p.provider.(*providers.GoogleProvider); ok && len(opts.GoogleGroups) != 0 {
+		// the groups given stand in for the Google Admin API
+		google := *g
+		google.GroupValidator = func(string) bool { return inGroups(req.Groups, opts.GoogleGroups) }
+		p.provider = &google
+	}
+	var upstream bool
+	p.serveMux = http.HandlerFunc(func(http.ResponseWriter, *http.Request) { upstream = true })
+
+	r, err := http.NewRequest(req.Method, "http://"+req.Host+req.Path, nil)
+	if err != nil {
+		return PolicyDecision{Rule: fmt.Sprintf("invalid request: %s", err)}
+	}
+	r.Host = req.Host
+	r.RemoteAddr = net.JoinHostPort(req.ClientIP, "0")
+	if req.ClientIP == "" {
+		// a documentation address (RFC 5737), in no allowed network
+		r.RemoteAddr = "192.0.2.1:0"
+	}
+	if req.Email != "" {
+		s := &providers.SessionState{Email: req.Email, User: strings.Split(req.Email, "@")[0], Groups: req.Groups}
+		if reason := p.denyReason(r, s, true); reason != "" {
+			return auditOnly(opts, reason, PolicyDecision{Rule: "denied at sign in: " + reason, Notes: notes})
+		}
+		value, err := p.cookieForSession(p.providerFor(r), s)
+		if err != nil {
+			return PolicyDecision{Rule: fmt.Sprintf("unable to create a session: %s", err), Notes: notes}
+		}
+		r.AddCookie(p.MakeSessionCookie(r, value, p.CookieExpire, time.Now()))
+	}
+
+	rw := &policyWriter{header: make(http.Header)}
+	p.ServeHTTP(rw, r)
+	d := PolicyDecision{Allowed: upstream, Notes: notes}
+	reason := rw.header.Get(deniedReasonHeader)
+	if reason == "" {
+		reason = p.requestMetrics.rejection()
+	}
+	switch {
+	case upstream && rw.header.Get("GAP-Auth") != "":
+		d.Rule = fmt.Sprintf("authorized as %s", rw.header.Get("GAP-Auth"))
+	case upstream && p.skipAuthPreflight && r.Method == "OPTIONS":
+		d.Rule = "skip-auth-preflight (no authentication required)"
+	case upstream:
+		for _, re := range p.compiledRegex {
+			if re.MatchString(r.URL.Path) {
+				d.Rule = fmt.Sprintf("skip-auth-regex=%q (no authentication required)", re.String())
+				break
+			}
+		}
+	case reason == rejectUnauthenticated && req.Email == "":
+		d.Rule = "authentication required (no email given)"
+	case reason == denyTermsNotAccepted:
+		d.Rule = "denied: " + reason
+		d.Notes = append(d.Notes, "the user must accept the terms of use at "+p.TermsPath+" first")
+	case reason != "":
+		d.Rule = "denied: " + reason
+		d = auditOnly(opts, reason, d)
+	case rw.status == http.StatusServiceUnavailable && p.maintenance.Status().Enabled:
+		d.Rule = "maintenance mode is on"
+	default:
+		d.Allowed, d.Rule = true, "served by oauth2_proxy (no authentication required)"
+	}
+	if opts.GitHubOrg != "" || opts.GitHubTeam != "" {
+		d.Notes = append(d.Notes, "github-org and github-team membership is checked with GitHub at sign in and is not evaluated")
+	}
+	return d
+}
+
+// inGroups reports whether one of groups is one of want.
+func inGroups(groups, want []string) bool {
+	for _, w := range want {
+		for _, g := range groups {
+			if strings.EqualFold(g, w) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// auditOnly notes that the authorization failure for reason is only logged
+// with authorization-audit-only.
+func auditOnly(opts *Options, reason string, d PolicyDecision) PolicyDecision {
+	if opts.AuthorizationAuditOnly && (reason == denyEmailNotAllowed || reason == denyGroupNotAllowed) {
+		d.Notes = append(d.Notes, "authorization-audit-only is set: the proxy logs this request as \"would deny\" and allows it")
+	}
+	return d
+}
+
+// policyWriter keeps the status and headers of the response to an evaluated
+// request and discards its body.
+type policyWriter struct {
+	header http.Header
+	status int
+}
+
+func (w *policyWriter) Header() http.Header { return w.header }
+
+func (w *policyWriter) Write(b []byte) (int, error) {
+	if w.status == 0 {
+		w.status = http.StatusOK
+	}
+	return len(b), nil
+}
+
+func (w *policyWriter) WriteHeader(status int) {
+	if w.status == 0 {
+		w.status = status
+	}
+}
+
+func evaluatePolicyCommand(args []string) int {
+	flagSet := newFlagSet("oauth2_proxy evaluate-policy")
+	groups := StringArray{}
+	email := flagSet.String("email", "", "email address of the authenticated user (empty for an unauthenticated request)")
+	flagSet.Var(&groups, "group", "group the user is a member of (may be given multiple times)")
+	host := flagSet.String("host", "", "request host; selects the tenant when tenants are configured")
+	clientIP := flagSet.String("client-ip", "", "address of the client, checked against allow-cidr, deny-cidr and maintenance-allow-cidr")
+	method := flagSet.String("method", "GET", "request method")
+	path := flagSet.String("path", "/", "request path")
+	flagSet.Parse(args)
+
+	opts, _, tenants := loadOptions(flagSet)
+	if len(tenants) != 0 {
+		opts = nil
+		for _, t := range tenants {
+			for _, h := range t.Hosts {
+				if strings.EqualFold(h, *host) {
+					opts = t.Opts
+				}
+			}
+		}
+		if opts == nil {
+			fmt.Fprintf(os.Stderr, "no tenant serves host %q\n", *host)
+			return 2
+		}
+	}
+	if err := opts.Validate(); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 2
+	}
+	d := EvaluatePolicy(opts, PolicyRequest{
+		Email:    *email,
+		Groups:   groups,
+		Method:   strings.ToUpper(*method),
+		Host:     *host,
+		Path:     *path,
+		ClientIP: *clientIP,
+	}, NewValidator(opts.EmailDomains, opts.AuthenticatedEmailsFile))
+	decision := "deny"
+	if d.Allowed {
+		decision = "allow"
+	}
+	fmt.Printf("decision: %s\nrule: %s\n", decision, d.Rule)
+	for _, note := range d.Notes {
+		fmt.Printf("note: %s\n", note)
+	}
+	if !d.Allowed {
+		return 1
+	}
+	return 0
+}
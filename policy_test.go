@@ -0,0 +1,119 @@
+package oauth2proxy
+
+import (
+	"io/ioutil"
+	"os"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestEvaluatePolicy(t *testing.T) {
+	o := testOptions()
+	o.EmailDomains = []string{"example.com"}
+	o.SkipAuthRegex = []string{"^/public/"}
+	o.SkipAuthPreflight = true
+	assert.Equal(t, nil, o.Validate())
+
+	for _, tc := range []struct {
+		req     PolicyRequest
+		allowed bool
+		rule    string
+	}{
+		{PolicyRequest{Method: "GET", Path: "/public/logo.png"}, true,
+			"skip-auth-regex=\"^/public/\" (no authentication required)"},
+		{PolicyRequest{Method: "OPTIONS", Path: "/api"}, true,
+			"skip-auth-preflight (no authentication required)"},
+		{PolicyRequest{Method: "GET", Path: "/oauth2/sign_in"}, true,
+			"served by oauth2_proxy (no authentication required)"},
+		{PolicyRequest{Method: "GET", Path: "/api"}, false,
+			"authentication required (no email given)"},
+		{PolicyRequest{Email: "User@Example.com", Method: "GET", Path: "/api"}, true,
+			"authorized as User@Example.com"},
+		{PolicyRequest{Email: "user@example.org", Method: "GET", Path: "/api"}, false,
+			"denied at sign in: email_not_allowed"},
+	} {
+		d := EvaluatePolicy(o, tc.req, NewValidator(o.EmailDomains, ""))
+		assert.Equal(t, tc.allowed, d.Allowed, tc.req.Path)
+		assert.Equal(t, tc.rule, d.Rule, tc.req.Path)
+	}
+}
+
+func TestEvaluatePolicyClientAndMaintenance(t *testing.T) {
+	o := testOptions()
+	o.AllowCIDRs = []string{"10.0.0.0/8"}
+	assert.Equal(t, nil, o.Validate())
+	validator := func(string) bool { return true }
+	req := PolicyRequest{Email: "user@example.com", Method: "GET", Path: "/", ClientIP: "192.168.1.1"}
+
+	d := EvaluatePolicy(o, req, validator)
+	assert.Equal(t, false, d.Allowed)
+	assert.Equal(t, "denied: client_not_allowed", d.Rule)
+
+	req.ClientIP = "10.1.2.3"
+	d = EvaluatePolicy(o, req, validator)
+	assert.Equal(t, true, d.Allowed)
+
+	o.maintenance = &maintenanceMode{adminOn: true}
+	d = EvaluatePolicy(o, req, validator)
+	assert.Equal(t, false, d.Allowed)
+	assert.Equal(t, "maintenance mode is on", d.Rule)
+}
+
+func TestEvaluatePolicyGoogleGroups(t *testing.T) {
+	f, _ := ioutil.TempFile("", "service_account")
+	defer os.Remove(f.Name())
+	f.WriteString(`{"type": "service_account", "client_email": "proxy@example.com", "private_key": ""}`)
+	f.Close()
+
+	o := testOptions()
+	o.GoogleGroups = []string{"admins@example.com"}
+	o.GoogleAdminEmail = "admin@example.com"
+	o.GoogleServiceAccountJSON = f.Name()
+	assert.Equal(t, nil, o.Validate())
+	validator := func(string) bool { return true }
+	req := PolicyRequest{Email: "user@example.com", Method: "GET", Path: "/"}
+
+	d := EvaluatePolicy(o, req, validator)
+	assert.Equal(t, false, d.Allowed)
+	assert.Equal(t, "denied at sign in: group_not_allowed", d.Rule)
+
+	req.Groups = []string{"staff@example.com", "admins@example.com"}
+	d = EvaluatePolicy(o, req, validator)
+	assert.Equal(t, true, d.Allowed)
+	assert.Equal(t, "authorized as user@example.com", d.Rule)
+}
+
+func TestEvaluatePolicyOktaGroups(t *testing.T) {
+	o := testOptions()
+	o.Provider = "okta"
+	o.OktaDomain = "example.okta.com"
+	o.OktaGroups = []string{"engineering"}
+	assert.Equal(t, nil, o.Validate())
+	validator := func(string) bool { return true }
+	req := PolicyRequest{Email: "user@example.com", Groups: []string{"Everyone"}, Method: "GET", Path: "/"}
+
+	d := EvaluatePolicy(o, req, validator)
+	assert.Equal(t, false, d.Allowed)
+	assert.Equal(t, "denied at sign in: group_not_allowed", d.Rule)
+
+	req.Groups = []string{"Everyone", "Engineering"}
+	d = EvaluatePolicy(o, req, validator)
+	assert.Equal(t, true, d.Allowed)
+}
+
+func TestEvaluatePolicyAuditOnly(t *testing.T) {
+	o := testOptions()
+	o.EmailDomains = []string{"example.com"}
+	o.AuthorizationAuditOnly = true
+	assert.Equal(t, nil, o.Validate())
+	validator := NewValidator(o.EmailDomains, "")
+
+	d := EvaluatePolicy(o, PolicyRequest{Email: "user@other.com", Method: "GET", Path: "/"}, validator)
+	assert.Equal(t, false, d.Allowed)
+	assert.Equal(t, []string{`authorization-audit-only is set: the proxy logs this request as "would deny" and allows it`}, d.Notes)
+
+	d = EvaluatePolicy(o, PolicyRequest{Email: "user@example.com", Method: "GET", Path: "/"}, validator)
+	assert.Equal(t, true, d.Allowed)
+	assert.Equal(t, 0, len(d.Notes))
+}
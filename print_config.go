@@ -0,0 +1,120 @@
+package oauth2proxy
+
+import (
+	"flag"
+	"fmt"
+	"io"
+	"net/url"
+	"os"
+	"reflect"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const redacted = "<redacted>"
+
+// redactedOptions are the config file options holding secrets.
+var redactedOptions = map[string]bool{
+	"client_secret":            true,
+	"cookie_secret":            true,
+	"basic_auth_password":      true,
+	"signature_key":            true,
+	"revocation_webhook_token": true,
+	"admin_token":              true,
+	"consul_token":             true,
+}
+
+// PrintConfig writes the resolved options in config file format with secrets
+// redacted. Each value is annotated with where it came from: a command line
+// flag, an environment variable, the config file or the default.
+func PrintConfig(w io.Writer, opts *Options, flagSet *flag.FlagSet, cfg EnvOptions, tenants []*Tenant) {
+	fmt.Fprintln(w, "## effective configuration (secrets redacted)")
+	printOptions(w, opts, flagSet, cfg)
+	for _, t := range tenants {
+		fmt.Fprintf(w, "\n[[tenant]]\nname = %s\nhosts = %s\n",
+			strconv.Quote(t.Name), formatConfigValue(t.Hosts))
+		printOptions(w, t.Opts, flagSet, t.cfg)
+	}
+}
+
+func printOptions(w io.Writer, opts *Options, flagSet *flag.FlagSet, cfg EnvOptions) {
+	set := make(map[string]bool)
+	flagSet.Visit(func(f *flag.Flag) { set[f.Name] = true })
+
+	val := reflect.ValueOf(opts).Elem()
+	typ := val.Type()
+	for i := 0; i < typ.NumField(); i++ {
+		field := typ.Field(i)
+		flagName := field.Tag.Get("flag")
+		if flagName == "" {
+			continue
+		}
+		cfgName := field.Tag.Get("cfg")
+		if cfgName == "" {
+			cfgName = strings.Replace(flagName, "-", "_", -1)
+		}
+		envName := field.Tag.Get("env")
+
+		var source string
+		switch {
+		case set[flagName]:
+			source = "flag -" + flagName
+		case envName != "" && os.Getenv(envName) != "":
+			source = "env " + envName
+		case cfg[cfgName] != nil:
+			source = "config file"
+		default:
+			source = "default"
+		}
+
+		value := val.Field(i).Interface()
+		if redactedOptions[cfgName] {
+			value = redactSecret(value.(string))
+		} else if cfgName == "session_store" {
+			value = redactURLPassword(value.(string))
+		}
+		fmt.Fprintf(w, "%s = %s # %s\n", cfgName, formatConfigValue(value), source)
+	}
+}
+
+func redactSecret(secret string) string {
+	if secret == "" || isAWSSecretRef(secret) {
+		return secret
+	}
+	return redacted
+}
+
+func redactURLPassword(s string) string {
+	u, err := url.Parse(s)
+	if err != nil || u.User == nil {
+		return s
+	}
+	if _, ok := u.User.Password(); ok {
+		u.User = url.UserPassword(u.User.Username(), redacted)
+	}
+	return strings.Replace(u.String(), url.QueryEscape(redacted), redacted, 1)
+}
+
+func formatConfigValue(v interface{}) string {
+	switch v := v.(type) {
+	case string:
+		return strconv.Quote(v)
+	case time.Duration:
+		return strconv.Quote(v.String())
+	case []string:
+		quoted := make([]string, 0, len(v))
+		for _, s := range v {
+			quoted = append(quoted, strconv.Quote(s))
+		}
+		return "[" + strings.Join(quoted, ", ") + "]"
+	case []interface{}:
+		values := make([]string, 0, len(v))
+		for _, e := range v {
+			values = append(values, formatConfigValue(e))
+		}
+		return "[" + strings.Join(values, ", ") + "]"
+	default:
+		return fmt.Sprintf("%v", v)
+	}
+}
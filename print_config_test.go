@@ -0,0 +1,44 @@
+package oauth2proxy
+
+import (
+	"bytes"
+	"flag"
+	"os"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestPrintConfig(t *testing.T) {
+	flagSet := flag.NewFlagSet("oauth2_proxy", flag.ContinueOnError)
+	flagSet.String("client-id", "", "")
+	flagSet.Parse([]string{"-client-id=bazquux"})
+
+	os.Setenv("OAUTH2_PROXY_COOKIE_NAME", "_env_cookie")
+	defer os.Unsetenv("OAUTH2_PROXY_COOKIE_NAME")
+
+	o := testOptions()
+	o.CookieName = "_env_cookie"
+	o.HostProviders = []string{"app.example.com=github:app-id:/etc/oauth2_proxy/app-client-secret"}
+	cfg := EnvOptions{
+		"client_secret":  o.ClientSecret,
+		"host_providers": o.HostProviders,
+	}
+
+	var buf bytes.Buffer
+	PrintConfig(&buf, o, flagSet, cfg, nil)
+	out := buf.String()
+	for _, line := range []string{
+		"client_id = \"bazquux\" # flag -client-id",
+		"client_secret = \"<redacted>\" # config file",
+		"cookie_secret = \"<redacted>\" # default",
+		"cookie_name = \"_env_cookie\" # env OAUTH2_PROXY_COOKIE_NAME",
+		"cookie_expire = \"168h0m0s\" # default",
+		"email_domains = [\"*\"] # default",
+		"host_providers = [\"app.example.com=github:app-id:/etc/oauth2_proxy/app-client-secret\"] # config file",
+	} {
+		assert.True(t, strings.Contains(out, line+"\n"), line)
+	}
+	assert.False(t, strings.Contains(out, "xyzzyplugh"))
+}
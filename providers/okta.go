@@ -8,13 +8,17 @@ import (
 	"log"
 	"net/http"
 	"net/url"
+	"strings"
 	"time"
 
+	"github.com/bitly/go-simplejson"
 	"github.com/bitly/oauth2_proxy/api"
 )
 
 type OktaProvider struct {
 	*ProviderData
+	// Groups are the okta-group(s) users must be a member of.
+	Groups []string
 }
 
 func NewOktaProvider(p *ProviderData) *OktaProvider {
@@ -55,40 +59,108 @@ func getOktaHeader(access_token string) http.Header {
 	return header
 }
 
-func (p *OktaProvider) GetEmailAddress(s *SessionState) (string, error) {
+// SetOktaGroups restricts sign in to the members of any of groups, and
+// requests the groups scope for the groups claim of the userinfo endpoint.
+func (p *OktaProvider) SetOktaGroups(groups []string) {
+	p.Groups = groups
+	if len(groups) != 0 && !strings.Contains(" "+p.Scope+" ", " groups ") {
+		p.Scope += " groups"
+	}
+}
+
+// getUserInfo returns the claims of the user at the userinfo endpoint.
+func (p *OktaProvider) getUserInfo(accessToken string) (*simplejson.Json, error) {
 	req, err := http.NewRequest("GET",
 		p.ValidateURL.String(), nil)
 	if err != nil {
 		log.Printf("failed building request %s", err)
-		return "", err
+		return nil, err
 	}
-	req.Header = getOktaHeader(s.AccessToken)
+	req.Header = getOktaHeader(accessToken)
 	json, err := api.Request(req)
 	if err != nil {
 		log.Printf("failed making request %s", err)
-		return "", err
+		return nil, err
 	}
-	return json.Get("email").String()
+	return json, nil
 }
 
-func (p *OktaProvider) GetUserName(s *SessionState) (string, error) {
-	req, err := http.NewRequest("GET",
-		p.ValidateURL.String(), nil)
+// getGroups returns the groups claim of the userinfo; it is empty unless
+// the groups scope is requested.
+func getGroups(json *simplejson.Json) []string {
+	groups, _ := json.Get("groups").StringArray()
+	return groups
+}
+
+// Redeem redeems the code and fills in the email address, user name and
+// groups of the session from the userinfo endpoint.
+func (p *OktaProvider) Redeem(redirectURL, code string) (*SessionState, error) {
+	s, err := p.ProviderData.Redeem(redirectURL, code)
+	if err != nil {
+		return nil, err
+	}
+	json, err := p.getUserInfo(s.AccessToken)
+	if err != nil {
+		return nil, err
+	}
+	if s.Email, err = json.Get("email").String(); err != nil {
+		return nil, err
+	}
+	s.User, _ = json.Get("preferred_username").String()
+	s.Groups = getGroups(json)
+	return s, nil
+}
+
+func (p *OktaProvider) GetEmailAddress(s *SessionState) (string, error) {
+	json, err := p.getUserInfo(s.AccessToken)
 	if err != nil {
-		log.Printf("failed building request %s", err)
 		return "", err
 	}
-	req.Header = getOktaHeader(s.AccessToken)
-	json, err := api.Request(req)
+	return json.Get("email").String()
+}
+
+func (p *OktaProvider) GetUserName(s *SessionState) (string, error) {
+	json, err := p.getUserInfo(s.AccessToken)
 	if err != nil {
-		log.Printf("failed making request %s", err)
 		return "", err
 	}
 	return json.Get("preferred_username").String()
 }
 
+// ValidateSessionGroups reports whether the user of the session is a member
+// of any of the okta-group(s), if set.
+func (p *OktaProvider) ValidateSessionGroups(s *SessionState) bool {
+	if len(p.Groups) == 0 {
+		return true
+	}
+	for _, want := range p.Groups {
+		for _, group := range s.Groups {
+			if strings.EqualFold(group, want) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// ValidateSessionState checks the access token, and with okta-group(s) that
+// the user is still in one of them, so that the groups of sessions without a
+// refresh token are checked again each time the cookie is refreshed.
 func (p *OktaProvider) ValidateSessionState(s *SessionState) bool {
-	return validateToken(p, s.AccessToken, getOktaHeader(s.AccessToken))
+	if len(p.Groups) == 0 {
+		return validateToken(p, s.AccessToken, getOktaHeader(s.AccessToken))
+	}
+	json, err := p.getUserInfo(s.AccessToken)
+	if err != nil {
+		return false
+	}
+	groups := getGroups(json)
+	if !p.ValidateSessionGroups(&SessionState{Groups: groups}) {
+		log.Printf("%s is no longer in the okta group(s)", s.Email)
+		return false
+	}
+	s.Groups = groups
+	return true
 }
 
 func (p *OktaProvider) RefreshSessionIfNeeded(s *SessionState) (bool, error) {
@@ -101,9 +173,20 @@ func (p *OktaProvider) RefreshSessionIfNeeded(s *SessionState) (bool, error) {
 		return false, err
 	}
 
+	// re-check that the user is in the proper okta group(s)
+	json, err := p.getUserInfo(newToken)
+	if err != nil {
+		return false, err
+	}
+	groups := getGroups(json)
+	if !p.ValidateSessionGroups(&SessionState{Groups: groups}) {
+		return false, fmt.Errorf("%s is no longer in the okta group(s)", s.Email)
+	}
+
 	origExpiration := s.ExpiresOn
 	s.AccessToken = newToken
 	s.ExpiresOn = time.Now().Add(duration).Truncate(time.Second)
+	s.Groups = groups
 	log.Printf("refreshed access token %s (expired on %s)", s, origExpiration)
 	return true, nil
 }
@@ -111,7 +194,7 @@ func (p *OktaProvider) RefreshSessionIfNeeded(s *SessionState) (bool, error) {
 func (p *OktaProvider) redeemRefreshToken(refreshToken string) (token string, expires time.Duration, err error) {
 	params := url.Values{}
 	params.Add("client_id", p.ClientID)
-	params.Add("client_secret", p.ClientSecret)
+	params.Add("client_secret", p.clientSecret())
 	params.Add("refresh_token", refreshToken)
 	params.Add("grant_type", "refresh_token")
 	var req *http.Request
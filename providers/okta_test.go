@@ -0,0 +1,143 @@
+package providers
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func testOktaProvider(hostname string) *OktaProvider {
+	p := NewOktaProvider(
+		&ProviderData{
+			ProviderName: "",
+			LoginURL:     &url.URL{},
+			RedeemURL:    &url.URL{},
+			ProfileURL:   &url.URL{},
+			ValidateURL:  &url.URL{},
+			Scope:        ""})
+	p.SetOktaDomain("example.okta.com")
+	if hostname != "" {
+		updateURL(p.Data().RedeemURL, hostname)
+		updateURL(p.Data().ValidateURL, hostname)
+	}
+	return p
+}
+
+// testOktaBackend serves the token endpoint and a userinfo endpoint whose
+// groups claim is *groups.
+func testOktaBackend(groups *string) *httptest.Server {
+	return httptest.NewServer(http.HandlerFunc(
+		func(w http.ResponseWriter, r *http.Request) {
+			switch r.URL.Path {
+			case "/oauth2/v1/token":
+				w.Write([]byte(`{"access_token": "imaginary_access_token", "refresh_token": "refresh", "expires_in": 3600}`))
+			case "/oauth2/v1/userinfo":
+				if r.Header.Get("Authorization") != "Bearer imaginary_access_token" {
+					w.WriteHeader(403)
+					return
+				}
+				w.Write([]byte(`{"email": "michael.bland@gsa.gov", "preferred_username": "mbland", "groups": ` + *groups + `}`))
+			default:
+				w.WriteHeader(404)
+			}
+		}))
+}
+
+func TestOktaProviderDefaults(t *testing.T) {
+	p := testOktaProvider("")
+	assert.Equal(t, "Okta", p.Data().ProviderName)
+	assert.Equal(t, "https://example.okta.com/oauth2/v1/authorize", p.Data().LoginURL.String())
+	assert.Equal(t, "https://example.okta.com/oauth2/v1/token", p.Data().RedeemURL.String())
+	assert.Equal(t, "https://example.okta.com/oauth2/v1/userinfo", p.Data().ValidateURL.String())
+	assert.Equal(t, "openid profile email offline_access", p.Data().Scope)
+}
+
+func TestOktaProviderGroupsScope(t *testing.T) {
+	p := testOktaProvider("")
+	p.SetOktaGroups([]string{"engineering"})
+	assert.Equal(t, "openid profile email offline_access groups", p.Data().Scope)
+	p.SetOktaGroups([]string{"engineering", "ops"})
+	assert.Equal(t, "openid profile email offline_access groups", p.Data().Scope)
+}
+
+func TestOktaProviderRedeemGroups(t *testing.T) {
+	groups := `["Everyone", "Engineering"]`
+	b := testOktaBackend(&groups)
+	defer b.Close()
+	bURL, _ := url.Parse(b.URL)
+	p := testOktaProvider(bURL.Host)
+	p.SetOktaGroups([]string{"engineering"})
+
+	s, err := p.Redeem("https://proxy.example.com/oauth2/callback", "code")
+	assert.Equal(t, nil, err)
+	assert.Equal(t, "michael.bland@gsa.gov", s.Email)
+	assert.Equal(t, "mbland", s.User)
+	assert.Equal(t, []string{"Everyone", "Engineering"}, s.Groups)
+	assert.True(t, p.ValidateSessionGroups(s))
+
+	p.SetOktaGroups([]string{"ops"})
+	assert.False(t, p.ValidateSessionGroups(s))
+}
+
+func TestOktaProviderValidateSessionGroupsWithoutGroups(t *testing.T) {
+	p := testOktaProvider("")
+	assert.True(t, p.ValidateSessionGroups(&SessionState{Email: "michael.bland@gsa.gov"}))
+}
+
+func TestOktaProviderRefreshRechecksGroups(t *testing.T) {
+	groups := `["Engineering"]`
+	b := testOktaBackend(&groups)
+	defer b.Close()
+	bURL, _ := url.Parse(b.URL)
+	p := testOktaProvider(bURL.Host)
+	p.SetOktaGroups([]string{"Engineering"})
+
+	s := &SessionState{
+		Email:        "michael.bland@gsa.gov",
+		AccessToken:  "expired",
+		RefreshToken: "refresh",
+		ExpiresOn:    time.Now().Add(-time.Minute),
+		Groups:       []string{"Engineering"},
+	}
+	refreshed, err := p.RefreshSessionIfNeeded(s)
+	assert.Equal(t, nil, err)
+	assert.True(t, refreshed)
+	assert.Equal(t, "imaginary_access_token", s.AccessToken)
+
+	groups = `["Everyone"]`
+	s.ExpiresOn = time.Now().Add(-time.Minute)
+	refreshed, err = p.RefreshSessionIfNeeded(s)
+	assert.False(t, refreshed)
+	assert.Equal(t, "michael.bland@gsa.gov is no longer in the okta group(s)", err.Error())
+}
+
+func TestOktaProviderValidateSessionStateRechecksGroups(t *testing.T) {
+	groups := `["Engineering"]`
+	b := testOktaBackend(&groups)
+	defer b.Close()
+	bURL, _ := url.Parse(b.URL)
+	p := testOktaProvider(bURL.Host)
+	p.SetOktaGroups([]string{"Engineering"})
+
+	// no refresh token, so groups are only checked again on validation
+	s := &SessionState{
+		Email:       "michael.bland@gsa.gov",
+		AccessToken: "imaginary_access_token",
+		Groups:      []string{"Engineering"},
+	}
+	assert.True(t, p.ValidateSessionState(s))
+
+	groups = `["Everyone", "Engineering"]`
+	assert.True(t, p.ValidateSessionState(s))
+	assert.Equal(t, []string{"Everyone", "Engineering"}, s.Groups)
+
+	groups = `["Everyone"]`
+	assert.False(t, p.ValidateSessionState(s))
+
+	s.AccessToken = "revoked"
+	assert.False(t, p.ValidateSessionState(s))
+}
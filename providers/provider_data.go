@@ -2,6 +2,7 @@ package providers
 
 import (
 	"net/url"
+	"sync"
 	"time"
 )
 
@@ -17,6 +18,22 @@ type ProviderData struct {
 	Scope             string
 	Prompt            string
 	MaxAge            time.Duration
+
+	secretMu sync.RWMutex
 }
 
 func (p *ProviderData) Data() *ProviderData { return p }
+
+// SetClientSecret replaces the client secret of a running provider, e.g.
+// after it has been rotated in an external secret store.
+func (p *ProviderData) SetClientSecret(secret string) {
+	p.secretMu.Lock()
+	p.ClientSecret = secret
+	p.secretMu.Unlock()
+}
+
+func (p *ProviderData) clientSecret() string {
+	p.secretMu.RLock()
+	defer p.secretMu.RUnlock()
+	return p.ClientSecret
+}
@@ -17,6 +17,12 @@ type Provider interface {
 	CookieForSession(*SessionState, *cookie.Cipher) (string, error)
 }
 
+// A SessionGroupValidator checks group membership with the groups of the
+// user in the session, rather than by email address as ValidateGroup.
+type SessionGroupValidator interface {
+	ValidateSessionGroups(*SessionState) bool
+}
+
 func New(provider string, p *ProviderData) Provider {
 	switch provider {
 	case "linkedin":
@@ -1,20 +1,42 @@
 package providers
 
 import (
+	"bytes"
+	"compress/flate"
+	"encoding/json"
 	"fmt"
+	"io"
+	"net/url"
 	"strconv"
 	"strings"
+	"sync"
 	"time"
 
 	"github.com/bitly/oauth2_proxy/cookie"
 )
 
+// compressedPrefix marks a session state that was compressed and encrypted
+// as a whole by EncodeCompressedSessionState.
+const compressedPrefix = "z1:"
+
+// Compressors, decompressors and their buffers are reused across sessions,
+// as a flate.Writer at BestCompression alone allocates about a megabyte.
+var (
+	bufferPool = sync.Pool{New: func() interface{} { return new(bytes.Buffer) }}
+	writerPool = sync.Pool{New: func() interface{} {
+		w, _ := flate.NewWriter(nil, flate.BestCompression)
+		return w
+	}}
+	readerPool sync.Pool
+)
+
 type SessionState struct {
 	AccessToken  string
 	ExpiresOn    time.Time
 	RefreshToken string
 	Email        string
 	User         string
+	Groups       []string
 }
 
 func (s *SessionState) IsExpired() bool {
@@ -46,7 +68,16 @@ func (s *SessionState) EncodeSessionState(c *cookie.Cipher) (string, error) {
 }
 
 func (s *SessionState) accountInfo() string {
-	return fmt.Sprintf("email:%s user:%s", s.Email, s.User)
+	info := fmt.Sprintf("email:%s user:%s", s.Email, s.User)
+	if len(s.Groups) != 0 {
+		// escaped, as group names may contain spaces, commas and pipes
+		groups := make([]string, len(s.Groups))
+		for i, g := range s.Groups {
+			groups[i] = url.QueryEscape(g)
+		}
+		info += " groups:" + strings.Join(groups, ",")
+	}
+	return info
 }
 
 func (s *SessionState) EncryptedString(c *cookie.Cipher) (string, error) {
@@ -69,10 +100,65 @@ func (s *SessionState) EncryptedString(c *cookie.Cipher) (string, error) {
 	return fmt.Sprintf("%s|%s|%d|%s", s.accountInfo(), a, s.ExpiresOn.Unix(), r), nil
 }
 
+// EncodeCompressedSessionState compresses the session state before encrypting
+// it, which considerably shortens cookies holding JWT access tokens.
+func (s *SessionState) EncodeCompressedSessionState(c *cookie.Cipher) (string, error) {
+	if c == nil {
+		panic("error. missing cipher")
+	}
+	buf := bufferPool.Get().(*bytes.Buffer)
+	buf.Reset()
+	defer bufferPool.Put(buf)
+	w := writerPool.Get().(*flate.Writer)
+	defer writerPool.Put(w)
+	w.Reset(buf)
+	// the encoder returns the errors of writing to the compressor
+	if err := json.NewEncoder(w).Encode(s); err != nil {
+		return "", fmt.Errorf("could not compress session state: %s", err)
+	}
+	if err := w.Close(); err != nil {
+		return "", fmt.Errorf("could not compress session state: %s", err)
+	}
+	e, err := c.Encrypt(buf.String())
+	if err != nil {
+		return "", err
+	}
+	return compressedPrefix + e, nil
+}
+
+func decodeSessionStateCompressed(v string, c *cookie.Cipher) (*SessionState, error) {
+	d, err := c.Decrypt(strings.TrimPrefix(v, compressedPrefix))
+	if err != nil {
+		return nil, err
+	}
+	buf := bufferPool.Get().(*bytes.Buffer)
+	buf.Reset()
+	defer bufferPool.Put(buf)
+	var r io.ReadCloser
+	if v := readerPool.Get(); v != nil {
+		r = v.(io.ReadCloser)
+		r.(flate.Resetter).Reset(strings.NewReader(d), nil)
+	} else {
+		r = flate.NewReader(strings.NewReader(d))
+	}
+	defer readerPool.Put(r)
+	if _, err = buf.ReadFrom(r); err != nil {
+		return nil, fmt.Errorf("could not decompress session state: %s", err)
+	}
+	s := &SessionState{}
+	if err = json.Unmarshal(buf.Bytes(), s); err != nil {
+		return nil, fmt.Errorf("could not decode session state: %s", err)
+	}
+	if s.User == "" {
+		s.User = strings.Split(s.Email, "@")[0]
+	}
+	return s, nil
+}
+
 func decodeSessionStatePlain(v string) (s *SessionState, err error) {
 	chunks := strings.Split(v, " ")
-	if len(chunks) != 2 {
-		return nil, fmt.Errorf("could not decode session state: expected 2 chunks got %d", len(chunks))
+	if len(chunks) != 2 && len(chunks) != 3 {
+		return nil, fmt.Errorf("could not decode session state: expected 2 or 3 chunks got %d", len(chunks))
 	}
 
 	email := strings.TrimPrefix(chunks[0], "email:")
@@ -81,13 +167,27 @@ func decodeSessionStatePlain(v string) (s *SessionState, err error) {
 		user = strings.Split(email, "@")[0]
 	}
 
-	return &SessionState{User: user, Email: email}, nil
+	var groups []string
+	if len(chunks) == 3 {
+		for _, g := range strings.Split(strings.TrimPrefix(chunks[2], "groups:"), ",") {
+			group, err := url.QueryUnescape(g)
+			if err != nil {
+				return nil, fmt.Errorf("could not decode session state: %s", err)
+			}
+			groups = append(groups, group)
+		}
+	}
+
+	return &SessionState{User: user, Email: email, Groups: groups}, nil
 }
 
 func DecodeSessionState(v string, c *cookie.Cipher) (s *SessionState, err error) {
 	if c == nil {
 		return decodeSessionStatePlain(v)
 	}
+	if strings.HasPrefix(v, compressedPrefix) {
+		return decodeSessionStateCompressed(v, c)
+	}
 
 	chunks := strings.Split(v, "|")
 	if len(chunks) != 4 {
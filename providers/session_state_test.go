@@ -84,6 +84,68 @@ func TestSessionStateSerializationWithUser(t *testing.T) {
 	assert.NotEqual(t, s.RefreshToken, ss.RefreshToken)
 }
 
+func TestSessionStateSerializationCompressed(t *testing.T) {
+	c, err := cookie.NewCipher([]byte(secret))
+	assert.Equal(t, nil, err)
+	jwt := "eyJhbGciOiJSUzI1NiJ9." + strings.Repeat("eyJzdWIiOiJ1c2VyQGRvbWFpbi5jb20ifQ", 20) + ".sig"
+	s := &SessionState{
+		Email:        "user@domain.com",
+		AccessToken:  jwt,
+		ExpiresOn:    time.Now().Add(time.Duration(1) * time.Hour),
+		RefreshToken: "refresh4321",
+	}
+	plain, err := s.EncodeSessionState(c)
+	assert.Equal(t, nil, err)
+	encoded, err := s.EncodeCompressedSessionState(c)
+	assert.Equal(t, nil, err)
+	assert.True(t, strings.HasPrefix(encoded, "z1:"))
+	assert.True(t, len(encoded) < len(plain))
+
+	ss, err := DecodeSessionState(encoded, c)
+	assert.Equal(t, nil, err)
+	assert.Equal(t, "user", ss.User)
+	assert.Equal(t, s.Email, ss.Email)
+	assert.Equal(t, s.AccessToken, ss.AccessToken)
+	assert.Equal(t, s.ExpiresOn.Unix(), ss.ExpiresOn.Unix())
+	assert.Equal(t, s.RefreshToken, ss.RefreshToken)
+
+	// uncompressed sessions still decode
+	ss, err = DecodeSessionState(plain, c)
+	assert.Equal(t, nil, err)
+	assert.Equal(t, s.AccessToken, ss.AccessToken)
+}
+
+func benchmarkSession() *SessionState {
+	return &SessionState{
+		Email:        "user@domain.com",
+		AccessToken:  "eyJhbGciOiJSUzI1NiJ9." + strings.Repeat("eyJzdWIiOiJ1c2VyQGRvbWFpbi5jb20ifQ", 20) + ".sig",
+		ExpiresOn:    time.Now().Add(time.Duration(1) * time.Hour),
+		RefreshToken: "refresh4321",
+	}
+}
+
+func BenchmarkEncodeCompressedSessionState(b *testing.B) {
+	c, _ := cookie.NewCipher([]byte(secret))
+	s := benchmarkSession()
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		if _, err := s.EncodeCompressedSessionState(c); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func BenchmarkDecodeCompressedSessionState(b *testing.B) {
+	c, _ := cookie.NewCipher([]byte(secret))
+	encoded, _ := benchmarkSession().EncodeCompressedSessionState(c)
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		if _, err := DecodeSessionState(encoded, c); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
 func TestSessionStateSerializationNoCipher(t *testing.T) {
 	s := &SessionState{
 		Email:        "user@domain.com",
@@ -140,6 +202,38 @@ func TestSessionStateAccountInfo(t *testing.T) {
 	assert.Equal(t, expected, s.accountInfo())
 }
 
+func TestSessionStateSerializationWithGroups(t *testing.T) {
+	c, err := cookie.NewCipher([]byte(secret))
+	assert.Equal(t, nil, err)
+	s := &SessionState{
+		Email:       "user@domain.com",
+		AccessToken: "token1234",
+		ExpiresOn:   time.Now().Add(time.Duration(1) * time.Hour),
+		Groups:      []string{"Engineering", "Site Reliability, Ops", "a|b"},
+	}
+	encoded, err := s.EncodeSessionState(c)
+	assert.Equal(t, nil, err)
+	assert.Equal(t, 3, strings.Count(encoded, "|"))
+
+	ss, err := DecodeSessionState(encoded, c)
+	assert.Equal(t, nil, err)
+	assert.Equal(t, s.Email, ss.Email)
+	assert.Equal(t, s.AccessToken, ss.AccessToken)
+	assert.Equal(t, s.Groups, ss.Groups)
+
+	encoded, err = s.EncodeSessionState(nil)
+	assert.Equal(t, nil, err)
+	ss, err = DecodeSessionState(encoded, nil)
+	assert.Equal(t, nil, err)
+	assert.Equal(t, s.Groups, ss.Groups)
+
+	encoded, err = s.EncodeCompressedSessionState(c)
+	assert.Equal(t, nil, err)
+	ss, err = DecodeSessionState(encoded, c)
+	assert.Equal(t, nil, err)
+	assert.Equal(t, s.Groups, ss.Groups)
+}
+
 func TestExpired(t *testing.T) {
 	s := &SessionState{ExpiresOn: time.Now().Add(time.Duration(-1) * time.Minute)}
 	assert.Equal(t, true, s.IsExpired())
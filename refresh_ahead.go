@@ -0,0 +1,171 @@
+package oauth2proxy
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"log"
+	"sync"
+	"time"
+
+	"github.com/bitly/oauth2_proxy/providers"
+)
+
+// refreshAheadWorkers is how many sessions are refreshed in the background at
+// once, and refreshAheadQueue how many may wait; beyond that, sessions are
+// refreshed when they expire as without refresh-ahead.
+const (
+	refreshAheadWorkers = 4
+	refreshAheadQueue   = 1024
+)
+
+// A refreshQueue holds the sessions to refresh in the background, each once.
+type refreshQueue struct {
+	jobs    chan refreshJob
+	mu      sync.Mutex
+	pending map[string]bool
+}
+
+type refreshJob struct {
+	key      string
+	provider providers.Provider
+	session  providers.SessionState
+}
+
+func newRefreshQueue() *refreshQueue {
+	return &refreshQueue{
+		jobs:    make(chan refreshJob, refreshAheadQueue),
+		pending: make(map[string]bool),
+	}
+}
+
+// add queues job, unless it is queued already or the queue is full.
+func (q *refreshQueue) add(job refreshJob) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	if q.pending[job.key] {
+		return
+	}
+	select {
+	case q.jobs <- job:
+		q.pending[job.key] = true
+	default:
+	}
+}
+
+func (q *refreshQueue) done(key string) {
+	q.mu.Lock()
+	delete(q.pending, key)
+	q.mu.Unlock()
+}
+
+func validateRefreshAhead(o *Options, msgs []string) []string {
+	if o.RefreshAhead < 0 {
+		return append(msgs, "refresh-ahead must not be negative")
+	}
+	if o.RefreshAhead > 0 && o.SessionStore == "" {
+		msgs = append(msgs, "refresh-ahead requires session-store")
+	}
+	return msgs
+}
+
+func refreshKey(refreshToken string) string {
+	sum := sha256.Sum256([]byte(refreshToken))
+	return "refresh:" + hex.EncodeToString(sum[:])
+}
+
+// refreshedAhead replaces s with the session refreshed in the background, if
+// there is one, and reports whether it did. The refreshed session is taken
+// out of the store, so that only one request before expiry gets the rotated
+// tokens. Otherwise a session that expires within refresh-ahead is queued to
+// be refreshed, while its request goes on with the current access token.
+func (p *OAuthProxy) refreshedAhead(provider providers.Provider, s *providers.SessionState) bool {
+	if p.refreshQueue == nil || s == nil || s.RefreshToken == "" || s.ExpiresOn.IsZero() {
+		return false
+	}
+	if time.Now().Add(p.refreshAhead).Before(s.ExpiresOn) {
+		return false
+	}
+	key := refreshKey(s.RefreshToken)
+	if value, err := p.store.Take(key + ":ahead"); err == nil {
+		refreshed, err := provider.SessionFromCookie(string(value), p.CookieCipher)
+		if err != nil {
+			log.Printf("error loading session refreshed ahead %s", err)
+			return false
+		}
+		*s = *refreshed
+		return true
+	}
+	if s.ExpiresOn.After(time.Now()) {
+		p.refreshQueue.add(refreshJob{key: key, provider: provider, session: *s})
+	}
+	return false
+}
+
+// StartRefreshAhead starts refreshing the queued sessions in the background,
+// until the proxy is closed.
+func (p *OAuthProxy) StartRefreshAhead() {
+	if p.refreshQueue == nil {
+		return
+	}
+	for i := 0; i < refreshAheadWorkers; i++ {
+		go func() {
+			for {
+				// a closed proxy leaves the queued jobs
+				select {
+				case <-p.done:
+					return
+				default:
+				}
+				select {
+				case job := <-p.refreshQueue.jobs:
+					p.refreshAheadOf(job)
+					p.refreshQueue.done(job.key)
+				case <-p.done:
+					return
+				}
+			}
+		}()
+	}
+}
+
+// refreshAheadOf redeems the refresh token of a queued session and keeps the
+// result in the session store, so that the next request of the session, on
+// any replica, picks it up. It is taken under the lock of refreshSession, and
+// also kept under its key, so that requests already refreshing the session
+// at expiry get the result instead of waiting for the lock. It is only kept
+// for refreshLockExpiration, like the result of refreshSession, so that old
+// or stolen cookies can't pick up the rotated tokens later; if no request
+// comes in time, the session is refreshed again when it expires.
+func (p *OAuthProxy) refreshAheadOf(job refreshJob) {
+	locked, err := p.store.SetNX(job.key+":lock", []byte("1"), refreshLockExpiration)
+	if err != nil {
+		log.Printf("error locking session refresh %s", err)
+		return
+	}
+	if !locked {
+		return
+	}
+
+	// providers only refresh sessions that expired
+	s := job.session
+	s.ExpiresOn = time.Now().Add(-time.Second)
+	ok, err := p.redeemRefreshToken(job.provider, &s)
+	if err != nil || !ok {
+		if err != nil {
+			log.Printf("error refreshing access token ahead of expiry %s %s", err, &job.session)
+		}
+		p.store.Del(job.key + ":lock")
+		return
+	}
+	value, err := p.cookieForSession(job.provider, &s)
+	if err == nil {
+		err = p.store.Set(job.key, []byte(value), refreshLockExpiration)
+	}
+	if err == nil {
+		err = p.store.Set(job.key+":ahead", []byte(value), refreshLockExpiration)
+	}
+	if err != nil {
+		log.Printf("error saving session refreshed ahead %s", err)
+		p.store.Del(job.key + ":lock")
+	}
+}
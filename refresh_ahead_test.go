@@ -0,0 +1,154 @@
+package oauth2proxy
+
+import (
+	"net/url"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/bitly/oauth2_proxy/providers"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRefreshAheadOptions(t *testing.T) {
+	o := testOptions()
+	o.RefreshAhead = time.Minute
+	assert.Equal(t, errorMsg([]string{"refresh-ahead requires session-store"}), o.Validate().Error())
+
+	o = testOptions()
+	o.RefreshAhead = -time.Minute
+	assert.Equal(t, errorMsg([]string{"refresh-ahead must not be negative"}), o.Validate().Error())
+}
+
+func TestRefreshAhead(t *testing.T) {
+	provider := &RefreshCountingProvider{
+		TestProvider: NewTestProvider(&url.URL{Host: "localhost"}, "michael.bland@gsa.gov"),
+	}
+	opts := testOptions()
+	opts.CookieSecret = "0123456789abcdefghijklmnopqrstuv"
+	opts.PassAccessToken = true
+	opts.SessionStore = "memory"
+	opts.RefreshAhead = 5 * time.Minute
+	assert.Equal(t, nil, opts.Validate())
+	proxy := newOAuthProxy(opts, func(string) bool { return true })
+
+	newSession := func(expiresIn time.Duration) *providers.SessionState {
+		return &providers.SessionState{
+			Email:        "michael.bland@gsa.gov",
+			AccessToken:  "access_token",
+			RefreshToken: "refresh_token",
+			ExpiresOn:    time.Now().Add(expiresIn),
+		}
+	}
+
+	// sessions that don't expire soon are left alone
+	assert.False(t, proxy.refreshedAhead(provider, newSession(time.Hour)))
+	assert.Equal(t, 0, len(proxy.refreshQueue.jobs))
+
+	// others are queued once, and go on with their current token
+	session := newSession(time.Minute)
+	assert.False(t, proxy.refreshedAhead(provider, session))
+	assert.False(t, proxy.refreshedAhead(provider, session))
+	assert.Equal(t, "access_token", session.AccessToken)
+	assert.Equal(t, 1, len(proxy.refreshQueue.jobs))
+
+	job := <-proxy.refreshQueue.jobs
+	proxy.refreshAheadOf(job)
+	proxy.refreshQueue.done(job.key)
+	assert.Equal(t, 1, provider.refreshes)
+
+	// the next request picks up the refreshed session
+	assert.True(t, proxy.refreshedAhead(provider, session))
+	assert.Equal(t, "refreshed_token", session.AccessToken)
+	assert.True(t, session.ExpiresOn.After(time.Now().Add(30*time.Minute)))
+
+	// only once, and the refresh token isn't redeemed again meanwhile
+	session = newSession(time.Minute)
+	assert.False(t, proxy.refreshedAhead(provider, session))
+	assert.Equal(t, "access_token", session.AccessToken)
+	job = <-proxy.refreshQueue.jobs
+	proxy.refreshAheadOf(job)
+	proxy.refreshQueue.done(job.key)
+	assert.Equal(t, 1, provider.refreshes)
+	assert.Equal(t, 0, len(proxy.refreshQueue.jobs))
+}
+
+func TestRefreshAheadConcurrentRequestsAtExpiry(t *testing.T) {
+	provider := &RefreshCountingProvider{
+		TestProvider: NewTestProvider(&url.URL{Host: "localhost"}, "michael.bland@gsa.gov"),
+	}
+	opts := testOptions()
+	opts.CookieSecret = "0123456789abcdefghijklmnopqrstuv"
+	opts.PassAccessToken = true
+	opts.SessionStore = "memory"
+	opts.RefreshAhead = 5 * time.Minute
+	assert.Equal(t, nil, opts.Validate())
+	proxy := newOAuthProxy(opts, func(string) bool { return true })
+
+	session := &providers.SessionState{
+		Email:        "michael.bland@gsa.gov",
+		AccessToken:  "access_token",
+		RefreshToken: "refresh_token",
+		ExpiresOn:    time.Now().Add(time.Minute),
+	}
+	assert.False(t, proxy.refreshedAhead(provider, session))
+	job := <-proxy.refreshQueue.jobs
+	proxy.refreshAheadOf(job)
+	proxy.refreshQueue.done(job.key)
+	assert.Equal(t, 1, provider.refreshes)
+
+	// a burst of requests with the old cookie once it expired, as in
+	// authenticate: one takes the session refreshed ahead, the others get it
+	// from refreshSession without waiting for its lock
+	start := time.Now()
+	var wg sync.WaitGroup
+	sessions := make([]*providers.SessionState, 5)
+	for i := range sessions {
+		s := *session
+		s.ExpiresOn = time.Now().Add(-time.Second)
+		sessions[i] = &s
+		wg.Add(1)
+		go func(s *providers.SessionState) {
+			defer wg.Done()
+			if proxy.refreshedAhead(provider, s) {
+				return
+			}
+			ok, err := proxy.refreshSession(provider, s)
+			assert.Equal(t, nil, err)
+			assert.True(t, ok)
+		}(sessions[i])
+	}
+	wg.Wait()
+
+	assert.True(t, time.Since(start) < time.Second)
+	assert.Equal(t, 1, provider.refreshes)
+	for _, s := range sessions {
+		assert.Equal(t, "refreshed_token", s.AccessToken)
+	}
+}
+
+func TestRefreshAheadStopsOnClose(t *testing.T) {
+	provider := &RefreshCountingProvider{
+		TestProvider: NewTestProvider(&url.URL{Host: "localhost"}, "michael.bland@gsa.gov"),
+	}
+	opts := testOptions()
+	opts.SessionStore = "memory"
+	opts.RefreshAhead = 5 * time.Minute
+	assert.Equal(t, nil, opts.Validate())
+	proxy := newOAuthProxy(opts, func(string) bool { return true })
+	proxy.StartRefreshAhead()
+	proxy.Close()
+	time.Sleep(10 * time.Millisecond)
+
+	// jobs queued after Close are left alone
+	session := &providers.SessionState{
+		Email:        "michael.bland@gsa.gov",
+		AccessToken:  "access_token",
+		RefreshToken: "refresh_token",
+		ExpiresOn:    time.Now().Add(time.Minute),
+	}
+	assert.False(t, proxy.refreshedAhead(provider, session))
+	time.Sleep(50 * time.Millisecond)
+	assert.Equal(t, 0, provider.refreshes)
+	assert.Equal(t, 1, len(proxy.refreshQueue.jobs))
+}
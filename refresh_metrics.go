@@ -0,0 +1,112 @@
+package oauth2proxy
+
+import (
+	"net"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/bitly/oauth2_proxy/providers"
+)
+
+// The outcomes refreshes are classified by: a spike of invalid_grant means
+// refresh tokens were revoked en masse, of network_error or server_error that
+// the identity provider is unreachable or failing.
+const (
+	refreshSuccess      = "success"
+	refreshInvalidGrant = "invalid_grant"
+	refreshNetworkError = "network_error"
+	refreshServerError  = "server_error"
+	refreshError        = "error"
+)
+
+// refreshDurationBuckets are the upper bounds, in seconds, of the buckets of
+// the refresh latency histogram.
+var refreshDurationBuckets = []float64{0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10}
+
+// providers report the responses of the token endpoint as "got <status> ..."
+var refreshStatusError = regexp.MustCompile(`^got (\d{3}) `)
+
+// refreshOutcome classifies the error of a refresh.
+func refreshOutcome(err error) string {
+	if err == nil {
+		return refreshSuccess
+	}
+	if _, ok := err.(net.Error); ok {
+		return refreshNetworkError
+	}
+	msg := err.Error()
+	if strings.Contains(msg, "invalid_grant") {
+		return refreshInvalidGrant
+	}
+	if m := refreshStatusError.FindStringSubmatch(msg); m != nil && m[1][0] == '5' {
+		return refreshServerError
+	}
+	return refreshError
+}
+
+type refreshLabels struct {
+	provider string
+	outcome  string
+}
+
+// refreshMetrics counts the refreshes of access tokens at the providers, and
+// their latency, by provider and outcome.
+type refreshMetrics struct {
+	mu         sync.Mutex
+	histograms map[refreshLabels]*histogram
+}
+
+func newRefreshMetrics() *refreshMetrics {
+	return &refreshMetrics{histograms: make(map[refreshLabels]*histogram)}
+}
+
+func (m *refreshMetrics) observe(provider string, err error, d time.Duration) {
+	labels := refreshLabels{provider, refreshOutcome(err)}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	h := m.histograms[labels]
+	if h == nil {
+		h = newHistogram(refreshDurationBuckets)
+		m.histograms[labels] = h
+	}
+	h.observe(d)
+}
+
+// collect writes the metrics.
+func (m *refreshMetrics) collect(w *promWriter, now time.Time) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	labels := make([]refreshLabels, 0, len(m.histograms))
+	for l := range m.histograms {
+		labels = append(labels, l)
+	}
+	sort.Slice(labels, func(i, j int) bool {
+		if labels[i].provider != labels[j].provider {
+			return labels[i].provider < labels[j].provider
+		}
+		return labels[i].outcome < labels[j].outcome
+	})
+
+	w.family("oauth2_proxy_token_refreshes_total", "counter", "Refreshes of access tokens at the provider, by outcome.")
+	for _, l := range labels {
+		w.sample("oauth2_proxy_token_refreshes_total", m.histograms[l].count, "provider", l.provider, "outcome", l.outcome)
+	}
+	w.family("oauth2_proxy_token_refresh_duration_seconds", "histogram", "Latency of refreshes of access tokens at the provider, by outcome.")
+	for _, l := range labels {
+		w.histogram("oauth2_proxy_token_refresh_duration_seconds", m.histograms[l], "provider", l.provider, "outcome", l.outcome)
+	}
+}
+
+// redeemRefreshToken refreshes s at the provider if it expired, recording
+// the outcome and latency of the refresh, if there was one.
+func (p *OAuthProxy) redeemRefreshToken(provider providers.Provider, s *providers.SessionState) (bool, error) {
+	start := time.Now()
+	ok, err := provider.RefreshSessionIfNeeded(s)
+	if ok || err != nil {
+		p.refreshMetrics.observe(provider.Data().ProviderName, err, time.Since(start))
+	}
+	return ok, err
+}
@@ -0,0 +1,89 @@
+package oauth2proxy
+
+import (
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+	"time"
+
+	"github.com/bitly/oauth2_proxy/providers"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRefreshOutcome(t *testing.T) {
+	assert.Equal(t, "success", refreshOutcome(nil))
+	assert.Equal(t, "network_error", refreshOutcome(&url.Error{Op: "Post", URL: "https://idp/token", Err: errors.New("connection refused")}))
+	assert.Equal(t, "invalid_grant", refreshOutcome(errors.New(`got 400 from "https://idp/token" {"error": "invalid_grant"}`)))
+	assert.Equal(t, "server_error", refreshOutcome(errors.New(`got 503 from "https://idp/token" unavailable`)))
+	assert.Equal(t, "error", refreshOutcome(errors.New(`got 401 from "https://idp/token" {"error": "invalid_client"}`)))
+	assert.Equal(t, "error", refreshOutcome(errors.New("unexpected end of JSON input")))
+}
+
+type FailingRefreshProvider struct {
+	*TestProvider
+	err error
+}
+
+func (p *FailingRefreshProvider) RefreshSessionIfNeeded(s *providers.SessionState) (bool, error) {
+	if s.ExpiresOn.After(time.Now()) {
+		return false, nil
+	}
+	return false, p.err
+}
+
+func TestRefreshMetrics(t *testing.T) {
+	opts := testOptions()
+	opts.AdminToken = "admin_token"
+	assert.Equal(t, nil, opts.Validate())
+	proxy := newOAuthProxy(opts, func(string) bool { return true })
+
+	expired := func() *providers.SessionState {
+		return &providers.SessionState{
+			Email:        "michael.bland@gsa.gov",
+			AccessToken:  "access_token",
+			RefreshToken: "refresh_token",
+			ExpiresOn:    time.Now().Add(-time.Minute),
+		}
+	}
+	provider := &RefreshCountingProvider{
+		TestProvider: NewTestProvider(&url.URL{Host: "localhost"}, "michael.bland@gsa.gov"),
+	}
+	ok, err := proxy.refreshSession(provider, expired())
+	assert.True(t, ok)
+	assert.Equal(t, nil, err)
+
+	failing := &FailingRefreshProvider{
+		TestProvider: NewTestProvider(&url.URL{Host: "localhost"}, "michael.bland@gsa.gov"),
+		err:          errors.New(`got 400 from "https://idp/token" {"error": "invalid_grant"}`),
+	}
+	for i := 0; i < 2; i++ {
+		_, err = proxy.refreshSession(failing, expired())
+		assert.NotEqual(t, nil, err)
+	}
+
+	// sessions that didn't need a refresh aren't counted
+	session := expired()
+	session.ExpiresOn = time.Now().Add(time.Hour)
+	proxy.refreshSession(failing, session)
+
+	metrics := func(token string) *httptest.ResponseRecorder {
+		rw := httptest.NewRecorder()
+		req, _ := http.NewRequest("GET", "/oauth2/admin/metrics", nil)
+		req.Header.Set("Authorization", "Bearer "+token)
+		proxy.ServeHTTP(rw, req)
+		return rw
+	}
+	rw := metrics("admin_token")
+	assert.Equal(t, 200, rw.Code)
+	body := rw.Body.String()
+	assert.Contains(t, body, "# TYPE oauth2_proxy_token_refreshes_total counter\n")
+	assert.Contains(t, body, `oauth2_proxy_token_refreshes_total{provider="Test Provider",outcome="success"} 1`+"\n")
+	assert.Contains(t, body, `oauth2_proxy_token_refreshes_total{provider="Test Provider",outcome="invalid_grant"} 2`+"\n")
+	assert.Contains(t, body, `oauth2_proxy_token_refresh_duration_seconds_bucket{provider="Test Provider",outcome="invalid_grant",le="10"} 2`+"\n")
+	assert.Contains(t, body, `oauth2_proxy_token_refresh_duration_seconds_bucket{provider="Test Provider",outcome="invalid_grant",le="+Inf"} 2`+"\n")
+	assert.Contains(t, body, `oauth2_proxy_token_refresh_duration_seconds_count{provider="Test Provider",outcome="success"} 1`+"\n")
+
+	assert.Equal(t, 401, metrics("wrong").Code)
+}
@@ -0,0 +1,179 @@
+package oauth2proxy
+
+import (
+	"net/http"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// requestDurationBuckets are the upper bounds, in seconds, of the buckets of
+// the upstream latency histogram.
+var requestDurationBuckets = []float64{0.005, 0.01, 0.025, 0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10}
+
+// The reasons requests are rejected for by the proxy, besides the denial
+// reasons of signed in users such as email_not_allowed.
+const (
+	rejectUnauthenticated  = "unauthenticated"
+	rejectClientNotAllowed = "client_not_allowed"
+	rejectRequestTooLarge  = "request_too_large"
+	rejectRateLimited      = "rate_limited"
+)
+
+type requestLabels struct {
+	upstream string
+	code     int
+}
+
+type signInFailureLabels struct {
+	provider string
+	reason   string
+}
+
+// requestMetrics counts the requests passed to upstreams, by upstream and
+// status code, and their latency by upstream, along with the requests the
+// proxy rejected and the sign ins that failed, by reason.
+type requestMetrics struct {
+	mu             sync.Mutex
+	requests       map[requestLabels]uint64
+	durations      map[string]*histogram
+	rejected       map[string]uint64
+	signInFailures map[signInFailureLabels]uint64
+}
+
+func newRequestMetrics() *requestMetrics {
+	return &requestMetrics{
+		requests:       make(map[requestLabels]uint64),
+		durations:      make(map[string]*histogram),
+		rejected:       make(map[string]uint64),
+		signInFailures: make(map[signInFailureLabels]uint64),
+	}
+}
+
+// observe records a request passed to upstream that was answered with code
+// after d.
+func (m *requestMetrics) observe(upstream string, code int, d time.Duration) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.requests[requestLabels{upstream, code}]++
+	h := m.durations[upstream]
+	if h == nil {
+		h = newHistogram(requestDurationBuckets)
+		m.durations[upstream] = h
+	}
+	h.observe(d)
+}
+
+// reject counts a request rejected for reason.
+func (m *requestMetrics) reject(reason string) {
+	m.mu.Lock()
+	m.rejected[reason]++
+	m.mu.Unlock()
+}
+
+// signInFailed counts a sign in with provider that failed for reason, one of
+// the reasons shown on the sign in page.
+func (m *requestMetrics) signInFailed(provider, reason string) {
+	m.mu.Lock()
+	m.signInFailures[signInFailureLabels{provider, reason}]++
+	m.mu.Unlock()
+}
+
+// rejection returns a reason a request was rejected for, if one was.
+func (m *requestMetrics) rejection() string {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	for reason := range m.rejected {
+		return reason
+	}
+	return ""
+}
+
+// collect writes the metrics.
+func (m *requestMetrics) collect(w *promWriter, now time.Time) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	requests := make([]requestLabels, 0, len(m.requests))
+	for l := range m.requests {
+		requests = append(requests, l)
+	}
+	sort.Slice(requests, func(i, j int) bool {
+		if requests[i].upstream != requests[j].upstream {
+			return requests[i].upstream < requests[j].upstream
+		}
+		return requests[i].code < requests[j].code
+	})
+	w.family("oauth2_proxy_requests_total", "counter", "Requests passed to upstreams, by upstream and status code.")
+	for _, l := range requests {
+		w.sample("oauth2_proxy_requests_total", m.requests[l], "upstream", l.upstream, "code", strconv.Itoa(l.code))
+	}
+
+	upstreams := make([]string, 0, len(m.durations))
+	for upstream := range m.durations {
+		upstreams = append(upstreams, upstream)
+	}
+	sort.Strings(upstreams)
+	w.family("oauth2_proxy_request_duration_seconds", "histogram", "Latency of requests passed to upstreams, by upstream.")
+	for _, upstream := range upstreams {
+		w.histogram("oauth2_proxy_request_duration_seconds", m.durations[upstream], "upstream", upstream)
+	}
+
+	reasons := make([]string, 0, len(m.rejected))
+	for reason := range m.rejected {
+		reasons = append(reasons, reason)
+	}
+	sort.Strings(reasons)
+	w.family("oauth2_proxy_rejected_requests_total", "counter", "Requests rejected by the proxy, by reason.")
+	for _, reason := range reasons {
+		w.sample("oauth2_proxy_rejected_requests_total", m.rejected[reason], "reason", reason)
+	}
+
+	failures := make([]signInFailureLabels, 0, len(m.signInFailures))
+	for l := range m.signInFailures {
+		failures = append(failures, l)
+	}
+	sort.Slice(failures, func(i, j int) bool {
+		if failures[i].provider != failures[j].provider {
+			return failures[i].provider < failures[j].provider
+		}
+		return failures[i].reason < failures[j].reason
+	})
+	w.family("oauth2_proxy_sign_in_failures_total", "counter", "Failed sign ins, by provider and reason.")
+	for _, l := range failures {
+		w.sample("oauth2_proxy_sign_in_failures_total", m.signInFailures[l], "provider", l.provider, "reason", l.reason)
+	}
+}
+
+// metricsWriter passes a response on while keeping its status code and the
+// upstream that answered it, which the upstream's proxy names in the
+// GAP-Upstream-Address header until the request logger removes it.
+type metricsWriter struct {
+	http.ResponseWriter
+	status   int
+	upstream string
+}
+
+func (w *metricsWriter) record(status int) {
+	if w.status == 0 {
+		w.status = status
+		w.upstream = w.Header().Get("GAP-Upstream-Address")
+	}
+}
+
+func (w *metricsWriter) WriteHeader(status int) {
+	w.record(status)
+	w.ResponseWriter.WriteHeader(status)
+}
+
+func (w *metricsWriter) Write(b []byte) (int, error) {
+	w.record(http.StatusOK)
+	return w.ResponseWriter.Write(b)
+}
+
+func (w *metricsWriter) Flush() {
+	if f, ok := w.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
@@ -0,0 +1,132 @@
+package oauth2proxy
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+	"time"
+
+	"github.com/bitly/oauth2_proxy/providers"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRequestMetrics(t *testing.T) {
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/missing" {
+			http.NotFound(w, r)
+			return
+		}
+		w.Write([]byte("upstream"))
+	}))
+	defer upstream.Close()
+	upstreamURL, _ := url.Parse(upstream.URL)
+	opts := testOptions()
+	opts.Upstreams = []string{upstream.URL}
+	opts.AdminToken = "admin_token"
+	assert.Equal(t, nil, opts.Validate())
+	proxy := newOAuthProxy(opts, func(email string) bool { return email == "jane@example.com" })
+
+	get := func(path, email string) int {
+		rw := httptest.NewRecorder()
+		req, _ := http.NewRequest("GET", path, nil)
+		if email != "" {
+			value, _ := (&providers.SessionState{Email: email}).EncodeSessionState(nil)
+			req.AddCookie(proxy.MakeSessionCookie(req, value, opts.CookieExpire, time.Now()))
+		}
+		proxy.ServeHTTP(rw, req)
+		return rw.Code
+	}
+	assert.Equal(t, 200, get("/app", "jane@example.com"))
+	assert.Equal(t, 200, get("/app", "jane@example.com"))
+	assert.Equal(t, 404, get("/missing", "jane@example.com"))
+	assert.Equal(t, 403, get("/app", ""))
+	assert.Equal(t, 403, get("/app", "john@example.com"))
+
+	rw := httptest.NewRecorder()
+	req, _ := http.NewRequest("GET", "/oauth2/callback?error=server_error", nil)
+	proxy.ServeHTTP(rw, req)
+	assert.Equal(t, 302, rw.Code)
+
+	rw = httptest.NewRecorder()
+	req, _ = http.NewRequest("GET", "/oauth2/admin/metrics", nil)
+	req.Header.Set("Authorization", "Bearer admin_token")
+	proxy.ServeHTTP(rw, req)
+	assert.Equal(t, 200, rw.Code)
+	body := rw.Body.String()
+	for _, line := range []string{
+		`oauth2_proxy_requests_total{upstream="` + upstreamURL.Host + `",code="200"} 2`,
+		`oauth2_proxy_requests_total{upstream="` + upstreamURL.Host + `",code="404"} 1`,
+		`oauth2_proxy_request_duration_seconds_count{upstream="` + upstreamURL.Host + `"} 3`,
+		`oauth2_proxy_rejected_requests_total{reason="email_not_allowed"} 1`,
+		`oauth2_proxy_rejected_requests_total{reason="unauthenticated"} 1`,
+		`oauth2_proxy_sign_in_failures_total{provider="Google",reason="provider_error"} 1`,
+		"# TYPE oauth2_proxy_token_refreshes_total counter",
+		"# TYPE oauth2_proxy_logins_total counter",
+	} {
+		assert.Contains(t, body, line+"\n")
+	}
+}
+
+func TestMetricsHandler(t *testing.T) {
+	opts := testOptions()
+	assert.Equal(t, nil, opts.Validate())
+	proxy := newOAuthProxy(opts, func(string) bool { return true })
+	proxy.requestMetrics.reject(rejectRateLimited)
+
+	rw := httptest.NewRecorder()
+	req, _ := http.NewRequest("GET", "/metrics", nil)
+	proxy.metricsHandler("/metrics").ServeHTTP(rw, req)
+	assert.Equal(t, 200, rw.Code)
+	assert.Equal(t, "text/plain; version=0.0.4", rw.Header().Get("Content-Type"))
+	assert.Contains(t, rw.Body.String(), `oauth2_proxy_rejected_requests_total{reason="rate_limited"} 1`+"\n")
+
+	rw = httptest.NewRecorder()
+	proxy.metricsHandler("/prometheus").ServeHTTP(rw, req)
+	assert.Equal(t, 404, rw.Code)
+	rw = httptest.NewRecorder()
+	req, _ = http.NewRequest("GET", "/prometheus", nil)
+	proxy.metricsHandler("/prometheus").ServeHTTP(rw, req)
+	assert.Equal(t, 200, rw.Code)
+
+	rw = httptest.NewRecorder()
+	req, _ = http.NewRequest("GET", "/oauth2/admin/metrics", nil)
+	proxy.metricsHandler("/metrics").ServeHTTP(rw, req)
+	assert.Equal(t, 404, rw.Code)
+
+	// without an admin token, the metrics are only on the metrics-address
+	rw = httptest.NewRecorder()
+	proxy.ServeHTTP(rw, req)
+	assert.Equal(t, 404, rw.Code)
+}
+
+func TestMetricsAddressOptions(t *testing.T) {
+	o := testOptions()
+	o.MetricsAddress = "127.0.0.1:9100"
+	assert.Equal(t, nil, o.Validate())
+
+	o.MetricsAddress = "9100"
+	err := o.Validate()
+	assert.NotEqual(t, nil, err)
+	assert.Equal(t, errorMsg([]string{`invalid metrics-address "9100"; must be <addr>:<port>`}), err.Error())
+
+	o.MetricsAddress = "127.0.0.1:9100"
+	o.MetricsPath = "metrics"
+	err = o.Validate()
+	assert.NotEqual(t, nil, err)
+	assert.Equal(t, errorMsg([]string{`invalid metrics-path "metrics"; must start with /`}), err.Error())
+
+	o.MetricsPath = "/metrics"
+	o.MetricsAddress = o.HttpAddress
+	err = o.Validate()
+	assert.NotEqual(t, nil, err)
+	assert.Equal(t, errorMsg([]string{"metrics-address must differ from http-address and https-address"}), err.Error())
+
+	o.MetricsAddress = "127.0.0.1:9100"
+	a := &Tenant{Name: "a", Hosts: []string{"a.example.com"}, Opts: o}
+	err = ValidateTenants([]*Tenant{a})
+	assert.NotEqual(t, nil, err)
+	assert.Equal(t, "Invalid tenant configuration:\n"+
+		"  metrics-address cannot be used with tenants; scrape the /oauth2/admin/metrics of each tenant",
+		err.Error())
+}
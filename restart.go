@@ -0,0 +1,142 @@
+// +build !windows,!plan9
+
+package oauth2proxy
+
+import (
+	"fmt"
+	"log"
+	"net"
+	"os"
+	"os/exec"
+	"os/signal"
+	"strconv"
+	"strings"
+	"syscall"
+)
+
+// restartPIDEnv holds the pid of the process that handed its listening
+// sockets to a new process; the new process tells it to shut down once it
+// is serving.
+const restartPIDEnv = "OAUTH2_PROXY_RESTART_PID"
+
+// handleSignals restarts the binary on SIGUSR2 and shuts down gracefully on
+// SIGTERM.
+func (s *Server) handleSignals() {
+	c := make(chan os.Signal, 1)
+	signal.Notify(c, syscall.SIGUSR2, syscall.SIGTERM)
+	go func() {
+		for sig := range c {
+			switch sig {
+			case syscall.SIGUSR2:
+				if err := s.restart(); err != nil {
+					log.Printf("ERROR: restart failed - %s", err)
+				}
+			case syscall.SIGTERM:
+				log.Printf("shutting down")
+				s.Shutdown()
+				return
+			}
+		}
+	}()
+}
+
+// restart starts a new process from the (possibly replaced) binary with the
+// same arguments and hands it the listening sockets, including the UDP
+// sockets of HTTP/3. Connections keep being accepted by this process until
+// the new one takes over.
+func (s *Server) restart() error {
+	s.mu.Lock()
+	sockets := s.sockets
+	s.mu.Unlock()
+
+	var files []*os.File
+	for _, sock := range sockets {
+		if ul, ok := sock.(*net.UnixListener); ok {
+			// the socket file is used by the new process
+			ul.SetUnlinkOnClose(false)
+		}
+		fs, ok := sock.(interface {
+			File() (*os.File, error)
+		})
+		if !ok {
+			return fmt.Errorf("unable to pass on socket %T", sock)
+		}
+		f, err := fs.File()
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		files = append(files, f)
+	}
+
+	exe, err := os.Executable()
+	if err != nil {
+		return err
+	}
+	cmd := exec.Command(exe, os.Args[1:]...)
+	cmd.Stdout = os.Stdout
+	cmd.Stderr = os.Stderr
+	cmd.ExtraFiles = files
+	s.mu.Lock()
+	cmd.Env = restartEnv(len(files), s.watchdogPID)
+	s.mu.Unlock()
+	if err := cmd.Start(); err != nil {
+		return err
+	}
+	log.Printf("restarting: started process %d", cmd.Process.Pid)
+	go func() {
+		// this process normally shuts down first, when the new one takes
+		// over; the new one exiting before means the restart failed
+		if err := cmd.Wait(); err != nil {
+			log.Printf("ERROR: restarted process %d exited - %s", cmd.Process.Pid, err)
+		} else {
+			log.Printf("restarted process %d exited", cmd.Process.Pid)
+		}
+	}()
+	return nil
+}
+
+// restartEnv returns the environment of the process started by restart. The
+// variables describing the sockets this process was started with are
+// replaced by those for the files passed on, and watchdogPID, if set,
+// becomes the pid systemd expects watchdog notifications from.
+func restartEnv(files int, watchdogPID string) []string {
+	var env []string
+	for _, kv := range os.Environ() {
+		switch strings.SplitN(kv, "=", 2)[0] {
+		case listenFDsEnv, restartPIDEnv, "LISTEN_PID", "LISTEN_FDS", "LISTEN_FDNAMES":
+			continue
+		case "WATCHDOG_PID":
+			if watchdogPID != "" {
+				continue
+			}
+		}
+		env = append(env, kv)
+	}
+	if watchdogPID != "" {
+		env = append(env, "WATCHDOG_PID="+watchdogPID)
+	}
+	return append(env,
+		fmt.Sprintf("%s=%d", listenFDsEnv, files),
+		fmt.Sprintf("%s=%d", restartPIDEnv, os.Getpid()))
+}
+
+// takeOver tells the process that handed over its listening sockets to shut
+// down, now that this process is serving. The environment is left as it
+// is; restart replaces the variables describing how this process started.
+func (s *Server) takeOver() {
+	pid, err := strconv.Atoi(os.Getenv(restartPIDEnv))
+	if err != nil {
+		return
+	}
+	s.mu.Lock()
+	if s.watchdogPID == strconv.Itoa(pid) {
+		// this process is about to become the main process of the service
+		s.watchdogPID = strconv.Itoa(os.Getpid())
+	}
+	s.mu.Unlock()
+	log.Printf("taking over listening sockets from process %d", pid)
+	if err := syscall.Kill(pid, syscall.SIGTERM); err != nil {
+		log.Printf("ERROR: unable to stop process %d - %s", pid, err)
+	}
+}
@@ -0,0 +1,7 @@
+// +build windows plan9
+
+package oauth2proxy
+
+func (s *Server) handleSignals() {}
+
+func (s *Server) takeOver() {}
@@ -0,0 +1,125 @@
+package oauth2proxy
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/bitly/oauth2_proxy/store"
+)
+
+// oktaRevokingEvents are the Okta event types after which the sessions of
+// the target user are revoked.
+var oktaRevokingEvents = map[string]bool{
+	"user.account.update_password":    true,
+	"user.account.reset_password":     true,
+	"user.lifecycle.suspend":          true,
+	"user.lifecycle.deactivate":       true,
+	"user.lifecycle.delete.initiated": true,
+	"user.session.clear":              true,
+}
+
+// revocationRequest is the body of a request to the revocation webhook: an
+// Okta event hook delivery, or a list of email addresses.
+type revocationRequest struct {
+	Emails []string `json:"emails"`
+	Data   struct {
+		Events []struct {
+			EventType string `json:"eventType"`
+			Target    []struct {
+				Type        string `json:"type"`
+				AlternateID string `json:"alternateId"`
+			} `json:"target"`
+		} `json:"events"`
+	} `json:"data"`
+}
+
+// emails returns the users whose sessions the request revokes.
+func (r *revocationRequest) emails() []string {
+	emails := r.Emails
+	for _, event := range r.Data.Events {
+		if !oktaRevokingEvents[event.EventType] {
+			continue
+		}
+		for _, target := range event.Target {
+			if target.Type == "User" && target.AlternateID != "" {
+				emails = append(emails, target.AlternateID)
+			}
+		}
+	}
+	return emails
+}
+
+func revocationKey(email string) string {
+	return "revoked:" + strings.ToLower(email)
+}
+
+// RevokeSessions invalidates the sessions of email issued until now.
+func (p *OAuthProxy) RevokeSessions(email string, now time.Time) error {
+	return p.revocationStore.Set(revocationKey(email), []byte(strconv.FormatInt(now.Unix(), 10)), p.CookieExpire)
+}
+
+// IsRevoked reports whether the sessions of email were revoked after the
+// session cookie was issued, age ago.
+func (p *OAuthProxy) IsRevoked(email string, age time.Duration) bool {
+	if p.revocationToken == "" || email == "" {
+		return false
+	}
+	value, err := p.revocationStore.Get(revocationKey(email))
+	if err == store.ErrNotFound {
+		return false
+	} else if err != nil {
+		log.Printf("error loading session revocation for %s: %s", email, err)
+		return false
+	}
+	revoked, _ := strconv.ParseInt(string(value), 10, 64)
+	issued := time.Now().Truncate(time.Second).Add(-age)
+	return !issued.After(time.Unix(revoked, 0))
+}
+
+// RevocationWebhook revokes the sessions of users after the identity provider
+// signals a change of their credentials or account status.
+func (p *OAuthProxy) RevocationWebhook(rw http.ResponseWriter, req *http.Request) {
+	if p.revocationToken == "" {
+		http.NotFound(rw, req)
+		return
+	}
+	if !hasToken(req, p.revocationToken) {
+		log.Printf("%s invalid revocation webhook token", getRemoteAddr(req))
+		http.Error(rw, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	switch req.Method {
+	case "GET":
+		// Okta verifies an event hook by asking for the challenge back
+		challenge := req.Header.Get("X-Okta-Verification-Challenge")
+		rw.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(rw).Encode(map[string]string{"verification": challenge})
+		return
+	case "POST":
+	default:
+		http.Error(rw, "Method Not Allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	var r revocationRequest
+	if err := json.NewDecoder(http.MaxBytesReader(rw, req.Body, 1<<20)).Decode(&r); err != nil {
+		http.Error(rw, fmt.Sprintf("invalid request: %s", err), http.StatusBadRequest)
+		return
+	}
+	now := time.Now()
+	for _, email := range r.emails() {
+		if err := p.RevokeSessions(email, now); err != nil {
+			log.Printf("error revoking sessions of %s: %s", email, err)
+			http.Error(rw, "Internal Error", http.StatusInternalServerError)
+			return
+		}
+		log.Printf("%s revoked sessions of %s", getRemoteAddr(req), email)
+	}
+	rw.WriteHeader(http.StatusNoContent)
+}
@@ -0,0 +1,209 @@
+package oauth2proxy
+
+import (
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// A securityEvent is a kind of authentication or authorization event
+// exported to a SIEM.
+type securityEvent struct {
+	ID       string
+	Name     string
+	Severity int // 0 to 10, as in CEF
+}
+
+var (
+	eventLogin          = securityEvent{"login", "User signed in", 3}
+	eventLoginDenied    = securityEvent{"login-denied", "Sign in denied", 7}
+	eventAccessDenied   = securityEvent{"access-denied", "Session rejected", 6}
+	eventSessionRevoked = securityEvent{"session-revoked", "Session revoked by the identity provider", 5}
+	eventRefreshFailed  = securityEvent{"refresh-failed", "Session refresh failed", 5}
+	eventSignOut        = securityEvent{"sign-out", "User signed out", 3}
+	eventDeviceApproved = securityEvent{"device-approved", "Device signed in", 4}
+	eventTermsAccepted  = securityEvent{"terms-accepted", "Terms of use accepted", 3}
+)
+
+// securityEventQueue is how many events may wait to be sent; events beyond
+// that are dropped rather than holding up requests while the SIEM is slow or
+// unreachable.
+const securityEventQueue = 1000
+
+// SecurityEventLogger sends security events over syslog in CEF (ArcSight)
+// or LEEF (QRadar) format. Events are queued and sent in the background.
+type SecurityEventLogger struct {
+	network  string
+	addr     string
+	format   string
+	hostname string
+
+	start   sync.Once
+	lines   chan string
+	dropped uint64
+	// conn is only used by the sending goroutine
+	conn net.Conn
+}
+
+// NewSecurityEventLogger returns a logger sending to a udp:// or tcp://
+// syslog address in the "cef" or "leef" format.
+func NewSecurityEventLogger(address, format string) (*SecurityEventLogger, error) {
+	u, err := url.Parse(address)
+	if err != nil {
+		return nil, err
+	}
+	if (u.Scheme != "udp" && u.Scheme != "tcp") || u.Host == "" {
+		return nil, fmt.Errorf("must be udp://<host>:<port> or tcp://<host>:<port>")
+	}
+	if _, _, err := net.SplitHostPort(u.Host); err != nil {
+		return nil, err
+	}
+	switch format {
+	case "cef", "leef":
+	default:
+		return nil, fmt.Errorf("invalid security-event-format %q; must be cef or leef", format)
+	}
+	hostname, _ := os.Hostname()
+	if hostname == "" {
+		hostname = "-"
+	}
+	return &SecurityEventLogger{
+		network:  u.Scheme,
+		addr:     u.Host,
+		format:   format,
+		hostname: hostname,
+		lines:    make(chan string, securityEventQueue),
+	}, nil
+}
+
+// Event sends an event for a request by user (if known), with the reason for
+// a failure.
+func (l *SecurityEventLogger) Event(e securityEvent, ip, user, host, uri, reason string, now time.Time) {
+	if l == nil {
+		return
+	}
+	outcome := "success"
+	if reason != "" {
+		outcome = "failure"
+	}
+	var msg string
+	if l.format == "leef" {
+		msg = fmt.Sprintf("LEEF:1.0|bitly|oauth2_proxy|%s|%s|", leefEscape(VERSION), leefEscape(e.ID))
+		msg += strings.Join([]string{
+			"devTime=" + now.UTC().Format("Jan 02 2006 15:04:05"),
+			"devTimeFormat=MMM dd yyyy HH:mm:ss",
+			"cat=" + e.ID,
+			"sev=" + fmt.Sprint(e.Severity),
+			"src=" + leefEscape(ip),
+			"usrName=" + leefEscape(user),
+			"dstHost=" + leefEscape(host),
+			"url=" + leefEscape(uri),
+			"outcome=" + outcome,
+			"reason=" + leefEscape(reason),
+		}, "\t")
+	} else {
+		msg = fmt.Sprintf("CEF:0|bitly|oauth2_proxy|%s|%s|%s|%d|", cefHeaderEscape(VERSION), cefHeaderEscape(e.ID), cefHeaderEscape(e.Name), e.Severity)
+		msg += strings.Join([]string{
+			fmt.Sprintf("rt=%d", now.UnixNano()/int64(time.Millisecond)),
+			"src=" + cefEscape(ip),
+			"suser=" + cefEscape(user),
+			"dhost=" + cefEscape(host),
+			"request=" + cefEscape(uri),
+			"outcome=" + outcome,
+			"reason=" + cefEscape(reason),
+		}, " ")
+	}
+
+	// facility authpriv; warning for failures, info otherwise
+	severity := 6
+	if outcome == "failure" {
+		severity = 4
+	}
+	line := fmt.Sprintf("<%d>%s %s oauth2_proxy: %s\n", 10*8+severity, now.Format(time.Stamp), l.hostname, msg)
+	l.start.Do(func() { go l.run() })
+	select {
+	case l.lines <- line:
+	default:
+		if atomic.AddUint64(&l.dropped, 1)%securityEventQueue == 1 {
+			log.Printf("security event queue for %s://%s is full; dropping events", l.network, l.addr)
+		}
+	}
+}
+
+// Dropped returns the number of events dropped because the queue was full.
+func (l *SecurityEventLogger) Dropped() uint64 {
+	if l == nil {
+		return 0
+	}
+	return atomic.LoadUint64(&l.dropped)
+}
+
+// collect writes the number of dropped events.
+func (l *SecurityEventLogger) collect(w *promWriter, now time.Time) {
+	w.family("oauth2_proxy_security_events_dropped_total", "counter", "Security events dropped because the queue to the SIEM was full.")
+	w.sample("oauth2_proxy_security_events_dropped_total", l.Dropped())
+}
+
+// run sends the queued events.
+func (l *SecurityEventLogger) run() {
+	for line := range l.lines {
+		if err := l.send(line); err != nil {
+			log.Printf("error sending security event to %s://%s: %s", l.network, l.addr, err)
+		}
+	}
+}
+
+func (l *SecurityEventLogger) send(line string) error {
+	for attempt := 0; attempt < 2; attempt++ {
+		if l.conn == nil {
+			conn, err := net.DialTimeout(l.network, l.addr, 5*time.Second)
+			if err != nil {
+				return err
+			}
+			l.conn = conn
+		}
+		l.conn.SetWriteDeadline(time.Now().Add(5 * time.Second))
+		if _, err := l.conn.Write([]byte(line)); err == nil {
+			return nil
+		} else if attempt == 1 {
+			return err
+		}
+		// the connection was closed; reconnect once
+		l.conn.Close()
+		l.conn = nil
+	}
+	return nil
+}
+
+var cefHeaderReplacer = strings.NewReplacer(`\`, `\\`, `|`, `\|`, "\n", " ", "\r", " ")
+var cefReplacer = strings.NewReplacer(`\`, `\\`, `=`, `\=`, "\n", `\n`, "\r", `\r`)
+var leefReplacer = strings.NewReplacer("\t", " ", "\n", " ", "\r", " ", "|", " ")
+
+func cefHeaderEscape(s string) string { return cefHeaderReplacer.Replace(s) }
+func cefEscape(s string) string       { return cefReplacer.Replace(s) }
+func leefEscape(s string) string      { return leefReplacer.Replace(s) }
+
+func parseSecurityEvents(o *Options, msgs []string) []string {
+	o.securityEvents = nil
+	if o.SecurityEventSyslog == "" {
+		return msgs
+	}
+	l, err := NewSecurityEventLogger(o.SecurityEventSyslog, o.SecurityEventFormat)
+	if err != nil {
+		return append(msgs, fmt.Sprintf("invalid security-event-syslog %q: %s", o.SecurityEventSyslog, err))
+	}
+	o.securityEvents = l
+	return msgs
+}
+
+// logSecurityEvent sends e for req by user to the SIEM, if configured.
+func (p *OAuthProxy) logSecurityEvent(req *http.Request, e securityEvent, user, reason string) {
+	p.securityEvents.Event(e, clientIP(req), user, req.Host, req.URL.RequestURI(), reason, time.Now())
+}
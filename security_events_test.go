@@ -0,0 +1,70 @@
+package oauth2proxy
+
+import (
+	"bytes"
+	"net"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestSecurityEventOptions(t *testing.T) {
+	o := testOptions()
+	o.SecurityEventSyslog = "udp://127.0.0.1:514"
+	assert.Equal(t, nil, o.Validate())
+	assert.NotEqual(t, (*SecurityEventLogger)(nil), o.securityEvents)
+
+	o.SecurityEventFormat = "json"
+	assert.NotEqual(t, nil, o.Validate())
+
+	o.SecurityEventFormat = "leef"
+	o.SecurityEventSyslog = "127.0.0.1:514"
+	assert.NotEqual(t, nil, o.Validate())
+}
+
+func TestSecurityEvents(t *testing.T) {
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	assert.Equal(t, nil, err)
+	defer conn.Close()
+	read := func() string {
+		buf := make([]byte, 4096)
+		conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+		n, _, err := conn.ReadFrom(buf)
+		assert.Equal(t, nil, err)
+		return string(buf[:n])
+	}
+	now := time.Unix(1500000000, 0)
+
+	l, err := NewSecurityEventLogger("udp://"+conn.LocalAddr().String(), "cef")
+	assert.Equal(t, nil, err)
+	l.Event(eventLoginDenied, "10.0.0.1", "jane@example.com", "app.example.com", "/oauth2/callback?a=b", "csrf failed", now)
+	msg := read()
+	assert.True(t, strings.HasPrefix(msg, "<84>"), msg)
+	assert.Contains(t, msg, " oauth2_proxy: CEF:0|bitly|oauth2_proxy|"+VERSION+"|login-denied|Sign in denied|7|rt=1500000000000 ")
+	assert.Contains(t, msg, "src=10.0.0.1 suser=jane@example.com dhost=app.example.com request=/oauth2/callback?a\\=b outcome=failure reason=csrf failed\n")
+
+	l, err = NewSecurityEventLogger("udp://"+conn.LocalAddr().String(), "leef")
+	assert.Equal(t, nil, err)
+	l.Event(eventLogin, "10.0.0.1", "jane@example.com", "app.example.com", "/", "", now)
+	msg = read()
+	assert.True(t, strings.HasPrefix(msg, "<86>"), msg)
+	assert.Contains(t, msg, " oauth2_proxy: LEEF:1.0|bitly|oauth2_proxy|"+VERSION+"|login|devTime=Jul 14 2017 02:40:00\t")
+	assert.Contains(t, msg, "\tcat=login\tsev=3\tsrc=10.0.0.1\tusrName=jane@example.com\tdstHost=app.example.com\turl=/\toutcome=success\treason=\n")
+}
+
+func TestSecurityEventsDropped(t *testing.T) {
+	l, err := NewSecurityEventLogger("udp://127.0.0.1:514", "cef")
+	assert.Equal(t, nil, err)
+	// nothing sends the queued events
+	l.start.Do(func() {})
+	for i := 0; i <= securityEventQueue; i++ {
+		l.Event(eventLogin, "10.0.0.1", "jane@example.com", "app.example.com", "/", "", time.Now())
+	}
+	assert.Equal(t, uint64(1), l.Dropped())
+
+	var buf bytes.Buffer
+	newMetricsRegistry(l).write(&buf, time.Now())
+	assert.Contains(t, buf.String(), "oauth2_proxy_security_events_dropped_total 1\n")
+}
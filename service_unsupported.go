@@ -0,0 +1,13 @@
+// +build !windows
+
+package oauth2proxy
+
+import (
+	"fmt"
+	"os"
+)
+
+func serviceCommand(args []string) int {
+	fmt.Fprintln(os.Stderr, "the service command is only supported on Windows")
+	return 2
+}
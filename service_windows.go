@@ -0,0 +1,205 @@
+// +build windows
+
+package oauth2proxy
+
+import (
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"strings"
+	"time"
+
+	"golang.org/x/sys/windows/svc"
+	"golang.org/x/sys/windows/svc/eventlog"
+	"golang.org/x/sys/windows/svc/mgr"
+)
+
+const serviceUsage = `usage: oauth2_proxy service <install|uninstall|start|stop|run> [-name=oauth2_proxy] [-- proxy flags]
+
+  install    register oauth2_proxy as a Windows service started with the
+             proxy flags (e.g. -config=C:\oauth2_proxy\oauth2_proxy.cfg)
+  uninstall  remove the service
+  start      start the service
+  stop       stop the service
+  run        run as the service; used by the service control manager
+`
+
+// serviceCommand registers, controls and runs oauth2_proxy as a Windows
+// service.
+func serviceCommand(args []string) int {
+	if len(args) == 0 {
+		fmt.Fprint(os.Stderr, serviceUsage)
+		return 2
+	}
+	action := args[0]
+	flagSet := flag.NewFlagSet("oauth2_proxy service "+action, flag.ExitOnError)
+	name := flagSet.String("name", "oauth2_proxy", "service name")
+	flagSet.Parse(args[1:])
+
+	var err error
+	switch action {
+	case "install":
+		err = installService(*name, flagSet.Args())
+	case "uninstall":
+		err = uninstallService(*name)
+	case "start":
+		err = controlService(*name, func(s *mgr.Service) error { return s.Start() })
+	case "stop":
+		err = controlService(*name, func(s *mgr.Service) error {
+			_, err := s.Control(svc.Stop)
+			return err
+		})
+	case "run":
+		err = runService(*name, flagSet.Args())
+	default:
+		fmt.Fprint(os.Stderr, serviceUsage)
+		return 2
+	}
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "service %s: %s\n", action, err)
+		return 1
+	}
+	return 0
+}
+
+func installService(name string, proxyArgs []string) error {
+	exe, err := os.Executable()
+	if err != nil {
+		return err
+	}
+	m, err := mgr.Connect()
+	if err != nil {
+		return err
+	}
+	defer m.Disconnect()
+	if s, err := m.OpenService(name); err == nil {
+		s.Close()
+		return fmt.Errorf("service %s already exists", name)
+	}
+
+	args := append([]string{"service", "run", "-name=" + name, "--"}, proxyArgs...)
+	s, err := m.CreateService(name, exe, mgr.Config{
+		DisplayName: "OAuth2 Proxy (" + name + ")",
+		Description: "Reverse proxy providing authentication with OAuth2 providers",
+		StartType:   mgr.StartAutomatic,
+	}, args...)
+	if err != nil {
+		return err
+	}
+	defer s.Close()
+	if err := eventlog.InstallAsEventCreate(name, eventlog.Error|eventlog.Warning|eventlog.Info); err != nil {
+		s.Delete()
+		return err
+	}
+	return nil
+}
+
+func uninstallService(name string) error {
+	m, err := mgr.Connect()
+	if err != nil {
+		return err
+	}
+	defer m.Disconnect()
+	s, err := m.OpenService(name)
+	if err != nil {
+		return fmt.Errorf("service %s is not installed", name)
+	}
+	defer s.Close()
+	if err := s.Delete(); err != nil {
+		return err
+	}
+	return eventlog.Remove(name)
+}
+
+func controlService(name string, control func(s *mgr.Service) error) error {
+	m, err := mgr.Connect()
+	if err != nil {
+		return err
+	}
+	defer m.Disconnect()
+	s, err := m.OpenService(name)
+	if err != nil {
+		return fmt.Errorf("service %s is not installed", name)
+	}
+	defer s.Close()
+	return control(s)
+}
+
+// runService runs the proxy under the service control manager, logging to
+// the Windows event log.
+func runService(name string, proxyArgs []string) error {
+	isService, err := svc.IsWindowsService()
+	if err != nil {
+		return err
+	}
+	if !isService {
+		return fmt.Errorf("not started by the service control manager")
+	}
+	elog, err := eventlog.Open(name)
+	if err != nil {
+		return err
+	}
+	defer elog.Close()
+	log.SetFlags(log.Lshortfile)
+	log.SetOutput(eventLogWriter{elog})
+
+	runProxy(proxyArgs, func(s *Server) {
+		err = svc.Run(name, &windowsService{server: s})
+	})
+	return err
+}
+
+// eventLogWriter writes log lines to the Windows event log.
+type eventLogWriter struct {
+	elog *eventlog.Log
+}
+
+func (w eventLogWriter) Write(p []byte) (int, error) {
+	msg := string(p)
+	var err error
+	switch {
+	case strings.Contains(msg, "FATAL:"), strings.Contains(msg, "ERROR:"):
+		err = w.elog.Error(1, msg)
+	case strings.Contains(msg, "WARNING:"):
+		err = w.elog.Warning(1, msg)
+	default:
+		err = w.elog.Info(1, msg)
+	}
+	return len(p), err
+}
+
+// windowsService runs the server until the service control manager stops
+// it.
+type windowsService struct {
+	server *Server
+}
+
+func (ws *windowsService) Execute(args []string, requests <-chan svc.ChangeRequest, status chan<- svc.Status) (bool, uint32) {
+	status <- svc.Status{State: svc.StartPending}
+	done := make(chan struct{})
+	go func() {
+		ws.server.ListenAndServe()
+		close(done)
+	}()
+	status <- svc.Status{State: svc.Running, Accepts: svc.AcceptStop | svc.AcceptShutdown}
+
+	for {
+		select {
+		case <-done:
+			// the server failed
+			return false, 1
+		case r := <-requests:
+			switch r.Cmd {
+			case svc.Interrogate:
+				status <- r.CurrentStatus
+			case svc.Stop, svc.Shutdown:
+				log.Printf("shutting down")
+				status <- svc.Status{State: svc.StopPending, WaitHint: uint32((ws.server.Opts.ShutdownTimeout + time.Second) / time.Millisecond)}
+				ws.server.Shutdown()
+				<-done
+				return false, 0
+			}
+		}
+	}
+}
@@ -0,0 +1,112 @@
+package oauth2proxy
+
+import (
+	"encoding/json"
+	"log"
+	"net/http"
+	"time"
+
+	"github.com/bitly/oauth2_proxy/providers"
+)
+
+// sessionInfo describes the session of a browser to single-page apps. The
+// expiry of the access token is given when it can't be refreshed, which ends
+// the session once it passes.
+type sessionInfo struct {
+	Authenticated        bool       `json:"authenticated"`
+	User                 string     `json:"user,omitempty"`
+	Email                string     `json:"email,omitempty"`
+	ExpiresAt            *time.Time `json:"expires_at,omitempty"`
+	ExpiresIn            int64      `json:"expires_in,omitempty"`
+	AccessTokenExpiresIn *int64     `json:"access_token_expires_in,omitempty"`
+}
+
+// validSession returns the session cookie of req and its age if the session
+// is still valid and authorized, without refreshing or saving it.
+func (p *OAuthProxy) validSession(req *http.Request) (*providers.SessionState, time.Duration) {
+	session, age, err := p.LoadCookiedSession(req)
+	if err != nil || session == nil {
+		return nil, 0
+	}
+	if p.IsRevoked(session.Email, age) {
+		return nil, 0
+	}
+	if session.IsExpired() && session.RefreshToken == "" {
+		return nil, 0
+	}
+	if session.Email != "" && p.denyReason(req, session, false) != "" {
+		return nil, 0
+	}
+	return session, age
+}
+
+// SessionInfo reports whether the browser is signed in and for how many
+// more seconds, so that single-page apps can ask users to sign in again
+// before a request fails. It doesn't extend the session.
+func (p *OAuthProxy) SessionInfo(rw http.ResponseWriter, req *http.Request) {
+	rw.Header().Set("Content-Type", "application/json")
+	rw.Header().Set("Cache-Control", "no-store")
+
+	session, age := p.validSession(req)
+	if session == nil {
+		rw.WriteHeader(http.StatusUnauthorized)
+		json.NewEncoder(rw).Encode(sessionInfo{})
+		return
+	}
+
+	now := time.Now()
+	expiresAt := now.Add(p.CookieExpire - age).Truncate(time.Second)
+	info := sessionInfo{
+		Authenticated: true,
+		User:          session.User,
+		Email:         session.Email,
+		ExpiresAt:     &expiresAt,
+		ExpiresIn:     int64(expiresAt.Sub(now).Seconds()),
+	}
+	if !session.ExpiresOn.IsZero() && session.RefreshToken == "" {
+		in := int64(session.ExpiresOn.Sub(now).Seconds())
+		info.AccessTokenExpiresIn = &in
+	}
+	json.NewEncoder(rw).Encode(info)
+}
+
+// RefreshSession re-issues the session cookie of a signed in browser, first
+// redeeming the refresh token of the session if its access token expired, so
+// that single-page apps can keep users signed in from an iframe or with fetch
+// rather than a full-page redirect. The cookie keeps the time the user signed
+// in, so the session still ends cookie-expire after it. It responds 204 once
+// refreshed and 401 when the user has to sign in again.
+func (p *OAuthProxy) RefreshSession(rw http.ResponseWriter, req *http.Request) {
+	rw.Header().Set("Cache-Control", "no-store")
+	remoteAddr := getRemoteAddr(req)
+
+	session, age := p.validSession(req)
+	if session == nil {
+		p.ClearSessionCookie(rw, req)
+		rw.WriteHeader(http.StatusUnauthorized)
+		return
+	}
+	signedIn := time.Now().Truncate(time.Second).Add(-age)
+
+	provider := p.providerFor(req)
+	if ok, err := p.refreshSession(provider, session); err != nil {
+		log.Printf("%s removing session. error refreshing access token %s %s", remoteAddr, err, session)
+		p.logSecurityEvent(req, eventRefreshFailed, session.Email, err.Error())
+		session = nil
+	} else if !ok && session.AccessToken != "" && !p.validateSession(provider, session) {
+		log.Printf("%s removing session. error validating %s", remoteAddr, session)
+		session = nil
+	}
+	if session == nil || session.IsExpired() {
+		p.ClearSessionCookie(rw, req)
+		rw.WriteHeader(http.StatusUnauthorized)
+		return
+	}
+
+	if err := p.saveSession(rw, req, session, signedIn); err != nil {
+		log.Printf("%s %s", remoteAddr, err)
+		rw.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	rw.WriteHeader(http.StatusNoContent)
+}
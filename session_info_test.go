@@ -0,0 +1,149 @@
+package oauth2proxy
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+	"time"
+
+	"github.com/bitly/oauth2_proxy/providers"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestSessionInfo(t *testing.T) {
+	opts := testOptions()
+	opts.CookieExpire = time.Hour
+	opts.CookieSecret = "0123456789abcdefghijklmnopqrstuv"
+	opts.PassAccessToken = true
+	assert.Equal(t, nil, opts.Validate())
+	allowed := true
+	proxy := newOAuthProxy(opts, func(string) bool { return allowed })
+
+	get := func(session *providers.SessionState, issued time.Time) (int, map[string]interface{}) {
+		rw := httptest.NewRecorder()
+		req, _ := http.NewRequest("GET", "/oauth2/session", nil)
+		if session != nil {
+			value, _ := session.EncodeSessionState(proxy.CookieCipher)
+			req.AddCookie(proxy.MakeSessionCookie(req, value, opts.CookieExpire, issued))
+		}
+		proxy.ServeHTTP(rw, req)
+		assert.Equal(t, "application/json", rw.Header().Get("Content-Type"))
+		assert.Equal(t, "no-store", rw.Header().Get("Cache-Control"))
+		assert.Equal(t, "", rw.Header().Get("Set-Cookie"))
+		var info map[string]interface{}
+		assert.Equal(t, nil, json.Unmarshal(rw.Body.Bytes(), &info))
+		return rw.Code, info
+	}
+
+	code, info := get(nil, time.Now())
+	assert.Equal(t, 401, code)
+	assert.Equal(t, map[string]interface{}{"authenticated": false}, info)
+
+	session := &providers.SessionState{Email: "jane@example.com", User: "jane", AccessToken: "access_token"}
+	code, info = get(session, time.Now().Add(-20*time.Minute))
+	assert.Equal(t, 200, code)
+	assert.Equal(t, true, info["authenticated"])
+	assert.Equal(t, "jane@example.com", info["email"])
+	assert.InDelta(t, 40*60, info["expires_in"], 2)
+	assert.NotEqual(t, nil, info["expires_at"])
+	assert.Equal(t, nil, info["access_token_expires_in"])
+
+	// an access token that can't be refreshed ends the session first
+	session.ExpiresOn = time.Now().Add(5 * time.Minute)
+	_, info = get(session, time.Now())
+	assert.InDelta(t, 5*60, info["access_token_expires_in"], 2)
+	session.ExpiresOn = time.Now().Add(-time.Minute)
+	code, _ = get(session, time.Now())
+	assert.Equal(t, 401, code)
+	session.RefreshToken = "refresh_token"
+	code, info = get(session, time.Now())
+	assert.Equal(t, 200, code)
+	assert.Equal(t, nil, info["access_token_expires_in"])
+
+	allowed = false
+	code, _ = get(session, time.Now())
+	assert.Equal(t, 401, code)
+}
+
+// ExpiryRefreshingProvider only refreshes expired sessions, as the providers
+// with refresh tokens do.
+type ExpiryRefreshingProvider struct {
+	*RefreshCountingProvider
+}
+
+func (p *ExpiryRefreshingProvider) RefreshSessionIfNeeded(s *providers.SessionState) (bool, error) {
+	if s == nil || s.ExpiresOn.After(time.Now()) || s.RefreshToken == "" {
+		return false, nil
+	}
+	return p.RefreshCountingProvider.RefreshSessionIfNeeded(s)
+}
+
+func TestRefreshSessionEndpoint(t *testing.T) {
+	opts := testOptions()
+	opts.CookieSecret = "0123456789abcdefghijklmnopqrstuv"
+	opts.PassAccessToken = true
+	assert.Equal(t, nil, opts.Validate())
+	provider := &ExpiryRefreshingProvider{&RefreshCountingProvider{
+		TestProvider: NewTestProvider(&url.URL{Host: "localhost"}, "jane@example.com"),
+	}}
+	provider.ValidToken = true
+	opts.provider = provider
+	proxy := newOAuthProxy(opts, func(string) bool { return true })
+
+	var age time.Duration
+	refresh := func(session *providers.SessionState) (*httptest.ResponseRecorder, *providers.SessionState) {
+		rw := httptest.NewRecorder()
+		req, _ := http.NewRequest("POST", "/oauth2/refresh", nil)
+		if session != nil {
+			value, _ := session.EncodeSessionState(proxy.CookieCipher)
+			req.AddCookie(proxy.MakeSessionCookie(req, value, opts.CookieExpire, time.Now().Add(-time.Hour)))
+		}
+		proxy.ServeHTTP(rw, req)
+		assert.Equal(t, "no-store", rw.Header().Get("Cache-Control"))
+		for _, c := range (&http.Response{Header: rw.Header()}).Cookies() {
+			if c.Name == opts.CookieName && c.Value != "" {
+				req, _ := http.NewRequest("GET", "/", nil)
+				req.AddCookie(c)
+				refreshed, cookieAge, err := proxy.LoadCookiedSession(req)
+				assert.Equal(t, nil, err)
+				age = cookieAge
+				return rw, refreshed
+			}
+		}
+		return rw, nil
+	}
+
+	rw, _ := refresh(nil)
+	assert.Equal(t, 401, rw.Code)
+
+	// a valid session gets a new cookie without redeeming its refresh token
+	session := &providers.SessionState{Email: "jane@example.com", AccessToken: "access_token",
+		RefreshToken: "refresh_token", ExpiresOn: time.Now().Add(time.Hour)}
+	rw, refreshed := refresh(session)
+	assert.Equal(t, 204, rw.Code)
+	assert.Equal(t, "access_token", refreshed.AccessToken)
+	assert.Equal(t, 0, provider.refreshes)
+	// the new cookie doesn't extend the session
+	assert.True(t, age >= time.Hour-time.Second, age)
+
+	// an expired access token is refreshed
+	session.ExpiresOn = time.Now().Add(-time.Minute)
+	rw, refreshed = refresh(session)
+	assert.Equal(t, 204, rw.Code)
+	assert.Equal(t, "refreshed_token", refreshed.AccessToken)
+	assert.Equal(t, 1, provider.refreshes)
+
+	// without a refresh token the user has to sign in again
+	session.RefreshToken = ""
+	rw, refreshed = refresh(session)
+	assert.Equal(t, 401, rw.Code)
+	assert.Equal(t, (*providers.SessionState)(nil), refreshed)
+
+	// as they do once the provider no longer accepts the access token
+	session.ExpiresOn = time.Now().Add(time.Hour)
+	provider.ValidToken = false
+	rw, _ = refresh(session)
+	assert.Equal(t, 401, rw.Code)
+}
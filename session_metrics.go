@@ -0,0 +1,202 @@
+package oauth2proxy
+
+import (
+	"encoding/json"
+	"fmt"
+	"hash/fnv"
+	"io"
+	"log"
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+)
+
+// activeSessionWindow is how recently a signed in user must have made a
+// request for their session to count as active.
+const activeSessionWindow = 15 * time.Minute
+
+// uniqueUserWindows are the rolling windows unique users are counted over,
+// e.g. for daily and weekly active users.
+var uniqueUserWindows = []struct {
+	name   string
+	window time.Duration
+}{
+	{"1h", time.Hour},
+	{"24h", 24 * time.Hour},
+	{"7d", 7 * 24 * time.Hour},
+}
+
+// sessionMetricsShards is the number of shards the signed in users are kept
+// in, so that concurrent requests rarely wait for the same lock.
+const sessionMetricsShards = 32
+
+// seenResolution is how precisely users are seen: a user seen less than this
+// long ago isn't recorded again, so that most requests only take a read
+// lock.
+const seenResolution = time.Minute
+
+// sessionUser is a user signed in with a provider.
+type sessionUser struct {
+	provider string
+	user     string
+}
+
+// sessionMetrics counts the sign ins by provider and keeps when each signed
+// in user was last seen, for the active sessions and unique users over the
+// uniqueUserWindows. Users not seen for the longest window are forgotten.
+// The users are spread over shards by a hash of the provider and user.
+type sessionMetrics struct {
+	mu     sync.Mutex
+	logins map[string]uint64
+	shards [sessionMetricsShards]sessionShard
+}
+
+// sessionShard keeps when the signed in users of one shard were last seen.
+type sessionShard struct {
+	mu       sync.RWMutex
+	lastSeen map[sessionUser]time.Time
+	pruned   time.Time
+}
+
+// sessionStats are the session metrics of a provider.
+type sessionStats struct {
+	Logins         uint64         `json:"logins"`
+	ActiveSessions int            `json:"active_sessions"`
+	UniqueUsers    map[string]int `json:"unique_users"`
+}
+
+func newSessionMetrics() *sessionMetrics {
+	m := &sessionMetrics{logins: make(map[string]uint64)}
+	for i := range m.shards {
+		m.shards[i].lastSeen = make(map[sessionUser]time.Time)
+	}
+	return m
+}
+
+// shard returns the shard u is kept in.
+func (m *sessionMetrics) shard(u sessionUser) *sessionShard {
+	h := fnv.New32a()
+	io.WriteString(h, u.provider)
+	h.Write([]byte{0})
+	io.WriteString(h, u.user)
+	return &m.shards[h.Sum32()%sessionMetricsShards]
+}
+
+// login counts a sign in of user with provider, which also makes them seen.
+func (m *sessionMetrics) login(provider, user string, now time.Time) {
+	m.mu.Lock()
+	m.logins[provider]++
+	m.mu.Unlock()
+	m.seen(provider, user, now)
+}
+
+// seen records a request of a user signed in with provider.
+func (m *sessionMetrics) seen(provider, user string, now time.Time) {
+	if user == "" {
+		return
+	}
+	u := sessionUser{provider, user}
+	s := m.shard(u)
+	s.mu.RLock()
+	t, ok := s.lastSeen[u]
+	s.mu.RUnlock()
+	if ok && now.Sub(t) < seenResolution {
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.lastSeen[u] = now
+	if now.Sub(s.pruned) > time.Hour {
+		s.prune(now)
+	}
+}
+
+// prune forgets the users not seen for the longest window.
+func (s *sessionShard) prune(now time.Time) {
+	longest := uniqueUserWindows[len(uniqueUserWindows)-1].window
+	for u, t := range s.lastSeen {
+		if now.Sub(t) > longest {
+			delete(s.lastSeen, u)
+		}
+	}
+	s.pruned = now
+}
+
+// stats returns the session metrics by provider as of now.
+func (m *sessionMetrics) stats(now time.Time) map[string]*sessionStats {
+	stats := make(map[string]*sessionStats)
+	get := func(provider string) *sessionStats {
+		s := stats[provider]
+		if s == nil {
+			s = &sessionStats{UniqueUsers: make(map[string]int)}
+			for _, w := range uniqueUserWindows {
+				s.UniqueUsers[w.name] = 0
+			}
+			stats[provider] = s
+		}
+		return s
+	}
+	m.mu.Lock()
+	for provider, n := range m.logins {
+		get(provider).Logins = n
+	}
+	m.mu.Unlock()
+	for i := range m.shards {
+		shard := &m.shards[i]
+		shard.mu.Lock()
+		shard.prune(now)
+		for u, t := range shard.lastSeen {
+			s := get(u.provider)
+			age := now.Sub(t)
+			if age <= activeSessionWindow {
+				s.ActiveSessions++
+			}
+			for _, w := range uniqueUserWindows {
+				if age <= w.window {
+					s.UniqueUsers[w.name]++
+				}
+			}
+		}
+		shard.mu.Unlock()
+	}
+	return stats
+}
+
+// collect writes the metrics as of now.
+func (m *sessionMetrics) collect(w *promWriter, now time.Time) {
+	stats := m.stats(now)
+	providers := make([]string, 0, len(stats))
+	for provider := range stats {
+		providers = append(providers, provider)
+	}
+	sort.Strings(providers)
+
+	w.family("oauth2_proxy_logins_total", "counter", "Sign ins, by provider.")
+	for _, provider := range providers {
+		w.sample("oauth2_proxy_logins_total", stats[provider].Logins, "provider", provider)
+	}
+	w.family("oauth2_proxy_active_sessions", "gauge", fmt.Sprintf("Signed in users who made a request in the last %s, by provider.", activeSessionWindow))
+	for _, provider := range providers {
+		w.sample("oauth2_proxy_active_sessions", stats[provider].ActiveSessions, "provider", provider)
+	}
+	w.family("oauth2_proxy_unique_users", "gauge", "Signed in users who made a request to this instance within the window, by provider; users of several instances are counted by each.")
+	for _, provider := range providers {
+		for _, win := range uniqueUserWindows {
+			w.sample("oauth2_proxy_unique_users", stats[provider].UniqueUsers[win.name], "provider", provider, "window", win.name)
+		}
+	}
+}
+
+// SessionStats serves the session metrics by provider as JSON.
+func (p *OAuthProxy) SessionStats(rw http.ResponseWriter, req *http.Request) {
+	if !p.authorizeAdmin(rw, req) {
+		return
+	}
+	if req.Method != "GET" {
+		http.Error(rw, "Method Not Allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	rw.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(rw).Encode(p.sessionMetrics.stats(time.Now()))
+}
@@ -0,0 +1,85 @@
+package oauth2proxy
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/bitly/oauth2_proxy/providers"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestSessionMetricsWindows(t *testing.T) {
+	m := newSessionMetrics()
+	now := time.Now()
+	m.login("Google", "jane@example.com", now.Add(-3*24*time.Hour))
+	m.seen("Google", "jane@example.com", now.Add(-5*time.Minute))
+	m.seen("Google", "john@example.com", now.Add(-2*time.Hour))
+	m.seen("GitHub", "jane@example.com", now.Add(-8*24*time.Hour))
+	m.seen("GitHub", "", now)
+
+	assert.Equal(t, map[string]*sessionStats{
+		"Google": {Logins: 1, ActiveSessions: 1, UniqueUsers: map[string]int{"1h": 1, "24h": 2, "7d": 2}},
+	}, m.stats(now))
+	users := 0
+	for i := range m.shards {
+		users += len(m.shards[i].lastSeen)
+	}
+	assert.Equal(t, 2, users)
+
+	var b bytes.Buffer
+	newMetricsRegistry(m).write(&b, now)
+	assert.Contains(t, b.String(), `oauth2_proxy_logins_total{provider="Google"} 1`+"\n")
+	assert.Contains(t, b.String(), `oauth2_proxy_active_sessions{provider="Google"} 1`+"\n")
+	assert.Contains(t, b.String(), `oauth2_proxy_unique_users{provider="Google",window="24h"} 2`+"\n")
+}
+
+func TestSessionMetricsSeenResolution(t *testing.T) {
+	m := newSessionMetrics()
+	now := time.Now()
+	m.seen("Google", "jane@example.com", now.Add(-15*time.Minute-30*time.Second))
+	// requests less than a minute apart are not recorded again
+	m.seen("Google", "jane@example.com", now.Add(-15*time.Minute+15*time.Second))
+	assert.Equal(t, 0, m.stats(now)["Google"].ActiveSessions)
+	m.seen("Google", "jane@example.com", now.Add(-10*time.Minute))
+	assert.Equal(t, 1, m.stats(now)["Google"].ActiveSessions)
+}
+
+func TestSessionStats(t *testing.T) {
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("upstream"))
+	}))
+	defer upstream.Close()
+	opts := testOptions()
+	opts.Upstreams = []string{upstream.URL}
+	opts.AdminToken = "admin_token"
+	assert.Equal(t, nil, opts.Validate())
+	proxy := newOAuthProxy(opts, func(string) bool { return true })
+
+	rw := httptest.NewRecorder()
+	req, _ := http.NewRequest("GET", "/app", nil)
+	value, _ := (&providers.SessionState{Email: "jane@example.com"}).EncodeSessionState(nil)
+	req.AddCookie(proxy.MakeSessionCookie(req, value, opts.CookieExpire, time.Now()))
+	proxy.ServeHTTP(rw, req)
+	assert.Equal(t, 200, rw.Code)
+
+	stats := func(token string) *httptest.ResponseRecorder {
+		rw := httptest.NewRecorder()
+		req, _ := http.NewRequest("GET", "/oauth2/admin/sessions", nil)
+		req.Header.Set("Authorization", "Bearer "+token)
+		proxy.ServeHTTP(rw, req)
+		return rw
+	}
+	rw = stats("admin_token")
+	assert.Equal(t, 200, rw.Code)
+	var got map[string]*sessionStats
+	assert.Equal(t, nil, json.Unmarshal(rw.Body.Bytes(), &got))
+	assert.Equal(t, map[string]*sessionStats{
+		"Google": {ActiveSessions: 1, UniqueUsers: map[string]int{"1h": 1, "24h": 1, "7d": 1}},
+	}, got)
+
+	assert.Equal(t, 401, stats("wrong").Code)
+}
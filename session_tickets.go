@@ -0,0 +1,97 @@
+package oauth2proxy
+
+import (
+	"crypto/rand"
+	"encoding/base64"
+	"errors"
+	"net/http"
+	"strings"
+
+	"github.com/bitly/oauth2_proxy/cookie"
+	"github.com/bitly/oauth2_proxy/store"
+)
+
+// sessionTicketPrefix marks a session cookie holding a ticket for a session
+// kept in the session store, instead of the session itself.
+const sessionTicketPrefix = "t1:"
+
+func sessionTicketKey(ticket string) string {
+	return "session:" + ticket
+}
+
+// tooLargeForCookie reports whether the signed cookie of a session value
+// exceeds cookie-max-size.
+func (p *OAuthProxy) tooLargeForCookie(value string) bool {
+	if p.cookieMaxSize == 0 {
+		return false
+	}
+	// the cookie is the base64 encoded value, its timestamp and signature
+	size := base64.URLEncoding.EncodedLen(len(value)) + 40
+	return size > p.cookieMaxSize
+}
+
+// storeLargeSession returns value, a serialized session, unless its cookie
+// would exceed cookie-max-size: with a session store, the session is then
+// kept in the store, under ticket if there is one, and a cookie value holding
+// the ticket returned instead. A session that fits in its cookie again is
+// removed from the store.
+func (p *OAuthProxy) storeLargeSession(value, ticket string) (string, error) {
+	if p.store == nil {
+		return value, nil
+	}
+	if !p.tooLargeForCookie(value) {
+		if ticket != "" {
+			p.store.Del(sessionTicketKey(ticket))
+		}
+		return value, nil
+	}
+	if ticket == "" {
+		b := make([]byte, 24)
+		if _, err := rand.Read(b); err != nil {
+			return "", err
+		}
+		ticket = base64.RawURLEncoding.EncodeToString(b)
+	}
+	if err := p.store.Set(sessionTicketKey(ticket), []byte(value), p.CookieExpire); err != nil {
+		return "", err
+	}
+	return sessionTicketPrefix + ticket, nil
+}
+
+// sessionTicket returns the ticket held by the session cookie of req, if it
+// holds one.
+func (p *OAuthProxy) sessionTicket(req *http.Request) string {
+	c, err := req.Cookie(p.CookieName)
+	if err != nil {
+		return ""
+	}
+	value, _, ok := cookie.Validate(c, p.CookieSeed, p.CookieExpire)
+	if !ok || !strings.HasPrefix(value, sessionTicketPrefix) {
+		return ""
+	}
+	return strings.TrimPrefix(value, sessionTicketPrefix)
+}
+
+// loadStoredSession returns the session a cookie value holds a ticket for,
+// or the value itself if it doesn't hold a ticket.
+func (p *OAuthProxy) loadStoredSession(value string) (string, error) {
+	if !strings.HasPrefix(value, sessionTicketPrefix) {
+		return value, nil
+	}
+	if p.store == nil {
+		return "", errors.New("session ticket without a session store")
+	}
+	stored, err := p.store.Get(sessionTicketKey(strings.TrimPrefix(value, sessionTicketPrefix)))
+	if err == store.ErrNotFound {
+		return "", errors.New("session ticket expired")
+	}
+	return string(stored), err
+}
+
+// deleteStoredSession removes the session the cookie of req holds a ticket
+// for, if it holds one.
+func (p *OAuthProxy) deleteStoredSession(req *http.Request) {
+	if ticket := p.sessionTicket(req); ticket != "" && p.store != nil {
+		p.store.Del(sessionTicketKey(ticket))
+	}
+}
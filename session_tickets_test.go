@@ -0,0 +1,106 @@
+package oauth2proxy
+
+import (
+	"bytes"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/bitly/oauth2_proxy/cookie"
+	"github.com/bitly/oauth2_proxy/providers"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestSessionTickets(t *testing.T) {
+	o := testOptions()
+	o.CookieMaxSize = -1
+	assert.Equal(t, errorMsg([]string{"cookie-max-size must not be negative"}), o.Validate().Error())
+
+	newProxy := func(sessionStore string) *OAuthProxy {
+		opts := testOptions()
+		opts.CookieSecret = "0123456789abcdefghijklmnopqrstuv"
+		opts.PassAccessToken = true
+		opts.SessionStore = sessionStore
+		opts.CookieMaxSize = 512
+		assert.Equal(t, nil, opts.Validate())
+		return newOAuthProxy(opts, func(string) bool { return true })
+	}
+	session := &providers.SessionState{Email: "jane@example.com", AccessToken: strings.Repeat("x", 1024)}
+	save := func(proxy *OAuthProxy, req *http.Request) *http.Cookie {
+		rw := httptest.NewRecorder()
+		assert.Equal(t, nil, proxy.SaveSession(rw, req, session))
+		return (&http.Response{Header: rw.Header()}).Cookies()[0]
+	}
+	withCookie := func(c *http.Cookie) *http.Request {
+		req, _ := http.NewRequest("GET", "/", nil)
+		req.AddCookie(c)
+		return req
+	}
+
+	// without a session store, the cookie holds the session regardless
+	proxy := newProxy("")
+	req, _ := http.NewRequest("GET", "/", nil)
+	c := save(proxy, req)
+	assert.True(t, len(c.Value) > 512)
+
+	proxy = newProxy("memory")
+	c = save(proxy, req)
+	assert.True(t, len(c.Value) < 512)
+	value, _, ok := cookie.Validate(c, proxy.CookieSeed, proxy.CookieExpire)
+	assert.True(t, ok)
+	assert.True(t, strings.HasPrefix(value, sessionTicketPrefix))
+
+	loaded, _, err := proxy.LoadCookiedSession(withCookie(c))
+	assert.Equal(t, nil, err)
+	assert.Equal(t, "jane@example.com", loaded.Email)
+	assert.Equal(t, session.AccessToken, loaded.AccessToken)
+
+	// saving the session again keeps its ticket
+	assert.Equal(t, proxy.sessionTicket(withCookie(c)), proxy.sessionTicket(withCookie(save(proxy, withCookie(c)))))
+
+	// signing in gets a new ticket, and the ticket sent is deleted
+	rw := httptest.NewRecorder()
+	assert.Equal(t, nil, proxy.saveNewSession(rw, withCookie(c), session))
+	signedIn := (&http.Response{Header: rw.Header()}).Cookies()[0]
+	assert.NotEqual(t, proxy.sessionTicket(withCookie(c)), proxy.sessionTicket(withCookie(signedIn)))
+	_, _, err = proxy.LoadCookiedSession(withCookie(c))
+	assert.Equal(t, "session ticket expired", err.Error())
+
+	// small sessions stay in the cookie, and the stored session of one that
+	// shrank is removed
+	small := &providers.SessionState{Email: "jane@example.com", AccessToken: "token"}
+	rw = httptest.NewRecorder()
+	assert.Equal(t, nil, proxy.SaveSession(rw, withCookie(signedIn), small))
+	value, _, _ = cookie.Validate((&http.Response{Header: rw.Header()}).Cookies()[0], proxy.CookieSeed, proxy.CookieExpire)
+	assert.False(t, strings.HasPrefix(value, sessionTicketPrefix))
+	_, _, err = proxy.LoadCookiedSession(withCookie(signedIn))
+	assert.Equal(t, "session ticket expired", err.Error())
+
+	// signing out removes the stored session
+	c = save(proxy, req)
+	proxy.ClearSessionCookie(httptest.NewRecorder(), withCookie(c))
+	_, _, err = proxy.LoadCookiedSession(withCookie(c))
+	assert.Equal(t, "session ticket expired", err.Error())
+}
+
+func TestLargeCookieWarning(t *testing.T) {
+	var logged bytes.Buffer
+	log.SetOutput(&logged)
+	defer log.SetOutput(os.Stderr)
+
+	// with cookie-max-size=0 and no session store, cookies browsers drop are
+	// still reported
+	opts := testOptions()
+	opts.CookieMaxSize = 0
+	assert.Equal(t, nil, opts.Validate())
+	proxy := newOAuthProxy(opts, func(string) bool { return true })
+	req, _ := http.NewRequest("GET", "/", nil)
+	proxy.MakeSessionCookie(req, strings.Repeat("x", 1024), opts.CookieExpire, time.Now())
+	assert.NotContains(t, logged.String(), "WARNING - Cookie Size")
+	proxy.MakeSessionCookie(req, strings.Repeat("x", 4096), opts.CookieExpire, time.Now())
+	assert.Contains(t, logged.String(), "WARNING - Cookie Size")
+}
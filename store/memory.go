@@ -0,0 +1,163 @@
+package store
+
+import (
+	"math"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+type memoryEntry struct {
+	value   []byte
+	expires time.Time
+}
+
+type tokenBucket struct {
+	tokens  float64
+	updated time.Time
+	// expires is when the bucket has refilled completely, after which it is
+	// the same as a new one
+	expires time.Time
+}
+
+// sweepInterval is how often a MemoryStore removes its expired entries;
+// until then they are only skipped.
+const sweepInterval = time.Minute
+
+// MemoryStore keeps values in process memory.
+type MemoryStore struct {
+	mu      sync.Mutex
+	entries map[string]memoryEntry
+	buckets map[string]*tokenBucket
+	swept   time.Time
+}
+
+func NewMemoryStore() *MemoryStore {
+	return &MemoryStore{
+		entries: make(map[string]memoryEntry),
+		buckets: make(map[string]*tokenBucket),
+	}
+}
+
+func (s *MemoryStore) Set(key string, value []byte, expiration time.Duration) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	now := time.Now()
+	s.sweep(now)
+	s.entries[key] = memoryEntry{value, now.Add(expiration)}
+	return nil
+}
+
+// sweep removes the entries and token buckets that expired before now, at
+// most once per sweepInterval so that writes don't have to go through all
+// of them.
+func (s *MemoryStore) sweep(now time.Time) {
+	if now.Sub(s.swept) < sweepInterval {
+		return
+	}
+	s.swept = now
+	for k, e := range s.entries {
+		if now.After(e.expires) {
+			delete(s.entries, k)
+		}
+	}
+	for k, b := range s.buckets {
+		if now.After(b.expires) {
+			delete(s.buckets, k)
+		}
+	}
+}
+
+func (s *MemoryStore) SetNX(key string, value []byte, expiration time.Duration) (bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	now := time.Now()
+	if e, ok := s.entries[key]; ok && !now.After(e.expires) {
+		return false, nil
+	}
+	s.sweep(now)
+	s.entries[key] = memoryEntry{value, now.Add(expiration)}
+	return true, nil
+}
+
+func (s *MemoryStore) Get(key string) ([]byte, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	e, ok := s.entries[key]
+	if !ok || time.Now().After(e.expires) {
+		return nil, ErrNotFound
+	}
+	return e.value, nil
+}
+
+func (s *MemoryStore) Take(key string) ([]byte, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	e, ok := s.entries[key]
+	delete(s.entries, key)
+	if !ok || time.Now().After(e.expires) {
+		return nil, ErrNotFound
+	}
+	return e.value, nil
+}
+
+func (s *MemoryStore) Del(key string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delete(s.entries, key)
+	return nil
+}
+
+func (s *MemoryStore) Incr(key string, expiration time.Duration) (int64, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	now := time.Now()
+	s.sweep(now)
+	var n int64
+	if e, ok := s.entries[key]; ok && !now.After(e.expires) {
+		n, _ = strconv.ParseInt(string(e.value), 10, 64)
+	}
+	n++
+	s.entries[key] = memoryEntry{[]byte(strconv.FormatInt(n, 10)), now.Add(expiration)}
+	return n, nil
+}
+
+func (s *MemoryStore) Keys(prefix string) ([]string, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	now := time.Now()
+	var keys []string
+	for k, e := range s.entries {
+		if strings.HasPrefix(k, prefix) && !now.After(e.expires) {
+			keys = append(keys, k)
+		}
+	}
+	sort.Strings(keys)
+	return keys, nil
+}
+
+func (s *MemoryStore) Ping() error {
+	return nil
+}
+
+func (s *MemoryStore) TakeToken(key string, rate float64, burst int) (bool, int, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	now := time.Now()
+	s.sweep(now)
+	b, ok := s.buckets[key]
+	if !ok || now.After(b.expires) {
+		b = &tokenBucket{tokens: float64(burst), updated: now}
+		s.buckets[key] = b
+	}
+	b.tokens = math.Min(float64(burst), b.tokens+now.Sub(b.updated).Seconds()*rate)
+	b.updated = now
+	b.expires = now.Add(time.Duration(float64(burst) / rate * float64(time.Second)))
+	if b.tokens < 1 {
+		return false, 0, nil
+	}
+	b.tokens--
+	return true, int(b.tokens), nil
+}
@@ -0,0 +1,110 @@
+package store
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestMemoryStore(t *testing.T) {
+	s := NewMemoryStore()
+	assert.Equal(t, nil, s.Set("key", []byte("value"), time.Minute))
+
+	value, err := s.Get("key")
+	assert.Equal(t, nil, err)
+	assert.Equal(t, "value", string(value))
+
+	assert.Equal(t, nil, s.Del("key"))
+	_, err = s.Get("key")
+	assert.Equal(t, ErrNotFound, err)
+
+	assert.Equal(t, nil, s.Set("once", []byte("value"), time.Minute))
+	value, err = s.Take("once")
+	assert.Equal(t, nil, err)
+	assert.Equal(t, "value", string(value))
+	_, err = s.Take("once")
+	assert.Equal(t, ErrNotFound, err)
+
+	ok, err := s.SetNX("lock", []byte("1"), time.Minute)
+	assert.Equal(t, nil, err)
+	assert.Equal(t, true, ok)
+	ok, err = s.SetNX("lock", []byte("2"), time.Minute)
+	assert.Equal(t, nil, err)
+	assert.Equal(t, false, ok)
+
+	assert.Equal(t, nil, s.Set("expired", []byte("value"), -time.Second))
+	_, err = s.Get("expired")
+	assert.Equal(t, ErrNotFound, err)
+
+	assert.Equal(t, nil, s.Set("prefix:b", []byte("value"), time.Minute))
+	assert.Equal(t, nil, s.Set("prefix:a", []byte("value"), time.Minute))
+	assert.Equal(t, nil, s.Set("prefix:expired", []byte("value"), -time.Second))
+	keys, err := s.Keys("prefix:")
+	assert.Equal(t, nil, err)
+	assert.Equal(t, []string{"prefix:a", "prefix:b"}, keys)
+}
+
+func TestNew(t *testing.T) {
+	s, err := New("memory")
+	assert.Equal(t, nil, err)
+	assert.IsType(t, &MemoryStore{}, s)
+
+	s, err = New("redis://localhost:6379/1")
+	assert.Equal(t, nil, err)
+	assert.IsType(t, &RedisStore{}, s)
+
+	_, err = New("memcached://localhost")
+	assert.Equal(t, "unsupported store \"memcached://localhost\"", err.Error())
+}
+
+func TestMemoryStoreTakeToken(t *testing.T) {
+	s := NewMemoryStore()
+	for i := 2; i >= 0; i-- {
+		ok, remaining, err := s.TakeToken("ip:10.0.0.1", 1, 3)
+		assert.Equal(t, nil, err)
+		assert.True(t, ok)
+		assert.Equal(t, i, remaining)
+	}
+	ok, remaining, err := s.TakeToken("ip:10.0.0.1", 1, 3)
+	assert.Equal(t, nil, err)
+	assert.False(t, ok)
+	assert.Equal(t, 0, remaining)
+
+	// other buckets are independent
+	ok, _, _ = s.TakeToken("ip:10.0.0.2", 1, 3)
+	assert.True(t, ok)
+
+	// refilled at the given rate
+	ok, _, _ = s.TakeToken("ip:10.0.0.3", 100, 1)
+	assert.True(t, ok)
+	ok, _, _ = s.TakeToken("ip:10.0.0.3", 100, 1)
+	assert.False(t, ok)
+	time.Sleep(20 * time.Millisecond)
+	ok, _, _ = s.TakeToken("ip:10.0.0.3", 100, 1)
+	assert.True(t, ok)
+
+	// refilled buckets are removed by the next sweep
+	time.Sleep(20 * time.Millisecond)
+	s.swept = time.Time{}
+	s.TakeToken("ip:10.0.0.4", 1, 3)
+	_, ok = s.buckets["ip:10.0.0.3"]
+	assert.False(t, ok)
+	_, ok = s.buckets["ip:10.0.0.1"]
+	assert.True(t, ok)
+}
+
+func TestMemoryStoreIncr(t *testing.T) {
+	s := NewMemoryStore()
+	for i := int64(1); i <= 3; i++ {
+		n, err := s.Incr("failures", time.Minute)
+		assert.Equal(t, nil, err)
+		assert.Equal(t, i, n)
+	}
+	value, _ := s.Get("failures")
+	assert.Equal(t, "3", string(value))
+
+	s.Incr("expired", -time.Second)
+	n, _ := s.Incr("expired", time.Minute)
+	assert.Equal(t, int64(1), n)
+}
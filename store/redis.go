@@ -0,0 +1,137 @@
+package store
+
+import (
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/go-redis/redis"
+)
+
+// keyPrefix namespaces the keys of the proxy in a shared redis database.
+const keyPrefix = "oauth2_proxy:"
+
+// RedisStore keeps values in redis, shared by all replicas using it.
+type RedisStore struct {
+	client *redis.Client
+}
+
+func NewRedisStore(url string) (*RedisStore, error) {
+	opts, err := redis.ParseURL(url)
+	if err != nil {
+		return nil, err
+	}
+	return &RedisStore{client: redis.NewClient(opts)}, nil
+}
+
+func (s *RedisStore) Set(key string, value []byte, expiration time.Duration) error {
+	return s.client.Set(keyPrefix+key, value, expiration).Err()
+}
+
+func (s *RedisStore) SetNX(key string, value []byte, expiration time.Duration) (bool, error) {
+	return s.client.SetNX(keyPrefix+key, value, expiration).Result()
+}
+
+func (s *RedisStore) Get(key string) ([]byte, error) {
+	value, err := s.client.Get(keyPrefix + key).Bytes()
+	if err == redis.Nil {
+		return nil, ErrNotFound
+	}
+	return value, err
+}
+
+// takeScript gets and deletes a key atomically, also on redis versions
+// without GETDEL.
+var takeScript = redis.NewScript(`
+local value = redis.call("GET", KEYS[1])
+if value then
+	redis.call("DEL", KEYS[1])
+end
+return value
+`)
+
+func (s *RedisStore) Take(key string) ([]byte, error) {
+	value, err := takeScript.Run(s.client, []string{keyPrefix + key}).Result()
+	if err == redis.Nil {
+		return nil, ErrNotFound
+	} else if err != nil {
+		return nil, err
+	}
+	v, ok := value.(string)
+	if !ok {
+		return nil, fmt.Errorf("unexpected value %v", value)
+	}
+	return []byte(v), nil
+}
+
+func (s *RedisStore) Del(key string) error {
+	return s.client.Del(keyPrefix + key).Err()
+}
+
+// globEscaper escapes the characters of a redis glob pattern.
+var globEscaper = strings.NewReplacer(`\`, `\\`, `*`, `\*`, `?`, `\?`, `[`, `\[`, `]`, `\]`)
+
+func (s *RedisStore) Keys(prefix string) ([]string, error) {
+	var keys []string
+	iter := s.client.Scan(0, globEscaper.Replace(keyPrefix+prefix)+"*", 100).Iterator()
+	for iter.Next() {
+		keys = append(keys, strings.TrimPrefix(iter.Val(), keyPrefix))
+	}
+	if err := iter.Err(); err != nil {
+		return nil, err
+	}
+	sort.Strings(keys)
+	return keys, nil
+}
+
+func (s *RedisStore) Ping() error {
+	return s.client.Ping().Err()
+}
+
+var incrScript = redis.NewScript(`
+local n = redis.call("INCR", KEYS[1])
+redis.call("PEXPIRE", KEYS[1], ARGV[1])
+return n
+`)
+
+func (s *RedisStore) Incr(key string, expiration time.Duration) (int64, error) {
+	return incrScript.Run(s.client, []string{keyPrefix + key}, int64(expiration/time.Millisecond)).Int64()
+}
+
+// takeTokenScript updates a token bucket atomically, by the clock of the redis
+// server so that replicas with skewed clocks agree; the tokens are returned
+// as a string as redis truncates numbers returned by scripts to integers.
+var takeTokenScript = redis.NewScript(`
+redis.replicate_commands()
+local rate, burst = tonumber(ARGV[1]), tonumber(ARGV[2])
+local t = redis.call("TIME")
+local now = tonumber(t[1]) + tonumber(t[2]) / 1000000
+local bucket = redis.call("HMGET", KEYS[1], "tokens", "updated")
+local tokens = tonumber(bucket[1]) or burst
+local updated = tonumber(bucket[2]) or now
+tokens = math.min(burst, tokens + math.max(0, now - updated) * rate)
+local ok = 0
+if tokens >= 1 then
+	tokens = tokens - 1
+	ok = 1
+end
+redis.call("HMSET", KEYS[1], "tokens", tostring(tokens), "updated", tostring(now))
+redis.call("PEXPIRE", KEYS[1], math.ceil(burst / rate * 1000))
+return {ok, tostring(tokens)}
+`)
+
+func (s *RedisStore) TakeToken(key string, rate float64, burst int) (bool, int, error) {
+	result, err := takeTokenScript.Run(s.client, []string{keyPrefix + key},
+		strconv.FormatFloat(rate, 'f', -1, 64), burst).Result()
+	if err != nil {
+		return false, 0, err
+	}
+	values, ok := result.([]interface{})
+	if !ok || len(values) != 2 {
+		return false, 0, fmt.Errorf("unexpected token bucket result %v", result)
+	}
+	tokens, _ := strconv.ParseFloat(fmt.Sprint(values[1]), 64)
+	return values[0] == int64(1), int(tokens), nil
+}
@@ -0,0 +1,49 @@
+// Package store provides key/value storage shared by the replicas of a proxy
+// deployment, e.g. for OAuth state.
+package store
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+)
+
+// ErrNotFound is returned by Get for missing or expired keys.
+var ErrNotFound = errors.New("not found")
+
+// A Store holds values that expire.
+type Store interface {
+	Set(key string, value []byte, expiration time.Duration) error
+	// SetNX sets the key only if it does not exist yet and reports whether
+	// it did, which makes it usable as a lock.
+	SetNX(key string, value []byte, expiration time.Duration) (bool, error)
+	Get(key string) ([]byte, error)
+	// Take returns the value of the key and deletes it in one step, so that
+	// of concurrent callers only one gets it.
+	Take(key string) ([]byte, error)
+	Del(key string) error
+	// Incr increments the counter at key, which starts at 0, sets it to
+	// expire after expiration and returns its new value.
+	Incr(key string, expiration time.Duration) (int64, error)
+	// Keys returns the keys starting with prefix.
+	Keys(prefix string) ([]string, error)
+	// TakeToken takes a token from the token bucket at key, which holds up
+	// to burst tokens and is refilled at rate tokens per second. It reports
+	// whether a token was available and how many are left.
+	TakeToken(key string, rate float64, burst int) (bool, int, error)
+	// Ping checks the connection to the store.
+	Ping() error
+}
+
+// New returns the store for spec, which is either "memory" (not shared, for
+// a single instance) or a redis://[:password@]host:port[/db] or rediss:// URL.
+func New(spec string) (Store, error) {
+	switch {
+	case spec == "memory":
+		return NewMemoryStore(), nil
+	case strings.HasPrefix(spec, "redis://"), strings.HasPrefix(spec, "rediss://"):
+		return NewRedisStore(spec)
+	}
+	return nil, fmt.Errorf("unsupported store %q", spec)
+}
@@ -0,0 +1,75 @@
+package oauth2proxy
+
+import (
+	"log"
+	"net"
+	"os"
+	"strconv"
+	"time"
+)
+
+// sdNotify sends a state notification (e.g. READY=1) to systemd when running
+// as a Type=notify service; it does nothing otherwise.
+func sdNotify(state string) error {
+	socket := os.Getenv("NOTIFY_SOCKET")
+	if socket == "" {
+		return nil
+	}
+	conn, err := net.DialUnix("unixgram", nil, &net.UnixAddr{Name: socket, Net: "unixgram"})
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	_, err = conn.Write([]byte(state))
+	return err
+}
+
+// sdWatchdogInterval returns the watchdog timeout configured with
+// WatchdogSec= for this process, or 0 if the watchdog is disabled or
+// watched is the pid of another process.
+func sdWatchdogInterval(watched string) time.Duration {
+	usec, err := strconv.Atoi(os.Getenv("WATCHDOG_USEC"))
+	if err != nil || usec <= 0 {
+		return 0
+	}
+	if watched != "" && watched != strconv.Itoa(os.Getpid()) {
+		return 0
+	}
+	return time.Duration(usec) * time.Microsecond
+}
+
+// sdWatchdog keeps the systemd watchdog from firing by sending WATCHDOG=1 at
+// half the configured timeout. If the process hangs, systemd restarts it.
+func sdWatchdog(done <-chan struct{}, watched string) {
+	interval := sdWatchdogInterval(watched)
+	if interval == 0 {
+		return
+	}
+	log.Printf("sending systemd watchdog notifications every %s", interval/2)
+	ticker := time.NewTicker(interval / 2)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-done:
+			return
+		case <-ticker.C:
+			if err := sdNotify("WATCHDOG=1"); err != nil {
+				log.Printf("ERROR: systemd watchdog notification failed - %s", err)
+			}
+		}
+	}
+}
+
+// systemdListenFDs returns the number of sockets passed by systemd socket
+// activation. The variables are left set; restart leaves them out of the
+// environment of the new process.
+func systemdListenFDs() int {
+	if os.Getenv("LISTEN_PID") != strconv.Itoa(os.Getpid()) {
+		return 0
+	}
+	n, err := strconv.Atoi(os.Getenv("LISTEN_FDS"))
+	if err != nil || n < 0 {
+		return 0
+	}
+	return n
+}
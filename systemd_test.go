@@ -0,0 +1,44 @@
+package oauth2proxy
+
+import (
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestSdNotify(t *testing.T) {
+	dir, err := ioutil.TempDir("", "oauth2_proxy_notify")
+	assert.Equal(t, nil, err)
+	defer os.RemoveAll(dir)
+
+	socket := filepath.Join(dir, "notify.sock")
+	conn, err := net.ListenUnixgram("unixgram", &net.UnixAddr{Name: socket, Net: "unixgram"})
+	assert.Equal(t, nil, err)
+	defer conn.Close()
+
+	os.Setenv("NOTIFY_SOCKET", socket)
+	defer os.Unsetenv("NOTIFY_SOCKET")
+	assert.Equal(t, nil, sdNotify("READY=1"))
+
+	buf := make([]byte, 64)
+	conn.SetReadDeadline(time.Now().Add(time.Second))
+	n, err := conn.Read(buf)
+	assert.Equal(t, nil, err)
+	assert.Equal(t, "READY=1", string(buf[:n]))
+}
+
+func TestSdWatchdogInterval(t *testing.T) {
+	defer os.Unsetenv("WATCHDOG_USEC")
+	assert.Equal(t, time.Duration(0), sdWatchdogInterval(""))
+
+	os.Setenv("WATCHDOG_USEC", "30000000")
+	assert.Equal(t, 30*time.Second, sdWatchdogInterval(""))
+	assert.Equal(t, 30*time.Second, sdWatchdogInterval(strconv.Itoa(os.Getpid())))
+	assert.Equal(t, time.Duration(0), sdWatchdogInterval("1"))
+}
@@ -1,21 +1,301 @@
-package main
+package oauth2proxy
 
 import (
+	"fmt"
 	"html/template"
+	"io"
 	"log"
+	"net/http"
+	"os"
 	"path"
+	"regexp"
+	"strings"
 )
 
-func loadTemplates(dir string) *template.Template {
+// staticAssets are served under <proxy-prefix>/static/ for the built-in
+// templates, so that the pages load nothing from elsewhere.
+var staticAssets = map[string]string{
+	"favicon.svg": `<svg xmlns="http://www.w3.org/2000/svg" viewBox="0 0 16 16">
+<rect x="2" y="7" width="12" height="8" rx="1" fill="#428bca"/>
+<path d="M5 7V5a3 3 0 0 1 6 0v2" fill="none" stroke="#428bca" stroke-width="2"/>
+</svg>
+`,
+	"sign_in.css": `body {
+	font-family: "Helvetica Neue",Helvetica,Arial,sans-serif;
+	font-size: 14px;
+	line-height: 1.42857143;
+	color: #333;
+	background: #f0f0f0;
+}
+.signin {
+	display:block;
+	margin:20px auto;
+	max-width:400px;
+	background: #fff;
+	border:1px solid #ccc;
+	border-radius: 10px;
+	padding: 20px;
+}
+.center {
+	text-align:center;
+}
+.btn {
+	color: #fff;
+	background-color: #428bca;
+	border: 1px solid #357ebd;
+	-webkit-border-radius: 4;
+	-moz-border-radius: 4;
+	border-radius: 4px;
+	font-size: 14px;
+	padding: 6px 12px;
+  	text-decoration: none;
+	cursor: pointer;
+}
+
+.btn:hover {
+	background-color: #3071a9;
+	border-color: #285e8e;
+	text-decoration: none;
+}
+label {
+	display: inline-block;
+	max-width: 100%;
+	margin-bottom: 5px;
+	font-weight: 700;
+}
+input {
+	display: block;
+	width: 100%;
+	height: 34px;
+	padding: 6px 12px;
+	font-size: 14px;
+	line-height: 1.42857143;
+	color: #555;
+	background-color: #fff;
+	background-image: none;
+	border: 1px solid #ccc;
+	border-radius: 4px;
+	-webkit-box-shadow: inset 0 1px 1px rgba(0,0,0,.075);
+	box-shadow: inset 0 1px 1px rgba(0,0,0,.075);
+	-webkit-transition: border-color ease-in-out .15s,-webkit-box-shadow ease-in-out .15s;
+	-o-transition: border-color ease-in-out .15s,box-shadow ease-in-out .15s;
+	transition: border-color ease-in-out .15s,box-shadow ease-in-out .15s;
+	margin:0;
+	box-sizing: border-box;
+}
+footer {
+	display:block;
+	font-size:10px;
+	color:#aaa;
+	text-align:center;
+	margin-bottom:10px;
+}
+footer a {
+	display:inline-block;
+	height:25px;
+	line-height:25px;
+	color:#aaa;
+	text-decoration:underline;
+}
+footer a:hover {
+	color:#aaa;
+}
+.banner {
+	margin-bottom:10px;
+}
+.logo {
+	display:block;
+	max-width:100%;
+	max-height:80px;
+	margin:0 auto 10px;
+}
+.provider {
+	margin-bottom:10px;
+}
+.provider-icon {
+	width:16px;
+	height:16px;
+	margin-right:6px;
+	vertical-align:text-bottom;
+}
+.alert {
+	padding:10px;
+	color:#a94442;
+	background-color:#f2dede;
+	border:1px solid #ebccd1;
+	border-radius:4px;
+}
+.notice {
+	padding:10px;
+	color:#8a6d3b;
+	background-color:#fcf8e3;
+	border:1px solid #faebcc;
+	border-radius:4px;
+}
+.terms {
+	text-align:left;
+	max-height:300px;
+	overflow:auto;
+	margin-bottom:10px;
+	padding:0 10px;
+	border:1px solid #ccc;
+	border-radius:4px;
+}
+.other-account {
+	display:block;
+	font-size:12px;
+	margin-bottom:10px;
+}
+`,
+}
+
+// branding customizes the built-in sign in and error pages.
+type branding struct {
+	Name           string
+	LogoURL        string
+	Color          string
+	SupportContact string
+	SupportURL     string // SupportContact as a mailto: or http(s) URL
+}
+
+var brandColorRegex = regexp.MustCompile(`^#([0-9a-fA-F]{3}|[0-9a-fA-F]{6})$`)
+
+func newBranding(o *Options) branding {
+	b := branding{
+		Name:           o.BrandName,
+		LogoURL:        o.BrandLogoURL,
+		Color:          o.BrandColor,
+		SupportContact: o.BrandSupportContact,
+		SupportURL:     o.BrandSupportContact,
+	}
+	if b.SupportContact != "" && !strings.Contains(b.SupportContact, "://") {
+		b.SupportURL = "mailto:" + b.SupportContact
+	}
+	return b
+}
+
+func validateBranding(o *Options, msgs []string) []string {
+	if o.BrandColor != "" && !brandColorRegex.MatchString(o.BrandColor) {
+		msgs = append(msgs, fmt.Sprintf("invalid brand-color %q; must be #rgb or #rrggbb", o.BrandColor))
+	}
+	if o.BrandLogoURL != "" && !validURL(o.BrandLogoURL) {
+		msgs = append(msgs, fmt.Sprintf("invalid brand-logo-url %q; must be an http(s) URL or a path", o.BrandLogoURL))
+	}
+	if c := o.BrandSupportContact; c != "" && !strings.HasPrefix(c, "https://") && !strings.HasPrefix(c, "http://") && !strings.Contains(c, "@") {
+		msgs = append(msgs, fmt.Sprintf("invalid brand-support-contact %q; must be an email address or an http(s) URL", c))
+	}
+	return msgs
+}
+
+// parseHostTemplatesDirs validates the custom template directories of hosts
+// given as host-templates-dir=host=dir.
+func parseHostTemplatesDirs(o *Options, msgs []string) []string {
+	o.templateDirs, o.hostTemplates = nil, nil
+	for _, ht := range o.HostTemplatesDirs {
+		s := strings.SplitN(ht, "=", 2)
+		if len(s) != 2 || s[0] == "" || s[1] == "" {
+			msgs = append(msgs, fmt.Sprintf("invalid host-templates-dir %q; expected host=dir", ht))
+			continue
+		}
+		host := strings.ToLower(s[0])
+		if _, ok := o.templateDirs[host]; ok {
+			msgs = append(msgs, fmt.Sprintf("duplicate host-templates-dir for host %q", host))
+			continue
+		}
+		t, err := parseCustomTemplates(s[1])
+		if err != nil {
+			msgs = append(msgs, fmt.Sprintf("error parsing host-templates-dir=%q: %s", ht, err))
+			continue
+		}
+		if o.templateDirs == nil {
+			o.templateDirs = make(map[string]string)
+			o.hostTemplates = make(map[string]*template.Template)
+		}
+		o.templateDirs[host] = s[1]
+		o.hostTemplates[host] = t
+	}
+	return msgs
+}
+
+// WatchTemplates re-parses the templates in dir, the custom-templates-dir
+// or, for a host, its host-templates-dir, whenever a file in it changes;
+// templates that fail to parse are logged and the previous ones are kept.
+func (p *OAuthProxy) WatchTemplates(host, dir string, done <-chan bool) error {
+	return WatchDirForUpdates(dir, done, func() {
+		t, err := parseCustomTemplates(dir)
+		if err != nil {
+			log.Printf("error reloading templates from %s: %s", dir, err)
+			return
+		}
+		p.templatesMu.Lock()
+		if host == "" {
+			p.templates = t
+		} else {
+			p.hostTemplates[host] = t
+		}
+		p.templatesMu.Unlock()
+		log.Printf("reloaded templates from %s", dir)
+	})
+}
+
+// executeTemplate renders the page template name for the host of req,
+// logging errors in it.
+func (p *OAuthProxy) executeTemplate(w io.Writer, req *http.Request, name string, data interface{}) {
+	p.templatesMu.RLock()
+	t := p.templates
+	if req != nil {
+		if ht, ok := p.hostTemplates[requestHost(req)]; ok {
+			t = ht
+		}
+	}
+	p.templatesMu.RUnlock()
+	if err := t.ExecuteTemplate(w, name, data); err != nil {
+		log.Printf("error rendering template %s: %s", name, err)
+	}
+}
+
+// requestHost returns the host of req without the port, in lower case.
+func requestHost(req *http.Request) string {
+	return strings.ToLower(stripPort(req.Host))
+}
+
+// customStaticDir returns the static directory of a custom template
+// directory, if there is one.
+func customStaticDir(dir string) string {
 	if dir == "" {
-		return getTemplates()
+		return ""
 	}
-	log.Printf("using custom template directory %q", dir)
-	t, err := template.New("").ParseFiles(path.Join(dir, "sign_in.html"), path.Join(dir, "error.html"))
-	if err != nil {
-		log.Fatalf("failed parsing template %s", err)
+	static := path.Join(dir, "static")
+	if fi, err := os.Stat(static); err != nil || !fi.IsDir() {
+		return ""
 	}
-	return t
+	return static
+}
+
+// parseCustomTemplates overrides the built-in templates with the page
+// templates in dir; any of them may be left out.
+func parseCustomTemplates(dir string) (*template.Template, error) {
+	if fi, err := os.Stat(dir); err != nil {
+		return nil, err
+	} else if !fi.IsDir() {
+		return nil, fmt.Errorf("%s is not a directory", dir)
+	}
+	t := getTemplates()
+	found := false
+	for _, name := range []string{"sign_in.html", "error.html", "forbidden.html", "sign_out.html", "signed_out.html", "device.html", "terms.html", "maintenance.html"} {
+		file := path.Join(dir, name)
+		if _, err := os.Stat(file); os.IsNotExist(err) {
+			continue
+		}
+		if _, err := t.ParseFiles(file); err != nil {
+			return nil, err
+		}
+		found = true
+	}
+	if !found {
+		return nil, fmt.Errorf("none of sign_in.html, error.html, forbidden.html, sign_out.html, signed_out.html, device.html, terms.html and maintenance.html found in %s", dir)
+	}
+	return t, nil
 }
 
 func getTemplates() *template.Template {
@@ -23,99 +303,53 @@ func getTemplates() *template.Template {
 <!DOCTYPE html>
 <html lang="en" charset="utf-8">
 <head>
-	<title>Sign In</title>
+	<title>Sign In{{ if .Brand.Name }} to {{.Brand.Name}}{{ end }}</title>
 	<meta name="viewport" content="width=device-width, initial-scale=1, maximum-scale=1, user-scalable=no">
-	<style>
-	body {
-		font-family: "Helvetica Neue",Helvetica,Arial,sans-serif;
-		font-size: 14px;
-		line-height: 1.42857143;
-		color: #333;
-		background: #f0f0f0;
-	}
-	.signin {
-		display:block;
-		margin:20px auto;
-		max-width:400px;
-		background: #fff;
-		border:1px solid #ccc;
-		border-radius: 10px;
-		padding: 20px;
-	}
-	.center {
-		text-align:center;
-	}
-	.btn {
-		color: #fff;
-		background-color: #428bca;
-		border: 1px solid #357ebd;
-		-webkit-border-radius: 4;
-		-moz-border-radius: 4;
-		border-radius: 4px;
-		font-size: 14px;
-		padding: 6px 12px;
-	  	text-decoration: none;
-		cursor: pointer;
-	}
-
-	.btn:hover {
-		background-color: #3071a9;
-		border-color: #285e8e;
-		text-decoration: none;
-	}
-	label {
-		display: inline-block;
-		max-width: 100%;
-		margin-bottom: 5px;
-		font-weight: 700;
-	}
-	input {
-		display: block;
-		width: 100%;
-		height: 34px;
-		padding: 6px 12px;
-		font-size: 14px;
-		line-height: 1.42857143;
-		color: #555;
-		background-color: #fff;
-		background-image: none;
-		border: 1px solid #ccc;
-		border-radius: 4px;
-		-webkit-box-shadow: inset 0 1px 1px rgba(0,0,0,.075);
-		box-shadow: inset 0 1px 1px rgba(0,0,0,.075);
-		-webkit-transition: border-color ease-in-out .15s,-webkit-box-shadow ease-in-out .15s;
-		-o-transition: border-color ease-in-out .15s,box-shadow ease-in-out .15s;
-		transition: border-color ease-in-out .15s,box-shadow ease-in-out .15s;
-		margin:0;
-		box-sizing: border-box;
-	}
-	footer {
-		display:block;
-		font-size:10px;
-		color:#aaa;
-		text-align:center;
-		margin-bottom:10px;
-	}
-	footer a {
-		display:inline-block;
-		height:25px;
-		line-height:25px;
-		color:#aaa;
-		text-decoration:underline;
-	}
-	footer a:hover {
-		color:#aaa;
-	}
+	<link rel="icon" href="{{.ProxyPrefix}}/static/favicon.svg">
+	<link rel="stylesheet" href="{{.ProxyPrefix}}/static/sign_in.css">
+	{{ if .Brand.Color }}
+	<style nonce="{{.CSPNonce}}">
+		.btn, .btn:hover { background-color: {{.Brand.Color}}; border-color: {{.Brand.Color}}; }
 	</style>
+	{{ end }}
 </head>
 <body>
 	<div class="signin center">
+	{{ if .Brand.LogoURL }}
+	<img class="logo" src="{{.Brand.LogoURL}}" alt="{{.Brand.Name}}">
+	{{ end }}
+	{{ if .Brand.Name }}
+	<h2>{{.Brand.Name}}</h2>
+	{{ end }}
+	{{ if .Notice }}
+	<p class="notice" role="status">{{.Notice}}</p>
+	{{ end }}
+	{{ if .Error }}
+	<p class="alert" role="alert">{{.Error}}</p>
+	{{ end }}
 	<form method="GET" action="{{.ProxyPrefix}}/start">
 	<input type="hidden" name="rd" value="{{.Redirect}}">
+	{{ if eq .Banner "-" }}
+	{{ else if eq .Banner "" }}
 	{{ if .SignInMessage }}
 	<p>{{.SignInMessage}}</p>
-	{{ end}}
+	{{ end }}
+	{{ else }}
+	<div class="banner">{{.Banner}}</div>
+	{{ end }}
+	{{ if .Providers }}
+	{{ range .Providers }}
+	<button type="submit" class="btn provider" name="provider" value="{{.Name}}">
+	{{ if .IconURL }}<img class="provider-icon" src="{{.IconURL}}" alt="">{{ end }}
+	Sign in with {{.Label}}
+	</button><br/>
+	{{ end }}
+	{{ if .Remembered }}
+	<a class="other-account" href="{{.ProxyPrefix}}/sign_in?choose_provider=1&amp;rd={{.Redirect}}">Use a different account</a>
+	{{ end }}
+	{{ else }}
 	<button type="submit" class="btn">Sign in with {{.ProviderName}}</button><br/>
+	{{ end }}
 	</form>
 	</div>
 
@@ -129,7 +363,10 @@ func getTemplates() *template.Template {
 	</form>
 	</div>
 	{{ end }}
-	<script>
+	{{ if .Brand.SupportContact }}
+	<p class="center">Trouble signing in? Contact <a href="{{.Brand.SupportURL}}">{{.Brand.SupportContact}}</a>.</p>
+	{{ end }}
+	<script nonce="{{.CSPNonce}}">
 		if (window.location.hash) {
 			(function() {
 				var inputs = document.getElementsByName('rd');
@@ -160,12 +397,246 @@ func getTemplates() *template.Template {
 <head>
 	<title>{{.Title}}</title>
 	<meta name="viewport" content="width=device-width, initial-scale=1, maximum-scale=1, user-scalable=no">
+	<link rel="icon" href="{{.ProxyPrefix}}/static/favicon.svg">
+	{{ if .Brand.Color }}
+	<style nonce="{{.CSPNonce}}">
+		h2, a { color: {{.Brand.Color}}; }
+	</style>
+	{{ end }}
+</head>
+<body>
+	{{ if .Brand.LogoURL }}
+	<img src="{{.Brand.LogoURL}}" alt="{{.Brand.Name}}" height="60">
+	{{ end }}
+	<h2>{{.Title}}</h2>
+	<p>{{.Message}}</p>
+	<hr>
+	<p><a href="{{.ProxyPrefix}}/sign_in">Sign In{{ if .Brand.Name }} to {{.Brand.Name}}{{ end }}</a></p>
+	{{ if .Brand.SupportContact }}
+	<p>Need help? Contact <a href="{{.Brand.SupportURL}}">{{.Brand.SupportContact}}</a>.</p>
+	{{ end }}
+</body>
+</html>{{end}}`)
+	if err != nil {
+		log.Fatalf("failed parsing template %s", err)
+	}
+
+	t, err = t.Parse(`{{define "forbidden.html"}}
+<!DOCTYPE html>
+<html lang="en" charset="utf-8">
+<head>
+	<title>{{.Title}}</title>
+	<meta name="viewport" content="width=device-width, initial-scale=1, maximum-scale=1, user-scalable=no">
+	<link rel="icon" href="{{.ProxyPrefix}}/static/favicon.svg">
+	{{ if .Brand.Color }}
+	<style nonce="{{.CSPNonce}}">
+		h2, a { color: {{.Brand.Color}}; }
+	</style>
+	{{ end }}
 </head>
 <body>
+	{{ if .Brand.LogoURL }}
+	<img src="{{.Brand.LogoURL}}" alt="{{.Brand.Name}}" height="60">
+	{{ end }}
 	<h2>{{.Title}}</h2>
+	<p>You are signed in as <b>{{.Identity}}</b>.</p>
+	<p>{{.Message}}</p>
+	<p><small>Reason: <code>{{.Reason}}</code></small></p>
+	<hr>
+	<p><a href="{{.ProxyPrefix}}/sign_in?choose_provider=1">Sign in with a different account</a></p>
+	{{ if .Brand.SupportContact }}
+	<p>Need help? Contact <a href="{{.Brand.SupportURL}}">{{.Brand.SupportContact}}</a> and mention the reason above.</p>
+	{{ end }}
+</body>
+</html>{{end}}`)
+	if err != nil {
+		log.Fatalf("failed parsing template %s", err)
+	}
+
+	t, err = t.Parse(`{{define "sign_out.html"}}
+<!DOCTYPE html>
+<html lang="en" charset="utf-8">
+<head>
+	<title>Sign Out{{ if .Brand.Name }} of {{.Brand.Name}}{{ end }}</title>
+	<meta name="viewport" content="width=device-width, initial-scale=1, maximum-scale=1, user-scalable=no">
+	<link rel="icon" href="{{.ProxyPrefix}}/static/favicon.svg">
+	<link rel="stylesheet" href="{{.ProxyPrefix}}/static/sign_in.css">
+	{{ if .Brand.Color }}
+	<style nonce="{{.CSPNonce}}">
+		.btn, .btn:hover { background-color: {{.Brand.Color}}; border-color: {{.Brand.Color}}; }
+	</style>
+	{{ end }}
+</head>
+<body>
+	<div class="signin center">
+	{{ if .Brand.LogoURL }}
+	<img class="logo" src="{{.Brand.LogoURL}}" alt="{{.Brand.Name}}">
+	{{ end }}
+	<p>You are signed in as <b>{{.Identity}}</b>.</p>
+	<form method="POST" action="{{.ProxyPrefix}}/sign_out">
+	<input type="hidden" name="csrf_token" value="{{.CSRFToken}}">
+	{{ if .Redirect }}<input type="hidden" name="rd" value="{{.Redirect}}">{{ end }}
+	<button type="submit" class="btn">Sign out{{ if .Brand.Name }} of {{.Brand.Name}}{{ end }}</button><br/>
+	</form>
+	<a href="{{.Cancel}}">Cancel</a>
+	</div>
+</body>
+</html>{{end}}`)
+	if err != nil {
+		log.Fatalf("failed parsing template %s", err)
+	}
+
+	t, err = t.Parse(`{{define "signed_out.html"}}
+<!DOCTYPE html>
+<html lang="en" charset="utf-8">
+<head>
+	<title>Signed Out{{ if .Brand.Name }} of {{.Brand.Name}}{{ end }}</title>
+	<meta name="viewport" content="width=device-width, initial-scale=1, maximum-scale=1, user-scalable=no">
+	<link rel="icon" href="{{.ProxyPrefix}}/static/favicon.svg">
+	<link rel="stylesheet" href="{{.ProxyPrefix}}/static/sign_in.css">
+</head>
+<body>
+	<div class="signin center">
+	{{ if .Brand.LogoURL }}
+	<img class="logo" src="{{.Brand.LogoURL}}" alt="{{.Brand.Name}}">
+	{{ end }}
+	<p>You have been signed out{{ if .Brand.Name }} of {{.Brand.Name}}{{ end }}.</p>
+	<p><a href="{{.ProxyPrefix}}/sign_in">Sign in again</a></p>
+	</div>
+</body>
+</html>{{end}}`)
+	if err != nil {
+		log.Fatalf("failed parsing template %s", err)
+	}
+
+	t, err = t.Parse(`{{define "device.html"}}
+<!DOCTYPE html>
+<html lang="en" charset="utf-8">
+<head>
+	<title>Sign In a Device{{ if .Brand.Name }} to {{.Brand.Name}}{{ end }}</title>
+	<meta name="viewport" content="width=device-width, initial-scale=1, maximum-scale=1, user-scalable=no">
+	<link rel="icon" href="{{.ProxyPrefix}}/static/favicon.svg">
+	<link rel="stylesheet" href="{{.ProxyPrefix}}/static/sign_in.css">
+	{{ if .Brand.Color }}
+	<style nonce="{{.CSPNonce}}">
+		.btn, .btn:hover { background-color: {{.Brand.Color}}; border-color: {{.Brand.Color}}; }
+	</style>
+	{{ end }}
+</head>
+<body>
+	<div class="signin center">
+	{{ if .Brand.LogoURL }}
+	<img class="logo" src="{{.Brand.LogoURL}}" alt="{{.Brand.Name}}">
+	{{ end }}
+	{{ if .Message }}<p{{ if not .Done }} class="alert" role="alert"{{ end }}>{{.Message}}</p>{{ end }}
+	{{ if not .Done }}
+	<p>Enter the code shown by the device to sign it in as <b>{{.Identity}}</b>.</p>
+	<form method="POST" action="{{.ProxyPrefix}}/device">
+	<input type="hidden" name="csrf_token" value="{{.CSRFToken}}">
+	<input type="text" name="user_code" value="{{.UserCode}}" placeholder="XXXX-XXXX" autocomplete="off" autocapitalize="characters" required autofocus><br/>
+	<button type="submit" name="approve" value="1" class="btn">Sign in the device</button><br/>
+	<button type="submit" name="deny" value="1">Deny</button>
+	</form>
+	{{ end }}
+	</div>
+</body>
+</html>{{end}}`)
+	if err != nil {
+		log.Fatalf("failed parsing template %s", err)
+	}
+
+	t, err = t.Parse(`{{define "terms.html"}}
+<!DOCTYPE html>
+<html lang="en" charset="utf-8">
+<head>
+	<title>Terms of Use{{ if .Brand.Name }} of {{.Brand.Name}}{{ end }}</title>
+	<meta name="viewport" content="width=device-width, initial-scale=1, maximum-scale=1, user-scalable=no">
+	<link rel="icon" href="{{.ProxyPrefix}}/static/favicon.svg">
+	<link rel="stylesheet" href="{{.ProxyPrefix}}/static/sign_in.css">
+	{{ if .Brand.Color }}
+	<style nonce="{{.CSPNonce}}">
+		.btn, .btn:hover { background-color: {{.Brand.Color}}; border-color: {{.Brand.Color}}; }
+	</style>
+	{{ end }}
+</head>
+<body>
+	<div class="signin center">
+	{{ if .Brand.LogoURL }}
+	<img class="logo" src="{{.Brand.LogoURL}}" alt="{{.Brand.Name}}">
+	{{ end }}
+	<p>You are signed in as <b>{{.Identity}}</b>. Please read and accept the terms of use to continue.</p>
+	<div class="terms">{{.Terms}}</div>
+	<form method="POST" action="{{.ProxyPrefix}}/terms">
+	<input type="hidden" name="csrf_token" value="{{.CSRFToken}}">
+	<input type="hidden" name="rd" value="{{.Redirect}}">
+	<button type="submit" name="accept" value="1" class="btn">I accept</button>
+	</form>
+	</div>
+</body>
+</html>{{end}}`)
+	if err != nil {
+		log.Fatalf("failed parsing template %s", err)
+	}
+
+	t, err = t.Parse(`{{define "maintenance.html"}}
+<!DOCTYPE html>
+<html lang="en" charset="utf-8">
+<head>
+	<title>{{.Title}}</title>
+	<meta name="viewport" content="width=device-width, initial-scale=1, maximum-scale=1, user-scalable=no">
+	<link rel="icon" href="{{.ProxyPrefix}}/static/favicon.svg">
+	{{ if .Brand.Color }}
+	<style nonce="{{.CSPNonce}}">
+		h2, a { color: {{.Brand.Color}}; }
+	</style>
+	{{ end }}
+</head>
+<body>
+	{{ if .Brand.LogoURL }}
+	<img src="{{.Brand.LogoURL}}" alt="{{.Brand.Name}}" height="60">
+	{{ end }}
+	<h2>{{ if .Brand.Name }}{{.Brand.Name}} is {{ else }}We are {{ end }}down for maintenance</h2>
+	{{ if .Message }}
 	<p>{{.Message}}</p>
+	{{ else }}
+	<p>Please try again in a few minutes.</p>
+	{{ end }}
+	{{ if .Brand.SupportContact }}
 	<hr>
-	<p><a href="{{.ProxyPrefix}}/sign_in">Sign In</a></p>
+	<p>Need help? Contact <a href="{{.Brand.SupportURL}}">{{.Brand.SupportContact}}</a>.</p>
+	{{ end }}
+</body>
+</html>{{end}}`)
+	if err != nil {
+		log.Fatalf("failed parsing template %s", err)
+	}
+
+	t, err = t.Parse(`{{define "resubmit.html"}}
+<!DOCTYPE html>
+<html lang="en" charset="utf-8">
+<head>
+	<title>Re-submit Form</title>
+	<meta name="viewport" content="width=device-width, initial-scale=1, maximum-scale=1, user-scalable=no">
+	<link rel="icon" href="{{.ProxyPrefix}}/static/favicon.svg">
+	{{ if .Brand.Color }}
+	<style nonce="{{.CSPNonce}}">
+		h2, a { color: {{.Brand.Color}}; }
+	</style>
+	{{ end }}
+</head>
+<body>
+	{{ if .Brand.LogoURL }}
+	<img src="{{.Brand.LogoURL}}" alt="{{.Brand.Name}}" height="60">
+	{{ end }}
+	<h2>Re-submit Form</h2>
+	<p>You were signed out when you submitted a form to <code>{{.URL}}</code>. Do you want to submit it again?</p>
+	<form method="POST" action="{{.URL}}">
+	{{ range .Fields }}
+	<input type="hidden" name="{{.Name}}" value="{{.Value}}">
+	{{ end }}
+	<button type="submit">Re-submit</button>
+	<a href="{{.URL}}">Cancel</a>
+	</form>
 </body>
 </html>{{end}}`)
 	if err != nil {
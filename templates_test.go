@@ -1,6 +1,12 @@
-package main
+package oauth2proxy
 
 import (
+	"bytes"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path"
 	"testing"
 
 	"github.com/stretchr/testify/assert"
@@ -10,3 +16,131 @@ func TestTemplatesCompile(t *testing.T) {
 	templates := getTemplates()
 	assert.NotEqual(t, templates, nil)
 }
+
+func TestCustomTemplates(t *testing.T) {
+	dir, err := ioutil.TempDir("", "templates")
+	assert.Equal(t, nil, err)
+	defer os.RemoveAll(dir)
+
+	_, err = parseCustomTemplates(dir)
+	assert.NotEqual(t, nil, err)
+
+	ioutil.WriteFile(path.Join(dir, "error.html"), []byte(`{{define "error.html"}}Oops: {{.Title}}{{end}}`), 0644)
+	templates, err := parseCustomTemplates(dir)
+	assert.Equal(t, nil, err)
+
+	var b bytes.Buffer
+	assert.Equal(t, nil, templates.ExecuteTemplate(&b, "error.html", map[string]string{"Title": "403 Permission Denied"}))
+	assert.Equal(t, "Oops: 403 Permission Denied", b.String())
+	// the built-in sign in page is kept
+	assert.NotEqual(t, nil, templates.Lookup("sign_in.html"))
+
+	ioutil.WriteFile(path.Join(dir, "sign_in.html"), []byte(`{{define "sign_in.html"}}{{.Unclosed}`), 0644)
+	_, err = parseCustomTemplates(dir)
+	assert.NotEqual(t, nil, err)
+}
+
+func TestBranding(t *testing.T) {
+	opts := testOptions()
+	opts.BrandName = "Acme Intranet"
+	opts.BrandLogoURL = "https://cdn.acme.com/logo.png"
+	opts.BrandColor = "#ff6600"
+	opts.BrandSupportContact = "helpdesk@acme.com"
+	assert.Equal(t, nil, opts.Validate())
+	proxy := newOAuthProxy(opts, func(string) bool { return true })
+
+	rw := httptest.NewRecorder()
+	req, _ := http.NewRequest("GET", "/oauth2/sign_in", nil)
+	proxy.ServeHTTP(rw, req)
+	assert.Equal(t, 200, rw.Code)
+	body := rw.Body.String()
+	assert.Contains(t, body, "<title>Sign In to Acme Intranet</title>")
+	assert.Contains(t, body, `<img class="logo" src="https://cdn.acme.com/logo.png" alt="Acme Intranet">`)
+	assert.Contains(t, body, "background-color: #ff6600;")
+	assert.Contains(t, body, `<a href="mailto:helpdesk@acme.com">helpdesk@acme.com</a>`)
+	assert.Contains(t, rw.Header().Get("Content-Security-Policy"), "img-src 'self' https://cdn.acme.com;")
+
+	rw = httptest.NewRecorder()
+	proxy.errorPage(rw, req, 403, "Permission Denied", "Invalid Account")
+	assert.Contains(t, rw.Body.String(), "Need help? Contact")
+
+	opts.BrandColor = "red; background: url(x)"
+	opts.BrandLogoURL = "javascript:alert(1)"
+	opts.BrandSupportContact = "call us"
+	err := opts.Validate()
+	assert.NotEqual(t, nil, err)
+	assert.Contains(t, err.Error(), "invalid brand-color")
+	assert.Contains(t, err.Error(), "invalid brand-logo-url")
+	assert.Contains(t, err.Error(), "invalid brand-support-contact")
+}
+
+func TestBanner(t *testing.T) {
+	signIn := func(banner string) string {
+		opts := testOptions()
+		opts.Banner = banner
+		opts.Footer = "-"
+		assert.Equal(t, nil, opts.Validate())
+		proxy := newOAuthProxy(opts, func(string) bool { return true })
+		proxy.SignInMessage = "Authenticate using example.com"
+		rw := httptest.NewRecorder()
+		req, _ := http.NewRequest("GET", "/oauth2/sign_in", nil)
+		proxy.ServeHTTP(rw, req)
+		return rw.Body.String()
+	}
+
+	body := signIn("")
+	assert.Contains(t, body, "<p>Authenticate using example.com</p>")
+	assert.NotContains(t, body, "Secured with")
+
+	body = signIn("<b>Authorized users only.</b>")
+	assert.Contains(t, body, `<div class="banner"><b>Authorized users only.</b></div>`)
+	assert.NotContains(t, body, "Authenticate using")
+
+	body = signIn("-")
+	assert.NotContains(t, body, "banner")
+	assert.NotContains(t, body, "Authenticate using")
+}
+
+func TestHostTemplates(t *testing.T) {
+	dir, err := ioutil.TempDir("", "templates")
+	assert.Equal(t, nil, err)
+	defer os.RemoveAll(dir)
+	ioutil.WriteFile(path.Join(dir, "error.html"), []byte(`Acme: {{.Title}}`), 0644)
+	os.Mkdir(path.Join(dir, "static"), 0755)
+	ioutil.WriteFile(path.Join(dir, "static", "sign_in.css"), []byte(`body { color: orange; }`), 0644)
+
+	opts := testOptions()
+	opts.HostTemplatesDirs = []string{"Acme.example.com=" + dir}
+	assert.Equal(t, nil, opts.Validate())
+	proxy := newOAuthProxy(opts, func(string) bool { return true })
+
+	get := func(host, path string) string {
+		rw := httptest.NewRecorder()
+		req, _ := http.NewRequest("GET", path, nil)
+		req.Host = host
+		if path == "" {
+			proxy.errorPage(rw, req, 500, "Internal Error", "")
+		} else {
+			proxy.ServeHTTP(rw, req)
+		}
+		return rw.Body.String()
+	}
+	assert.Equal(t, "Acme: 500 Internal Error", get("acme.example.com:8443", ""))
+	assert.Equal(t, "body { color: orange; }", get("acme.example.com", "/oauth2/static/sign_in.css"))
+	// the built-in templates and assets are kept for other hosts and pages
+	assert.Contains(t, get("other.example.com", ""), "<title>500 Internal Error</title>")
+	assert.Contains(t, get("other.example.com", "/oauth2/static/sign_in.css"), "font-family")
+	assert.Contains(t, get("acme.example.com", "/oauth2/sign_in"), "<title>Sign In</title>")
+	// ErrorPage has no request, so it renders the built-in templates
+	rw := httptest.NewRecorder()
+	proxy.ErrorPage(rw, 500, "Internal Error", "")
+	assert.Contains(t, rw.Body.String(), "<title>500 Internal Error</title>")
+
+	opts = testOptions()
+	opts.HostTemplatesDirs = []string{"acme.example.com", "acme.example.com=" + dir, "ACME.example.com=" + dir, "other.example.com=" + path.Join(dir, "missing")}
+	err = opts.Validate()
+	assert.NotEqual(t, nil, err)
+	assert.Contains(t, err.Error(), `invalid host-templates-dir "acme.example.com"; expected host=dir`)
+	assert.Contains(t, err.Error(), `duplicate host-templates-dir for host "acme.example.com"`)
+	assert.Contains(t, err.Error(), `error parsing host-templates-dir="other.example.com=`)
+}
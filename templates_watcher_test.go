@@ -0,0 +1,72 @@
+// +build go1.3,!plan9,!solaris
+
+package oauth2proxy
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestWatchTemplates(t *testing.T) {
+	dir, err := ioutil.TempDir("", "templates")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	file := filepath.Join(dir, "error.html")
+	write := func(content string) {
+		if err := ioutil.WriteFile(file, []byte(content), 0600); err != nil {
+			t.Fatal(err)
+		}
+	}
+	write(`first {{.Title}}`)
+
+	opts := testOptions()
+	opts.CustomTemplatesDir = dir
+	opts.TemplatesWatch = true
+	assert.Equal(t, nil, opts.Validate())
+	proxy := newOAuthProxy(opts, func(string) bool { return true })
+	done := make(chan bool)
+	defer close(done)
+	assert.Equal(t, nil, proxy.WatchTemplates("", dir, done))
+
+	errorPage := func() string {
+		rw := httptest.NewRecorder()
+		req, _ := http.NewRequest("GET", "/", nil)
+		proxy.errorPage(rw, req, 500, "Internal Error", "")
+		return rw.Body.String()
+	}
+	waitFor := func(prefix string) {
+		for deadline := time.Now().Add(5 * time.Second); time.Now().Before(deadline); time.Sleep(20 * time.Millisecond) {
+			if strings.HasPrefix(errorPage(), prefix) {
+				return
+			}
+		}
+		t.Fatalf("template not reloaded: %q", errorPage())
+	}
+	assert.Equal(t, "first 500 Internal Error", errorPage())
+
+	write(`second {{.Title}}`)
+	waitFor("second")
+
+	// a broken template keeps the previous one
+	write(`third {{.Title`)
+	time.Sleep(300 * time.Millisecond)
+	assert.Equal(t, "second 500 Internal Error", errorPage())
+	write(`fourth {{.Title}}`)
+	waitFor("fourth")
+}
+
+func TestTemplatesWatchRequiresDir(t *testing.T) {
+	opts := testOptions()
+	opts.TemplatesWatch = true
+	assert.Equal(t, errorMsg([]string{"templates-watch requires custom-templates-dir or host-templates-dir"}), opts.Validate().Error())
+}
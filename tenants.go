@@ -0,0 +1,142 @@
+package oauth2proxy
+
+import (
+	"flag"
+	"fmt"
+	"net"
+	"net/http"
+	"strings"
+
+	"github.com/mreiferson/go-options"
+)
+
+// A Tenant is an isolated set of options (upstreams, provider, cookie and
+// authorization rules) served for its own hosts by a single proxy.
+type Tenant struct {
+	Name  string
+	Hosts []string
+	Opts  *Options
+
+	cfg EnvOptions
+}
+
+// Tenants returns the options for each [[tenant]] block of a config file.
+// Settings outside of the tenant blocks (and the environment) are inherited
+// by every tenant; flags given on the command line apply to all of them.
+func (cfg EnvOptions) Tenants(flagSet *flag.FlagSet) ([]*Tenant, error) {
+	blocks, ok := cfg["tenant"]
+	if !ok {
+		return nil, nil
+	}
+	list, ok := blocks.([]map[string]interface{})
+	if !ok {
+		return nil, fmt.Errorf("tenant must be a list of [[tenant]] tables")
+	}
+
+	var tenants []*Tenant
+	for i, block := range list {
+		tcfg := make(EnvOptions)
+		t := &Tenant{Name: fmt.Sprintf("tenant %d", i+1), cfg: tcfg}
+		for k, v := range cfg {
+			if k != "tenant" {
+				tcfg[k] = v
+			}
+		}
+		for k, v := range block {
+			switch k {
+			case "name":
+				name, ok := v.(string)
+				if !ok {
+					return nil, fmt.Errorf("%s: name must be a string", t.Name)
+				}
+				t.Name = name
+			case "hosts":
+				hosts, ok := v.([]interface{})
+				if !ok {
+					return nil, fmt.Errorf("%s: hosts must be a list of strings", t.Name)
+				}
+				for _, h := range hosts {
+					host, ok := h.(string)
+					if !ok {
+						return nil, fmt.Errorf("%s: hosts must be a list of strings", t.Name)
+					}
+					t.Hosts = append(t.Hosts, strings.ToLower(host))
+				}
+			default:
+				tcfg[k] = v
+			}
+		}
+		t.Opts = NewOptions()
+		options.Resolve(t.Opts, flagSet, tcfg)
+		tenants = append(tenants, t)
+	}
+	return tenants, nil
+}
+
+// ValidateTenants validates the options of every tenant and checks that
+// tenants do not share hosts or session cookies.
+func ValidateTenants(tenants []*Tenant) error {
+	msgs := make([]string, 0)
+	hosts := make(map[string]string)
+	cookies := make(map[string]string)
+	for _, t := range tenants {
+		if t.Opts.MetricsAddress != "" {
+			msgs = append(msgs, "metrics-address cannot be used with tenants; scrape the /oauth2/admin/metrics of each tenant")
+			break
+		}
+	}
+	for _, t := range tenants {
+		if err := t.Opts.Validate(); err != nil {
+			errs := strings.TrimPrefix(err.Error(), "Invalid configuration:\n  ")
+			for _, m := range strings.Split(errs, "\n  ") {
+				msgs = append(msgs, fmt.Sprintf("tenant %q: %s", t.Name, m))
+			}
+		}
+		if len(t.Hosts) == 0 {
+			msgs = append(msgs, fmt.Sprintf("tenant %q: missing setting: hosts", t.Name))
+		}
+		for _, h := range t.Hosts {
+			if other, ok := hosts[h]; ok {
+				msgs = append(msgs, fmt.Sprintf("tenant %q: host %q is already served by tenant %q", t.Name, h, other))
+				continue
+			}
+			hosts[h] = t.Name
+		}
+		if t.Opts.CookieDomain != "" {
+			key := t.Opts.CookieDomain + " " + t.Opts.CookieName
+			if other, ok := cookies[key]; ok {
+				msgs = append(msgs, fmt.Sprintf("tenant %q: cookie %q for domain %q is already used by tenant %q", t.Name, t.Opts.CookieName, t.Opts.CookieDomain, other))
+				continue
+			}
+			cookies[key] = t.Name
+		}
+	}
+	if len(msgs) != 0 {
+		return fmt.Errorf("Invalid tenant configuration:\n  %s",
+			strings.Join(msgs, "\n  "))
+	}
+	return nil
+}
+
+// TenantMux dispatches requests to the handler of the tenant serving the
+// request host.
+type TenantMux map[string]http.Handler
+
+func (m TenantMux) Handle(t *Tenant, handler http.Handler) {
+	for _, h := range t.Hosts {
+		m[h] = handler
+	}
+}
+
+func (m TenantMux) ServeHTTP(rw http.ResponseWriter, req *http.Request) {
+	host := req.Host
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		host = h
+	}
+	handler, ok := m[strings.ToLower(host)]
+	if !ok {
+		http.NotFound(rw, req)
+		return
+	}
+	handler.ServeHTTP(rw, req)
+}
@@ -0,0 +1,46 @@
+package oauth2proxy
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestValidateTenants(t *testing.T) {
+	a := &Tenant{Name: "a", Hosts: []string{"a.example.com"}, Opts: testOptions()}
+	b := &Tenant{Name: "b", Hosts: []string{"b.example.com"}, Opts: testOptions()}
+	assert.Equal(t, nil, ValidateTenants([]*Tenant{a, b}))
+
+	b.Hosts = append(b.Hosts, "a.example.com")
+	b.Opts.ClientID = ""
+	a.Opts.CookieDomain = ".example.com"
+	b.Opts.CookieDomain = ".example.com"
+	err := ValidateTenants([]*Tenant{a, b})
+	assert.NotEqual(t, nil, err)
+	assert.Equal(t, "Invalid tenant configuration:\n"+
+		"  tenant \"b\": missing setting: client-id\n"+
+		"  tenant \"b\": host \"a.example.com\" is already served by tenant \"a\"\n"+
+		"  tenant \"b\": cookie \"_oauth2_proxy\" for domain \".example.com\" is already used by tenant \"a\"",
+		err.Error())
+}
+
+func TestTenantMux(t *testing.T) {
+	mux := make(TenantMux)
+	mux.Handle(&Tenant{Hosts: []string{"a.example.com"}},
+		http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+			rw.Write([]byte("tenant a"))
+		}))
+
+	rw := httptest.NewRecorder()
+	req, _ := http.NewRequest("GET", "http://A.example.com:8080/", nil)
+	mux.ServeHTTP(rw, req)
+	assert.Equal(t, 200, rw.Code)
+	assert.Equal(t, "tenant a", rw.Body.String())
+
+	rw = httptest.NewRecorder()
+	req, _ = http.NewRequest("GET", "http://b.example.com/", nil)
+	mux.ServeHTTP(rw, req)
+	assert.Equal(t, 404, rw.Code)
+}
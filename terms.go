@@ -0,0 +1,187 @@
+package oauth2proxy
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"html/template"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"net/url"
+	"time"
+
+	"github.com/bitly/oauth2_proxy/store"
+)
+
+// termsForever is how long an acceptance is kept without terms-interval;
+// a new terms-version has to be accepted again regardless.
+const termsForever = 10 * 365 * 24 * time.Hour
+
+// denyTermsNotAccepted is the reason code of requests by signed in users
+// who have yet to accept the terms.
+const denyTermsNotAccepted = "terms_not_accepted"
+
+// The terms of use, or acceptable use policy, that users must accept before
+// they are let through.
+type terms struct {
+	HTML    template.HTML
+	Version string
+}
+
+// parseTerms loads the terms-file. Without a terms-version, the version is
+// derived from its content, so that any change has to be accepted again.
+func parseTerms(o *Options, msgs []string) []string {
+	o.terms = nil
+	if o.TermsFile == "" {
+		if o.TermsVersion != "" || o.TermsInterval != 0 {
+			msgs = append(msgs, "terms-version and terms-interval require terms-file")
+		}
+		return msgs
+	}
+	if o.TermsInterval < 0 {
+		msgs = append(msgs, "terms-interval must not be negative")
+	}
+	data, err := ioutil.ReadFile(o.TermsFile)
+	if err != nil {
+		return append(msgs, fmt.Sprintf("error reading terms-file %q: %s", o.TermsFile, err))
+	}
+	version := o.TermsVersion
+	if version == "" {
+		sum := sha256.Sum256(data)
+		version = hex.EncodeToString(sum[:6])
+	}
+	o.terms = &terms{HTML: template.HTML(data), Version: version}
+	return msgs
+}
+
+func termsKey(version, identity string) string {
+	return "terms:" + version + ":" + identity
+}
+
+// termsAccepted reports whether identity accepted the current terms, or
+// there are none.
+func (p *OAuthProxy) termsAccepted(identity string) (bool, error) {
+	if p.terms == nil {
+		return true, nil
+	}
+	_, err := p.termsStore.Get(termsKey(p.terms.Version, identity))
+	if err == store.ErrNotFound {
+		return false, nil
+	}
+	return err == nil, err
+}
+
+// termsRedirect returns where to send a user who just signed in: the terms
+// page if they have yet to accept the terms, which then continues to
+// redirect.
+func (p *OAuthProxy) termsRedirect(identity, redirect string) string {
+	if ok, err := p.termsAccepted(identity); ok || err != nil {
+		return redirect
+	}
+	return p.TermsPath + "?" + url.Values{"rd": {redirect}}.Encode()
+}
+
+// checkTerms lets an authenticated request through if the user accepted the
+// terms. Otherwise browsers are sent to the terms page, and other clients
+// denied with the terms_not_accepted reason.
+func (p *OAuthProxy) checkTerms(rw http.ResponseWriter, req *http.Request) bool {
+	identity := rw.Header().Get("GAP-Auth")
+	ok, err := p.termsAccepted(identity)
+	if err != nil {
+		log.Printf("%s error loading terms acceptance %s", getRemoteAddr(req), err)
+		p.errorPage(rw, req, 500, "Internal Error", "Internal Error")
+		return false
+	}
+	if ok {
+		return true
+	}
+	if acceptsHTML(req) {
+		http.Redirect(rw, req, p.TermsPath+"?"+url.Values{"rd": {req.URL.RequestURI()}}.Encode(), 302)
+		return false
+	}
+	termsNotAccepted(rw)
+	return false
+}
+
+// termsNotAccepted tells requests that aren't page loads, and those of
+// /oauth2/auth, that the terms have yet to be accepted.
+func termsNotAccepted(rw http.ResponseWriter) {
+	rw.Header().Set(deniedReasonHeader, denyTermsNotAccepted)
+	http.Error(rw, "Forbidden: the terms of use have not been accepted", http.StatusForbidden)
+}
+
+// TermsPage shows the terms to signed in users, and records their acceptance
+// before continuing to where they were going.
+func (p *OAuthProxy) TermsPage(rw http.ResponseWriter, req *http.Request) {
+	session, _ := p.validSession(req)
+	if session == nil {
+		http.Redirect(rw, req, p.SignInPath+"?"+url.Values{"rd": {req.URL.RequestURI()}}.Encode(), 302)
+		return
+	}
+	redirect := req.FormValue("rd")
+	if !p.IsValidRedirect(req, redirect) {
+		redirect = "/"
+	}
+	t := struct {
+		Identity    string
+		Terms       template.HTML
+		Version     string
+		CSRFToken   string
+		Redirect    string
+		ProxyPrefix string
+		CSPNonce    string
+		Brand       branding
+	}{
+		Identity:    session.Email,
+		Terms:       p.terms.HTML,
+		Version:     p.terms.Version,
+		CSRFToken:   p.pageCSRFToken(rw, req, session),
+		Redirect:    redirect,
+		ProxyPrefix: p.ProxyPrefix,
+		Brand:       p.brand,
+	}
+	if t.Identity == "" {
+		t.Identity = session.User
+	}
+
+	if req.Method == "POST" {
+		ok, sent := p.checkOrigin(req)
+		if !sent {
+			ok = t.CSRFToken != "" && hmac.Equal([]byte(req.FormValue("csrf_token")), []byte(t.CSRFToken))
+		}
+		if !ok {
+			log.Printf("%s terms acceptance without a valid origin or csrf token, potential attack", getRemoteAddr(req))
+			p.errorPage(rw, req, 403, "Permission Denied", "Invalid Origin")
+			return
+		}
+		if err := p.acceptTerms(req, t.Identity); err != nil {
+			log.Printf("%s error saving terms acceptance %s", getRemoteAddr(req), err)
+			p.errorPage(rw, req, 500, "Internal Error", "Internal Error")
+			return
+		}
+		http.Redirect(rw, req, redirect, 302)
+		return
+	}
+	t.CSPNonce = p.setContentSecurityPolicy(rw)
+	p.executeTemplate(rw, req, "terms.html", t)
+}
+
+// acceptTerms records that identity accepted the current terms, for
+// terms-interval or until they change, and writes the consent record.
+func (p *OAuthProxy) acceptTerms(req *http.Request, identity string) error {
+	expiration := p.termsInterval
+	if expiration == 0 {
+		expiration = termsForever
+	}
+	if err := p.recordConsent(req, identity, "terms", p.terms.Version); err != nil {
+		return err
+	}
+	now := time.Now().UTC().Format(time.RFC3339)
+	if err := p.termsStore.Set(termsKey(p.terms.Version, identity), []byte(now), expiration); err != nil {
+		return err
+	}
+	p.logSecurityEvent(req, eventTermsAccepted, identity, "terms version "+p.terms.Version)
+	return nil
+}
@@ -0,0 +1,150 @@
+package oauth2proxy
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/bitly/oauth2_proxy/providers"
+	"github.com/bitly/oauth2_proxy/store"
+	"github.com/stretchr/testify/assert"
+)
+
+func writeTermsFile(t *testing.T, content string) string {
+	f, err := ioutil.TempFile("", "terms")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	f.WriteString(content)
+	return f.Name()
+}
+
+func TestTermsOptions(t *testing.T) {
+	o := testOptions()
+	o.TermsVersion = "2018-06"
+	assert.Equal(t, errorMsg([]string{
+		"terms-version and terms-interval require terms-file",
+	}), o.Validate().Error())
+
+	file := writeTermsFile(t, "<p>Be nice.</p>")
+	defer os.Remove(file)
+	o = testOptions()
+	o.TermsFile = file
+	assert.Equal(t, errorMsg([]string{
+		"terms-file requires session-store, so that acceptance applies to all replicas",
+	}), o.Validate().Error())
+	o.SessionStore = "memory"
+	assert.Equal(t, errorMsg([]string{
+		"terms-file requires a persistent session-store such as redis://, as consent records are kept for 10 years",
+	}), o.Validate().Error())
+	o.SessionStore = "redis://localhost:6379/1"
+	o.TermsInterval = -time.Hour
+	assert.Equal(t, errorMsg([]string{
+		"terms-interval must not be negative",
+	}), o.Validate().Error())
+
+	// the version changes with the content
+	o.TermsInterval = 0
+	assert.Equal(t, nil, o.Validate())
+	version := o.terms.Version
+	assert.Equal(t, 12, len(version))
+	ioutil.WriteFile(file, []byte("<p>Be very nice.</p>"), 0600)
+	assert.Equal(t, nil, o.Validate())
+	assert.NotEqual(t, version, o.terms.Version)
+	o.TermsVersion = "2018-06"
+	assert.Equal(t, nil, o.Validate())
+	assert.Equal(t, "2018-06", o.terms.Version)
+}
+
+func TestTerms(t *testing.T) {
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("upstream"))
+	}))
+	defer upstream.Close()
+	file := writeTermsFile(t, "<p>Be nice.</p>")
+	defer os.Remove(file)
+
+	opts := testOptions()
+	opts.Upstreams = []string{upstream.URL}
+	opts.TermsFile = file
+	opts.SessionStore = "redis://localhost:6379/1"
+	assert.Equal(t, nil, opts.Validate())
+	opts.sessionStore = store.NewMemoryStore()
+	proxy := newOAuthProxy(opts, func(string) bool { return true })
+
+	session := &providers.SessionState{Email: "jane@example.com"}
+	value, _ := session.EncodeSessionState(nil)
+	nonce := &http.Cookie{Name: "_oauth2_proxy_session_nonce", Value: "0123456789abcdef"}
+	request := func(method, path string, form url.Values) *httptest.ResponseRecorder {
+		rw := httptest.NewRecorder()
+		req, _ := http.NewRequest(method, path, strings.NewReader(form.Encode()))
+		req.AddCookie(proxy.MakeSessionCookie(req, value, opts.CookieExpire, time.Now()))
+		req.AddCookie(nonce)
+		if method == "POST" {
+			req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		} else {
+			req.Header.Set("Accept", "text/html")
+		}
+		proxy.ServeHTTP(rw, req)
+		return rw
+	}
+
+	// page loads are sent to the terms page, other requests denied
+	rw := request("GET", "/app?x=1", nil)
+	assert.Equal(t, 302, rw.Code)
+	assert.Equal(t, "/oauth2/terms?rd="+url.QueryEscape("/app?x=1"), rw.Header().Get("Location"))
+	rw = request("POST", "/app", nil)
+	assert.Equal(t, 403, rw.Code)
+	assert.Equal(t, "terms_not_accepted", rw.Header().Get(deniedReasonHeader))
+	rw = request("GET", "/oauth2/auth", nil)
+	assert.Equal(t, 403, rw.Code)
+	assert.Equal(t, "terms_not_accepted", rw.Header().Get(deniedReasonHeader))
+
+	rw = request("GET", "/oauth2/terms?rd="+url.QueryEscape("/app?x=1"), nil)
+	assert.Equal(t, 200, rw.Code)
+	assert.Contains(t, rw.Body.String(), `<div class="terms"><p>Be nice.</p></div>`)
+	assert.Contains(t, rw.Body.String(), `<input type="hidden" name="rd" value="/app?x=1">`)
+
+	// accepting requires the csrf token
+	rw = request("POST", "/oauth2/terms", url.Values{"rd": {"/app?x=1"}, "accept": {"1"}})
+	assert.Equal(t, 403, rw.Code)
+	req, _ := http.NewRequest("GET", "/", nil)
+	req.AddCookie(nonce)
+	rw = request("POST", "/oauth2/terms", url.Values{"rd": {"/app?x=1"}, "accept": {"1"}, "csrf_token": {proxy.CSRFToken(req, session)}})
+	assert.Equal(t, 302, rw.Code)
+	assert.Equal(t, "/app?x=1", rw.Header().Get("Location"))
+
+	rw = request("GET", "/app", nil)
+	assert.Equal(t, 200, rw.Code)
+	assert.Equal(t, "upstream", rw.Body.String())
+	rw = request("GET", "/oauth2/auth", nil)
+	assert.Equal(t, 202, rw.Code)
+
+	// new terms have to be accepted again
+	proxy.terms = &terms{HTML: "<p>Be very nice.</p>", Version: "2"}
+	rw = request("GET", "/app", nil)
+	assert.Equal(t, 302, rw.Code)
+}
+
+func TestTermsPageRequiresSession(t *testing.T) {
+	file := writeTermsFile(t, "<p>Be nice.</p>")
+	defer os.Remove(file)
+	opts := testOptions()
+	opts.TermsFile = file
+	opts.SessionStore = "redis://localhost:6379/1"
+	assert.Equal(t, nil, opts.Validate())
+	opts.sessionStore = store.NewMemoryStore()
+	proxy := newOAuthProxy(opts, func(string) bool { return true })
+
+	rw := httptest.NewRecorder()
+	req, _ := http.NewRequest("GET", "/oauth2/terms", nil)
+	proxy.ServeHTTP(rw, req)
+	assert.Equal(t, 302, rw.Code)
+	assert.Equal(t, "/oauth2/sign_in?rd="+url.QueryEscape("/oauth2/terms"), rw.Header().Get("Location"))
+}
@@ -0,0 +1,127 @@
+package oauth2proxy
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"io/ioutil"
+	"strings"
+)
+
+var tlsVersions = map[string]uint16{
+	"1.0": tls.VersionTLS10,
+	"1.1": tls.VersionTLS11,
+	"1.2": tls.VersionTLS12,
+	"1.3": tls.VersionTLS13,
+}
+
+var tlsCipherSuites = map[string]uint16{
+	"TLS_RSA_WITH_AES_128_CBC_SHA":            tls.TLS_RSA_WITH_AES_128_CBC_SHA,
+	"TLS_RSA_WITH_AES_256_CBC_SHA":            tls.TLS_RSA_WITH_AES_256_CBC_SHA,
+	"TLS_RSA_WITH_AES_128_GCM_SHA256":         tls.TLS_RSA_WITH_AES_128_GCM_SHA256,
+	"TLS_RSA_WITH_AES_256_GCM_SHA384":         tls.TLS_RSA_WITH_AES_256_GCM_SHA384,
+	"TLS_ECDHE_ECDSA_WITH_AES_128_CBC_SHA":    tls.TLS_ECDHE_ECDSA_WITH_AES_128_CBC_SHA,
+	"TLS_ECDHE_ECDSA_WITH_AES_256_CBC_SHA":    tls.TLS_ECDHE_ECDSA_WITH_AES_256_CBC_SHA,
+	"TLS_ECDHE_RSA_WITH_AES_128_CBC_SHA":      tls.TLS_ECDHE_RSA_WITH_AES_128_CBC_SHA,
+	"TLS_ECDHE_RSA_WITH_AES_256_CBC_SHA":      tls.TLS_ECDHE_RSA_WITH_AES_256_CBC_SHA,
+	"TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256":   tls.TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256,
+	"TLS_ECDHE_ECDSA_WITH_AES_128_GCM_SHA256": tls.TLS_ECDHE_ECDSA_WITH_AES_128_GCM_SHA256,
+	"TLS_ECDHE_RSA_WITH_AES_256_GCM_SHA384":   tls.TLS_ECDHE_RSA_WITH_AES_256_GCM_SHA384,
+	"TLS_ECDHE_ECDSA_WITH_AES_256_GCM_SHA384": tls.TLS_ECDHE_ECDSA_WITH_AES_256_GCM_SHA384,
+	"TLS_ECDHE_RSA_WITH_CHACHA20_POLY1305":    tls.TLS_ECDHE_RSA_WITH_CHACHA20_POLY1305,
+	"TLS_ECDHE_ECDSA_WITH_CHACHA20_POLY1305":  tls.TLS_ECDHE_ECDSA_WITH_CHACHA20_POLY1305,
+}
+
+var tlsCurves = map[string]tls.CurveID{
+	"P256":   tls.CurveP256,
+	"P384":   tls.CurveP384,
+	"P521":   tls.CurveP521,
+	"X25519": tls.X25519,
+}
+
+// parseTLSOptions parses the TLS versions, cipher suites and curves of the
+// HTTPS listener.
+func parseTLSOptions(o *Options, msgs []string) []string {
+	var ok bool
+	if o.tlsMinVersion, ok = tlsVersions[o.TLSMinVersion]; !ok {
+		msgs = append(msgs, fmt.Sprintf("invalid tls-min-version %q; must be one of 1.0, 1.1, 1.2 or 1.3", o.TLSMinVersion))
+	}
+	// without tls-max-version, the newest version Go supports is allowed
+	o.tlsMaxVersion = 0
+	if o.TLSMaxVersion != "" {
+		if o.tlsMaxVersion, ok = tlsVersions[o.TLSMaxVersion]; !ok {
+			msgs = append(msgs, fmt.Sprintf("invalid tls-max-version %q; must be one of 1.0, 1.1, 1.2 or 1.3", o.TLSMaxVersion))
+		} else if o.tlsMaxVersion < o.tlsMinVersion {
+			msgs = append(msgs, "tls-max-version must not be lower than tls-min-version")
+		} else if o.HTTP3 && o.tlsMaxVersion < tls.VersionTLS13 {
+			msgs = append(msgs, "http3 requires TLS 1.3; tls-max-version must be 1.3 or unset")
+		}
+	}
+
+	o.tlsCipherSuites = nil
+	for _, name := range o.TLSCipherSuites {
+		id, ok := tlsCipherSuites[strings.ToUpper(name)]
+		if !ok {
+			msgs = append(msgs, fmt.Sprintf("unsupported tls-cipher-suite %q", name))
+			continue
+		}
+		o.tlsCipherSuites = append(o.tlsCipherSuites, id)
+	}
+
+	o.tlsCurves = nil
+	for _, name := range o.TLSCurves {
+		id, ok := tlsCurves[strings.ToUpper(name)]
+		if !ok {
+			msgs = append(msgs, fmt.Sprintf("unsupported tls-curve %q; must be one of P256, P384, P521 or X25519", name))
+			continue
+		}
+		o.tlsCurves = append(o.tlsCurves, id)
+	}
+
+	if o.HTTP2 && o.HTTP2MaxStreams < 1 {
+		msgs = append(msgs, "http2-max-concurrent-streams must be at least 1")
+	}
+	if o.HTTP3 && (o.TLSCertFile == "" || o.TLSKeyFile == "") {
+		msgs = append(msgs, "http3 requires tls-cert and tls-key")
+	}
+	return msgs
+}
+
+// http2CipherSuites reports whether HTTP/2 can be served with the cipher
+// suites: it requires TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256 or its ECDSA
+// counterpart, and no suites means the defaults, which include both.
+func http2CipherSuites(suites []uint16) bool {
+	if len(suites) == 0 {
+		return true
+	}
+	for _, id := range suites {
+		if id == tls.TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256 || id == tls.TLS_ECDHE_ECDSA_WITH_AES_128_GCM_SHA256 {
+			return true
+		}
+	}
+	return false
+}
+
+// parseTLSClientCA loads the certificate authorities that client certificates
+// are verified against.
+func parseTLSClientCA(o *Options, msgs []string) []string {
+	o.tlsClientCAs = nil
+	if o.TLSClientCAFile == "" {
+		if o.TLSClientCertRequired {
+			msgs = append(msgs, "tls-client-cert-required requires tls-client-ca")
+		}
+		return msgs
+	}
+	if o.TLSCertFile == "" || o.TLSKeyFile == "" {
+		msgs = append(msgs, "tls-client-ca requires tls-cert and tls-key")
+	}
+	b, err := ioutil.ReadFile(o.TLSClientCAFile)
+	if err != nil {
+		return append(msgs, fmt.Sprintf("unable to read tls-client-ca: %s", err))
+	}
+	o.tlsClientCAs = x509.NewCertPool()
+	if !o.tlsClientCAs.AppendCertsFromPEM(b) {
+		msgs = append(msgs, fmt.Sprintf("no PEM certificates found in tls-client-ca %s", o.TLSClientCAFile))
+	}
+	return msgs
+}
@@ -0,0 +1,173 @@
+package oauth2proxy
+
+import (
+	"bytes"
+	"crypto/x509"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"time"
+
+	"github.com/bitly/oauth2_proxy/providers"
+	"gopkg.in/square/go-jose.v2"
+	"gopkg.in/square/go-jose.v2/jwt"
+)
+
+// A trustedIdentity verifies the identity tokens of a fronting oauth2_proxy
+// (see upstream-jwt-header), or of a gateway minting tokens with the same
+// claims, so that requests it authenticated are let through without signing
+// in again, e.g. when proxies are chained across network zones.
+type trustedIdentity struct {
+	header   string
+	keys     []jose.JSONWebKey
+	issuer   string
+	audience string
+}
+
+// trustedIdentityMaxAge caps how long after it was issued an identity token
+// is accepted, whatever its expiry, as the fronting proxy mints a new one for
+// every request.
+const trustedIdentityMaxAge = 5 * time.Minute
+
+// parseTrustedIdentity loads the keys to verify the tokens in the
+// trusted-identity-header with.
+func parseTrustedIdentity(o *Options, msgs []string) []string {
+	o.trustedIdentity = nil
+	if o.TrustedIdentityHeader == "" {
+		if o.TrustedIdentityKeyFile != "" || o.TrustedIdentityIssuer != "" || o.TrustedIdentityAudience != "" {
+			msgs = append(msgs, "trusted-identity-key-file, trusted-identity-issuer and trusted-identity-audience require trusted-identity-header")
+		}
+		return msgs
+	}
+	if o.TrustedIdentityKeyFile == "" || o.TrustedIdentityIssuer == "" || o.TrustedIdentityAudience == "" {
+		return append(msgs, "trusted-identity-header requires trusted-identity-key-file, trusted-identity-issuer and trusted-identity-audience")
+	}
+	keys, err := loadVerificationKeys(o.TrustedIdentityKeyFile)
+	if err != nil {
+		return append(msgs, fmt.Sprintf("invalid trusted-identity-key-file %s: %s", o.TrustedIdentityKeyFile, err))
+	}
+	o.trustedIdentity = &trustedIdentity{
+		header:   o.TrustedIdentityHeader,
+		keys:     keys,
+		issuer:   o.TrustedIdentityIssuer,
+		audience: o.TrustedIdentityAudience,
+	}
+	return msgs
+}
+
+// loadVerificationKeys reads a JSON Web Key Set, such as the
+// /oauth2/.well-known/jwks.json of the fronting proxy, or PEM encoded public
+// keys or certificates.
+func loadVerificationKeys(path string) ([]jose.JSONWebKey, error) {
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	if bytes.HasPrefix(bytes.TrimSpace(b), []byte("{")) {
+		var jwks jose.JSONWebKeySet
+		if err := json.Unmarshal(b, &jwks); err != nil {
+			return nil, err
+		}
+		if len(jwks.Keys) == 0 {
+			return nil, errors.New("no keys in the JSON Web Key Set")
+		}
+		return jwks.Keys, nil
+	}
+	var keys []jose.JSONWebKey
+	for {
+		var block *pem.Block
+		block, b = pem.Decode(b)
+		if block == nil {
+			break
+		}
+		switch block.Type {
+		case "PUBLIC KEY":
+			key, err := x509.ParsePKIXPublicKey(block.Bytes)
+			if err != nil {
+				return nil, err
+			}
+			keys = append(keys, jose.JSONWebKey{Key: key})
+		case "CERTIFICATE":
+			cert, err := x509.ParseCertificate(block.Bytes)
+			if err != nil {
+				return nil, err
+			}
+			keys = append(keys, jose.JSONWebKey{Key: cert.PublicKey})
+		}
+	}
+	if len(keys) == 0 {
+		return nil, errors.New("no PEM public key or certificate found")
+	}
+	return keys, nil
+}
+
+// Verify returns the session of the user the token identifies, if it is
+// signed with one of the keys, by the trusted-identity-issuer for the
+// trusted-identity-audience, and valid now. Groups in the token are
+// ignored: users are authorized by this proxy's own settings.
+func (t *trustedIdentity) Verify(token string, now time.Time) (*providers.SessionState, error) {
+	tok, err := jwt.ParseSigned(token)
+	if err != nil {
+		return nil, err
+	}
+	kid := ""
+	if len(tok.Headers) != 0 {
+		kid = tok.Headers[0].KeyID
+	}
+	var claims identityClaims
+	verified := false
+	for _, key := range t.keys {
+		if kid != "" && key.KeyID != "" && key.KeyID != kid {
+			continue
+		}
+		if tok.Claims(key.Key, &claims) == nil {
+			verified = true
+			break
+		}
+	}
+	if !verified {
+		return nil, errors.New("identity token not signed with a trusted key")
+	}
+	if claims.Expiry == nil {
+		return nil, errors.New("identity token without expiry")
+	}
+	if claims.IssuedAt == nil {
+		return nil, errors.New("identity token without issued at")
+	}
+	if now.Sub(claims.IssuedAt.Time()) > trustedIdentityMaxAge {
+		return nil, errors.New("identity token issued too long ago")
+	}
+	if err := claims.Validate(jwt.Expected{Issuer: t.issuer, Audience: jwt.Audience{t.audience}, Time: now}); err != nil {
+		return nil, fmt.Errorf("invalid identity token: %s", err)
+	}
+	if claims.Email == "" {
+		return nil, errors.New("identity token without email")
+	}
+	return &providers.SessionState{Email: claims.Email, User: claims.PreferredUsername}, nil
+}
+
+// CheckTrustedIdentity authenticates a request by the identity token in the
+// trusted-identity-header. The header is removed, so that upstreams never
+// get one that wasn't verified. Users must still be authorized by this
+// proxy.
+func (p *OAuthProxy) CheckTrustedIdentity(req *http.Request) (*providers.SessionState, error) {
+	if p.trustedIdentity == nil {
+		return nil, nil
+	}
+	token := req.Header.Get(p.trustedIdentity.header)
+	req.Header.Del(p.trustedIdentity.header)
+	if token == "" {
+		return nil, nil
+	}
+	s, err := p.trustedIdentity.Verify(token, time.Now())
+	if err != nil {
+		return nil, err
+	}
+	if !p.IsAuthorized(req, s.Email, false) {
+		return nil, fmt.Errorf("trusted identity %s not authorized", s.Email)
+	}
+	return s, nil
+}
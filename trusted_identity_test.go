@@ -0,0 +1,120 @@
+package oauth2proxy
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"encoding/pem"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/bitly/oauth2_proxy/providers"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestTrustedIdentityOptions(t *testing.T) {
+	o := testOptions()
+	o.TrustedIdentityIssuer = "https://outer.example.com/oauth2"
+	assert.Equal(t, errorMsg([]string{
+		"trusted-identity-key-file, trusted-identity-issuer and trusted-identity-audience require trusted-identity-header",
+	}), o.Validate().Error())
+
+	o = testOptions()
+	o.TrustedIdentityHeader = "X-Forwarded-Identity"
+	o.TrustedIdentityKeyFile = "jwks.json"
+	o.TrustedIdentityIssuer = "https://outer.example.com/oauth2"
+	assert.Equal(t, errorMsg([]string{
+		"trusted-identity-header requires trusted-identity-key-file, trusted-identity-issuer and trusted-identity-audience",
+	}), o.Validate().Error())
+}
+
+func TestTrustedIdentityKeys(t *testing.T) {
+	key, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	der, _ := x509.MarshalPKIXPublicKey(key.Public())
+	f, _ := ioutil.TempFile("", "trusted_identity")
+	defer os.Remove(f.Name())
+	pem.Encode(f, &pem.Block{Type: "PUBLIC KEY", Bytes: der})
+	f.Close()
+
+	keys, err := loadVerificationKeys(f.Name())
+	assert.Equal(t, nil, err)
+	assert.Equal(t, 1, len(keys))
+	assert.Equal(t, key.Public(), keys[0].Key)
+
+	ioutil.WriteFile(f.Name(), []byte("not a key"), 0600)
+	_, err = loadVerificationKeys(f.Name())
+	assert.Equal(t, "no PEM public key or certificate found", err.Error())
+}
+
+func TestTrustedIdentity(t *testing.T) {
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(r.Header.Get("X-Forwarded-Email") + r.Header.Get("X-Forwarded-Identity")))
+	}))
+	defer upstream.Close()
+
+	// the outer proxy signs, the inner one trusts its JWKS
+	key, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	outer, err := newIdentitySigner(key, time.Minute)
+	assert.Equal(t, nil, err)
+	f, _ := ioutil.TempFile("", "trusted_identity")
+	defer os.Remove(f.Name())
+	f.Write(outer.jwks)
+	f.Close()
+
+	opts := testOptions()
+	opts.Upstreams = []string{upstream.URL}
+	opts.EmailDomains = []string{"example.com"}
+	opts.TrustedIdentityHeader = "X-Forwarded-Identity"
+	opts.TrustedIdentityKeyFile = f.Name()
+	opts.TrustedIdentityIssuer = "https://outer.example.com/oauth2"
+	opts.TrustedIdentityAudience = "https://inner.example.com/"
+	assert.Equal(t, nil, opts.Validate())
+	proxy := newOAuthProxy(opts, func(email string) bool { return email == "jane@example.com" })
+
+	request := func(token string) *httptest.ResponseRecorder {
+		rw := httptest.NewRecorder()
+		req, _ := http.NewRequest("GET", "/app", nil)
+		req.Header.Set("X-Forwarded-Identity", token)
+		proxy.ServeHTTP(rw, req)
+		return rw
+	}
+	const issuer, audience = "https://outer.example.com/oauth2", "https://inner.example.com/"
+	sign := func(session *providers.SessionState, issuer, audience string, now time.Time) string {
+		token, err := outer.Sign(session, issuer, audience, now)
+		assert.Equal(t, nil, err)
+		return token
+	}
+	jane := &providers.SessionState{Email: "jane@example.com", Groups: []string{"admins"}}
+
+	rw := request(sign(jane, issuer, audience, time.Now()))
+	assert.Equal(t, 200, rw.Code)
+	assert.Equal(t, "jane@example.com", rw.Body.String())
+
+	session, err := proxy.trustedIdentity.Verify(sign(jane, issuer, audience, time.Now()), time.Now())
+	assert.Equal(t, nil, err)
+	assert.Equal(t, []string(nil), session.Groups)
+
+	assert.Equal(t, 403, request(sign(jane, issuer, audience, time.Now().Add(-time.Hour))).Code)
+	assert.Equal(t, 403, request(sign(jane, "https://other.example.com/oauth2", audience, time.Now())).Code)
+	assert.Equal(t, 403, request(sign(jane, issuer, "https://other-app.example.com/", time.Now())).Code)
+	assert.Equal(t, 403, request(sign(jane, issuer, "", time.Now())).Code)
+	assert.Equal(t, 403, request(sign(&providers.SessionState{Email: "john@example.com"}, issuer, audience, time.Now())).Code)
+	assert.Equal(t, 403, request(sign(&providers.SessionState{User: "jane"}, issuer, audience, time.Now())).Code)
+	assert.Equal(t, 403, request("not a token").Code)
+
+	// still valid, but issued longer ago than trustedIdentityMaxAge
+	long, _ := newIdentitySigner(key, time.Hour)
+	old, _ := long.Sign(jane, issuer, audience, time.Now().Add(-10*time.Minute))
+	_, err = proxy.trustedIdentity.Verify(old, time.Now())
+	assert.Equal(t, "identity token issued too long ago", err.Error())
+
+	other, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	forger, _ := newIdentitySigner(other, time.Minute)
+	forged, _ := forger.Sign(jane, issuer, audience, time.Now())
+	assert.Equal(t, 403, request(forged).Code)
+}
@@ -0,0 +1,35 @@
+// +build !windows,!plan9
+
+package oauth2proxy
+
+import (
+	"net"
+	"os"
+	"sync"
+	"syscall"
+)
+
+// umaskMu serializes the changes to the process umask made while listening.
+var umaskMu sync.Mutex
+
+// listenUnix listens on the unix socket path, which is created with mode so
+// that it is never reachable with wider permissions, not even briefly.
+func listenUnix(path string, mode os.FileMode) (net.Listener, error) {
+	if mode == 0 {
+		return net.Listen("unix", path)
+	}
+	umaskMu.Lock()
+	old := syscall.Umask(int(^mode & 0777))
+	ln, err := net.Listen("unix", path)
+	syscall.Umask(old)
+	umaskMu.Unlock()
+	if err != nil {
+		return nil, err
+	}
+	// the umask only removes permissions; set the exact mode
+	if err := os.Chmod(path, mode); err != nil {
+		ln.Close()
+		return nil, err
+	}
+	return ln, nil
+}
@@ -0,0 +1,20 @@
+// +build windows plan9
+
+package oauth2proxy
+
+import (
+	"net"
+	"os"
+)
+
+// listenUnix listens on the unix socket path and sets its mode, if given.
+func listenUnix(path string, mode os.FileMode) (net.Listener, error) {
+	ln, err := net.Listen("unix", path)
+	if err == nil && mode != 0 {
+		if err = os.Chmod(path, mode); err != nil {
+			ln.Close()
+			return nil, err
+		}
+	}
+	return ln, err
+}
@@ -0,0 +1,325 @@
+package oauth2proxy
+
+import (
+	"bytes"
+	"container/list"
+	"fmt"
+	"net/http"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// An upstreamCache keeps upstream responses that their Cache-Control header
+// allows shared caches to store, such as static assets, in memory, so that
+// repeated requests for them don't reach the upstream. The least recently
+// used responses are evicted to stay within the size limit.
+type upstreamCache struct {
+	maxBytes     int
+	paths        []*regexp.Regexp
+	contentTypes []string
+
+	mu      sync.Mutex
+	bytes   int
+	lru     *list.List // of *cachedResponse, most recently used first
+	entries map[string]*list.Element
+}
+
+type cachedResponse struct {
+	key     string
+	status  int
+	header  http.Header
+	body    []byte
+	stored  time.Time
+	expires time.Time
+}
+
+func (r *cachedResponse) size() int {
+	n := len(r.key) + len(r.body)
+	for k, v := range r.header {
+		n += len(k)
+		for _, s := range v {
+			n += len(s)
+		}
+	}
+	return n
+}
+
+// parseUpstreamCache sets up the upstream cache, if it has a size.
+func parseUpstreamCache(o *Options, msgs []string) []string {
+	o.upstreamCache = nil
+	if o.UpstreamCacheSize <= 0 {
+		if o.UpstreamCacheSize < 0 {
+			msgs = append(msgs, "upstream-cache-size must not be negative")
+		} else if len(o.UpstreamCachePaths) != 0 || len(o.UpstreamCacheContentTypes) != 0 {
+			msgs = append(msgs, "upstream-cache-path and upstream-cache-content-type require upstream-cache-size")
+		}
+		return msgs
+	}
+	c := &upstreamCache{
+		maxBytes: o.UpstreamCacheSize,
+		lru:      list.New(),
+		entries:  make(map[string]*list.Element),
+	}
+	for _, p := range o.UpstreamCachePaths {
+		re, err := regexp.Compile(p)
+		if err != nil {
+			msgs = append(msgs, fmt.Sprintf("invalid upstream-cache-path %q: %s", p, err))
+			continue
+		}
+		c.paths = append(c.paths, re)
+	}
+	for _, t := range o.UpstreamCacheContentTypes {
+		c.contentTypes = append(c.contentTypes, strings.ToLower(t))
+	}
+	o.upstreamCache = c
+	return msgs
+}
+
+// Handler serves the cacheable requests to next from the cache, and caches
+// the responses of next that allow it.
+func (c *upstreamCache) Handler(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		if !c.cacheableRequest(req) {
+			next.ServeHTTP(rw, req)
+			return
+		}
+		key := req.Host + req.URL.RequestURI() + "\x00" + req.Header.Get("Accept-Encoding")
+		now := time.Now()
+		if r := c.get(key, now); r != nil && !hasDirective(req.Header, "no-cache") && req.Header.Get("Pragma") != "no-cache" {
+			c.serve(rw, req, r, now)
+			return
+		}
+
+		rw.Header().Set("X-Cache", "MISS")
+		w := &cacheWriter{ResponseWriter: rw, before: cloneHeader(rw.Header()), limit: c.maxBytes / 8}
+		next.ServeHTTP(w, req)
+		if r := w.response(key, now); r != nil && c.cacheableResponse(r) {
+			c.add(r)
+		}
+	})
+}
+
+// cacheableRequest reports whether req may be answered from the cache.
+func (c *upstreamCache) cacheableRequest(req *http.Request) bool {
+	if req.Method != "GET" || req.Header.Get("Range") != "" {
+		return false
+	}
+	if len(c.paths) == 0 {
+		return true
+	}
+	for _, re := range c.paths {
+		if re.MatchString(req.URL.Path) {
+			return true
+		}
+	}
+	return false
+}
+
+// cacheableResponse reports whether r may be stored, and sets when it
+// expires. As a shared cache, only responses marked public or with s-maxage
+// are stored.
+func (c *upstreamCache) cacheableResponse(r *cachedResponse) bool {
+	h := r.header
+	if r.status != http.StatusOK || h.Get("Set-Cookie") != "" {
+		return false
+	}
+	if vary := h.Get("Vary"); vary != "" && !strings.EqualFold(vary, "Accept-Encoding") {
+		return false
+	}
+	if hasDirective(h, "no-store") || hasDirective(h, "no-cache") || hasDirective(h, "private") {
+		return false
+	}
+	sMaxAge, shared := directiveSeconds(h, "s-maxage")
+	if !shared && !hasDirective(h, "public") {
+		return false
+	}
+	if len(c.contentTypes) != 0 && !c.matchContentType(h.Get("Content-Type")) {
+		return false
+	}
+
+	switch maxAge, ok := directiveSeconds(h, "max-age"); {
+	case shared:
+		r.expires = r.stored.Add(time.Duration(sMaxAge) * time.Second)
+	case ok:
+		r.expires = r.stored.Add(time.Duration(maxAge) * time.Second)
+	default:
+		expires, err := http.ParseTime(h.Get("Expires"))
+		if err != nil {
+			return false
+		}
+		date, err := http.ParseTime(h.Get("Date"))
+		if err != nil {
+			date = r.stored
+		}
+		r.expires = r.stored.Add(expires.Sub(date))
+	}
+	return r.expires.After(r.stored)
+}
+
+func (c *upstreamCache) matchContentType(contentType string) bool {
+	contentType = strings.ToLower(contentType)
+	for _, t := range c.contentTypes {
+		if strings.HasPrefix(contentType, t) {
+			return true
+		}
+	}
+	return false
+}
+
+// get returns the fresh response cached under key, if there is one.
+func (c *upstreamCache) get(key string, now time.Time) *cachedResponse {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	e, ok := c.entries[key]
+	if !ok {
+		return nil
+	}
+	r := e.Value.(*cachedResponse)
+	if !now.Before(r.expires) {
+		c.remove(e)
+		return nil
+	}
+	c.lru.MoveToFront(e)
+	return r
+}
+
+// add caches r, evicting the least recently used responses to make room.
+func (c *upstreamCache) add(r *cachedResponse) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if e, ok := c.entries[r.key]; ok {
+		c.remove(e)
+	}
+	c.entries[r.key] = c.lru.PushFront(r)
+	c.bytes += r.size()
+	for c.bytes > c.maxBytes {
+		c.remove(c.lru.Back())
+	}
+}
+
+func (c *upstreamCache) remove(e *list.Element) {
+	r := c.lru.Remove(e).(*cachedResponse)
+	delete(c.entries, r.key)
+	c.bytes -= r.size()
+}
+
+// serve responds with the cached response r, or 304 Not Modified if the
+// client has it already.
+func (c *upstreamCache) serve(rw http.ResponseWriter, req *http.Request, r *cachedResponse, now time.Time) {
+	for k, v := range r.header {
+		rw.Header()[k] = append([]string(nil), v...)
+	}
+	rw.Header().Set("Age", strconv.Itoa(int(now.Sub(r.stored).Seconds())))
+	rw.Header().Set("X-Cache", "HIT")
+	if etag := r.header.Get("ETag"); etag != "" && req.Header.Get("If-None-Match") == etag {
+		rw.WriteHeader(http.StatusNotModified)
+		return
+	}
+	rw.WriteHeader(r.status)
+	rw.Write(r.body)
+}
+
+// hasDirective reports whether the Cache-Control header has directive.
+func hasDirective(h http.Header, directive string) bool {
+	_, ok := cacheDirective(h, directive)
+	return ok
+}
+
+// directiveSeconds returns the value of a directive such as max-age.
+func directiveSeconds(h http.Header, directive string) (int, bool) {
+	value, ok := cacheDirective(h, directive)
+	if !ok {
+		return 0, false
+	}
+	seconds, err := strconv.Atoi(value)
+	if err != nil || seconds < 0 {
+		return 0, false
+	}
+	return seconds, true
+}
+
+func cacheDirective(h http.Header, directive string) (string, bool) {
+	for _, v := range h["Cache-Control"] {
+		for _, d := range strings.Split(v, ",") {
+			kv := strings.SplitN(strings.TrimSpace(d), "=", 2)
+			if strings.EqualFold(kv[0], directive) {
+				if len(kv) == 1 {
+					return "", true
+				}
+				return strings.Trim(kv[1], `"`), true
+			}
+		}
+	}
+	return "", false
+}
+
+func cloneHeader(h http.Header) http.Header {
+	c := make(http.Header, len(h))
+	for k, v := range h {
+		c[k] = append([]string(nil), v...)
+	}
+	return c
+}
+
+// cacheWriter passes a response on while keeping a copy of it, up to limit
+// bytes of body, and of the headers added by the upstream.
+type cacheWriter struct {
+	http.ResponseWriter
+	before   http.Header
+	status   int
+	header   http.Header
+	body     bytes.Buffer
+	limit    int
+	overflow bool
+}
+
+func (w *cacheWriter) WriteHeader(status int) {
+	if w.header == nil {
+		w.status = status
+		w.header = make(http.Header)
+		for k, v := range w.Header() {
+			if before, ok := w.before[k]; !ok || strings.Join(before, "\n") != strings.Join(v, "\n") {
+				w.header[k] = append([]string(nil), v...)
+			}
+		}
+	}
+	w.ResponseWriter.WriteHeader(status)
+}
+
+func (w *cacheWriter) Write(b []byte) (int, error) {
+	if w.header == nil {
+		w.WriteHeader(http.StatusOK)
+	}
+	if !w.overflow {
+		if w.body.Len()+len(b) > w.limit {
+			w.overflow = true
+			w.body = bytes.Buffer{}
+		} else {
+			w.body.Write(b)
+		}
+	}
+	return w.ResponseWriter.Write(b)
+}
+
+func (w *cacheWriter) Flush() {
+	if f, ok := w.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+// response returns the response written, unless it was too large.
+func (w *cacheWriter) response(key string, now time.Time) *cachedResponse {
+	if w.header == nil || w.overflow {
+		return nil
+	}
+	return &cachedResponse{
+		key:    key,
+		status: w.status,
+		header: w.header,
+		body:   w.body.Bytes(),
+		stored: now,
+	}
+}
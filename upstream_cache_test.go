@@ -0,0 +1,136 @@
+package oauth2proxy
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestUpstreamCacheOptions(t *testing.T) {
+	o := testOptions()
+	o.UpstreamCachePaths = []string{"^/static/"}
+	assert.Equal(t, errorMsg([]string{
+		"upstream-cache-path and upstream-cache-content-type require upstream-cache-size",
+	}), o.Validate().Error())
+
+	o = testOptions()
+	o.UpstreamCacheSize = 1 << 20
+	o.UpstreamCachePaths = []string{"^/static/", "("}
+	assert.Equal(t, errorMsg([]string{
+		"invalid upstream-cache-path \"(\": error parsing regexp: missing closing ): `(`",
+	}), o.Validate().Error())
+}
+
+func TestUpstreamCache(t *testing.T) {
+	hits := map[string]int{}
+	upstream := http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		hits[req.URL.Path]++
+		switch req.URL.Path {
+		case "/static/app.css":
+			rw.Header().Set("Cache-Control", "public, max-age=60")
+			rw.Header().Set("Content-Type", "text/css")
+			rw.Header().Set("ETag", `"v1"`)
+		case "/static/shared.js":
+			rw.Header().Set("Cache-Control", "s-maxage=60")
+			rw.Header().Set("Content-Type", "application/javascript")
+		case "/static/private.css":
+			rw.Header().Set("Cache-Control", "private, max-age=60")
+			rw.Header().Set("Content-Type", "text/css")
+		case "/static/plain.css":
+			rw.Header().Set("Cache-Control", "max-age=60")
+			rw.Header().Set("Content-Type", "text/css")
+		case "/static/cookie.css":
+			rw.Header().Set("Cache-Control", "public, max-age=60")
+			rw.Header().Set("Set-Cookie", "a=b")
+		case "/static/expired.css":
+			rw.Header().Set("Cache-Control", "public, max-age=0")
+		case "/static/missing.css":
+			rw.Header().Set("Cache-Control", "public, max-age=60")
+			rw.WriteHeader(404)
+		case "/api/data":
+			rw.Header().Set("Cache-Control", "public, max-age=60")
+		}
+		fmt.Fprintf(rw, "%s %d", req.URL.Path, hits[req.URL.Path])
+	})
+
+	opts := testOptions()
+	opts.UpstreamCacheSize = 1 << 20
+	opts.UpstreamCachePaths = []string{"^/static/"}
+	assert.Equal(t, nil, opts.Validate())
+	handler := opts.upstreamCache.Handler(upstream)
+
+	get := func(path string, header ...string) *httptest.ResponseRecorder {
+		rw := httptest.NewRecorder()
+		rw.Header().Set("GAP-Auth", "jane@example.com")
+		req, _ := http.NewRequest("GET", path, nil)
+		for i := 0; i < len(header); i += 2 {
+			req.Header.Set(header[i], header[i+1])
+		}
+		handler.ServeHTTP(rw, req)
+		return rw
+	}
+
+	rw := get("/static/app.css")
+	assert.Equal(t, "MISS", rw.Header().Get("X-Cache"))
+	rw = get("/static/app.css")
+	assert.Equal(t, 200, rw.Code)
+	assert.Equal(t, "HIT", rw.Header().Get("X-Cache"))
+	assert.Equal(t, "/static/app.css 1", rw.Body.String())
+	assert.Equal(t, "text/css", rw.Header().Get("Content-Type"))
+	assert.Equal(t, "0", rw.Header().Get("Age"))
+	rw = get("/static/app.css", "If-None-Match", `"v1"`)
+	assert.Equal(t, 304, rw.Code)
+	rw = get("/static/app.css", "Cache-Control", "no-cache")
+	assert.Equal(t, "/static/app.css 2", rw.Body.String())
+	rw = get("/static/app.css", "Accept-Encoding", "gzip")
+	assert.Equal(t, "/static/app.css 3", rw.Body.String())
+
+	get("/static/shared.js")
+	assert.Equal(t, "/static/shared.js 1", get("/static/shared.js").Body.String())
+
+	// responses that aren't public, or aren't matched, aren't cached
+	for _, path := range []string{"/static/private.css", "/static/plain.css", "/static/cookie.css",
+		"/static/expired.css", "/static/missing.css", "/api/data"} {
+		get(path)
+		rw = get(path)
+		assert.Equal(t, path+" 2", rw.Body.String(), path)
+	}
+	rw = httptest.NewRecorder()
+	req, _ := http.NewRequest("HEAD", "/static/app.css", nil)
+	handler.ServeHTTP(rw, req)
+	assert.Equal(t, "", rw.Header().Get("X-Cache"))
+}
+
+func TestUpstreamCacheContentTypes(t *testing.T) {
+	c := &upstreamCache{contentTypes: []string{"image/", "text/css"}}
+	for contentType, ok := range map[string]bool{
+		"image/png":               true,
+		"text/css; charset=utf-8": true,
+		"TEXT/CSS":                true,
+		"text/html":               false,
+		"":                        false,
+	} {
+		assert.Equal(t, ok, c.matchContentType(contentType), contentType)
+	}
+}
+
+func TestUpstreamCacheEviction(t *testing.T) {
+	body := strings.Repeat("x", 100)
+	opts := testOptions()
+	opts.UpstreamCacheSize = 1000
+	assert.Equal(t, nil, opts.Validate())
+	c := opts.upstreamCache
+	now := time.Now()
+	for i := 0; i < 20; i++ {
+		c.add(&cachedResponse{key: fmt.Sprintf("/%d", i), body: []byte(body), expires: now.Add(time.Minute)})
+	}
+	assert.True(t, c.bytes <= 1000)
+	assert.Equal(t, (*cachedResponse)(nil), c.get("/0", now))
+	assert.NotEqual(t, (*cachedResponse)(nil), c.get("/19", now))
+	assert.Equal(t, (*cachedResponse)(nil), c.get("/19", now.Add(time.Minute)))
+}
@@ -0,0 +1,121 @@
+package oauth2proxy
+
+import (
+	"log"
+	"net"
+	"net/http"
+	"reflect"
+	"sort"
+	"sync"
+	"time"
+)
+
+// An upstreamResolver proxies requests to an upstream with a hostname and
+// resolves the hostname again every upstream-dns-refresh. Connections are
+// kept alive and reused for as long as the upstream answers on them, so
+// without it an upstream moved by a DNS failover or a blue/green switch would
+// keep getting requests at its old addresses. When the addresses change, the
+// requests go out on a new transport, which connects to the new addresses,
+// and the idle connections of the old one are closed; connections with
+// requests in progress are closed once idle, after IdleConnTimeout.
+type upstreamResolver struct {
+	host   string
+	lookup func(host string) ([]string, error)
+
+	mu        sync.RWMutex
+	addrs     []string
+	transport *http.Transport
+}
+
+func newUpstreamResolver(host string) *upstreamResolver {
+	r := &upstreamResolver{host: host, lookup: net.LookupHost, transport: newUpstreamTransport()}
+	r.addrs, _ = r.resolve()
+	return r
+}
+
+// newUpstreamTransport returns a transport with the settings of
+// http.DefaultTransport.
+func newUpstreamTransport() *http.Transport {
+	return &http.Transport{
+		Proxy: http.ProxyFromEnvironment,
+		DialContext: (&net.Dialer{
+			Timeout:   30 * time.Second,
+			KeepAlive: 30 * time.Second,
+		}).DialContext,
+		MaxIdleConns:          100,
+		IdleConnTimeout:       90 * time.Second,
+		TLSHandshakeTimeout:   10 * time.Second,
+		ExpectContinueTimeout: 1 * time.Second,
+	}
+}
+
+func (r *upstreamResolver) RoundTrip(req *http.Request) (*http.Response, error) {
+	r.mu.RLock()
+	transport := r.transport
+	r.mu.RUnlock()
+	return transport.RoundTrip(req)
+}
+
+// resolve looks up the addresses of the hostname, sorted so that a change in
+// their order alone isn't taken for a change.
+func (r *upstreamResolver) resolve() ([]string, error) {
+	addrs, err := r.lookup(r.host)
+	if err != nil {
+		return nil, err
+	}
+	sort.Strings(addrs)
+	return addrs, nil
+}
+
+// refresh resolves the hostname again and, if its addresses changed, moves
+// on to a new transport. Lookup errors keep the current addresses, as the
+// upstream may well still be there.
+func (r *upstreamResolver) refresh() {
+	addrs, err := r.resolve()
+	if err != nil {
+		log.Printf("error resolving upstream %s: %s", r.host, err)
+		return
+	}
+	r.mu.Lock()
+	if reflect.DeepEqual(addrs, r.addrs) {
+		r.mu.Unlock()
+		return
+	}
+	old := r.transport
+	r.addrs, r.transport = addrs, newUpstreamTransport()
+	r.mu.Unlock()
+
+	old.CloseIdleConnections()
+	log.Printf("upstream %s resolves to %v", r.host, addrs)
+}
+
+// RefreshEvery resolves the hostname again at interval until done is closed.
+func (r *upstreamResolver) RefreshEvery(interval time.Duration, done <-chan bool) {
+	ticker := time.NewTicker(interval)
+	go func() {
+		defer ticker.Stop()
+		for {
+			select {
+			case <-done:
+				return
+			case <-ticker.C:
+				r.refresh()
+			}
+		}
+	}()
+}
+
+// StartUpstreamDNSRefresh starts resolving the upstream hostnames and SRV
+// records again in the background.
+func (p *OAuthProxy) StartUpstreamDNSRefresh() {
+	for _, r := range p.upstreamResolvers {
+		r.RefreshEvery(p.upstreamDNSRefresh, p.done)
+	}
+	interval := p.upstreamDNSRefresh
+	if interval == 0 {
+		interval = defaultSRVRefresh
+	}
+	for _, u := range p.srvUpstreams {
+		u.RefreshEvery(interval, p.done)
+	}
+}
@@ -0,0 +1,75 @@
+package oauth2proxy
+
+import (
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestUpstreamDNSRefreshOptions(t *testing.T) {
+	o := testOptions()
+	o.UpstreamDNSRefresh = -time.Second
+	assert.Equal(t, errorMsg([]string{"upstream-dns-refresh must not be negative"}), o.Validate().Error())
+
+	o = testOptions()
+	o.Upstreams = []string{"http://localhost:8080/", "http://127.0.0.1:8081/foo/"}
+	o.UpstreamDNSRefresh = 30 * time.Second
+	assert.Equal(t, nil, o.Validate())
+	proxy := newOAuthProxy(o, func(string) bool { return true })
+	assert.Equal(t, 1, len(proxy.upstreamResolvers))
+	assert.Equal(t, "localhost", proxy.upstreamResolvers[0].host)
+}
+
+func TestUpstreamResolverRefresh(t *testing.T) {
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("upstream"))
+	}))
+	defer upstream.Close()
+	u, _ := url.Parse(upstream.URL)
+
+	addrs := []string{"10.0.0.2", "10.0.0.1"}
+	var lookupErr error
+	r := &upstreamResolver{
+		host: "upstream.example.com",
+		lookup: func(host string) ([]string, error) {
+			return append([]string(nil), addrs...), lookupErr
+		},
+		transport: newUpstreamTransport(),
+	}
+	r.addrs, _ = r.resolve()
+	assert.Equal(t, []string{"10.0.0.1", "10.0.0.2"}, r.addrs)
+
+	proxy := NewReverseProxy(u)
+	proxy.Transport = r
+	get := func() string {
+		rw := httptest.NewRecorder()
+		req, _ := http.NewRequest("GET", "/", nil)
+		proxy.ServeHTTP(rw, req)
+		return rw.Body.String()
+	}
+	assert.Equal(t, "upstream", get())
+	transport := r.transport
+
+	// the order of the addresses doesn't matter
+	addrs = []string{"10.0.0.1", "10.0.0.2"}
+	r.refresh()
+	assert.True(t, transport == r.transport)
+
+	// errors keep the addresses
+	lookupErr = errors.New("no such host")
+	r.refresh()
+	assert.True(t, transport == r.transport)
+	assert.Equal(t, []string{"10.0.0.1", "10.0.0.2"}, r.addrs)
+
+	lookupErr = nil
+	addrs = []string{"10.0.0.3"}
+	r.refresh()
+	assert.True(t, transport != r.transport)
+	assert.Equal(t, []string{"10.0.0.3"}, r.addrs)
+	assert.Equal(t, "upstream", get())
+}
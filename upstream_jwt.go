@@ -0,0 +1,158 @@
+package oauth2proxy
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/url"
+	"time"
+
+	"github.com/bitly/oauth2_proxy/providers"
+	"gopkg.in/square/go-jose.v2"
+	"gopkg.in/square/go-jose.v2/jwt"
+)
+
+// identityClaims are the claims of the identity token passed to upstreams.
+type identityClaims struct {
+	jwt.Claims
+	Email             string   `json:"email,omitempty"`
+	PreferredUsername string   `json:"preferred_username,omitempty"`
+	Groups            []string `json:"groups,omitempty"`
+}
+
+// identitySigner mints the short lived identity tokens passed to upstreams
+// in upstream-jwt-header and publishes the key to verify them as a JWKS.
+type identitySigner struct {
+	signer     jose.Signer
+	jwks       []byte
+	expiration time.Duration
+}
+
+// newIdentitySigner returns a signer for key, an RSA or ECDSA P-256 private
+// key.
+func newIdentitySigner(key crypto.Signer, expiration time.Duration) (*identitySigner, error) {
+	var alg jose.SignatureAlgorithm
+	switch k := key.(type) {
+	case *rsa.PrivateKey:
+		alg = jose.RS256
+	case *ecdsa.PrivateKey:
+		if k.Curve != elliptic.P256() {
+			return nil, errors.New("ECDSA keys must use the P-256 curve")
+		}
+		alg = jose.ES256
+	default:
+		return nil, fmt.Errorf("unsupported key type %T", key)
+	}
+
+	pub := jose.JSONWebKey{Key: key.Public(), Algorithm: string(alg), Use: "sig"}
+	thumbprint, err := pub.Thumbprint(crypto.SHA256)
+	if err != nil {
+		return nil, err
+	}
+	pub.KeyID = base64.RawURLEncoding.EncodeToString(thumbprint)
+	jwks, err := json.Marshal(jose.JSONWebKeySet{Keys: []jose.JSONWebKey{pub}})
+	if err != nil {
+		return nil, err
+	}
+
+	signer, err := jose.NewSigner(jose.SigningKey{
+		Algorithm: alg,
+		Key:       jose.JSONWebKey{Key: key, KeyID: pub.KeyID},
+	}, (&jose.SignerOptions{}).WithType("JWT"))
+	if err != nil {
+		return nil, err
+	}
+	return &identitySigner{signer: signer, jwks: jwks, expiration: expiration}, nil
+}
+
+// Sign returns an identity token for the session issued by issuer for
+// audience, the upstream the request is passed to, if any.
+func (s *identitySigner) Sign(session *providers.SessionState, issuer, audience string, now time.Time) (string, error) {
+	subject := session.Email
+	if subject == "" {
+		subject = session.User
+	}
+	claims := identityClaims{
+		Claims: jwt.Claims{
+			Issuer:    issuer,
+			Subject:   subject,
+			IssuedAt:  jwt.NewNumericDate(now),
+			NotBefore: jwt.NewNumericDate(now),
+			Expiry:    jwt.NewNumericDate(now.Add(s.expiration)),
+		},
+		Email:             session.Email,
+		PreferredUsername: session.User,
+		Groups:            session.Groups,
+	}
+	if audience != "" {
+		claims.Audience = jwt.Audience{audience}
+	}
+	return jwt.Signed(s.signer).Claims(claims).CompactSerialize()
+}
+
+// loadSigningKey reads a PEM encoded RSA or ECDSA private key.
+func loadSigningKey(path string) (crypto.Signer, error) {
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	block, _ := pem.Decode(b)
+	if block == nil {
+		return nil, errors.New("no PEM private key found")
+	}
+	if key, err := x509.ParsePKCS1PrivateKey(block.Bytes); err == nil {
+		return key, nil
+	}
+	if key, err := x509.ParseECPrivateKey(block.Bytes); err == nil {
+		return key, nil
+	}
+	key, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+	if err != nil {
+		return nil, errors.New("unsupported private key; must be PKCS#1, PKCS#8 or EC")
+	}
+	signer, ok := key.(crypto.Signer)
+	if !ok {
+		return nil, fmt.Errorf("unsupported private key type %T", key)
+	}
+	return signer, nil
+}
+
+// parseUpstreamJWT sets up signing of identity tokens for upstreams. The key
+// and issuer are configured rather than generated or taken from the request,
+// so that upstreams can verify the tokens of every replica and no client can
+// choose the issuer.
+func parseUpstreamJWT(o *Options, msgs []string) []string {
+	o.jwtSigner = nil
+	if o.UpstreamJWTHeader == "" {
+		if o.UpstreamJWTKeyFile != "" || o.UpstreamJWTIssuer != "" {
+			msgs = append(msgs, "upstream-jwt-key-file and upstream-jwt-issuer require upstream-jwt-header")
+		}
+		return msgs
+	}
+	if o.UpstreamJWTExpiration <= 0 {
+		msgs = append(msgs, "upstream-jwt-expiration must be positive")
+	}
+	if u, err := url.Parse(o.UpstreamJWTIssuer); err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		msgs = append(msgs, fmt.Sprintf("upstream-jwt-header requires upstream-jwt-issuer, an http(s) URL such as https://internal.yourcompany.com/oauth2; got %q", o.UpstreamJWTIssuer))
+	}
+	if o.UpstreamJWTKeyFile == "" {
+		return append(msgs, "upstream-jwt-header requires upstream-jwt-key-file")
+	}
+
+	key, err := loadSigningKey(o.UpstreamJWTKeyFile)
+	if err == nil {
+		o.jwtSigner, err = newIdentitySigner(key, o.UpstreamJWTExpiration)
+	}
+	if err != nil {
+		msgs = append(msgs, fmt.Sprintf("invalid upstream-jwt-key-file %s: %s", o.UpstreamJWTKeyFile, err))
+	}
+	return msgs
+}
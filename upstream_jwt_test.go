@@ -0,0 +1,118 @@
+package oauth2proxy
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/json"
+	"encoding/pem"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/bitly/oauth2_proxy/providers"
+	"github.com/stretchr/testify/assert"
+	"gopkg.in/square/go-jose.v2"
+	"gopkg.in/square/go-jose.v2/jwt"
+)
+
+func TestUpstreamJWTKeyFile(t *testing.T) {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	assert.Equal(t, nil, err)
+	f, err := ioutil.TempFile("", "upstream_jwt_key")
+	assert.Equal(t, nil, err)
+	defer os.Remove(f.Name())
+	pem.Encode(f, &pem.Block{Type: "RSA PRIVATE KEY", Bytes: x509.MarshalPKCS1PrivateKey(key)})
+	f.Close()
+
+	o := testOptions()
+	o.UpstreamJWTHeader = "X-Forwarded-Identity"
+	o.UpstreamJWTKeyFile = f.Name()
+	o.UpstreamJWTIssuer = "https://internal.example.com/oauth2"
+	o.UpstreamJWTExpiration = time.Minute
+	assert.Equal(t, nil, o.Validate())
+	assert.NotEqual(t, (*identitySigner)(nil), o.jwtSigner)
+
+	var jwks jose.JSONWebKeySet
+	assert.Equal(t, nil, json.Unmarshal(o.jwtSigner.jwks, &jwks))
+	assert.Equal(t, 1, len(jwks.Keys))
+	assert.Equal(t, "RS256", jwks.Keys[0].Algorithm)
+	assert.Equal(t, &key.PublicKey, jwks.Keys[0].Key)
+
+	o.UpstreamJWTKeyFile = "/nonexistent"
+	assert.NotEqual(t, nil, o.Validate())
+
+	o.UpstreamJWTKeyFile = ""
+	o.UpstreamJWTIssuer = ""
+	err = o.Validate()
+	assert.NotEqual(t, nil, err)
+	assert.Equal(t, errorMsg([]string{
+		`upstream-jwt-header requires upstream-jwt-issuer, an http(s) URL such as https://internal.yourcompany.com/oauth2; got ""`,
+		"upstream-jwt-header requires upstream-jwt-key-file",
+	}), err.Error())
+}
+
+// writeUpstreamJWTKey writes a new ECDSA P-256 key for upstream JWTs.
+func writeUpstreamJWTKey(t *testing.T) string {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	assert.Equal(t, nil, err)
+	b, err := x509.MarshalECPrivateKey(key)
+	assert.Equal(t, nil, err)
+	f, err := ioutil.TempFile("", "upstream_jwt_key")
+	assert.Equal(t, nil, err)
+	pem.Encode(f, &pem.Block{Type: "EC PRIVATE KEY", Bytes: b})
+	f.Close()
+	return f.Name()
+}
+
+func TestUpstreamJWT(t *testing.T) {
+	var upstreamJWT string
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		upstreamJWT = r.Header.Get("X-Forwarded-Identity")
+	}))
+	defer upstream.Close()
+
+	keyFile := writeUpstreamJWTKey(t)
+	defer os.Remove(keyFile)
+	opts := testOptions()
+	opts.Upstreams = []string{upstream.URL}
+	opts.UpstreamJWTHeader = "X-Forwarded-Identity"
+	opts.UpstreamJWTKeyFile = keyFile
+	opts.UpstreamJWTIssuer = "https://internal.example.com/oauth2"
+	opts.UpstreamJWTExpiration = time.Minute
+	assert.Equal(t, nil, opts.Validate())
+	proxy := newOAuthProxy(opts, func(string) bool { return true })
+
+	rw := httptest.NewRecorder()
+	req, _ := http.NewRequest("GET", "/oauth2/.well-known/jwks.json", nil)
+	proxy.ServeHTTP(rw, req)
+	assert.Equal(t, 200, rw.Code)
+	var jwks jose.JSONWebKeySet
+	assert.Equal(t, nil, json.Unmarshal(rw.Body.Bytes(), &jwks))
+	assert.Equal(t, 1, len(jwks.Keys))
+
+	rw = httptest.NewRecorder()
+	req, _ = http.NewRequest("GET", "http://app.example.com/", nil)
+	session := &providers.SessionState{Email: "jane@example.com", User: "jane"}
+	value, _ := session.EncodeSessionState(nil)
+	req.AddCookie(proxy.MakeSessionCookie(req, value, time.Hour, time.Now()))
+	proxy.ServeHTTP(rw, req)
+	assert.Equal(t, 200, rw.Code)
+
+	token, err := jwt.ParseSigned(upstreamJWT)
+	assert.Equal(t, nil, err)
+	var claims identityClaims
+	assert.Equal(t, nil, token.Claims(jwks.Keys[0].Key, &claims))
+	assert.Equal(t, "jane@example.com", claims.Subject)
+	assert.Equal(t, "jane", claims.PreferredUsername)
+	assert.Equal(t, nil, claims.Validate(jwt.Expected{
+		Issuer:   "https://internal.example.com/oauth2",
+		Audience: jwt.Audience{upstream.URL + "/"},
+		Time:     time.Now(),
+	}))
+}
@@ -0,0 +1,158 @@
+package oauth2proxy
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"math/rand"
+	"net"
+	"net/http"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// defaultSRVRefresh is how often SRV records of upstreams are looked up
+// again when upstream-dns-refresh isn't set.
+const defaultSRVRefresh = 30 * time.Second
+
+// An srvUpstream proxies requests to the targets of an SRV record, such as
+// one of Consul DNS or a Kubernetes headless service, for upstreams given as
+// srv://<name> (or srv+https://<name> to connect with TLS). Only the targets
+// of the lowest priority get requests, shared by their weights, as records
+// of the other priorities are backups for when those are gone from DNS. The
+// instances of consul:// upstreams are kept as targets too.
+type srvUpstream struct {
+	name      string
+	lookup    func(service, proto, name string) (string, []*net.SRV, error)
+	transport *http.Transport
+
+	mu      sync.RWMutex
+	targets []*net.SRV
+}
+
+func newSRVUpstream(name string) *srvUpstream {
+	u := &srvUpstream{name: name, lookup: net.LookupSRV, transport: newUpstreamTransport()}
+	if err := u.refresh(); err != nil {
+		log.Printf("error looking up SRV record %s: %s", name, err)
+	}
+	return u
+}
+
+// RoundTrip sends the request to one of the targets, picked at random by
+// weight. A request for the record name itself, as when pass-host-header is
+// off, gets the host name of the target instead.
+func (u *srvUpstream) RoundTrip(req *http.Request) (*http.Response, error) {
+	target := u.pick()
+	if target == nil {
+		return nil, fmt.Errorf("no targets in SRV record %s", u.name)
+	}
+	host := strings.TrimSuffix(target.Target, ".")
+	out := *req
+	reqURL := *req.URL
+	reqURL.Host = net.JoinHostPort(host, strconv.Itoa(int(target.Port)))
+	out.URL = &reqURL
+	if out.Host == u.name {
+		out.Host = host
+	}
+	return u.transport.RoundTrip(&out)
+}
+
+func (u *srvUpstream) pick() *net.SRV {
+	u.mu.RLock()
+	defer u.mu.RUnlock()
+	if len(u.targets) == 0 {
+		return nil
+	}
+	total := 0
+	for _, t := range u.targets {
+		total += int(t.Weight)
+	}
+	if total == 0 {
+		return u.targets[rand.Intn(len(u.targets))]
+	}
+	n := rand.Intn(total)
+	for _, t := range u.targets {
+		if n -= int(t.Weight); n < 0 {
+			return t
+		}
+	}
+	return u.targets[len(u.targets)-1]
+}
+
+// refresh looks up the record again and keeps the targets of the lowest
+// priority. An error or an empty answer keeps the current targets.
+func (u *srvUpstream) refresh() error {
+	_, records, err := u.lookup("", "", u.name)
+	if err != nil {
+		return err
+	}
+	if len(records) == 0 {
+		return errors.New("no targets")
+	}
+	u.setTargets(records)
+	return nil
+}
+
+// setTargets keeps the records of the lowest priority as the targets.
+func (u *srvUpstream) setTargets(records []*net.SRV) {
+	var targets []*net.SRV
+	for _, r := range records {
+		if len(targets) != 0 && r.Priority > targets[0].Priority {
+			continue
+		}
+		if len(targets) != 0 && r.Priority < targets[0].Priority {
+			targets = nil
+		}
+		targets = append(targets, r)
+	}
+	// lookups shuffle the targets by weight
+	sort.Slice(targets, func(i, j int) bool {
+		if targets[i].Target != targets[j].Target {
+			return targets[i].Target < targets[j].Target
+		}
+		return targets[i].Port < targets[j].Port
+	})
+
+	u.mu.Lock()
+	changed := !reflect.DeepEqual(targets, u.targets)
+	u.targets = targets
+	u.mu.Unlock()
+	if changed {
+		u.transport.CloseIdleConnections()
+		if len(targets) == 0 {
+			log.Printf("upstream %s has no targets", u.name)
+		} else {
+			log.Printf("upstream %s targets %s", u.name, formatSRV(targets))
+		}
+	}
+}
+
+func formatSRV(targets []*net.SRV) string {
+	s := make([]string, len(targets))
+	for i, t := range targets {
+		s[i] = fmt.Sprintf("%s:%d (weight %d)", strings.TrimSuffix(t.Target, "."), t.Port, t.Weight)
+	}
+	return strings.Join(s, ", ")
+}
+
+// RefreshEvery looks up the record again at interval until done is closed.
+func (u *srvUpstream) RefreshEvery(interval time.Duration, done <-chan bool) {
+	ticker := time.NewTicker(interval)
+	go func() {
+		defer ticker.Stop()
+		for {
+			select {
+			case <-done:
+				return
+			case <-ticker.C:
+				if err := u.refresh(); err != nil {
+					log.Printf("error looking up SRV record %s: %s", u.name, err)
+				}
+			}
+		}
+	}()
+}
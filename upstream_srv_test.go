@@ -0,0 +1,80 @@
+package oauth2proxy
+
+import (
+	"errors"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strconv"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestSRVUpstream(t *testing.T) {
+	var hosts []string
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		hosts = append(hosts, r.Host)
+		w.Write([]byte(r.URL.Path))
+	}))
+	defer upstream.Close()
+	_, port, _ := net.SplitHostPort(upstream.Listener.Addr().String())
+	p, _ := strconv.Atoi(port)
+
+	records := []*net.SRV{
+		{Target: "backup.example.com.", Port: 8080, Priority: 20, Weight: 10},
+		{Target: "127.0.0.1.", Port: uint16(p), Priority: 10, Weight: 0},
+	}
+	var lookupErr error
+	u := &srvUpstream{
+		name: "_http._tcp.web.example.com",
+		lookup: func(service, proto, name string) (string, []*net.SRV, error) {
+			return "", records, lookupErr
+		},
+		transport: newUpstreamTransport(),
+	}
+	assert.Equal(t, nil, u.refresh())
+	assert.Equal(t, 1, len(u.targets))
+
+	proxy := NewReverseProxy(&url.URL{Scheme: "http", Host: u.name})
+	setProxyUpstreamHostHeader(proxy, &url.URL{Scheme: "http", Host: u.name})
+	proxy.Transport = u
+	rw := httptest.NewRecorder()
+	req, _ := http.NewRequest("GET", "/foo", nil)
+	req.RequestURI = "/foo"
+	proxy.ServeHTTP(rw, req)
+	assert.Equal(t, 200, rw.Code)
+	assert.Equal(t, "/foo", rw.Body.String())
+	assert.Equal(t, []string{"127.0.0.1"}, hosts)
+
+	// errors and empty answers keep the targets
+	lookupErr = errors.New("no such host")
+	assert.NotEqual(t, nil, u.refresh())
+	lookupErr, records = nil, nil
+	assert.NotEqual(t, nil, u.refresh())
+	assert.Equal(t, "127.0.0.1.", u.pick().Target)
+
+	records = []*net.SRV{{Target: "backup.example.com.", Port: 8080, Priority: 20, Weight: 10}}
+	assert.Equal(t, nil, u.refresh())
+	assert.Equal(t, "backup.example.com.", u.pick().Target)
+}
+
+func TestSRVUpstreamWeights(t *testing.T) {
+	u := &srvUpstream{targets: []*net.SRV{
+		{Target: "a.", Weight: 3},
+		{Target: "b.", Weight: 1},
+		{Target: "c.", Weight: 0},
+	}}
+	picked := map[string]int{}
+	for i := 0; i < 4000; i++ {
+		picked[u.pick().Target]++
+	}
+	assert.Equal(t, 0, picked["c."])
+	assert.True(t, picked["a."] > 2*picked["b."], "%v", picked)
+
+	u = &srvUpstream{}
+	assert.Equal(t, (*net.SRV)(nil), u.pick())
+	_, err := u.RoundTrip(httptest.NewRequest("GET", "/", nil))
+	assert.NotEqual(t, nil, err)
+}
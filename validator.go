@@ -1,4 +1,4 @@
-package main
+package oauth2proxy
 
 import (
 	"encoding/csv"
@@ -21,10 +21,13 @@ func NewUserMap(usersFile string, done <-chan bool, onUpdate func()) *UserMap {
 	atomic.StorePointer(&um.m, unsafe.Pointer(&m))
 	if usersFile != "" {
 		log.Printf("using authenticated emails file %s", usersFile)
-		WatchForUpdates(usersFile, done, func() {
+		err := WatchForUpdates(usersFile, done, func() {
 			um.LoadAuthenticatedEmailsFile()
 			onUpdate()
 		})
+		if err != nil {
+			log.Printf("ERROR: authenticated-emails-file=%q won't be reloaded: %s", usersFile, err)
+		}
 		um.LoadAuthenticatedEmailsFile()
 	}
 	return um
@@ -36,10 +39,13 @@ func (um *UserMap) IsValid(email string) (result bool) {
 	return
 }
 
+// LoadAuthenticatedEmailsFile re-reads the users file; if it can't be read,
+// the previous users are kept.
 func (um *UserMap) LoadAuthenticatedEmailsFile() {
 	r, err := os.Open(um.usersFile)
 	if err != nil {
-		log.Fatalf("failed opening authenticated-emails-file=%q, %s", um.usersFile, err)
+		log.Printf("error opening authenticated-emails-file=%q, %s", um.usersFile, err)
+		return
 	}
 	defer r.Close()
 	csv_reader := csv.NewReader(r)
@@ -1,10 +1,11 @@
 // +build go1.3,!plan9,!solaris
 
-package main
+package oauth2proxy
 
 import (
 	"io/ioutil"
 	"os"
+	"path/filepath"
 	"testing"
 )
 
@@ -100,3 +101,61 @@ func TestValidatorOverwriteEmailListViaRenameAndReplace(t *testing.T) {
 		t.Error("email removed from list should not validate")
 	}
 }
+
+// writeKubernetesVolume mimics the way the kubelet updates a mounted
+// ConfigMap: the files are written to a new timestamped directory and the
+// ..data symlink is atomically replaced to point at it.
+func writeKubernetesVolume(t *testing.T, dir, version string, emails string) {
+	tsDir := filepath.Join(dir, "..20180101_"+version)
+	if err := os.Mkdir(tsDir, 0700); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(filepath.Join(tsDir, "emails"), []byte(emails), 0600); err != nil {
+		t.Fatal(err)
+	}
+	tmpLink := filepath.Join(dir, "..data_tmp")
+	if err := os.Symlink(filepath.Base(tsDir), tmpLink); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Rename(tmpLink, filepath.Join(dir, "..data")); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestValidatorOverwriteEmailListViaKubernetesVolume(t *testing.T) {
+	dir, err := ioutil.TempDir("", "test_k8s_volume_")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	writeKubernetesVolume(t, dir, "1", "xyzzy@example.com")
+	emailsFile := filepath.Join(dir, "emails")
+	if err := os.Symlink(filepath.Join("..data", "emails"), emailsFile); err != nil {
+		t.Fatal(err)
+	}
+
+	done := make(chan bool, 1)
+	defer func() { done <- true }()
+	updated := make(chan bool, 1)
+	validator := newValidatorImpl(nil, emailsFile, done, func() {
+		select {
+		case updated <- true:
+		default:
+		}
+	})
+
+	if !validator("xyzzy@example.com") {
+		t.Error("email in list should validate")
+	}
+
+	writeKubernetesVolume(t, dir, "2", "plugh@example.com")
+	<-updated
+
+	if validator("xyzzy@example.com") {
+		t.Error("email removed from list should not validate")
+	}
+	if !validator("plugh@example.com") {
+		t.Error("email added to list should validate")
+	}
+}
@@ -1,3 +1,3 @@
-package main
+package oauth2proxy
 
 const VERSION = "2.2.1-alpha"
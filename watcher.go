@@ -1,8 +1,9 @@
 // +build go1.3,!plan9,!solaris
 
-package main
+package oauth2proxy
 
 import (
+	"fmt"
 	"log"
 	"os"
 	"path/filepath"
@@ -30,20 +31,49 @@ func WaitForReplacement(filename string, op fsnotify.Op,
 	}
 }
 
-func WatchForUpdates(filename string, done <-chan bool, action func()) {
+// kubernetesDataLink is the symlink that Kubernetes atomically replaces
+// when the contents of a mounted ConfigMap or Secret change.
+const kubernetesDataLink = "..data"
+
+// WatchForUpdates calls action whenever filename changes, until done is
+// closed. It returns an error if filename can't be watched.
+func WatchForUpdates(filename string, done <-chan bool, action func()) error {
 	filename = filepath.Clean(filename)
 	watcher, err := fsnotify.NewWatcher()
 	if err != nil {
-		log.Fatal("failed to create watcher for ", filename, ": ", err)
+		return fmt.Errorf("failed to create watcher for %s: %s", filename, err)
+	}
+	if err = watcher.Add(filename); err != nil {
+		watcher.Close()
+		return fmt.Errorf("failed to add %s to watcher: %s", filename, err)
+	}
+	dataLink := filepath.Join(filepath.Dir(filename), kubernetesDataLink)
+	// Files mounted from a Kubernetes ConfigMap or Secret are symlinks
+	// through the ..data link, which is swapped on every update.
+	if _, err := os.Lstat(dataLink); err == nil {
+		if err = watcher.Add(filepath.Dir(filename)); err != nil {
+			watcher.Close()
+			return fmt.Errorf("failed to add %s to watcher: %s", filepath.Dir(filename), err)
+		}
 	}
 	go func() {
 		defer watcher.Close()
 		for {
 			select {
-			case _ = <-done:
+			case <-done:
 				log.Printf("Shutting down watcher for: %s", filename)
-				break
+				return
 			case event := <-watcher.Events:
+				if event.Name == dataLink {
+					if event.Op&fsnotify.Create != 0 {
+						log.Printf("reloading %s after update of mounted volume", filename)
+						action()
+					}
+					continue
+				}
+				if event.Name != filename {
+					continue
+				}
 				// On Arch Linux, it appears Chmod events precede Remove events,
 				// which causes a race between action() and the coming Remove event.
 				// If the Remove wins, the action() (which calls
@@ -61,8 +91,51 @@ func WatchForUpdates(filename string, done <-chan bool, action func()) {
 			}
 		}
 	}()
-	if err = watcher.Add(filename); err != nil {
-		log.Fatal("failed to add ", filename, " to watcher: ", err)
-	}
 	log.Printf("watching %s for updates", filename)
+	return nil
+}
+
+// WatchDirForUpdates calls action whenever a file in dir is created, written,
+// removed or renamed. Events arriving together, as when an editor saves a
+// file, result in a single call.
+func WatchDirForUpdates(dir string, done <-chan bool, action func()) error {
+	const settle_interval = 100 * time.Millisecond
+
+	dir = filepath.Clean(dir)
+	watcher, err := fsnotify.NewWatcher()
+	if err != nil {
+		return fmt.Errorf("failed to create watcher for %s: %s", dir, err)
+	}
+	if err = watcher.Add(dir); err != nil {
+		watcher.Close()
+		return fmt.Errorf("failed to add %s to watcher: %s", dir, err)
+	}
+	go func() {
+		defer watcher.Close()
+		for {
+			select {
+			case <-done:
+				log.Printf("Shutting down watcher for: %s", dir)
+				return
+			case event := <-watcher.Events:
+				if event.Op == fsnotify.Chmod {
+					continue
+				}
+				time.Sleep(settle_interval)
+				for drained := false; !drained; {
+					select {
+					case <-watcher.Events:
+					default:
+						drained = true
+					}
+				}
+				log.Printf("reloading after event: %s", event)
+				action()
+			case err := <-watcher.Errors:
+				log.Printf("error watching %s: %s", dir, err)
+			}
+		}
+	}()
+	log.Printf("watching %s for updates", dir)
+	return nil
 }
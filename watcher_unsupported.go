@@ -1,12 +1,17 @@
 // +build !go1.3 plan9 solaris
 
-package main
+package oauth2proxy
 
 import (
 	"log"
 )
 
-func WatchForUpdates(filename string, done <-chan bool, action func()) {
+func WatchForUpdates(filename string, done <-chan bool, action func()) error {
 	log.Printf("file watching not implemented on this platform")
-	go func() { <-done }()
+	return nil
+}
+
+func WatchDirForUpdates(dir string, done <-chan bool, action func()) error {
+	log.Printf("file watching not implemented on this platform")
+	return nil
 }